@@ -5,3 +5,8 @@ type Hash interface {
 	Generate(s string) (string, error)
 	Compare(hash string, s string) error
 }
+
+// Rehasher is a Hash that can tell when a stored hash was made by an outdated algorithm or with outdated parameters
+type Rehasher interface {
+	NeedsRehash(hash string) bool
+}
@@ -0,0 +1,15 @@
+package common
+
+import "context"
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
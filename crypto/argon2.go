@@ -0,0 +1,122 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2Prefix starts every PHC string made by Argon2Hash
+const argon2Prefix = "$argon2id$"
+
+// phcEncoding is the unpadded base64 the PHC string format uses for salts and hashes
+var phcEncoding = base64.RawStdEncoding
+
+// Argon2Params are the tunable costs of argon2id
+type Argon2Params struct {
+	// Memory is in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follows the RFC 9106 second recommendation: 64 MiB of memory and 3 passes
+func DefaultArgon2Params() Argon2Params {
+	return Argon2Params{
+		Memory:      64 * 1024,
+		Iterations:  3,
+		Parallelism: 2,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+// Argon2Hash hashes with argon2id into PHC strings. It still verifies hashes made by Hash, so existing users can log in
+type Argon2Hash struct {
+	params Argon2Params
+	legacy Hash
+}
+
+// NewArgon2Hash creates an Argon2Hash that generates hashes with params
+func NewArgon2Hash(params Argon2Params) *Argon2Hash {
+	return &Argon2Hash{params: params}
+}
+
+// Generate hashes a string into a PHC string like $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func (a *Argon2Hash) Generate(s string) (string, error) {
+	salt := make([]byte, a.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(s), salt, a.params.Iterations, a.params.Memory, a.params.Parallelism, a.params.KeyLength)
+	return fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2Prefix, argon2.Version, a.params.Memory, a.params.Iterations, a.params.Parallelism,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key),
+	), nil
+}
+
+// Compare checks a string against a PHC string, or against a legacy bcrypt hash||salt
+func (a *Argon2Hash) Compare(hash string, s string) error {
+	if !strings.HasPrefix(hash, argon2Prefix) {
+		return a.legacy.Compare(hash, s)
+	}
+	params, salt, key, err := decodePHC(hash)
+	if err != nil {
+		return err
+	}
+	computed := argon2.IDKey([]byte(s), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return fmt.Errorf("Hash does not match")
+	}
+	return nil
+}
+
+// NeedsRehash reports if a hash is legacy bcrypt, or argon2id with parameters other than the current ones
+func (a *Argon2Hash) NeedsRehash(hash string) bool {
+	params, salt, _, err := decodePHC(hash)
+	if err != nil {
+		return true
+	}
+	return params.Memory != a.params.Memory ||
+		params.Iterations != a.params.Iterations ||
+		params.Parallelism != a.params.Parallelism ||
+		params.KeyLength != a.params.KeyLength ||
+		uint32(len(salt)) != a.params.SaltLength
+}
+
+// decodePHC parses the parameters, salt and key out of a PHC string
+func decodePHC(hash string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, fmt.Errorf("Invalid hash, not an argon2id PHC string")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, err
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("Unsupported argon2 version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, err
+	}
+	salt, err := phcEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := phcEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
@@ -0,0 +1,74 @@
+package crypto_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Dacode45/addressbook/crypto"
+)
+
+// testParams keep the tests fast
+var testParams = crypto.Argon2Params{
+	Memory:      1024,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func Test_Argon2Hash(t *testing.T) {
+	t.Run("Can generate and compare hashes", should_be_able_to_hash_argon2)
+	t.Run("Writes PHC strings", should_write_phc_strings)
+	t.Run("Verifies legacy bcrypt hashes", should_verify_legacy_hashes)
+	t.Run("Knows when to rehash", should_know_when_to_rehash)
+}
+
+func should_be_able_to_hash_argon2(t *testing.T) {
+	c := crypto.NewArgon2Hash(testParams)
+	input := "testInput"
+
+	generatedHash, generatedError := c.Generate(input)
+	assert.NoError(t, generatedError, "Error generating Hash")
+	assert.NoError(t, c.Compare(generatedHash, input), "Comparison should be successful")
+	assert.Error(t, c.Compare(generatedHash, "testCompare"), "Comparison should not be successful")
+
+	generatedHash2, _ := c.Generate(input)
+	assert.NotEqual(t, generatedHash, generatedHash2, "Same salt generated")
+}
+
+func should_write_phc_strings(t *testing.T) {
+	c := crypto.NewArgon2Hash(testParams)
+	generatedHash, err := c.Generate("testInput")
+	assert.NoError(t, err, "Error generating Hash")
+	assert.True(t, strings.HasPrefix(generatedHash, "$argon2id$v=19$m=1024,t=1,p=1$"), "Unexpected hash %s", generatedHash)
+	assert.Len(t, strings.Split(generatedHash, "$"), 6, "PHC strings have 6 parts")
+
+	// hashes keep working when the parameters change
+	other := crypto.NewArgon2Hash(crypto.Argon2Params{Memory: 2048, Iterations: 2, Parallelism: 1, SaltLength: 8, KeyLength: 16})
+	assert.NoError(t, other.Compare(generatedHash, "testInput"), "Comparison should use the hash's parameters")
+}
+
+func should_verify_legacy_hashes(t *testing.T) {
+	legacy := crypto.Hash{}
+	legacyHash, err := legacy.Generate("testInput")
+	assert.NoError(t, err, "Error generating Hash")
+
+	c := crypto.NewArgon2Hash(testParams)
+	assert.NoError(t, c.Compare(legacyHash, "testInput"), "Legacy comparison should be successful")
+	assert.Error(t, c.Compare(legacyHash, "testCompare"), "Legacy comparison should not be successful")
+}
+
+func should_know_when_to_rehash(t *testing.T) {
+	c := crypto.NewArgon2Hash(testParams)
+	current, _ := c.Generate("testInput")
+	assert.False(t, c.NeedsRehash(current), "Current hash should not need a rehash")
+
+	legacyHash, _ := (&crypto.Hash{}).Generate("testInput")
+	assert.True(t, c.NeedsRehash(legacyHash), "Legacy hash should need a rehash")
+
+	stronger := testParams
+	stronger.Iterations = 2
+	assert.True(t, crypto.NewArgon2Hash(stronger).NeedsRehash(current), "Outdated parameters should need a rehash")
+}
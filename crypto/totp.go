@@ -0,0 +1,132 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// secrets are shared with authenticator apps as unpadded base32
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP generates and validates RFC 6238 time based one time passwords using HMAC-SHA1
+type TOTP struct {
+	Issuer string
+	Period int64
+	Digits int
+	// Skew is how many periods before and after the current one are accepted to allow for clock drift
+	Skew int64
+}
+
+// NewTOTP creates a TOTP with the defaults every authenticator app supports: 30 second periods and 6 digits
+func NewTOTP(issuer string) *TOTP {
+	return &TOTP{
+		Issuer: issuer,
+		Period: 30,
+		Digits: 6,
+		Skew:   1,
+	}
+}
+
+// GenerateSecret generates a new random base32 encoded secret
+func (t *TOTP) GenerateSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return secretEncoding.EncodeToString(secret), nil
+}
+
+// Code generates the code for the period containing at
+func (t *TOTP) Code(secret string, at time.Time) (string, error) {
+	return t.codeAt(secret, t.step(at))
+}
+
+// Validate checks a code against the periods around at. Returns the period the code belongs to so callers can refuse to accept it twice
+func (t *TOTP) Validate(secret string, code string, at time.Time) (int64, error) {
+	code = strings.TrimSpace(code)
+	if len(code) != t.Digits {
+		return 0, fmt.Errorf("Invalid code")
+	}
+	current := t.step(at)
+	for step := current - t.Skew; step <= current+t.Skew; step++ {
+		expected, err := t.codeAt(secret, step)
+		if err != nil {
+			return 0, err
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid code")
+}
+
+// URI builds the otpauth:// uri authenticator apps use to enroll an account
+func (t *TOTP) URI(account string, secret string) string {
+	label := url.PathEscape(t.Issuer + ":" + account)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", t.Issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", t.Digits))
+	params.Set("period", fmt.Sprintf("%d", t.Period))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+// QRCode renders the enrollment uri as a size x size png
+func (t *TOTP) QRCode(account string, secret string, size int) ([]byte, error) {
+	return qrcode.Encode(t.URI(account, secret), qrcode.Medium, size)
+}
+
+// step is the number of periods since the unix epoch
+func (t *TOTP) step(at time.Time) int64 {
+	return at.Unix() / t.Period
+}
+
+// codeAt is the HOTP (RFC 4226) value of the secret for a counter
+func (t *TOTP) codeAt(secret string, counter int64) (string, error) {
+	key, err := secretEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < t.Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", t.Digits, value%mod), nil
+}
+
+// recovery codes avoid characters that are easy to confuse
+const recoveryAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// GenerateRecoveryCodes generates count single use codes in the format xxxxx-xxxxx
+func GenerateRecoveryCodes(count int) ([]string, error) {
+	codes := make([]string, count)
+	for i := range codes {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		for j, b := range raw {
+			raw[j] = recoveryAlphabet[int(b)%len(recoveryAlphabet)]
+		}
+		codes[i] = string(raw[:5]) + "-" + string(raw[5:])
+	}
+	return codes, nil
+}
@@ -0,0 +1,83 @@
+package crypto_test
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Dacode45/addressbook/crypto"
+)
+
+func Test_TOTP(t *testing.T) {
+	t.Run("Matches the RFC 6238 test vectors", should_match_rfc_vectors)
+	t.Run("Validates codes around the current period", should_validate_with_skew)
+	t.Run("Builds an otpauth uri", should_build_uri)
+	t.Run("Generates unique recovery codes", should_generate_recovery_codes)
+}
+
+func should_match_rfc_vectors(t *testing.T) {
+	totp := crypto.NewTOTP("test")
+	totp.Digits = 8
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for unix, expected := range vectors {
+		code, err := totp.Code(secret, time.Unix(unix, 0))
+		assert.NoError(t, err, "Error generating code")
+		assert.Equal(t, expected, code, "Code doesn't match the rfc")
+	}
+}
+
+func should_validate_with_skew(t *testing.T) {
+	totp := crypto.NewTOTP("test")
+	secret, err := totp.GenerateSecret()
+	assert.NoError(t, err, "Error generating secret")
+
+	now := time.Now()
+	code, _ := totp.Code(secret, now.Add(-30*time.Second))
+	step, err := totp.Validate(secret, code, now)
+	assert.NoError(t, err, "Previous period should be accepted")
+	assert.Equal(t, now.Unix()/30-1, step, "Unexpected period")
+
+	code, _ = totp.Code(secret, now.Add(-2*time.Minute))
+	_, err = totp.Validate(secret, code, now)
+	assert.Error(t, err, "Old codes should not be accepted")
+
+	_, err = totp.Validate(secret, "12", now)
+	assert.Error(t, err, "Short codes should not be accepted")
+}
+
+func should_build_uri(t *testing.T) {
+	totp := crypto.NewTOTP("addressbook")
+	uri := totp.URI("test user", "JBSWY3DPEHPK3PXP")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/addressbook:test%20user?"), "Unexpected uri %s", uri)
+	assert.Contains(t, uri, "secret=JBSWY3DPEHPK3PXP")
+	assert.Contains(t, uri, "issuer=addressbook")
+
+	png, err := totp.QRCode("test user", "JBSWY3DPEHPK3PXP", 256)
+	assert.NoError(t, err, "Error rendering qr code")
+	assert.Equal(t, "\x89PNG", string(png[:4]), "QR code should be a png")
+}
+
+func should_generate_recovery_codes(t *testing.T) {
+	codes, err := crypto.GenerateRecoveryCodes(10)
+	assert.NoError(t, err, "Error generating codes")
+	assert.Len(t, codes, 10)
+
+	seen := map[string]bool{}
+	for _, c := range codes {
+		assert.Len(t, c, 11)
+		assert.False(t, seen[c], "Duplicate recovery code")
+		seen[c] = true
+	}
+}
@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/Dacode45/addressbook/common"
+)
+
+// LogMailer writes emails to a writer instead of sending them. Useful for development and tests
+type LogMailer struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+// NewLogMailer creates a mailer that writes every message to w
+func NewLogMailer(w io.Writer) *LogMailer {
+	return &LogMailer{writer: w}
+}
+
+// NewFileMailer creates a mailer that appends every message to the file at path
+func NewFileMailer(path string) (*LogMailer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewLogMailer(f), nil
+}
+
+// Send writes the message
+func (m *LogMailer) Send(ctx context.Context, msg common.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintf(m.writer, "To: %s\nSubject: %s\n\n%s\n\n", msg.To, msg.Subject, msg.Body)
+	return err
+}
+
+// Close closes the writer if it is a file
+func (m *LogMailer) Close() error {
+	if c, ok := m.writer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
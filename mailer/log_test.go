@@ -0,0 +1,47 @@
+package mailer_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Dacode45/addressbook/common"
+	"github.com/Dacode45/addressbook/mailer"
+)
+
+func Test_LogMailer(t *testing.T) {
+	t.Run("Writes messages", should_write_messages)
+	t.Run("Appends messages to a file", should_append_to_file)
+}
+
+func should_write_messages(t *testing.T) {
+	var buf bytes.Buffer
+	m := mailer.NewLogMailer(&buf)
+
+	err := m.Send(context.Background(), common.Message{To: "test@test.com", Subject: "Hello", Body: "World"})
+	assert.NoError(t, err, "Failed to send")
+	assert.Equal(t, "To: test@test.com\nSubject: Hello\n\nWorld\n\n", buf.String(), "Unexpected message")
+}
+
+func should_append_to_file(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailer")
+	assert.NoError(t, err, "Failed to create directory")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mail.log")
+	for i := 0; i < 2; i++ {
+		m, err := mailer.NewFileMailer(path)
+		assert.NoError(t, err, "Failed to open file")
+		assert.NoError(t, m.Send(context.Background(), common.Message{To: "test@test.com", Subject: "Hello", Body: "World"}))
+		assert.NoError(t, m.Close(), "Failed to close file")
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	assert.NoError(t, err, "Failed to read file")
+	assert.Equal(t, 2, bytes.Count(contents, []byte("Subject: Hello")), "Both messages expected")
+}
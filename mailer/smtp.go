@@ -0,0 +1,45 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/Dacode45/addressbook/common"
+)
+
+// SMTPMailer sends emails through an smtp server
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer creates a mailer for the server at addr (host:port). Uses PLAIN auth when a username is given
+func NewSMTPMailer(addr string, from string, username string, password string) *SMTPMailer {
+	var auth smtp.Auth
+	if username != "" {
+		host := strings.Split(addr, ":")[0]
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &SMTPMailer{addr, from, auth}
+}
+
+// Send sends the message
+func (m *SMTPMailer) Send(ctx context.Context, msg common.Message) error {
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return fmt.Errorf("Invalid header value")
+	}
+	headers := []string{
+		"From: " + m.from,
+		"To: " + msg.To,
+		"Subject: " + msg.Subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	body := strings.Join(headers, "\r\n") + "\r\n\r\n" + strings.Replace(msg.Body, "\n", "\r\n", -1)
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, []byte(body))
+}
@@ -2,21 +2,31 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/Dacode45/addressbook/crypto"
+	"github.com/Dacode45/addressbook/password"
 	"github.com/Dacode45/addressbook/server"
 	"github.com/Dacode45/addressbook/storage"
 )
 
 const (
-	mongoURL           = "localhost"
-	dbName             = "addressbook"
-	userCollectionName = "user"
+	mongoURL               = "localhost"
+	dbName                 = "addressbook"
+	userCollectionName     = "user"
+	throttleCollectionName = "login_attempts"
+	auditCollectionName    = "audit_log"
+	roleCollectionName     = "roles"
+	clientCollectionName   = "oauth_clients"
+	codeCollectionName     = "oauth_codes"
+	orgCollectionName      = "orgs"
+	inviteCollectionName   = "org_invites"
 )
 
 var config = server.ServerConfig{
@@ -31,12 +41,42 @@ func main() {
 	}
 	defer session.Close()
 
-	hash := crypto.Hash{}
-	uStorage := storage.NewMongoUserStorage(session.Copy(), dbName, userCollectionName, &hash)
+	// argon2id, upgrading bcrypt hashes from before as users log in
+	hash := crypto.NewArgon2Hash(crypto.DefaultArgon2Params())
+	uStorage := storage.NewMongoUserStorage(session.Copy(), dbName, userCollectionName, hash)
+	config.Throttle = storage.NewMongoThrottleStorage(session.Copy(), dbName, throttleCollectionName)
+	config.Audit = storage.NewMongoAuditStorage(session.Copy(), dbName, auditCollectionName)
+	config.Roles = storage.NewMongoRoleStorage(session.Copy(), dbName, roleCollectionName)
+	config.OAuth = storage.NewMongoOAuthStorage(session.Copy(), dbName, clientCollectionName, codeCollectionName)
+	config.Orgs = storage.NewMongoOrgStorage(session.Copy(), dbName, orgCollectionName, inviteCollectionName)
+	// contact photos are kept on disk, in BLOB_DIR or ./blobs
+	blobDir := os.Getenv("BLOB_DIR")
+	if blobDir == "" {
+		blobDir = "blobs"
+	}
+	config.Blobs = storage.NewFSBlobStore(blobDir)
+	// the first admin, only used while there are no admins
+	config.AdminUsername = os.Getenv("ADMIN_USERNAME")
+	config.AdminPassword = os.Getenv("ADMIN_PASSWORD")
+	// login through an OpenID Connect provider, disabled without an issuer
+	config.OIDCIssuer = os.Getenv("OIDC_ISSUER")
+	config.OIDCClientID = os.Getenv("OIDC_CLIENT_ID")
+	config.OIDCClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+
+	// a file or directory of breached password hashes, see the readme
+	if path := os.Getenv("BREACHED_PASSWORDS"); path != "" {
+		corpus, err := password.NewCorpus(path)
+		if err != nil {
+			log.Fatalf("Unable to load breached passwords: %s", err)
+		}
+		config.PasswordPolicy = password.DefaultPolicy()
+		config.PasswordPolicy.Breached = corpus
+	}
 
 	errChan := make(chan error)
 
 	s := server.NewServer(uStorage, config)
+	go server.PurgeDeletedAccounts(context.Background(), uStorage, config, time.Hour)
 
 	go func() {
 		errChan <- s.Start()
@@ -0,0 +1,176 @@
+package mock
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+)
+
+// authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+var b64 = base64.RawURLEncoding
+
+// Authenticator is a software webauthn authenticator so passkey flows can be tested without a browser. It holds a single ES256 credential
+type Authenticator struct {
+	Origin       string
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+// NewAuthenticator creates an authenticator that acts as a browser on origin
+func NewAuthenticator(origin string) *Authenticator {
+	return &Authenticator{Origin: origin}
+}
+
+// CredentialID returns the id of the registered credential
+func (a *Authenticator) CredentialID() []byte {
+	return a.credentialID
+}
+
+// Register answers the options of navigator.credentials.create() with a "none" attestation
+func (a *Authenticator) Register(creationOptions []byte) ([]byte, error) {
+	var creation struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RP        struct {
+				ID string `json:"id"`
+			} `json:"rp"`
+			User struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(creationOptions, &creation); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	a.key = key
+	a.credentialID = make([]byte, 32)
+	if _, err = rand.Read(a.credentialID); err != nil {
+		return nil, err
+	}
+	a.userHandle, err = b64.DecodeString(creation.PublicKey.User.ID)
+	if err != nil {
+		return nil, err
+	}
+	a.signCount = 0
+
+	publicKey, err := webauthncbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: key.PublicKey.X.FillBytes(make([]byte, 32)),
+		-3: key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	attested := make([]byte, 16+2)
+	binary.BigEndian.PutUint16(attested[16:], uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, publicKey...)
+	authData := a.authenticatorData(creation.PublicKey.RP.ID, flagUserPresent|flagUserVerified|flagAttested, attested)
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		return nil, err
+	}
+	clientData, err := a.clientData("webauthn.create", creation.PublicKey.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"id":    b64.EncodeToString(a.credentialID),
+		"rawId": b64.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64.EncodeToString(clientData),
+			"attestationObject": b64.EncodeToString(attestation),
+			"transports":        []string{"internal"},
+		},
+	})
+}
+
+// Login answers the options of navigator.credentials.get() by signing the challenge
+func (a *Authenticator) Login(assertionOptions []byte) ([]byte, error) {
+	if a.key == nil {
+		return nil, fmt.Errorf("no credential registered")
+	}
+	var assertion struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RPID      string `json:"rpId"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(assertionOptions, &assertion); err != nil {
+		return nil, err
+	}
+
+	a.signCount++
+	authData := a.authenticatorData(assertion.PublicKey.RPID, flagUserPresent|flagUserVerified, nil)
+	clientData, err := a.clientData("webauthn.get", assertion.PublicKey.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"id":    b64.EncodeToString(a.credentialID),
+		"rawId": b64.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64.EncodeToString(clientData),
+			"authenticatorData": b64.EncodeToString(authData),
+			"signature":         b64.EncodeToString(signature),
+			"userHandle":        b64.EncodeToString(a.userHandle),
+		},
+	})
+}
+
+// authenticatorData is the rp id hash, flags and counter, followed by the attested credential when registering
+func (a *Authenticator) authenticatorData(rpID string, flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append(rpIDHash[:], flags)
+	counter := make([]byte, 4)
+	binary.BigEndian.PutUint32(counter, a.signCount)
+	data = append(data, counter...)
+	return append(data, attested...)
+}
+
+// clientData is the json a browser would build for the ceremony
+func (a *Authenticator) clientData(ceremony string, challenge string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"type":        ceremony,
+		"challenge":   challenge,
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+}
@@ -1,10 +1,16 @@
 package mock
 
 import (
+	"fmt"
+	"math/rand"
+
 	"github.com/Dacode45/addressbook/models"
 	"github.com/icrowley/fake"
 )
 
+// fakeTags are the tags fake contacts are tagged with
+var fakeTags = []string{"family", "friends", "work", "vip"}
+
 // FakeContacts generates count contacts
 func FakeContacts(count int) []models.Contact {
 	contacts := make([]models.Contact, count)
@@ -12,8 +18,25 @@ func FakeContacts(count int) []models.Contact {
 		contacts[i] = models.Contact{
 			FirstName: fake.FirstName(),
 			LastName:  fake.LastName(),
-			Email:     fake.EmailAddress(),
-			Phone:     fake.Phone(),
+			Emails: models.ContactValues{
+				{Label: models.LabelWork, Value: fake.EmailAddress(), Preferred: true},
+				{Label: models.LabelHome, Value: fake.EmailAddress()},
+			},
+			Phones: models.ContactValues{{Label: models.LabelMobile, Value: fake.Phone()}},
+			Addresses: models.Addresses{{
+				Label:    models.LabelHome,
+				Street:   fake.StreetAddress(),
+				Locality: fake.City(),
+				Region:   fake.State(),
+				Postcode: fake.Zip(),
+				Country:  fake.Country(),
+			}},
+			Organization: fake.Company(),
+			JobTitle:     fake.JobTitle(),
+			Birthday:     fmt.Sprintf("%d-%02d-%02d", fake.Year(1950, 2000), fake.MonthNum(), 1+rand.Intn(28)),
+			URLs:         models.URLs{"https://" + fake.DomainName()},
+			Notes:        fake.Sentence(),
+			Tags:         models.Tags{fakeTags[rand.Intn(len(fakeTags))]},
 		}
 	}
 	return contacts
@@ -0,0 +1,234 @@
+package mock
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// oidcKeyID identifies the provider's only signing key
+const oidcKeyID = "mock-key"
+
+// OIDCUser is who the OIDCProvider logs in. It becomes the claims of the ID token
+type OIDCUser struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+}
+
+// oidcGrant is an authorization code waiting to be exchanged
+type oidcGrant struct {
+	user          OIDCUser
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+}
+
+// OIDCProvider is a local OpenID Connect provider so OIDC login can be tested without a real one.
+// The authorize endpoint logs in the current user without a login page, and only the authorization code flow with S256 pkce is supported
+type OIDCProvider struct {
+	ClientID     string
+	ClientSecret string
+	server       *httptest.Server
+	key          *rsa.PrivateKey
+
+	mu     sync.Mutex
+	user   OIDCUser
+	grants map[string]oidcGrant
+}
+
+// NewOIDCProvider starts a provider that accepts a single client
+func NewOIDCProvider(clientID string, clientSecret string) (*OIDCProvider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	p := &OIDCProvider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		key:          key,
+		grants:       map[string]oidcGrant{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/keys", p.keys)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	return p, nil
+}
+
+// Issuer is the url of the provider
+func (p *OIDCProvider) Issuer() string {
+	return p.server.URL
+}
+
+// Close stops the provider
+func (p *OIDCProvider) Close() {
+	p.server.Close()
+}
+
+// Login sets the user the next authorization logs in
+func (p *OIDCProvider) Login(user OIDCUser) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.user = user
+}
+
+// discovery serves the discovery document
+func (p *OIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.Issuer(),
+		"authorization_endpoint":                p.Issuer() + "/authorize",
+		"token_endpoint":                        p.Issuer() + "/token",
+		"jwks_uri":                              p.Issuer() + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// keys serves the public signing key as a JWKS
+func (p *OIDCProvider) keys(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": oidcKeyID,
+			"n":   b64.EncodeToString(pub.N.Bytes()),
+			"e":   b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize logs in the current user and redirects back with an authorization code
+func (p *OIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("redirect_uri") == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if query.Get("client_id") != p.ClientID || query.Get("response_type") != "code" {
+		http.Error(w, "unknown client or unsupported response type", http.StatusBadRequest)
+		return
+	}
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "pkce with S256 is required", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	p.mu.Lock()
+	p.grants[code] = oidcGrant{
+		user:          p.user,
+		redirectURI:   redirectURI.String(),
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+	}
+	p.mu.Unlock()
+
+	callback := redirectURI.Query()
+	callback.Set("code", code)
+	callback.Set("state", query.Get("state"))
+	redirectURI.RawQuery = callback.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token exchanges an authorization code for an access token and a signed ID token
+func (p *OIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, "invalid_request")
+		return
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.ClientID || clientSecret != p.ClientSecret {
+		oauthError(w, "invalid_client")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		oauthError(w, "unsupported_grant_type")
+		return
+	}
+
+	p.mu.Lock()
+	code := r.PostForm.Get("code")
+	grant, ok := p.grants[code]
+	delete(p.grants, code)
+	p.mu.Unlock()
+	if !ok || grant.redirectURI != r.PostForm.Get("redirect_uri") {
+		oauthError(w, "invalid_grant")
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if b64.EncodeToString(challenge[:]) != grant.codeChallenge {
+		oauthError(w, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                p.Issuer(),
+		"sub":                grant.user.Subject,
+		"aud":                p.ClientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"email":              grant.user.Email,
+		"email_verified":     grant.user.EmailVerified,
+		"preferred_username": grant.user.PreferredUsername,
+	}
+	if grant.nonce != "" {
+		claims["nonce"] = grant.nonce
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = oidcKeyID
+	signed, err := idToken.SignedString(p.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     signed,
+	})
+}
+
+// oauthError responds with an oauth2 error
+func oauthError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+// writeJSON responds with v as json
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// randomString returns 16 random bytes, base64url encoded
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("unable to read random bytes: %s", err))
+	}
+	return b64.EncodeToString(b)
+}
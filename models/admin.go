@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// UserQuery searches users by a case insensitive substring of their username or email, a page at a time
+type UserQuery struct {
+	Search string
+	Offset int
+	Limit  int
+}
+
+// UserSummary is a user as admins see them in listings
+type UserSummary struct {
+	Username              string     `json:"username"`
+	Email                 string     `json:"email,omitempty"`
+	EmailVerified         bool       `json:"email_verified"`
+	Roles                 []Role     `json:"roles"`
+	Disabled              bool       `json:"disabled"`
+	PasswordResetRequired bool       `json:"password_reset_required"`
+	TwoFactorEnabled      bool       `json:"two_factor_enabled"`
+	DeletedAt             *time.Time `json:"deleted_at,omitempty"`
+	ContactCount          int        `json:"contact_count"`
+}
+
+// UserPage is one page of a UserQuery
+type UserPage struct {
+	Users  []UserSummary `json:"users"`
+	Total  int           `json:"total"`
+	Offset int           `json:"offset"`
+	Limit  int           `json:"limit"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// Attachment is a file attached to a contact, like a signed agreement or the scan of a business card. The file is kept
+// in a blob store under its id, which copies of the contact share
+type Attachment struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	// ContentType is sniffed from the file, not taken from the upload
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	// Hash is the hex sha256 of the file
+	Hash      string    `json:"sha256"`
+	CreatedAt time.Time `json:"created_at"`
+}
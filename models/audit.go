@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// AuditEntry records an action taken by one user on another, like an admin disabling an account
+type AuditEntry struct {
+	Actor   string            `json:"actor"`
+	Action  string            `json:"action"`
+	Target  string            `json:"target,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+	At      time.Time         `json:"at"`
+}
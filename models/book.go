@@ -0,0 +1,71 @@
+package models
+
+import "time"
+
+const (
+	// DefaultBookID is the id of the book every user has. The contacts api works against it
+	DefaultBookID = "default"
+	// DefaultBookName is the name of the default book
+	DefaultBookName = "Contacts"
+)
+
+// BookPermission is how much a user can do with a book. Each permission includes the ones before it
+type BookPermission string
+
+const (
+	// BookRead lets users see the book and its contacts
+	BookRead BookPermission = "read"
+	// BookEdit lets users add, change and remove the book's contacts
+	BookEdit BookPermission = "edit"
+	// BookManage lets users rename the book and share it
+	BookManage BookPermission = "manage"
+	// BookOwner is the permission of the user who made the book. It can't be granted, only owners delete books
+	BookOwner BookPermission = "owner"
+)
+
+// bookPermissionRanks orders the permissions
+var bookPermissionRanks = map[BookPermission]int{BookRead: 1, BookEdit: 2, BookManage: 3, BookOwner: 4}
+
+// Allows checks if the permission includes need
+func (p BookPermission) Allows(need BookPermission) bool {
+	return bookPermissionRanks[p] > 0 && bookPermissionRanks[p] >= bookPermissionRanks[need]
+}
+
+// Grantable checks if the permission can be shared
+func (p BookPermission) Grantable() bool {
+	return p == BookRead || p == BookEdit || p == BookManage
+}
+
+// Book is an address book. Contacts belong to exactly one of their owner's books
+type Book struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Default   bool      `json:"default"`
+	Owner     string    `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	// Permission is what the user reading the book can do with it
+	Permission BookPermission `json:"permission,omitempty"`
+	// Shares are only listed to users who can manage the book
+	Shares []BookShare `json:"shares,omitempty"`
+	// ContactCount is filled in when listing books
+	ContactCount int `json:"contact_count"`
+	// Fields are the custom fields of the book's contacts
+	Fields FieldDefinitions `json:"fields,omitempty"`
+}
+
+// BookShare grants a user, or the members of a group of users, access to a book
+type BookShare struct {
+	Username   string         `json:"username,omitempty"`
+	GroupID    string         `json:"group_id,omitempty"`
+	Permission BookPermission `json:"permission"`
+	GrantedBy  string         `json:"granted_by,omitempty"`
+	GrantedAt  time.Time      `json:"granted_at,omitempty"`
+}
+
+// Grantee describes who the share is for, like user:alice or group:<id>
+func (s BookShare) Grantee() string {
+	if s.GroupID != "" {
+		return "group:" + s.GroupID
+	}
+	return "user:" + s.Username
+}
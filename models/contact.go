@@ -1,10 +1,149 @@
 package models
 
-// Contact satisfies the Contact interface. Can be marshaled through json or csv
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Contact satisfies the Contact interface. Can be marshaled through json or csv. In csv, lists are written to a single cell
 type Contact struct {
-	ID        string `json:"id" csv:"id"`
-	FirstName string `json:"first_name" csv:"first_name"`
-	LastName  string `json:"last_name" csv:"last_name"`
-	Email     string `json:"email" csv:"email"`
-	Phone     string `json:"phone" csv:"phone"`
+	ID string `json:"id" csv:"id"`
+	// BookID is the book the contact is in. Set by the api, it isn't part of imports and exports.
+	// Contacts in a company directory aren't in a book
+	BookID string `json:"book_id,omitempty" csv:"-"`
+	// DisplayName is the full name built by a NameFormat. Set by the api, it is left out when contacts are saved or imported
+	DisplayName string `json:"display_name,omitempty" csv:"display_name"`
+	// Prefix and Suffix are honorifics, like Dr. and Jr.
+	Prefix string `json:"prefix" csv:"prefix"`
+	// FirstName is the given name and LastName the family name
+	FirstName  string `json:"first_name" csv:"first_name"`
+	MiddleName string `json:"middle_name" csv:"middle_name"`
+	LastName   string `json:"last_name" csv:"last_name"`
+	Suffix     string `json:"suffix" csv:"suffix"`
+	Nickname   string `json:"nickname" csv:"nickname"`
+	// PhoneticFirstName and PhoneticLastName are how the names are read, like the kana of Japanese names. Used for sorting
+	PhoneticFirstName string `json:"phonetic_first_name" csv:"phonetic_first_name"`
+	PhoneticLastName  string `json:"phonetic_last_name" csv:"phonetic_last_name"`
+	// Emails and Phones also read the email and phone columns of csv files from before labels
+	Emails       ContactValues `json:"emails" csv:"emails,email"`
+	Phones       ContactValues `json:"phones" csv:"phones,phone"`
+	Addresses    Addresses     `json:"addresses" csv:"addresses"`
+	Organization string        `json:"organization" csv:"organization"`
+	JobTitle     string        `json:"job_title" csv:"job_title"`
+	// Birthday and Anniversary are YYYY-MM-DD dates, or --MM-DD when the year isn't known
+	Birthday    string `json:"birthday" csv:"birthday"`
+	Anniversary string `json:"anniversary" csv:"anniversary"`
+	URLs        URLs   `json:"urls" csv:"urls"`
+	Notes       string `json:"notes" csv:"notes"`
+	Tags        Tags   `json:"tags" csv:"tags"`
+	// Custom holds the values of the custom fields of the contact's book. In csv they are x- columns, like x-account_manager
+	Custom CustomFields `json:"custom,omitempty" csv:"-"`
+	// Photo is uploaded on its own, and kept when the contact is updated
+	Photo *ContactPhoto `json:"photo,omitempty" csv:"-"`
+	// Attachments are uploaded on their own, and kept when the contact is updated
+	Attachments []Attachment `json:"attachments,omitempty" csv:"-"`
+	// LastContacted is the latest call, meeting or email on the contact's timeline. It is worked out from the timeline
+	LastContacted *time.Time `json:"last_contacted,omitempty" csv:"-"`
+}
+
+// PreferredEmail returns the preferred email, or the first one
+func (c Contact) PreferredEmail() string {
+	email, _ := c.Emails.Preferred()
+	return email.Value
+}
+
+// PreferredPhone returns the preferred phone number, or the first one
+func (c Contact) PreferredPhone() string {
+	phone, _ := c.Phones.Preferred()
+	return phone.Value
+}
+
+// Normalize trims the contact's fields, drops empty values, and keeps a single preferred value in each list.
+// The display name is cleared, it is built when the contact is served
+func (c *Contact) Normalize() {
+	c.DisplayName = ""
+	c.Prefix = strings.TrimSpace(c.Prefix)
+	c.FirstName = strings.TrimSpace(c.FirstName)
+	c.MiddleName = strings.TrimSpace(c.MiddleName)
+	c.LastName = strings.TrimSpace(c.LastName)
+	c.Suffix = strings.TrimSpace(c.Suffix)
+	c.Nickname = strings.TrimSpace(c.Nickname)
+	c.PhoneticFirstName = strings.TrimSpace(c.PhoneticFirstName)
+	c.PhoneticLastName = strings.TrimSpace(c.PhoneticLastName)
+	c.Emails = c.Emails.normalize()
+	c.Phones = c.Phones.normalize()
+	c.Addresses = c.Addresses.normalize()
+	c.Organization = strings.TrimSpace(c.Organization)
+	c.JobTitle = strings.TrimSpace(c.JobTitle)
+	c.Birthday = strings.TrimSpace(c.Birthday)
+	c.Anniversary = strings.TrimSpace(c.Anniversary)
+	urls := URLs{}
+	for _, u := range c.URLs {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	c.URLs = urls
+	c.Tags = c.Tags.normalize()
+	c.Custom = c.Custom.normalize()
+}
+
+// Validate checks the contact's labels, dates, urls, notes and tags. Normalize first
+func (c Contact) Validate() error {
+	for _, v := range append(append(ContactValues{}, c.Emails...), c.Phones...) {
+		if err := validateLabel(v.Label); err != nil {
+			return err
+		}
+	}
+	for _, a := range c.Addresses {
+		if err := validateLabel(a.Label); err != nil {
+			return err
+		}
+	}
+	if err := validateDate("birthday", c.Birthday); err != nil {
+		return err
+	}
+	if err := validateDate("anniversary", c.Anniversary); err != nil {
+		return err
+	}
+	for _, u := range c.URLs {
+		if err := validateURL(u); err != nil {
+			return err
+		}
+	}
+	if len(c.Notes) > maxNotesLength {
+		return fmt.Errorf("notes must be at most %d characters", maxNotesLength)
+	}
+	return c.Tags.validate()
+}
+
+// Matches checks if the contact's names, emails, phones, organisation, job title, tags or custom values contain query, ignoring case.
+// Everything matches an empty query
+func (c Contact) Matches(query string) bool {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return true
+	}
+	fields := []string{
+		joinNonEmpty(" ", c.Prefix, c.FirstName, c.MiddleName, c.LastName, c.Suffix),
+		c.LastName + c.FirstName,
+		c.Nickname,
+		joinNonEmpty(" ", c.PhoneticFirstName, c.PhoneticLastName),
+		c.Organization,
+		c.JobTitle,
+	}
+	for _, v := range append(append(ContactValues{}, c.Emails...), c.Phones...) {
+		fields = append(fields, v.Value)
+	}
+	fields = append(fields, c.Tags...)
+	for _, key := range c.Custom.Keys() {
+		fields = append(fields, c.Custom[key])
+	}
+	for _, field := range fields {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
 }
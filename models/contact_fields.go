@@ -0,0 +1,254 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Labels suggested for emails, phones and addresses. Any other label is kept as a custom label
+const (
+	LabelHome   = "home"
+	LabelWork   = "work"
+	LabelMobile = "mobile"
+	LabelOther  = "other"
+)
+
+const (
+	// maxLabelLength bounds custom labels
+	maxLabelLength = 30
+	// maxNotesLength bounds the notes of a contact
+	maxNotesLength = 10000
+	// csvListSeparator separates the entries of a list in a csv cell
+	csvListSeparator = ";"
+	// csvPreferredMark marks the preferred entry of a list in a csv cell
+	csvPreferredMark = "*"
+	// csvAddressSeparator separates the fields of an address in a csv cell
+	csvAddressSeparator = "|"
+)
+
+// ContactValue is a labelled email or phone number. Preferred marks the one to use first
+type ContactValue struct {
+	Label     string `json:"label,omitempty"`
+	Value     string `json:"value"`
+	Preferred bool   `json:"preferred,omitempty"`
+}
+
+// ContactValues are the emails or phone numbers of a contact. In csv they are written as
+// "*work:alice@acme.com; home:alice@example.com", the star marking the preferred value
+type ContactValues []ContactValue
+
+// Preferred returns the preferred value, or the first one if none is preferred
+func (values ContactValues) Preferred() (ContactValue, bool) {
+	for _, v := range values {
+		if v.Preferred {
+			return v, true
+		}
+	}
+	if len(values) > 0 {
+		return values[0], true
+	}
+	return ContactValue{}, false
+}
+
+// normalize trims values and labels, drops empty values, and keeps the first preferred value
+func (values ContactValues) normalize() ContactValues {
+	normalized := ContactValues{}
+	preferred := false
+	for _, v := range values {
+		v.Value = strings.TrimSpace(v.Value)
+		if v.Value == "" {
+			continue
+		}
+		v.Label = normalizeLabel(v.Label)
+		v.Preferred = v.Preferred && !preferred
+		preferred = preferred || v.Preferred
+		normalized = append(normalized, v)
+	}
+	return normalized
+}
+
+// MarshalCSV writes the values to a single csv cell
+func (values ContactValues) MarshalCSV() (string, error) {
+	entries := make([]string, len(values))
+	for i, v := range values {
+		entries[i] = csvEntry(v.Label, v.Preferred, v.Value)
+	}
+	return strings.Join(entries, csvListSeparator+" "), nil
+}
+
+// UnmarshalCSV reads the values from a single csv cell. A plain value, like in csv files from before labels, is an unlabelled value
+func (values *ContactValues) UnmarshalCSV(cell string) error {
+	parsed := ContactValues{}
+	for _, entry := range splitCSVList(cell) {
+		label, preferred, value := parseCSVEntry(entry)
+		parsed = append(parsed, ContactValue{Label: label, Value: value, Preferred: preferred})
+	}
+	*values = parsed
+	return nil
+}
+
+// Address is a labelled postal address
+type Address struct {
+	Label     string `json:"label,omitempty"`
+	Street    string `json:"street"`
+	Locality  string `json:"locality"`
+	Region    string `json:"region"`
+	Postcode  string `json:"postcode"`
+	Country   string `json:"country"`
+	Preferred bool   `json:"preferred,omitempty"`
+}
+
+// empty checks if none of the address's fields are set
+func (a Address) empty() bool {
+	return a.Street == "" && a.Locality == "" && a.Region == "" && a.Postcode == "" && a.Country == ""
+}
+
+// Addresses are the postal addresses of a contact. In csv they are written as
+// "*home:12 Main St|Springfield|IL|62701|US", the fields separated by pipes
+type Addresses []Address
+
+// normalize trims fields and labels, drops empty addresses, and keeps the first preferred address
+func (addresses Addresses) normalize() Addresses {
+	normalized := Addresses{}
+	preferred := false
+	for _, a := range addresses {
+		a.Street = strings.TrimSpace(a.Street)
+		a.Locality = strings.TrimSpace(a.Locality)
+		a.Region = strings.TrimSpace(a.Region)
+		a.Postcode = strings.TrimSpace(a.Postcode)
+		a.Country = strings.TrimSpace(a.Country)
+		if a.empty() {
+			continue
+		}
+		a.Label = normalizeLabel(a.Label)
+		a.Preferred = a.Preferred && !preferred
+		preferred = preferred || a.Preferred
+		normalized = append(normalized, a)
+	}
+	return normalized
+}
+
+// MarshalCSV writes the addresses to a single csv cell
+func (addresses Addresses) MarshalCSV() (string, error) {
+	entries := make([]string, len(addresses))
+	for i, a := range addresses {
+		fields := strings.Join([]string{a.Street, a.Locality, a.Region, a.Postcode, a.Country}, csvAddressSeparator)
+		entries[i] = csvEntry(a.Label, a.Preferred, fields)
+	}
+	return strings.Join(entries, csvListSeparator+" "), nil
+}
+
+// UnmarshalCSV reads the addresses from a single csv cell. Missing trailing fields are left empty
+func (addresses *Addresses) UnmarshalCSV(cell string) error {
+	parsed := Addresses{}
+	for _, entry := range splitCSVList(cell) {
+		label, preferred, value := parseCSVEntry(entry)
+		fields := strings.Split(value, csvAddressSeparator)
+		if len(fields) > 5 {
+			return fmt.Errorf("addresses have at most 5 fields, got %q", value)
+		}
+		fields = append(fields, make([]string, 5-len(fields))...)
+		parsed = append(parsed, Address{
+			Label:     label,
+			Street:    fields[0],
+			Locality:  fields[1],
+			Region:    fields[2],
+			Postcode:  fields[3],
+			Country:   fields[4],
+			Preferred: preferred,
+		})
+	}
+	*addresses = parsed
+	return nil
+}
+
+// URLs are the websites of a contact. In csv they are separated by semicolons
+type URLs []string
+
+// MarshalCSV writes the urls to a single csv cell
+func (urls URLs) MarshalCSV() (string, error) {
+	return strings.Join(urls, csvListSeparator+" "), nil
+}
+
+// UnmarshalCSV reads the urls from a single csv cell
+func (urls *URLs) UnmarshalCSV(cell string) error {
+	*urls = URLs(splitCSVList(cell))
+	return nil
+}
+
+// validateURL checks a website is an absolute http or https url
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q isn't an http or https url", raw)
+	}
+	return nil
+}
+
+// validateDate checks a birthday or anniversary is a YYYY-MM-DD date, or --MM-DD when the year isn't known
+func validateDate(field string, date string) error {
+	if date == "" {
+		return nil
+	}
+	if strings.HasPrefix(date, "--") {
+		// a leap year, so --02-29 is valid
+		date = "2000" + date[1:]
+	}
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return fmt.Errorf("%s must be YYYY-MM-DD, or --MM-DD without a year", field)
+	}
+	return nil
+}
+
+// normalizeLabel lowercases and trims a label
+func normalizeLabel(label string) string {
+	return strings.ToLower(strings.TrimSpace(label))
+}
+
+// validateLabel checks a custom label fits in csv cells
+func validateLabel(label string) error {
+	if len(label) > maxLabelLength {
+		return fmt.Errorf("labels must be at most %d characters", maxLabelLength)
+	}
+	if strings.ContainsAny(label, ":"+csvListSeparator+csvPreferredMark+csvAddressSeparator) {
+		return fmt.Errorf("labels can't contain : ; * or |")
+	}
+	return nil
+}
+
+// csvEntry writes an entry of a list as [*][label:]value
+func csvEntry(label string, preferred bool, value string) string {
+	entry := value
+	if label != "" {
+		entry = label + ":" + entry
+	}
+	if preferred {
+		entry = csvPreferredMark + entry
+	}
+	return entry
+}
+
+// parseCSVEntry reads an entry of a list written by csvEntry
+func parseCSVEntry(entry string) (label string, preferred bool, value string) {
+	if strings.HasPrefix(entry, csvPreferredMark) {
+		preferred = true
+		entry = entry[len(csvPreferredMark):]
+	}
+	if i := strings.Index(entry, ":"); i >= 0 && !strings.Contains(entry[:i], "@") {
+		label, entry = entry[:i], entry[i+1:]
+	}
+	return strings.TrimSpace(label), preferred, strings.TrimSpace(entry)
+}
+
+// splitCSVList splits a csv cell into its entries, dropping empty ones
+func splitCSVList(cell string) []string {
+	entries := []string{}
+	for _, entry := range strings.Split(cell, csvListSeparator) {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
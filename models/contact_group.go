@@ -0,0 +1,87 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// ContactGroup is a named group of the user's contacts, like a mailing list. Groups can contain other groups
+type ContactGroup struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Contacts are the ids of the contacts in the group. They can be in any of the user's own books
+	Contacts []string `json:"contacts"`
+	// Groups are the ids of the groups nested in the group
+	Groups    []string  `json:"groups"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+}
+
+// GroupCycleError is returned when groups contain themselves through their nested groups
+type GroupCycleError struct {
+	// Path are the names of the groups in the cycle, starting and ending with the same group
+	Path []string
+}
+
+func (e GroupCycleError) Error() string {
+	return "groups can't contain themselves: " + strings.Join(e.Path, " > ")
+}
+
+// GroupExpansion is a group flattened to the email addresses of its contacts and the contacts of its nested groups
+type GroupExpansion struct {
+	GroupID string `json:"group_id"`
+	// Emails are the preferred emails of the contacts, each listed once ignoring case
+	Emails []string `json:"emails"`
+	// Recipients are the emails with the names of their contacts, like "Ada Lovelace" <ada@example.com>
+	Recipients []string `json:"recipients"`
+	// WithoutEmail are the ids of the contacts that have no email
+	WithoutEmail []string `json:"without_email"`
+}
+
+// ExpandGroup flattens a group to the ids of its contacts and the contacts of its nested groups, each listed once,
+// in the order they are found. Groups that don't exist are skipped. Fails with a GroupCycleError if a group contains itself
+func ExpandGroup(groups []ContactGroup, id string) ([]string, error) {
+	byID := map[string]ContactGroup{}
+	for _, g := range groups {
+		byID[g.ID] = g
+	}
+	contacts := []string{}
+	seen := map[string]bool{}
+	done := map[string]bool{}
+	// path are the groups being expanded, from the group asked for down to the current one
+	path := []ContactGroup{}
+	var visit func(id string) error
+	visit = func(id string) error {
+		group, ok := byID[id]
+		if !ok || done[id] {
+			return nil
+		}
+		for i, ancestor := range path {
+			if ancestor.ID == id {
+				cycle := []string{}
+				for _, g := range path[i:] {
+					cycle = append(cycle, g.Name)
+				}
+				return GroupCycleError{Path: append(cycle, group.Name)}
+			}
+		}
+		for _, c := range group.Contacts {
+			if !seen[c] {
+				seen[c] = true
+				contacts = append(contacts, c)
+			}
+		}
+		path = append(path, group)
+		for _, nested := range group.Groups {
+			if err := visit(nested); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		done[id] = true
+		return nil
+	}
+	if err := visit(id); err != nil {
+		return nil, err
+	}
+	return contacts, nil
+}
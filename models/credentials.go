@@ -2,6 +2,44 @@ package models
 
 // Credentials are used for logging in
 type Credentials struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username string  `json:"username"`
+	Password string  `json:"password"`
+	Scopes   []Scope `json:"scopes,omitempty"`
+	// UserID is the id of the user the token was issued to, so a token can't be used by a later user with the same username.
+	// Never read from request bodies
+	UserID string `json:"-" mapstructure:"user_id"`
+	// SessionVersion is the User's SessionVersion when the token was issued. Never read from request bodies
+	SessionVersion int `json:"-" mapstructure:"session_version"`
+	// Impersonator is the admin acting as the user, for tokens issued through impersonation. Never read from request bodies
+	Impersonator string `json:"-" mapstructure:"impersonator"`
+	// ClientID and GrantID are set on access tokens issued to third party apps. Never read from request bodies
+	ClientID string `json:"-" mapstructure:"client_id"`
+	GrantID  string `json:"-" mapstructure:"grant_id"`
+}
+
+// GrantedScopes returns the scopes the credentials carry. Tokens issued before scopes existed carry none and are granted the DefaultScopes
+func (c Credentials) GrantedScopes() []Scope {
+	if c.Scopes == nil {
+		return DefaultScopes
+	}
+	return c.Scopes
+}
+
+// MissingScopes returns the scopes from required that the credentials were not granted
+func (c Credentials) MissingScopes(required ...Scope) []Scope {
+	var missing []Scope
+	granted := c.GrantedScopes()
+	for _, r := range required {
+		found := false
+		for _, g := range granted {
+			if g == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, r)
+		}
+	}
+	return missing
 }
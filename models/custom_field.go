@@ -0,0 +1,337 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldType is the type of the values of a custom field
+type FieldType string
+
+const (
+	// FieldString holds free text
+	FieldString FieldType = "string"
+	// FieldNumber holds a decimal number, like 42 or -1.5
+	FieldNumber FieldType = "number"
+	// FieldDate holds a YYYY-MM-DD date
+	FieldDate FieldType = "date"
+	// FieldEnum holds one of the options of the field
+	FieldEnum FieldType = "enum"
+	// FieldURL holds an http or https url
+	FieldURL FieldType = "url"
+	// FieldBoolean holds true or false
+	FieldBoolean FieldType = "boolean"
+)
+
+const (
+	// MaxBookFields bounds the custom fields of a book
+	MaxBookFields = 50
+	// maxFieldValueLength bounds the value of a custom field
+	maxFieldValueLength = 1000
+	// maxFieldLabelLength bounds the label of a custom field
+	maxFieldLabelLength = 100
+	// maxFieldOptions bounds the options of an enum field
+	maxFieldOptions = 100
+)
+
+// fieldKeyPattern is the form of custom field keys. They are used in csv columns, vCard properties and filters
+var fieldKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,39}$`)
+
+// Valid checks if the type exists
+func (t FieldType) Valid() bool {
+	switch t {
+	case FieldString, FieldNumber, FieldDate, FieldEnum, FieldURL, FieldBoolean:
+		return true
+	}
+	return false
+}
+
+// Ordered checks if values of the type can be compared with lower and upper bounds
+func (t FieldType) Ordered() bool {
+	return t == FieldNumber || t == FieldDate
+}
+
+// FieldDefinition defines a custom field of the contacts in a book, like a customer tier or a Slack handle
+type FieldDefinition struct {
+	// Key names the field in contacts, csv columns and filters, like account_manager
+	Key   string    `json:"key"`
+	Label string    `json:"label"`
+	Type  FieldType `json:"type"`
+	// Options are the values of enum fields
+	Options  []string `json:"options,omitempty"`
+	Required bool     `json:"required,omitempty"`
+}
+
+// Normalize checks a value fits the field and returns it in its canonical form:
+// numbers without trailing zeros, true or false, and enum values spelled like their option
+func (d FieldDefinition) Normalize(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch d.Type {
+	case FieldNumber:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s must be a number", d.Key)
+		}
+		return strconv.FormatFloat(n, 'f', -1, 64), nil
+	case FieldDate:
+		if _, err := time.Parse("2006-01-02", value); err != nil {
+			return "", fmt.Errorf("%s must be a YYYY-MM-DD date", d.Key)
+		}
+	case FieldEnum:
+		for _, option := range d.Options {
+			if strings.EqualFold(option, value) {
+				return option, nil
+			}
+		}
+		return "", fmt.Errorf("%s must be one of %s", d.Key, strings.Join(d.Options, ", "))
+	case FieldURL:
+		if err := validateURL(value); err != nil {
+			return "", fmt.Errorf("%s: %s", d.Key, err)
+		}
+	case FieldBoolean:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("%s must be true or false", d.Key)
+		}
+		return strconv.FormatBool(b), nil
+	}
+	if len(value) > maxFieldValueLength {
+		return "", fmt.Errorf("%s must be at most %d characters", d.Key, maxFieldValueLength)
+	}
+	return value, nil
+}
+
+// Compare orders two normalized values of the field, numerically for numbers
+func (d FieldDefinition) Compare(a string, b string) int {
+	if d.Type == FieldNumber {
+		x, _ := strconv.ParseFloat(a, 64)
+		y, _ := strconv.ParseFloat(b, 64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// FieldDefinitions are the custom fields of a book
+type FieldDefinitions []FieldDefinition
+
+// Find finds the definition of a field by key
+func (defs FieldDefinitions) Find(key string) (FieldDefinition, bool) {
+	for _, d := range defs {
+		if d.Key == key {
+			return d, true
+		}
+	}
+	return FieldDefinition{}, false
+}
+
+// Normalize trims the definitions, lowercases keys and labels fields by their key when they have no label
+func (defs FieldDefinitions) Normalize() FieldDefinitions {
+	normalized := FieldDefinitions{}
+	for _, d := range defs {
+		d.Key = strings.ToLower(strings.TrimSpace(d.Key))
+		d.Label = strings.TrimSpace(d.Label)
+		if d.Label == "" {
+			d.Label = d.Key
+		}
+		options := []string{}
+		for _, option := range d.Options {
+			if option = strings.TrimSpace(option); option != "" {
+				options = append(options, option)
+			}
+		}
+		d.Options = nil
+		if d.Type == FieldEnum {
+			d.Options = options
+		}
+		normalized = append(normalized, d)
+	}
+	return normalized
+}
+
+// Validate checks the keys are well formed and unique, the types exist and enum fields have distinct options. Normalize first
+func (defs FieldDefinitions) Validate() error {
+	if len(defs) > MaxBookFields {
+		return fmt.Errorf("books have at most %d custom fields", MaxBookFields)
+	}
+	keys := map[string]bool{}
+	for _, d := range defs {
+		if !fieldKeyPattern.MatchString(d.Key) {
+			return fmt.Errorf("field keys are up to 40 lowercase letters, digits and underscores, starting with a letter, got %q", d.Key)
+		}
+		if keys[d.Key] {
+			return fmt.Errorf("field %s is defined twice", d.Key)
+		}
+		keys[d.Key] = true
+		if len(d.Label) > maxFieldLabelLength {
+			return fmt.Errorf("field labels must be at most %d characters", maxFieldLabelLength)
+		}
+		if !d.Type.Valid() {
+			return fmt.Errorf("field %s must be a string, number, date, enum, url or boolean", d.Key)
+		}
+		if d.Type != FieldEnum {
+			continue
+		}
+		if len(d.Options) == 0 || len(d.Options) > maxFieldOptions {
+			return fmt.Errorf("enum field %s must have between 1 and %d options", d.Key, maxFieldOptions)
+		}
+		options := map[string]bool{}
+		for _, option := range d.Options {
+			if options[strings.ToLower(option)] || len(option) > maxFieldLabelLength {
+				return fmt.Errorf("the options of %s must be distinct and at most %d characters", d.Key, maxFieldLabelLength)
+			}
+			options[strings.ToLower(option)] = true
+		}
+	}
+	return nil
+}
+
+// Apply checks the custom values of a contact against the definitions and returns them normalized.
+// Values of fields that aren't defined are refused, and required fields must have a value
+func (defs FieldDefinitions) Apply(custom CustomFields) (CustomFields, error) {
+	applied := CustomFields{}
+	for _, key := range custom.Keys() {
+		d, ok := defs.Find(key)
+		if !ok {
+			return nil, fmt.Errorf("the book has no field %s", key)
+		}
+		value, err := d.Normalize(custom[key])
+		if err != nil {
+			return nil, err
+		}
+		applied[key] = value
+	}
+	for _, d := range defs {
+		if _, ok := applied[d.Key]; d.Required && !ok {
+			return nil, fmt.Errorf("%s is required", d.Key)
+		}
+	}
+	return applied.orNil(), nil
+}
+
+// Keep returns the custom values that fit the definitions, normalized, and drops the others.
+// Used when contacts change books or the definitions of their book change
+func (defs FieldDefinitions) Keep(custom CustomFields) CustomFields {
+	kept := CustomFields{}
+	for key, value := range custom {
+		if d, ok := defs.Find(key); ok {
+			if value, err := d.Normalize(value); err == nil {
+				kept[key] = value
+			}
+		}
+	}
+	return kept.orNil()
+}
+
+// CustomFields are the values of the custom fields of a contact, by key. Values are kept as text in the
+// canonical form of their field. In json, numbers and booleans are also read from json numbers and booleans
+type CustomFields map[string]string
+
+// Keys lists the keys of the fields with a value, sorted
+func (custom CustomFields) Keys() []string {
+	keys := []string{}
+	for key := range custom {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// UnmarshalJSON reads an object of strings, numbers, booleans and nulls. Nulls are left out
+func (custom *CustomFields) UnmarshalJSON(data []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	parsed := CustomFields{}
+	for key, value := range raw {
+		switch v := value.(type) {
+		case nil:
+		case string:
+			parsed[key] = v
+		case float64:
+			parsed[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			parsed[key] = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("custom field %s must be a string, number or boolean", key)
+		}
+	}
+	*custom = parsed
+	return nil
+}
+
+// normalize trims the values and drops empty ones
+func (custom CustomFields) normalize() CustomFields {
+	normalized := CustomFields{}
+	for key, value := range custom {
+		if value = strings.TrimSpace(value); value != "" {
+			normalized[strings.ToLower(strings.TrimSpace(key))] = value
+		}
+	}
+	return normalized.orNil()
+}
+
+// orNil returns nil for contacts without custom values, like contacts read from storage
+func (custom CustomFields) orNil() CustomFields {
+	if len(custom) == 0 {
+		return nil
+	}
+	return custom
+}
+
+// FieldFilter filters contacts on the value of a custom field
+type FieldFilter struct {
+	Field FieldDefinition
+	// Op is eq, or gte and lte for lower and upper bounds of numbers and dates
+	Op    string
+	Value string
+}
+
+// NewFieldFilter checks the operation fits the field and normalizes the value
+func NewFieldFilter(field FieldDefinition, op string, value string) (FieldFilter, error) {
+	switch op {
+	case "", "eq":
+		op = "eq"
+	case "gte", "lte":
+		if !field.Type.Ordered() {
+			return FieldFilter{}, fmt.Errorf("only number and date fields can be filtered with %s", op)
+		}
+	default:
+		return FieldFilter{}, fmt.Errorf("fields are filtered with eq, gte or lte, not %s", op)
+	}
+	normalized, err := field.Normalize(value)
+	if err != nil {
+		return FieldFilter{}, err
+	}
+	return FieldFilter{Field: field, Op: op, Value: normalized}, nil
+}
+
+// Matches checks the contact's value of the field passes the filter. Contacts without a value never match
+func (f FieldFilter) Matches(c Contact) bool {
+	value, ok := c.Custom[f.Field.Key]
+	if !ok {
+		return false
+	}
+	cmp := f.Field.Compare(value, f.Value)
+	switch f.Op {
+	case "gte":
+		return cmp >= 0
+	case "lte":
+		return cmp <= 0
+	}
+	if f.Field.Type == FieldString || f.Field.Type == FieldURL {
+		return strings.EqualFold(value, f.Value)
+	}
+	return cmp == 0
+}
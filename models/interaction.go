@@ -0,0 +1,97 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// InteractionKind is what happened in an interaction with a contact
+type InteractionKind string
+
+const (
+	InteractionCall    InteractionKind = "call"
+	InteractionMeeting InteractionKind = "meeting"
+	InteractionEmail   InteractionKind = "email"
+	// InteractionNote is a note about the contact, which doesn't count as contacting them
+	InteractionNote InteractionKind = "note"
+)
+
+const (
+	// maxInteractionLength bounds the text of interactions
+	maxInteractionLength = 10000
+	// maxInteractionLinks bounds the other contacts an interaction links
+	maxInteractionLinks = 50
+)
+
+// Interaction is a call, meeting or email with a contact, or a note about them, on their timeline
+type Interaction struct {
+	ID string `json:"id"`
+	// ContactID is the contact the interaction was logged against
+	ContactID string          `json:"contact_id"`
+	Kind      InteractionKind `json:"kind"`
+	// At is when the interaction happened, defaulting to when it was logged
+	At   time.Time `json:"at"`
+	Text string    `json:"text"`
+	// Links are other contacts of the book the interaction was with, whose timelines show it too
+	Links []string `json:"links,omitempty"`
+	// Author is the user who logged the interaction, who needn't own the book
+	Author    string    `json:"author"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// InteractionPage is one page of the timeline of a contact, newest first
+type InteractionPage struct {
+	Interactions []Interaction `json:"interactions"`
+	Total        int           `json:"total"`
+	Offset       int           `json:"offset"`
+	Limit        int           `json:"limit"`
+}
+
+// Normalize trims the text and drops repeated links and links to the contact itself
+func (i *Interaction) Normalize() {
+	i.Kind = InteractionKind(strings.ToLower(strings.TrimSpace(string(i.Kind))))
+	i.Text = strings.TrimSpace(i.Text)
+	links := []string{}
+	seen := map[string]bool{i.ContactID: true}
+	for _, link := range i.Links {
+		if link = strings.TrimSpace(link); link != "" && !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+	i.Links = links
+}
+
+// Validate checks the kind, text and links of the interaction. Normalize first
+func (i Interaction) Validate() error {
+	switch i.Kind {
+	case InteractionCall, InteractionMeeting, InteractionEmail, InteractionNote:
+	default:
+		return fmt.Errorf("kind must be call, meeting, email or note")
+	}
+	if i.At.IsZero() {
+		return fmt.Errorf("at is required")
+	}
+	if len(i.Text) > maxInteractionLength {
+		return fmt.Errorf("text must be at most %d characters", maxInteractionLength)
+	}
+	if i.Kind == InteractionNote && i.Text == "" {
+		return fmt.Errorf("notes need a text")
+	}
+	if len(i.Links) > maxInteractionLinks {
+		return fmt.Errorf("interactions can link at most %d contacts", maxInteractionLinks)
+	}
+	return nil
+}
+
+// Contacted checks if the interaction was contact with the contact by a time. Notes aren't, and neither are
+// interactions planned after it
+func (i Interaction) Contacted(by time.Time) bool {
+	return i.Kind != InteractionNote && !i.At.After(by)
+}
+
+// ContactedSince checks if the contact was last contacted at or after a time. Contacts never contacted weren't
+func (c Contact) ContactedSince(t time.Time) bool {
+	return c.LastContacted != nil && !c.LastContacted.Before(t)
+}
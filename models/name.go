@@ -0,0 +1,141 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// NameOrder is the order given and family names are written in
+type NameOrder string
+
+const (
+	// NameOrderAuto writes family names first for Chinese, Japanese and Korean locales and names, given names first otherwise
+	NameOrderAuto NameOrder = ""
+	// NameOrderGivenFirst always writes given names first
+	NameOrderGivenFirst NameOrder = "given_first"
+	// NameOrderFamilyFirst always writes family names first
+	NameOrderFamilyFirst NameOrder = "family_first"
+)
+
+// familyFirstLanguages are the languages names are written family name first in
+var familyFirstLanguages = map[string]bool{"zh": true, "ja": true, "ko": true}
+
+// NameFormat builds the display and sort names of contacts. The zero value is the default format
+type NameFormat struct {
+	// Order is the order of given and family names. Defaults to NameOrderAuto
+	Order NameOrder `json:"order"`
+	// SortByGivenName sorts by given name instead of family name
+	SortByGivenName bool `json:"sort_by_given_name"`
+	// ShowNickname displays the nickname instead of the given name
+	ShowNickname bool `json:"show_nickname"`
+	// HideHonorifics leaves the prefix and suffix out of display names
+	HideHonorifics bool `json:"hide_honorifics"`
+}
+
+// DisplayName is the contact's full name as written in locale, like "Dr. María José García-López Jr." or "山田太郎".
+// Contacts without a name are displayed by their organisation, email or phone
+func (f NameFormat) DisplayName(c Contact, locale string) string {
+	given := c.FirstName
+	if f.ShowNickname && c.Nickname != "" {
+		given = c.Nickname
+	}
+	name := f.joinNames(locale, given, c.MiddleName, c.LastName)
+	if name == "" {
+		return c.fallbackName()
+	}
+	if !f.HideHonorifics {
+		name = joinNonEmpty(" ", c.Prefix, name, c.Suffix)
+	}
+	return name
+}
+
+// SortName is the key the contact sorts by in locale. Phonetic names are used when set,
+// so names in scripts without an alphabetical order sort by their reading
+func (f NameFormat) SortName(c Contact, locale string) string {
+	given, family := c.FirstName, c.LastName
+	if c.PhoneticFirstName != "" {
+		given = c.PhoneticFirstName
+	}
+	if c.PhoneticLastName != "" {
+		family = c.PhoneticLastName
+	}
+	name := joinNonEmpty(" ", family, given, c.MiddleName)
+	if f.SortByGivenName {
+		name = joinNonEmpty(" ", given, c.MiddleName, family)
+	}
+	if name == "" {
+		name = c.fallbackName()
+	}
+	return strings.ToLower(name)
+}
+
+// Present sets the display names of contacts and sorts them by sort name, in locale
+func (f NameFormat) Present(contacts []Contact, locale string) {
+	keyed := make([]struct {
+		key     string
+		contact Contact
+	}, len(contacts))
+	for i, c := range contacts {
+		c.DisplayName = f.DisplayName(c, locale)
+		keyed[i].key, keyed[i].contact = f.SortName(c, locale), c
+	}
+	sort.SliceStable(keyed, func(i, j int) bool { return keyed[i].key < keyed[j].key })
+	for i := range keyed {
+		contacts[i] = keyed[i].contact
+	}
+}
+
+// joinNames writes the given, middle and family names in the order of the format and locale.
+// Names written in Chinese, Japanese or Korean scripts aren't separated by spaces
+func (f NameFormat) joinNames(locale string, given string, middle string, family string) string {
+	familyFirst := f.Order == NameOrderFamilyFirst
+	if f.Order == NameOrderAuto {
+		familyFirst = familyFirstLocale(locale) || isCJK(given) || isCJK(family)
+	}
+	if !familyFirst {
+		return joinNonEmpty(" ", given, middle, family)
+	}
+	separator := " "
+	if isCJK(given+middle+family) && strings.IndexFunc(given+middle+family, unicode.IsSpace) < 0 {
+		separator = ""
+	}
+	return joinNonEmpty(separator, family, given, middle)
+}
+
+// fallbackName names contacts without a name by their organisation, email or phone
+func (c Contact) fallbackName() string {
+	for _, name := range []string{c.Nickname, c.Organization, c.PreferredEmail(), c.PreferredPhone()} {
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// familyFirstLocale checks if names are written family name first in locale, like ja or zh-Hant-TW
+func familyFirstLocale(locale string) bool {
+	language := strings.SplitN(strings.Replace(locale, "_", "-", -1), "-", 2)[0]
+	return familyFirstLanguages[strings.ToLower(language)]
+}
+
+// isCJK checks if a name is written in a Chinese, Japanese or Korean script
+func isCJK(name string) bool {
+	for _, r := range name {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			return true
+		}
+	}
+	return false
+}
+
+// joinNonEmpty joins the parts that aren't empty
+func joinNonEmpty(separator string, parts ...string) string {
+	kept := []string{}
+	for _, part := range parts {
+		if part != "" {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, separator)
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"net/url"
+	"time"
+)
+
+// ClientScopes are the scopes third party apps can be granted. They can't change the account or use the admin api
+var ClientScopes = []Scope{
+	ScopeContactsRead,
+	ScopeContactsWrite,
+	ScopeContactsDelete,
+	ScopeContactsImport,
+	ScopeContactsExport,
+	ScopeProfileRead,
+}
+
+// IsClientScope checks that third party apps can be granted the scope
+func (s Scope) IsClientScope() bool {
+	for _, c := range ClientScopes {
+		if s == c {
+			return true
+		}
+	}
+	return false
+}
+
+// OAuthClient is a third party app registered to ask users for access to their account
+type OAuthClient struct {
+	ID           string   `json:"client_id"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	// Scopes are the most the client can ask for
+	Scopes []Scope `json:"scopes"`
+	// Confidential clients authenticate with their secret at the token endpoint. Public clients, like mobile apps, only have pkce
+	Confidential bool      `json:"confidential"`
+	SecretHash   string    `json:"-"`
+	CreatedBy    string    `json:"created_by"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// HasRedirectURI checks that uri is exactly one of the client's redirect uris
+func (c OAuthClient) HasRedirectURI(uri string) bool {
+	for _, r := range c.RedirectURIs {
+		if r == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsScope checks that the client can ask for the scope
+func (c OAuthClient) AllowsScope(scope Scope) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidRedirectURI checks that uri is absolute, has no fragment, and only uses http for loopback addresses
+func ValidRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	}
+	return false
+}
+
+// OAuthGrant is a user's consent for a client to act for them with some scopes. Removing it revokes the client's tokens
+type OAuthGrant struct {
+	ID         string    `json:"id"`
+	ClientID   string    `json:"client_id"`
+	ClientName string    `json:"client_name"`
+	Scopes     []Scope   `json:"scopes"`
+	GrantedAt  time.Time `json:"granted_at"`
+}
+
+// OAuthCode is an authorization code waiting to be exchanged for an access token. Only the hash of the code is stored
+type OAuthCode struct {
+	CodeHash      string
+	ClientID      string
+	Username      string
+	GrantID       string
+	RedirectURI   string
+	Scopes        []Scope
+	CodeChallenge string
+	ExpiresAt     time.Time
+}
@@ -0,0 +1,7 @@
+package models
+
+// OIDCIdentity links a user to an account at an OpenID Connect provider. Subjects are only unique within their issuer
+type OIDCIdentity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+}
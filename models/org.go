@@ -0,0 +1,54 @@
+package models
+
+import "time"
+
+// OrgRole is what a member can do in an organisation
+type OrgRole string
+
+const (
+	// OrgRoleMember lets users read the company directory and invite others
+	OrgRoleMember OrgRole = "member"
+	// OrgRoleAdmin lets users curate the directory, manage members and rename or delete the organisation
+	OrgRoleAdmin OrgRole = "admin"
+)
+
+// Valid checks if the role exists
+func (r OrgRole) Valid() bool {
+	return r == OrgRoleMember || r == OrgRoleAdmin
+}
+
+// Org is an organisation with a company directory its members share
+type Org struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	// Role is the role of the user reading the organisation
+	Role OrgRole `json:"role,omitempty"`
+}
+
+// OrgMembership is a user's membership of an organisation. Kept on the user
+type OrgMembership struct {
+	OrgID    string    `json:"org_id"`
+	Role     OrgRole   `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// OrgMember is a member of an organisation, as listed to the other members
+type OrgMember struct {
+	Username string    `json:"username"`
+	Role     OrgRole   `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// OrgInvite invites a user into an organisation. It is removed once accepted or declined
+type OrgInvite struct {
+	ID        string    `json:"id"`
+	OrgID     string    `json:"org_id"`
+	OrgName   string    `json:"org_name"`
+	Username  string    `json:"username"`
+	Role      OrgRole   `json:"role"`
+	InvitedBy string    `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
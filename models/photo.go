@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// ContactPhoto describes the photo of a contact. The photo and its thumbnails are kept in a blob store under its hash,
+// so contacts with the same photo share it. Its fields are tagged out of csv too, as gocsv reads the fields of struct pointers
+type ContactPhoto struct {
+	// Hash is the hex sha256 of the photo
+	Hash        string    `json:"hash" csv:"-"`
+	ContentType string    `json:"content_type" csv:"-"`
+	Width       int       `json:"width" csv:"-"`
+	Height      int       `json:"height" csv:"-"`
+	Size        int64     `json:"size" csv:"-"`
+	UpdatedAt   time.Time `json:"updated_at" csv:"-"`
+}
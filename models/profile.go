@@ -0,0 +1,30 @@
+package models
+
+// ProfileVisibility controls who can see a user's profile
+type ProfileVisibility string
+
+const (
+	// VisibilityPublic shows the profile, including a verified email, to every logged in user
+	VisibilityPublic ProfileVisibility = "public"
+	// VisibilityUsers shows only the username to every logged in user. The default
+	VisibilityUsers ProfileVisibility = "users"
+	// VisibilityPrivate hides the profile from everyone but the owner and users granted access to their contacts
+	VisibilityPrivate ProfileVisibility = "private"
+)
+
+// IsValid checks if the visibility is one of the known values
+func (v ProfileVisibility) IsValid() bool {
+	switch v {
+	case VisibilityPublic, VisibilityUsers, VisibilityPrivate:
+		return true
+	}
+	return false
+}
+
+// Profile is what other users can see of a user. Contacts are only included for the owner and users granted access
+type Profile struct {
+	Username          string            `json:"username"`
+	Email             string            `json:"email,omitempty"`
+	ProfileVisibility ProfileVisibility `json:"profile_visibility,omitempty"`
+	Contacts          []Contact         `json:"contacts,omitempty"`
+}
@@ -0,0 +1,112 @@
+package models
+
+import "regexp"
+
+// Permission allows an action in the admin api. Roles grant permissions
+type Permission string
+
+const (
+	// PermissionUsersRead allows listing and searching users
+	PermissionUsersRead Permission = "users:read"
+	// PermissionUsersContacts allows reading the contacts of any user
+	PermissionUsersContacts Permission = "users:contacts"
+	// PermissionUsersManage allows disabling, enabling and unlocking users, and forcing password resets
+	PermissionUsersManage Permission = "users:manage"
+	// PermissionUsersImpersonate allows acting as another user
+	PermissionUsersImpersonate Permission = "users:impersonate"
+	// PermissionRolesManage allows defining roles and assigning them to users
+	PermissionRolesManage Permission = "roles:manage"
+	// PermissionAuditRead allows reading the audit log
+	PermissionAuditRead Permission = "audit:read"
+	// PermissionClientsManage allows registering and removing third party apps
+	PermissionClientsManage Permission = "clients:manage"
+)
+
+// Permissions are every permission the api checks
+var Permissions = []Permission{
+	PermissionUsersRead,
+	PermissionUsersContacts,
+	PermissionUsersManage,
+	PermissionUsersImpersonate,
+	PermissionRolesManage,
+	PermissionAuditRead,
+	PermissionClientsManage,
+}
+
+// IsValid checks that the permission is one the api checks
+func (p Permission) IsValid() bool {
+	for _, known := range Permissions {
+		if p == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Role names a set of permissions that can be assigned to users
+type Role string
+
+const (
+	// RoleUser is every user. It grants no permissions
+	RoleUser Role = "user"
+	// RoleAdmin grants every permission
+	RoleAdmin Role = "admin"
+	// RoleSupport can look at every user and their contacts, but not change them
+	RoleSupport Role = "support"
+	// RoleAuditor can only read the audit log
+	RoleAuditor Role = "auditor"
+)
+
+// roleNamePattern keeps role names usable in urls
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// IsValid checks that the role name is lower case letters, digits, dashes and underscores
+func (r Role) IsValid() bool {
+	return roleNamePattern.MatchString(string(r))
+}
+
+// RoleDefinition is a role and the permissions it grants. Built in roles ship with the service and can't be changed
+type RoleDefinition struct {
+	Name        Role         `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Permissions []Permission `json:"permissions"`
+	BuiltIn     bool         `json:"built_in"`
+}
+
+// BuiltInRoles are the roles that ship with the service
+var BuiltInRoles = []RoleDefinition{
+	{
+		Name:        RoleUser,
+		Description: "Every user",
+		Permissions: []Permission{},
+		BuiltIn:     true,
+	},
+	{
+		Name:        RoleAdmin,
+		Description: "Manages every user, role, third party app and the audit log",
+		Permissions: Permissions,
+		BuiltIn:     true,
+	},
+	{
+		Name:        RoleSupport,
+		Description: "Reads every user and their contacts",
+		Permissions: []Permission{PermissionUsersRead, PermissionUsersContacts},
+		BuiltIn:     true,
+	},
+	{
+		Name:        RoleAuditor,
+		Description: "Reads the audit log",
+		Permissions: []Permission{PermissionAuditRead},
+		BuiltIn:     true,
+	},
+}
+
+// BuiltInRole finds a built in role by name
+func BuiltInRole(name Role) (RoleDefinition, bool) {
+	for _, def := range BuiltInRoles {
+		if def.Name == name {
+			return def, true
+		}
+	}
+	return RoleDefinition{}, false
+}
@@ -0,0 +1,55 @@
+package models
+
+// Scope is a permission carried by a token. Routes declare the scopes they require
+type Scope string
+
+const (
+	// ScopeContactsRead allows listing and fetching contacts
+	ScopeContactsRead Scope = "contacts:read"
+	// ScopeContactsWrite allows creating and updating contacts
+	ScopeContactsWrite Scope = "contacts:write"
+	// ScopeContactsDelete allows deleting contacts
+	ScopeContactsDelete Scope = "contacts:delete"
+	// ScopeContactsImport allows importing contacts from csv
+	ScopeContactsImport Scope = "contacts:import"
+	// ScopeContactsExport allows exporting contacts as csv
+	ScopeContactsExport Scope = "contacts:export"
+	// ScopeProfileRead allows reading the logged in user
+	ScopeProfileRead Scope = "profile:read"
+	// ScopeProfileWrite allows changing the logged in user's account settings
+	ScopeProfileWrite Scope = "profile:write"
+	// ScopeAdmin allows using the admin api. Only has an effect for admins
+	ScopeAdmin Scope = "admin"
+)
+
+// DefaultScopes are granted to a user logging in with their password when they don't ask for fewer
+var DefaultScopes = []Scope{
+	ScopeContactsRead,
+	ScopeContactsWrite,
+	ScopeContactsDelete,
+	ScopeContactsImport,
+	ScopeContactsExport,
+	ScopeProfileRead,
+	ScopeProfileWrite,
+	ScopeAdmin,
+}
+
+// ImpersonationScopes are granted to admins impersonating a user. They can act on the contacts but not change the account
+var ImpersonationScopes = []Scope{
+	ScopeContactsRead,
+	ScopeContactsWrite,
+	ScopeContactsDelete,
+	ScopeContactsImport,
+	ScopeContactsExport,
+	ScopeProfileRead,
+}
+
+// IsValid checks that the scope is one the api knows about
+func (s Scope) IsValid() bool {
+	for _, d := range DefaultScopes {
+		if s == d {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxTagLength bounds the names of tags
+	maxTagLength = 50
+	// MaxContactTags bounds the tags of a contact
+	MaxContactTags = 50
+)
+
+// Tag is a tag of the contacts in a book, with the number of contacts tagged with it
+type Tag struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// NormalizeTag trims a tag and collapses the spaces in it. Tags are compared ignoring case
+func NormalizeTag(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// ValidateTag checks a normalized tag fits in urls and csv cells
+func ValidateTag(name string) error {
+	if name == "" || len(name) > maxTagLength {
+		return fmt.Errorf("tags must be between 1 and %d characters", maxTagLength)
+	}
+	if strings.ContainsAny(name, ",;/") {
+		return fmt.Errorf("tags can't contain , ; or /")
+	}
+	return nil
+}
+
+// Tags are the tags of a contact. In csv they are separated by semicolons
+type Tags []string
+
+// Has checks if one of the tags is name, ignoring case
+func (tags Tags) Has(name string) bool {
+	for _, tag := range tags {
+		if strings.EqualFold(tag, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add adds the names that aren't tags yet
+func (tags Tags) Add(names ...string) Tags {
+	added := append(Tags{}, tags...)
+	for _, name := range names {
+		if !added.Has(name) {
+			added = append(added, name)
+		}
+	}
+	return added
+}
+
+// Remove removes the names, ignoring case
+func (tags Tags) Remove(names ...string) Tags {
+	kept := Tags{}
+	for _, tag := range tags {
+		if !Tags(names).Has(tag) {
+			kept = append(kept, tag)
+		}
+	}
+	return kept
+}
+
+// Replace replaces the tag from with to. Contacts that already have to keep a single one
+func (tags Tags) Replace(from string, to string) Tags {
+	if !tags.Has(from) {
+		return tags
+	}
+	replaced := Tags{}
+	for _, tag := range tags {
+		if strings.EqualFold(tag, from) {
+			tag = to
+		}
+		if !replaced.Has(tag) {
+			replaced = append(replaced, tag)
+		}
+	}
+	return replaced
+}
+
+// normalize trims the tags and drops empty and repeated ones
+func (tags Tags) normalize() Tags {
+	normalized := Tags{}
+	for _, tag := range tags {
+		if tag = NormalizeTag(tag); tag != "" && !normalized.Has(tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
+}
+
+// validate checks each tag and the number of tags
+func (tags Tags) validate() error {
+	if len(tags) > MaxContactTags {
+		return fmt.Errorf("contacts have at most %d tags", MaxContactTags)
+	}
+	for _, tag := range tags {
+		if err := ValidateTag(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarshalCSV writes the tags to a single csv cell
+func (tags Tags) MarshalCSV() (string, error) {
+	return strings.Join(tags, csvListSeparator+" "), nil
+}
+
+// UnmarshalCSV reads the tags from a single csv cell
+func (tags *Tags) UnmarshalCSV(cell string) error {
+	*tags = Tags(splitCSVList(cell))
+	return nil
+}
+
+// CountTags counts the contacts with each tag. names are tags to list even when no contact has them.
+// Tags are sorted by name, ignoring case, and spelled like their first use
+func CountTags(names []string, contacts []Contact) []Tag {
+	counts := map[string]*Tag{}
+	tag := func(name string) *Tag {
+		key := strings.ToLower(name)
+		if counts[key] == nil {
+			counts[key] = &Tag{Name: name}
+		}
+		return counts[key]
+	}
+	for _, name := range names {
+		tag(name)
+	}
+	for _, c := range contacts {
+		for _, name := range c.Tags {
+			tag(name).Count++
+		}
+	}
+	tags := []Tag{}
+	for _, t := range counts {
+		tags = append(tags, *t)
+	}
+	sort.Slice(tags, func(i, j int) bool { return strings.ToLower(tags[i].Name) < strings.ToLower(tags[j].Name) })
+	return tags
+}
+
+// TagFilter filters contacts by their tags
+type TagFilter struct {
+	Tags Tags
+	// Any matches contacts with any of the tags instead of all of them
+	Any bool
+}
+
+// Matches checks if the contact has all of the tags, or any of them. Everything matches a filter without tags
+func (f TagFilter) Matches(c Contact) bool {
+	if len(f.Tags) == 0 {
+		return true
+	}
+	for _, tag := range f.Tags {
+		has := c.Tags.Has(tag)
+		if f.Any && has {
+			return true
+		}
+		if !f.Any && !has {
+			return false
+		}
+	}
+	return !f.Any
+}
@@ -1,9 +1,97 @@
 package models
 
+import "time"
+
 // User is a wrapper around a list of contacts.
 type User struct {
-	UserID   string `json:"id,omitempty"`
-	Username string `json:"username"`
-	Password string `json:"password,omitempty"`
+	UserID           string `json:"id,omitempty"`
+	Username         string `json:"username"`
+	Password         string `json:"password,omitempty"`
+	Email            string `json:"email,omitempty"`
+	EmailVerified    bool   `json:"email_verified"`
+	TwoFactorEnabled bool   `json:"two_factor_enabled"`
+	// Roles are assigned by admins. Every user has RoleUser without it being listed
+	Roles    []Role `json:"roles,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+	// PasswordResetRequired blocks logging in with the password until a new one is set
+	PasswordResetRequired bool `json:"password_reset_required,omitempty"`
+	// ProfileVisibility is empty for users who never changed it, which means VisibilityUsers
+	ProfileVisibility ProfileVisibility `json:"profile_visibility,omitempty"`
+	// ContactViewers are the usernames granted read access to the user's contacts
+	ContactViewers []string `json:"contact_viewers,omitempty"`
+	// TOTPSecret is the shared secret of an enabled or pending two factor enrollment. Never serialized
+	TOTPSecret string `json:"-"`
+	// WebAuthnCredentials are the passkeys the user can log in with. Listed through their own endpoint
+	WebAuthnCredentials []WebAuthnCredential `json:"-"`
+	// OIDCIdentities are the accounts at external identity providers the user can log in with
+	OIDCIdentities []OIDCIdentity `json:"oidc_identities,omitempty"`
+	// OAuthGrants are the third party apps the user let act for them. Listed through their own endpoint
+	OAuthGrants []OAuthGrant `json:"-"`
+	// SessionVersion is carried by tokens. Bumping it revokes every token issued before
+	SessionVersion int `json:"-"`
+	// DeletedAt is set while the account waits out its grace period before being deleted for good
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Books are the books the user made. The default book isn't listed
+	Books []Book `json:"-"`
+	// DefaultBookFields are the custom fields of the default book
+	DefaultBookFields FieldDefinitions `json:"-"`
+	// UserGroups are the groups of users the user made to share books with
+	UserGroups []UserGroup `json:"-"`
+	// Orgs are the organisations the user is a member of. Listed through their own endpoint
+	Orgs     []OrgMembership `json:"-"`
 	Contacts []Contact
 }
+
+// Visibility returns the user's profile visibility, defaulting to VisibilityUsers
+func (u User) Visibility() ProfileVisibility {
+	if u.ProfileVisibility == "" {
+		return VisibilityUsers
+	}
+	return u.ProfileVisibility
+}
+
+// HasRole checks if the user was assigned a role. Every user has RoleUser
+func (u User) HasRole(role Role) bool {
+	if role == RoleUser {
+		return true
+	}
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// OAuthGrant finds the user's grant to a client
+func (u User) OAuthGrant(clientID string) (OAuthGrant, bool) {
+	for _, g := range u.OAuthGrants {
+		if g.ClientID == clientID {
+			return g, true
+		}
+	}
+	return OAuthGrant{}, false
+}
+
+// OrgRole finds the user's role in an organisation
+func (u User) OrgRole(orgID string) (OrgRole, bool) {
+	for _, m := range u.Orgs {
+		if m.OrgID == orgID {
+			return m.Role, true
+		}
+	}
+	return "", false
+}
+
+// CanViewContacts checks if username is the user or was granted access to their contacts
+func (u User) CanViewContacts(username string) bool {
+	if username == u.Username {
+		return true
+	}
+	for _, viewer := range u.ContactViewers {
+		if viewer == username {
+			return true
+		}
+	}
+	return false
+}
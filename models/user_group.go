@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// UserGroup is a named list of users made by its owner, so books can be shared with all of them at once.
+// The owner counts as a member
+type UserGroup struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	Members   []string  `json:"members"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+}
+
+// HasMember checks if the user is the owner or a member of the group
+func (g UserGroup) HasMember(username string) bool {
+	if g.Owner == username {
+		return true
+	}
+	for _, m := range g.Members {
+		if m == username {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// WebAuthnCredential is a passkey or security key registered to a user
+type WebAuthnCredential struct {
+	ID              []byte    `json:"id"`
+	Name            string    `json:"name"`
+	PublicKey       []byte    `json:"-"`
+	AttestationType string    `json:"-"`
+	Transports      []string  `json:"transports,omitempty"`
+	AAGUID          []byte    `json:"-"`
+	SignCount       uint32    `json:"sign_count"`
+	BackupEligible  bool      `json:"backup_eligible"`
+	BackupState     bool      `json:"backup_state"`
+	CloneWarning    bool      `json:"clone_warning"`
+	CreatedAt       time.Time `json:"created_at"`
+	LastUsedAt      time.Time `json:"last_used_at,omitempty"`
+}
+
+// WebAuthnCeremony is the kind of webauthn ceremony a session belongs to. Each kind keeps its own session
+type WebAuthnCeremony string
+
+const (
+	// WebAuthnRegistration is the ceremony of registering a passkey, started by the logged in user
+	WebAuthnRegistration WebAuthnCeremony = "registration"
+	// WebAuthnLogin is the ceremony of logging in with a passkey, which anyone can start for any username
+	WebAuthnLogin WebAuthnCeremony = "login"
+)
@@ -0,0 +1,127 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// prefixLength is how many hex characters of the sha1 hash are used as the k-anonymity prefix
+const prefixLength = 5
+
+// BreachCorpus knows passwords that appeared in data breaches
+type BreachCorpus interface {
+	Contains(password string) (bool, error)
+}
+
+// hashPassword returns the uppercase hex sha1 of a password split into its prefix and suffix
+func hashPassword(password string) (string, string) {
+	sum := sha1.Sum([]byte(password))
+	h := strings.ToUpper(hex.EncodeToString(sum[:]))
+	return h[:prefixLength], h[prefixLength:]
+}
+
+// parseLine reads a "HASH:COUNT" line, where the count is optional. Returns an empty hash for blank lines
+func parseLine(line string) string {
+	line = strings.TrimSpace(line)
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.ToUpper(line)
+}
+
+// PrefixDirCorpus reads a directory of Have I Been Pwned style range files. Each file is named by a 5 character hash prefix, and lists the suffixes of hashes with that prefix
+type PrefixDirCorpus struct {
+	dir string
+}
+
+// NewPrefixDirCorpus creates a corpus over a directory of range files. Files are read on lookup, so only one prefix is ever in memory
+func NewPrefixDirCorpus(dir string) (*PrefixDirCorpus, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &PrefixDirCorpus{dir}, nil
+}
+
+// Contains looks the password up in the file of its prefix
+func (c *PrefixDirCorpus) Contains(password string) (bool, error) {
+	prefix, suffix := hashPassword(password)
+	f, err := os.Open(filepath.Join(c.dir, prefix))
+	if os.IsNotExist(err) {
+		f, err = os.Open(filepath.Join(c.dir, prefix+".txt"))
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if parseLine(scanner.Text()) == suffix {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// PrefixFileCorpus is a corpus loaded from one file of full sha1 hashes, indexed by prefix in memory
+type PrefixFileCorpus struct {
+	suffixes map[string]map[string]struct{}
+}
+
+// NewPrefixFileCorpus loads a file with one "HASH:COUNT" line per breached password. The count is optional
+func NewPrefixFileCorpus(path string) (*PrefixFileCorpus, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &PrefixFileCorpus{suffixes: map[string]map[string]struct{}{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		h := parseLine(scanner.Text())
+		if h == "" {
+			continue
+		}
+		if len(h) != sha1.Size*2 {
+			return nil, fmt.Errorf("%s:%d is not a sha1 hash", path, line)
+		}
+		prefix, suffix := h[:prefixLength], h[prefixLength:]
+		if c.suffixes[prefix] == nil {
+			c.suffixes[prefix] = map[string]struct{}{}
+		}
+		c.suffixes[prefix][suffix] = struct{}{}
+	}
+	return c, scanner.Err()
+}
+
+// Contains looks the password up in the suffixes of its prefix
+func (c *PrefixFileCorpus) Contains(password string) (bool, error) {
+	prefix, suffix := hashPassword(password)
+	_, ok := c.suffixes[prefix][suffix]
+	return ok, nil
+}
+
+// NewCorpus loads a PrefixDirCorpus if path is a directory, and a PrefixFileCorpus otherwise
+func NewCorpus(path string) (BreachCorpus, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return NewPrefixDirCorpus(path)
+	}
+	return NewPrefixFileCorpus(path)
+}
@@ -0,0 +1,75 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	zxcvbn "github.com/nbutton23/zxcvbn-go"
+)
+
+// Violation is a rule a password breaks. Code is stable for clients to match on
+type Violation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Policy is the set of rules new passwords must follow
+type Policy struct {
+	// MinLength is the minimum number of characters
+	MinLength int
+	// MinStrength is the minimum zxcvbn score, from 0 (guessable) to 4 (very unguessable)
+	MinStrength int
+	// ForbidUsername rejects passwords that contain the username
+	ForbidUsername bool
+	// Breached rejects passwords found in a breach corpus when set
+	Breached BreachCorpus
+}
+
+// DefaultPolicy requires 8 characters, a zxcvbn score of 3 and no username. It doesn't check a breach corpus
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MinLength:      8,
+		MinStrength:    3,
+		ForbidUsername: true,
+	}
+}
+
+// Check returns every rule the password breaks. userInputs, like the username and email, make passwords built from them score lower
+func (p *Policy) Check(password string, username string, userInputs ...string) ([]Violation, error) {
+	var violations []Violation
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, Violation{
+			Code:    "too_short",
+			Message: fmt.Sprintf("password must be at least %d characters", p.MinLength),
+		})
+	}
+	if p.ForbidUsername && username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		violations = append(violations, Violation{
+			Code:    "contains_username",
+			Message: "password must not contain the username",
+		})
+	}
+	if p.MinStrength > 0 && password != "" {
+		inputs := append([]string{username}, userInputs...)
+		if strength := zxcvbn.PasswordStrength(password, inputs); strength.Score < p.MinStrength {
+			violations = append(violations, Violation{
+				Code:    "too_weak",
+				Message: fmt.Sprintf("password is too easy to guess, it would be cracked in %s", strength.CrackTimeDisplay),
+			})
+		}
+	}
+	if p.Breached != nil && password != "" {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			violations = append(violations, Violation{
+				Code:    "breached",
+				Message: "password has appeared in a data breach",
+			})
+		}
+	}
+	return violations, nil
+}
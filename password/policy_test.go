@@ -0,0 +1,102 @@
+package password_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Dacode45/addressbook/password"
+)
+
+// sha1 of "password1", split into its prefix and suffix
+const (
+	breachedPrefix = "E38AD"
+	breachedSuffix = "214943DAAD1D64C102FAEC29DE4AFE9DA3D"
+)
+
+func Test_Policy(t *testing.T) {
+	t.Run("Accepts strong passwords", should_accept_strong_passwords)
+	t.Run("Reports every violation", should_report_violations)
+	t.Run("Rejects passwords from a prefix directory", should_check_prefix_directory)
+	t.Run("Rejects passwords from a prefix file", should_check_prefix_file)
+}
+
+func violationCodes(violations []password.Violation) []string {
+	codes := []string{}
+	for _, v := range violations {
+		codes = append(codes, v.Code)
+	}
+	return codes
+}
+
+func should_accept_strong_passwords(t *testing.T) {
+	policy := password.DefaultPolicy()
+	violations, err := policy.Check("correct horse battery staple", "testUser")
+	assert.NoError(t, err, "Check failed")
+	assert.Empty(t, violations, "Strong password should pass")
+}
+
+func should_report_violations(t *testing.T) {
+	policy := password.DefaultPolicy()
+
+	violations, err := policy.Check("", "testUser")
+	assert.NoError(t, err, "Check failed")
+	assert.Equal(t, []string{"too_short"}, violationCodes(violations))
+
+	violations, err = policy.Check("testuser", "testUser")
+	assert.NoError(t, err, "Check failed")
+	assert.Equal(t, []string{"contains_username", "too_weak"}, violationCodes(violations))
+
+	violations, err = policy.Check("testUser-Xq8$vW2#pL", "testUser")
+	assert.NoError(t, err, "Check failed")
+	assert.Equal(t, []string{"contains_username"}, violationCodes(violations))
+}
+
+func should_check_prefix_directory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "corpus")
+	assert.NoError(t, err, "Failed to create directory")
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, breachedPrefix), []byte("0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n"+breachedSuffix+":2413945\r\n"), 0600)
+	assert.NoError(t, err, "Failed to write range file")
+
+	corpus, err := password.NewCorpus(dir)
+	assert.NoError(t, err, "Failed to load corpus")
+	assertBreached(t, corpus)
+}
+
+func should_check_prefix_file(t *testing.T) {
+	dir, err := ioutil.TempDir("", "corpus")
+	assert.NoError(t, err, "Failed to create directory")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "breached.txt")
+	err = ioutil.WriteFile(path, []byte(breachedPrefix+breachedSuffix+":2413945\n\n7C4A8D09CA3762AF61E59520943DC26494F8941B\n"), 0600)
+	assert.NoError(t, err, "Failed to write corpus")
+
+	corpus, err := password.NewCorpus(path)
+	assert.NoError(t, err, "Failed to load corpus")
+	assertBreached(t, corpus)
+
+	breached, err := corpus.Contains("123456")
+	assert.NoError(t, err, "Lookup failed")
+	assert.True(t, breached, "Hash without a count should be loaded")
+}
+
+func assertBreached(t *testing.T, corpus password.BreachCorpus) {
+	breached, err := corpus.Contains("password1")
+	assert.NoError(t, err, "Lookup failed")
+	assert.True(t, breached, "password1 is breached")
+
+	breached, err = corpus.Contains("correct horse battery staple")
+	assert.NoError(t, err, "Lookup failed")
+	assert.False(t, breached, "Password is not in the corpus")
+
+	policy := &password.Policy{Breached: corpus}
+	violations, err := policy.Check("password1", "testUser")
+	assert.NoError(t, err, "Check failed")
+	assert.Equal(t, []string{"breached"}, violationCodes(violations))
+}
@@ -0,0 +1,140 @@
+package photo
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"unicode"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gomedium"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// ContentTypeSVG is the format of initials avatars drawn as vectors
+const ContentTypeSVG = "image/svg+xml"
+
+// avatarPalette are the backgrounds of initials avatars, all dark enough for white initials to be readable on them
+var avatarPalette = []color.RGBA{
+	{0xC6, 0x28, 0x28, 0xFF}, // red
+	{0xAD, 0x14, 0x57, 0xFF}, // pink
+	{0x6A, 0x1B, 0x9A, 0xFF}, // purple
+	{0x45, 0x27, 0xA0, 0xFF}, // deep purple
+	{0x28, 0x35, 0x93, 0xFF}, // indigo
+	{0x15, 0x65, 0xC0, 0xFF}, // blue
+	{0x02, 0x77, 0xBD, 0xFF}, // light blue
+	{0x00, 0x83, 0x8F, 0xFF}, // cyan
+	{0x00, 0x69, 0x5C, 0xFF}, // teal
+	{0x2E, 0x7D, 0x32, 0xFF}, // green
+	{0x55, 0x8B, 0x2F, 0xFF}, // light green
+	{0xBF, 0x36, 0x0C, 0xFF}, // deep orange
+	{0x4E, 0x34, 0x2E, 0xFF}, // brown
+	{0x37, 0x47, 0x4F, 0xFF}, // blue grey
+}
+
+// avatarFont draws the initials of PNG avatars. It is parsed once, faces are made of it for every avatar as they
+// aren't safe for concurrent use
+var avatarFont, avatarFontErr = opentype.Parse(gomedium.TTF)
+
+// Avatar is the initials of a contact on a background color, shown in place of a photo
+type Avatar struct {
+	Initials   string
+	Background color.RGBA
+}
+
+// NewAvatar makes the avatar of a contact from its display name. The color follows its id, so contacts keep their
+// color when renamed
+func NewAvatar(id, name string) Avatar {
+	return Avatar{Initials: Initials(name), Background: AvatarColor(id)}
+}
+
+// Initials are the first letters of the first and last words of a name, upper cased, like AL for Ada Lovelace.
+// Words starting with punctuation use their first letter or digit
+func Initials(name string) string {
+	letters := []rune{}
+	for _, word := range strings.Fields(name) {
+		for _, r := range word {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				letters = append(letters, unicode.ToUpper(r))
+				break
+			}
+		}
+	}
+	switch len(letters) {
+	case 0:
+		return ""
+	case 1:
+		return string(letters[0])
+	}
+	return string(letters[0]) + string(letters[len(letters)-1])
+}
+
+// AvatarColor picks the background of an avatar from the palette, the same one for the same id
+func AvatarColor(id string) color.RGBA {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return avatarPalette[h.Sum32()%uint32(len(avatarPalette))]
+}
+
+// Hex is the background as a CSS color, like #1565c0
+func (a Avatar) Hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", a.Background.R, a.Background.G, a.Background.B)
+}
+
+// SVG draws the avatar as a square SVG, left to clients to scale and round
+func (a Avatar) SVG() []byte {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, `<svg xmlns="http://www.w3.org/2000/svg" width="128" height="128" viewBox="0 0 128 128">`)
+	fmt.Fprintf(&out, `<rect width="128" height="128" fill="%s"/>`, a.Hex())
+	out.WriteString(`<text x="64" y="64" dy=".35em" text-anchor="middle" fill="#ffffff" ` +
+		`font-family="Helvetica, Arial, sans-serif" font-size="52" font-weight="500">`)
+	xml.EscapeText(&out, []byte(a.Initials))
+	out.WriteString(`</text></svg>`)
+	return out.Bytes()
+}
+
+// PNG draws the avatar as a square PNG of size pixels. Initials the font has no glyphs for, like Chinese or Japanese
+// ones, are left out, leaving the background
+func (a Avatar) PNG(size int) ([]byte, error) {
+	if avatarFontErr != nil {
+		return nil, avatarFontErr
+	}
+	face, err := opentype.NewFace(avatarFont, &opentype.FaceOptions{
+		Size:    float64(size) * 0.4,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: a.Background}, image.Point{}, draw.Src)
+	var text strings.Builder
+	for _, r := range a.Initials {
+		if _, ok := face.GlyphAdvance(r); ok {
+			text.WriteRune(r)
+		}
+	}
+	d := font.Drawer{Dst: img, Src: image.White, Face: face}
+	// centred on the width of the initials and the height of capitals
+	d.Dot = fixed.Point26_6{
+		X: (fixed.I(size) - d.MeasureString(text.String())) / 2,
+		Y: (fixed.I(size) + face.Metrics().CapHeight) / 2,
+	}
+	d.DrawString(text.String())
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,148 @@
+package photo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+)
+
+// orientationTag is the EXIF tag of the orientation of a photo
+const orientationTag = 0x0112
+
+// exifOrientation reads the EXIF orientation of a JPEG, from 1 for upright to 8. Photos without one are upright
+func exifOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		// the metadata segments come before the start of scan
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// tiffOrientation reads the orientation from the first directory of the TIFF structure of an EXIF segment
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	dir := int(order.Uint32(tiff[4:]))
+	if dir < 8 || dir+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[dir:]))
+	for e := 0; e < entries; e++ {
+		entry := dir + 2 + e*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == orientationTag {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orient turns an image upright following its EXIF orientation. Orientations 5 to 8 swap the width and height
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// source finds the pixel of the image drawn at x, y of the upright image
+	var source func(x, y int) (int, int)
+	switch orientation {
+	case 2:
+		source = func(x, y int) (int, int) { return w - 1 - x, y }
+	case 3:
+		source = func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }
+	case 4:
+		source = func(x, y int) (int, int) { return x, h - 1 - y }
+	case 5:
+		source = func(x, y int) (int, int) { return y, x }
+	case 6:
+		source = func(x, y int) (int, int) { return y, h - 1 - x }
+	case 7:
+		source = func(x, y int) (int, int) { return w - 1 - y, h - 1 - x }
+	case 8:
+		source = func(x, y int) (int, int) { return w - 1 - y, x }
+	}
+	if orientation >= 5 {
+		w, h = h, w
+	}
+	upright := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sx, sy := source(x, y)
+			upright.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return upright
+}
+
+// stripWebP drops the EXIF and XMP chunks of a WebP and clears their flags, keeping the image data as is
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, ErrUnsupportedFormat
+	}
+	out := append([]byte{}, data[:12]...)
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errors.New("unable to read photo: truncated WebP chunk")
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		if size < 0 || size > len(data)-i-8 {
+			return nil, errors.New("unable to read photo: truncated WebP chunk")
+		}
+		// chunks are padded to an even size
+		end := i + 8 + size + size%2
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[i:end]
+		switch string(chunk[:4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk = append([]byte{}, chunk...)
+			if len(chunk) > 8 {
+				// the EXIF and XMP flags
+				chunk[8] &^= 0x08 | 0x04
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, chunk...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
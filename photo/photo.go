@@ -0,0 +1,142 @@
+// Package photo validates contact photos, strips their metadata and makes their thumbnails, and draws initials
+// avatars for contacts without a photo
+package photo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"golang.org/x/image/draw"
+	// registers WebP with image.Decode
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// ContentTypeJPEG, ContentTypePNG and ContentTypeWebP are the formats photos can be uploaded in
+	ContentTypeJPEG = "image/jpeg"
+	ContentTypePNG  = "image/png"
+	ContentTypeWebP = "image/webp"
+
+	// jpegQuality is the quality photos and thumbnails are encoded at
+	jpegQuality = 90
+)
+
+// ErrUnsupportedFormat is returned for uploads that aren't JPEG, PNG or WebP
+var ErrUnsupportedFormat = errors.New("photos must be JPEG, PNG or WebP")
+
+// ThumbnailSizes are the widths and heights, in pixels, of the square thumbnails made of every photo
+var ThumbnailSizes = []int{64, 128, 256}
+
+// Limits bound the photos accepted
+type Limits struct {
+	// MaxBytes bounds the size of uploads
+	MaxBytes int64
+	// MaxDimension bounds the width and height. It is checked before the pixels are decoded
+	MaxDimension int
+	// MinDimension is the smallest width and height accepted
+	MinDimension int
+}
+
+// DefaultLimits accepts photos up to 5 MB and 4096 pixels wide and high, and at least 16 pixels wide and high
+func DefaultLimits() Limits {
+	return Limits{MaxBytes: 5 << 20, MaxDimension: 4096, MinDimension: 16}
+}
+
+// Photo is an uploaded photo without its metadata, and its thumbnails
+type Photo struct {
+	Data        []byte
+	ContentType string
+	Width       int
+	Height      int
+	// Thumbnails are JPEGs by size, one for each of ThumbnailSizes
+	Thumbnails map[int][]byte
+}
+
+// Hash is the hex sha256 of the photo, which it is stored under
+func (p *Photo) Hash() string {
+	sum := sha256.Sum256(p.Data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Process checks an upload is a JPEG, PNG or WebP within the limits, strips its metadata and makes its thumbnails.
+// JPEGs and PNGs are encoded again, JPEGs turned upright following their EXIF orientation. WebPs keep their image
+// data but lose their EXIF and XMP chunks
+func Process(data []byte, limits Limits) (*Photo, error) {
+	if int64(len(data)) > limits.MaxBytes {
+		return nil, fmt.Errorf("photos must be at most %d bytes", limits.MaxBytes)
+	}
+	contentType := http.DetectContentType(data)
+	if contentType != ContentTypeJPEG && contentType != ContentTypePNG && contentType != ContentTypeWebP {
+		return nil, ErrUnsupportedFormat
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read photo: %s", err)
+	}
+	if config.Width > limits.MaxDimension || config.Height > limits.MaxDimension {
+		return nil, fmt.Errorf("photos must be at most %d pixels wide and high", limits.MaxDimension)
+	}
+	if config.Width < limits.MinDimension || config.Height < limits.MinDimension {
+		return nil, fmt.Errorf("photos must be at least %d pixels wide and high", limits.MinDimension)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read photo: %s", err)
+	}
+
+	var out bytes.Buffer
+	switch contentType {
+	case ContentTypeJPEG:
+		img = orient(img, exifOrientation(data))
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: jpegQuality})
+	case ContentTypePNG:
+		err = png.Encode(&out, img)
+	case ContentTypeWebP:
+		var stripped []byte
+		if stripped, err = stripWebP(data); err == nil {
+			out.Write(stripped)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Photo{
+		Data:        out.Bytes(),
+		ContentType: contentType,
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+		Thumbnails:  map[int][]byte{},
+	}
+	for _, size := range ThumbnailSizes {
+		if p.Thumbnails[size], err = thumbnail(img, size); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// thumbnail crops the middle square of an image and scales it to size, on white so transparent PNGs stay readable
+func thumbnail(img image.Image, size int) ([]byte, error) {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	crop := image.Rect(0, 0, side, side).Add(b.Min).Add(image.Pt((b.Dx()-side)/2, (b.Dy()-side)/2))
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, crop, draw.Over, nil)
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, dst, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
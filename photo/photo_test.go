@@ -0,0 +1,129 @@
+package photo_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Dacode45/addressbook/photo"
+)
+
+func Test_Photo(t *testing.T) {
+	t.Run("Strips metadata and turns photos upright", should_strip_metadata)
+	t.Run("Rejects bad photos", should_reject_bad_photos)
+	t.Run("Draws initials avatars", should_draw_avatars)
+}
+
+// newImage makes an image of a single color
+func newImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{200, 80, 40, 255})
+		}
+	}
+	return img
+}
+
+// withOrientation inserts an EXIF segment with an orientation after the start of a JPEG
+func withOrientation(jpg []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = append(tiff, 0, 1)
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry[0:], 0x0112)
+	binary.BigEndian.PutUint16(entry[2:], 3)
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	tiff = append(append(tiff, entry...), 0, 0, 0, 0)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(segment)+2))
+	out := append([]byte{0xFF, 0xD8, 0xFF, 0xE1}, length...)
+	out = append(out, segment...)
+	return append(out, jpg[2:]...)
+}
+
+func should_strip_metadata(t *testing.T) {
+	var jpg bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&jpg, newImage(40, 20), nil), "Encode failed")
+	data := withOrientation(jpg.Bytes(), 6)
+	assert.Contains(t, string(data), "Exif", "The upload should have EXIF")
+
+	p, err := photo.Process(data, photo.DefaultLimits())
+	assert.NoError(t, err, "Process failed")
+	assert.Equal(t, photo.ContentTypeJPEG, p.ContentType, "Unexpected content type")
+	assert.NotContains(t, string(p.Data), "Exif", "EXIF should be stripped")
+	assert.Equal(t, 20, p.Width, "Rotated photos should swap their width")
+	assert.Equal(t, 40, p.Height, "Rotated photos should swap their height")
+	assert.Len(t, p.Hash(), 64, "Hashes are hex sha256")
+
+	for _, size := range photo.ThumbnailSizes {
+		config, format, err := image.DecodeConfig(bytes.NewReader(p.Thumbnails[size]))
+		assert.NoError(t, err, "Thumbnails should decode")
+		assert.Equal(t, "jpeg", format, "Thumbnails are JPEGs")
+		assert.Equal(t, size, config.Width, "Unexpected thumbnail width")
+		assert.Equal(t, size, config.Height, "Thumbnails are square")
+	}
+}
+
+func should_reject_bad_photos(t *testing.T) {
+	_, err := photo.Process([]byte("BEGIN:VCARD"), photo.DefaultLimits())
+	assert.Equal(t, photo.ErrUnsupportedFormat, err, "Only images are accepted")
+
+	var tiny bytes.Buffer
+	assert.NoError(t, png.Encode(&tiny, newImage(8, 8)), "Encode failed")
+	_, err = photo.Process(tiny.Bytes(), photo.DefaultLimits())
+	assert.Error(t, err, "Tiny photos should be rejected")
+
+	var large bytes.Buffer
+	assert.NoError(t, png.Encode(&large, newImage(64, 64)), "Encode failed")
+	limits := photo.DefaultLimits()
+	limits.MaxDimension = 32
+	_, err = photo.Process(large.Bytes(), limits)
+	assert.Error(t, err, "Photos above the dimension limit should be rejected")
+	limits = photo.DefaultLimits()
+	limits.MaxBytes = 10
+	_, err = photo.Process(large.Bytes(), limits)
+	assert.Error(t, err, "Photos above the size limit should be rejected")
+
+	p, err := photo.Process(large.Bytes(), photo.DefaultLimits())
+	assert.NoError(t, err, "PNGs should be accepted")
+	assert.Equal(t, photo.ContentTypePNG, p.ContentType, "PNGs stay PNGs")
+}
+
+func should_draw_avatars(t *testing.T) {
+	assert.Equal(t, "AL", photo.Initials("Ada King Lovelace"), "Initials are of the first and last words")
+	assert.Equal(t, "A", photo.Initials("ada"), "Single words have one initial")
+	assert.Equal(t, "ÉO", photo.Initials("(Émile) o'Brien"), "Initials skip punctuation")
+	assert.Equal(t, "", photo.Initials("  "), "Empty names have no initials")
+
+	assert.Equal(t, photo.AvatarColor("5a1b"), photo.AvatarColor("5a1b"), "Colors should follow the id")
+	avatar := photo.NewAvatar("5a1b", "Ada <Lovelace>")
+	assert.Contains(t, string(avatar.SVG()), avatar.Hex(), "The SVG should have the color")
+
+	data, err := avatar.PNG(128)
+	assert.NoError(t, err, "PNG failed")
+	img, err := png.Decode(bytes.NewReader(data))
+	assert.NoError(t, err, "Avatars should decode")
+	assert.Equal(t, 128, img.Bounds().Dx(), "Unexpected avatar size")
+	r, g, b, _ := img.At(0, 0).RGBA()
+	assert.Equal(t, avatar.Background.R, uint8(r>>8), "The corners should be the background")
+	assert.Equal(t, avatar.Background.G, uint8(g>>8), "The corners should be the background")
+	assert.Equal(t, avatar.Background.B, uint8(b>>8), "The corners should be the background")
+	white := false
+	for y := 0; y < 128 && !white; y++ {
+		for x := 0; x < 128 && !white; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			white = r > 0xF000 && g > 0xF000 && b > 0xF000
+		}
+	}
+	assert.True(t, white, "The initials should be drawn in white")
+	_, err = photo.NewAvatar("5a1b", "王小明").PNG(64)
+	assert.NoError(t, err, "Initials without glyphs should be left out")
+}
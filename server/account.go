@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/storage"
+)
+
+// accountRequest is the body of the account management endpoints. Each uses the fields it needs
+type accountRequest struct {
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	CurrentPassword string `json:"current_password"`
+}
+
+// AccountDeletion is returned when an account is deleted. The account can be restored until RestoreBefore
+type AccountDeletion struct {
+	DeletedAt     time.Time `json:"deleted_at"`
+	RestoreBefore time.Time `json:"restore_before"`
+}
+
+// ChangePasswordHandler sets a new password after checking the current one. Every other session of the user is revoked, and a new token is returned
+func (ur *userRouter) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	body, err := decodeAccountRequest(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	if handler := ur.confirmPassword(r, user.Username, body.CurrentPassword); handler != nil {
+		handler(w, r)
+		return
+	}
+	if err = ur.checkPassword(body.Password, user.Username, user.Email); err != nil {
+		servePasswordError(err)(w, r)
+		return
+	}
+
+	if err = ur.userStorage.SetPassword(ctx, user.Username, body.Password); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	ur.serveRenewedToken(ctx, user.Username)(w, r)
+}
+
+// ChangeUsernameHandler renames the user. Tokens carry the username, so a new token is returned and old ones stop working
+func (ur *userRouter) ChangeUsernameHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	body, err := decodeAccountRequest(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	if err = validateUsername(body.Username); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+
+	err = ur.userStorage.SetUsername(ctx, user.Username, body.Username)
+	if err == storage.ErrUsernameTaken {
+		StatusConflict.Serve(err)(w, r)
+		return
+	}
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	ur.serveRenewedToken(ctx, body.Username)(w, r)
+}
+
+// DeleteAccountHandler schedules the user for deletion after checking their password. The account can be restored with RestoreAccountHandler during the grace period
+func (ur *userRouter) DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	body, err := decodeAccountRequest(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	if handler := ur.confirmPassword(r, user.Username, body.Password); handler != nil {
+		handler(w, r)
+		return
+	}
+
+	now := time.Now()
+	if err = ur.userStorage.ScheduleDeletion(ctx, user.Username, now); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(AccountDeletion{
+		DeletedAt:     now,
+		RestoreBefore: now.Add(ur.gracePeriod),
+	})(w, r)
+}
+
+// RestoreAccountHandler cancels the deletion of an account during its grace period, and logs in like LoginHandler
+func (ur *userRouter) RestoreAccountHandler(w http.ResponseWriter, r *http.Request) {
+	credentials, err := decodeCredentials(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	credentials.Scopes, err = validateScopes(credentials.Scopes)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+
+	// only accounts scheduled for deletion get a password check, so this can't be used to check passwords of other accounts
+	ctx := r.Context()
+	user, err := ur.userStorage.FindByUsername(ctx, credentials.Username)
+	if err != nil {
+		StatusUnauthorized.Serve(fmt.Errorf("Incorrect password"))(w, r)
+		return
+	}
+	if user.DeletedAt == nil {
+		StatusBadRequest.Serve(fmt.Errorf("Account is not scheduled for deletion"))(w, r)
+		return
+	}
+	if handler := ur.confirmPassword(r, credentials.Username, credentials.Password); handler != nil {
+		handler(w, r)
+		return
+	}
+	// the purge may not have run yet
+	if time.Now().After(user.DeletedAt.Add(ur.gracePeriod)) {
+		StatusNotFound.Serve(fmt.Errorf("Account was deleted"))(w, r)
+		return
+	}
+	if err = ur.userStorage.RestoreUser(ctx, user.Username); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	user.DeletedAt = nil
+	ur.serveLogin(user, credentials)(w, r)
+}
+
+// confirmPassword checks a password like LoginHandler, including throttling. Returns the handler to serve if the password wasn't accepted.
+// Like LoginHandler, failures are only forgotten for users without two factor
+func (ur *userRouter) confirmPassword(r *http.Request, username string, password string) http.HandlerFunc {
+	if err := ur.throttle.Check(r, username); err != nil {
+		return serveThrottleError(err)
+	}
+	user, err := ur.userStorage.Login(r.Context(), models.Credentials{Username: username, Password: password})
+	if err != nil {
+		if err = ur.throttle.Failure(r, username); err != nil {
+			log.Printf("Unable to record failed login: %s", err)
+		}
+		return StatusUnauthorized.Serve(fmt.Errorf("Incorrect password"))
+	}
+	// the username also counts wrong second factor codes, which a password alone must not forget
+	if !user.TwoFactorEnabled {
+		if err = ur.throttle.Success(r, username); err != nil {
+			log.Printf("Unable to reset failed logins: %s", err)
+		}
+	}
+	return nil
+}
+
+// serveRenewedToken responds with a new JWTToken after the user's username or session version changed. The scopes of the current token are kept
+func (ur *userRouter) serveRenewedToken(ctx context.Context, username string) http.HandlerFunc {
+	user, err := ur.userStorage.FindByUsername(ctx, username)
+	if err != nil {
+		return StatusInternalServerError.Serve(err)
+	}
+	var credentials models.Credentials
+	if creds, ok := ctx.Value(ContextCredentialsKey).(*models.Credentials); ok && creds != nil {
+		credentials.Scopes = creds.Scopes
+	}
+	return ur.serveToken(user, credentials)
+}
+
+// accountDeletedError tells a deleted user until when they can restore their account
+func (ur *userRouter) accountDeletedError(user *models.User) error {
+	return ErrorDetails{
+		Message: "Account is scheduled for deletion",
+		Code:    "account_deleted",
+		Details: map[string]time.Time{"restore_before": user.DeletedAt.Add(ur.gracePeriod)},
+	}
+}
+
+// PurgeDeletedAccounts deletes accounts whose grace period is over every interval, until ctx is done. The photos and
+// attachments of their contacts are deleted from the blob store too
+func PurgeDeletedAccounts(ctx context.Context, u storage.UserStorage, config ServerConfig, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	blobs := config.blobStore()
+	for {
+		removed, err := u.PurgeDeletedUsers(ctx, time.Now().Add(-config.deletionGracePeriod()))
+		// the users removed before a failure are cleaned up too
+		for _, user := range removed {
+			for _, c := range user.Contacts {
+				releaseContactFiles(ctx, u, blobs, c)
+			}
+		}
+		if err != nil {
+			log.Printf("Unable to purge deleted accounts: %s", err)
+		} else if len(removed) > 0 {
+			log.Printf("Purged %d deleted accounts", len(removed))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// validateUsername rejects usernames that can't be used in urls
+func validateUsername(username string) error {
+	if username == "" {
+		return fmt.Errorf("username is required")
+	}
+	if strings.ContainsAny(username, "/?# \t\r\n") {
+		return fmt.Errorf("username can't contain spaces, slashes, question marks or hashes")
+	}
+	return nil
+}
+
+// decodeAccountRequest decodes an accountRequest from the json body
+func decodeAccountRequest(r *http.Request) (accountRequest, error) {
+	var a accountRequest
+	if r.Body == nil {
+		return a, fmt.Errorf("no request body")
+	}
+	err := json.NewDecoder(r.Body).Decode(&a)
+	return a, err
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/Dacode45/addressbook/common"
+	"github.com/Dacode45/addressbook/models"
+	"github.com/google/uuid"
+)
+
+const (
+	// purposeVerifyEmail is the purpose of email verification tokens
+	purposeVerifyEmail = "verify_email"
+	// purposeResetPassword is the purpose of password reset tokens
+	purposeResetPassword = "reset_password"
+	// verifyEmailTTL is how long an email verification link works
+	verifyEmailTTL = 24 * time.Hour
+	// resetPasswordTTL is how long a password reset link works
+	resetPasswordTTL = time.Hour
+)
+
+// accountRecoveryRequest is the body of the email and password endpoints
+type accountRecoveryRequest struct {
+	Email    string `json:"email"`
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ChangeEmailHandler changes the email of the logged in user and sends a verification email to the new address
+func (ur *userRouter) ChangeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := decodeAccountRecoveryRequest(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	email, err := normalizeEmail(body.Email)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	user, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	err = ur.userStorage.SetEmail(ctx, user.Username, email)
+	if err != nil {
+		StatusBadRequest.Serve(fmt.Errorf("email is already in use"))(w, r)
+		return
+	}
+	if email != "" {
+		ur.sendVerification(ctx, user.Username, email)
+	}
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// ResendVerificationHandler sends a new verification email. Links in earlier emails stop working
+func (ur *userRouter) ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	if user.Email == "" || user.EmailVerified {
+		StatusBadRequest.Serve(fmt.Errorf("no unverified email"))(w, r)
+		return
+	}
+	ur.sendVerification(ctx, user.Username, user.Email)
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// VerifyEmailHandler verifies an email with the token from the verification email
+func (ur *userRouter) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := decodeAccountRecoveryRequest(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	claims, err := ur.consumeActionToken(ctx, body.Token, purposeVerifyEmail)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	err = ur.userStorage.MarkEmailVerified(ctx, claims.Username, claims.Email)
+	if err != nil {
+		StatusBadRequest.Serve(fmt.Errorf("email has changed since the token was sent"))(w, r)
+		return
+	}
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// ForgotPasswordHandler emails a password reset link if a user has that verified email. Always succeeds so emails can't be probed
+func (ur *userRouter) ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := decodeAccountRecoveryRequest(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	email, err := normalizeEmail(body.Email)
+	if err != nil || email == "" {
+		StatusBadRequest.Serve(fmt.Errorf("invalid email"))(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	user, err := ur.userStorage.FindByEmail(ctx, email)
+	if err == nil && user.EmailVerified && user.DeletedAt == nil {
+		ur.sendPasswordReset(ctx, user,
+			"Someone asked to reset the password of %s. If it was you, open the link below within an hour.\n\n%s\n\nIf it wasn't, you can ignore this email.")
+	}
+	StatusOK.Serve(map[string]string{"msg": "If that email belongs to an account, a reset link was sent"})(w, r)
+}
+
+// ResetPasswordHandler sets a new password with the token from the password reset email
+func (ur *userRouter) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := decodeAccountRecoveryRequest(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	// check the password before using the token up, so the user can try another
+	claims, err := ur.jwtCoder.DecodeAction(body.Token, purposeResetPassword)
+	if err != nil {
+		StatusBadRequest.Serve(fmt.Errorf("Invalid or expired token"))(w, r)
+		return
+	}
+	if err = ur.checkPassword(body.Password, claims.Username, claims.Email); err != nil {
+		servePasswordError(err)(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	claims, err = ur.consumeActionToken(ctx, body.Token, purposeResetPassword)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	err = ur.userStorage.SetPassword(ctx, claims.Username, body.Password)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// sendVerification emails a verification link. Failures are logged since the user can ask for another email
+func (ur *userRouter) sendVerification(ctx context.Context, username string, email string) {
+	token, err := ur.issueActionToken(ctx, ActionClaims{Username: username, Purpose: purposeVerifyEmail, Email: email}, verifyEmailTTL)
+	if err != nil {
+		log.Printf("Unable to create verification token: %s", err)
+		return
+	}
+	ur.sendMail(ctx, common.Message{
+		To:      email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf(
+			"Open the link below to verify the email of %s.\n\n%s/verify-email?token=%s",
+			username, ur.publicURL, token,
+		),
+	})
+}
+
+// sendPasswordReset emails a password reset link to the user's email. body formats the username and the link.
+// Failures are logged since the user can ask for another email
+func (ur *userRouter) sendPasswordReset(ctx context.Context, user *models.User, body string) {
+	token, err := ur.issueActionToken(ctx, ActionClaims{Username: user.Username, Purpose: purposeResetPassword, Email: user.Email}, resetPasswordTTL)
+	if err != nil {
+		log.Printf("Unable to create password reset token: %s", err)
+		return
+	}
+	ur.sendMail(ctx, common.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body:    fmt.Sprintf(body, user.Username, fmt.Sprintf("%s/reset-password?token=%s", ur.publicURL, token)),
+	})
+}
+
+// sendMail sends an email and logs failures
+func (ur *userRouter) sendMail(ctx context.Context, m common.Message) {
+	if err := ur.mailer.Send(ctx, m); err != nil {
+		log.Printf("Unable to send email to %s: %s", m.To, err)
+	}
+}
+
+// issueActionToken creates a single use token. Only the latest token of each purpose works
+func (ur *userRouter) issueActionToken(ctx context.Context, claims ActionClaims, ttl time.Duration) (string, error) {
+	claims.Nonce = uuid.New().String()
+	err := ur.userStorage.SetTokenNonce(ctx, claims.Username, claims.Purpose, claims.Nonce)
+	if err != nil {
+		return "", err
+	}
+	token, err := ur.jwtCoder.CreateAction(claims, ttl)
+	return token.Token, err
+}
+
+// consumeActionToken checks a single use token and uses it up
+func (ur *userRouter) consumeActionToken(ctx context.Context, token string, purpose string) (*ActionClaims, error) {
+	claims, err := ur.jwtCoder.DecodeAction(token, purpose)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid or expired token")
+	}
+	err = ur.userStorage.ConsumeTokenNonce(ctx, claims.Username, purpose, claims.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// normalizeEmail lowercases an email and checks that it is a bare address. Empty emails are allowed
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return "", nil
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", fmt.Errorf("invalid email")
+	}
+	return email, nil
+}
+
+// decodeAccountRecoveryRequest decodes an accountRecoveryRequest from the json body
+func decodeAccountRecoveryRequest(r *http.Request) (accountRecoveryRequest, error) {
+	var a accountRecoveryRequest
+	if r.Body == nil {
+		return a, fmt.Errorf("no request body")
+	}
+	err := json.NewDecoder(r.Body).Decode(&a)
+	return a, err
+}
+
+// servePasswordResetRequired responds to a correct password for users an admin required to reset their password, and emails
+// them a reset link. Admins force resets when the password may be known to someone else, so the link only goes to a verified email
+func (ur *userRouter) servePasswordResetRequired(user *models.User) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		message := "Password must be reset. Ask an admin for help, since the account has no verified email"
+		if user.Email != "" && user.EmailVerified {
+			ur.sendPasswordReset(r.Context(), user,
+				"An admin asked for the password of %s to be reset. Open the link below within an hour to set a new one.\n\n%s")
+			message = "Password must be reset. A reset link was sent to the account's email"
+		}
+		StatusForbidden.Serve(ErrorDetails{
+			Message: message,
+			Code:    "password_reset_required",
+		})(w, r)
+	}
+}
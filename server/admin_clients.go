@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/storage"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// clientRegistration is the body of the client registration request
+type clientRegistration struct {
+	Name         string         `json:"name"`
+	RedirectURIs []string       `json:"redirect_uris"`
+	Scopes       []models.Scope `json:"scopes"`
+	Confidential bool           `json:"confidential"`
+}
+
+// RegisteredClient is a newly registered client with its secret. The secret is only shown once
+type RegisteredClient struct {
+	models.OAuthClient
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// ListClientsHandler lists the registered third party apps
+func (ar *adminRouter) ListClientsHandler(w http.ResponseWriter, r *http.Request) {
+	clients, err := ar.oauth.FindClients(r.Context())
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(clients)(w, r)
+}
+
+// CreateClientHandler registers a third party app. Confidential apps get a secret, which is only in this response
+func (ar *adminRouter) CreateClientHandler(w http.ResponseWriter, r *http.Request) {
+	admin, _ := r.Context().Value(ContextUserKey).(*models.User)
+	var body clientRegistration
+	if r.Body == nil {
+		StatusBadRequest.Serve(fmt.Errorf("no request body"))(w, r)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	if err := validateClientRegistration(&body); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+
+	registered := RegisteredClient{OAuthClient: models.OAuthClient{
+		ID:           strings.Replace(uuid.New().String(), "-", "", -1),
+		Name:         body.Name,
+		RedirectURIs: body.RedirectURIs,
+		Scopes:       body.Scopes,
+		Confidential: body.Confidential,
+		CreatedBy:    admin.Username,
+		CreatedAt:    time.Now(),
+	}}
+	if body.Confidential {
+		registered.ClientSecret = randomToken()
+		registered.SecretHash = hashSecret(registered.ClientSecret)
+	}
+	if err := ar.oauth.InsertClient(r.Context(), registered.OAuthClient); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	ar.record(r.Context(), admin, "create_client", "", map[string]string{"client_id": registered.ID, "name": registered.Name})
+	StatusCreated.Serve(registered)(w, r)
+}
+
+// DeleteClientHandler removes the third party app in the url. Every grant to it is removed, which revokes its tokens
+func (ar *adminRouter) DeleteClientHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	admin, _ := ctx.Value(ContextUserKey).(*models.User)
+	id := mux.Vars(r)["id"]
+
+	err := ar.oauth.DeleteClient(ctx, id)
+	if err == storage.ErrClientNotFound {
+		StatusNotFound.Serve(err)(w, r)
+		return
+	}
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	if err = ar.userStorage.RemoveOAuthGrantFromAll(ctx, id); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	ar.record(ctx, admin, "delete_client", "", map[string]string{"client_id": id})
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// validateClientRegistration checks the name, redirect uris and scopes of a new client. No scopes means every scope apps can have
+func validateClientRegistration(body *clientRegistration) error {
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(body.RedirectURIs) == 0 {
+		return fmt.Errorf("at least one redirect uri is required")
+	}
+	for _, uri := range body.RedirectURIs {
+		if !models.ValidRedirectURI(uri) {
+			return fmt.Errorf("redirect uri %s must be an absolute https url without a fragment, or http on localhost", uri)
+		}
+	}
+	if len(body.Scopes) == 0 {
+		body.Scopes = models.ClientScopes
+	}
+	for _, s := range body.Scopes {
+		if !s.IsClientScope() {
+			return fmt.Errorf("apps can't be granted the %s scope", s)
+		}
+	}
+	return nil
+}
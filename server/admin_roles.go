@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/storage"
+	"github.com/gorilla/mux"
+)
+
+// AssignRoleHandler gives the user in the url the role in the url
+func (ar *adminRouter) AssignRoleHandler(w http.ResponseWriter, r *http.Request) {
+	admin, target, ok := ar.findTarget(w, r)
+	if !ok {
+		return
+	}
+	role := models.Role(mux.Vars(r)["role"])
+	if role == models.RoleUser {
+		StatusBadRequest.Serve(fmt.Errorf("every user has the user role"))(w, r)
+		return
+	}
+	if _, err := ar.rbac.Role(r.Context(), role); err != nil {
+		serveRoleError(err)(w, r)
+		return
+	}
+
+	if err := ar.userStorage.AssignRole(r.Context(), target.Username, role); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	ar.record(r.Context(), admin, "assign_role", target.Username, map[string]string{"role": string(role)})
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// UnassignRoleHandler takes the role in the url away from the user in the url
+func (ar *adminRouter) UnassignRoleHandler(w http.ResponseWriter, r *http.Request) {
+	admin, target, ok := ar.findTarget(w, r)
+	if !ok {
+		return
+	}
+	role := models.Role(mux.Vars(r)["role"])
+	// keeps at least one admin around
+	if admin.Username == target.Username && role == models.RoleAdmin {
+		StatusBadRequest.Serve(fmt.Errorf("admins can't remove their own admin role"))(w, r)
+		return
+	}
+
+	if err := ar.userStorage.UnassignRole(r.Context(), target.Username, role); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	ar.record(r.Context(), admin, "unassign_role", target.Username, map[string]string{"role": string(role)})
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// ListRolesHandler lists the built in and custom roles with their permissions
+func (ar *adminRouter) ListRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := ar.rbac.Roles(r.Context())
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(roles)(w, r)
+}
+
+// CreateRoleHandler defines a custom role. Fails if a role with the name exists
+func (ar *adminRouter) CreateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	admin, _ := r.Context().Value(ContextUserKey).(*models.User)
+	def, err := decodeRoleDefinition(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	if _, err = ar.rbac.Role(r.Context(), def.Name); err != storage.ErrRoleNotFound {
+		if err == nil {
+			err = fmt.Errorf("role %s already exists", def.Name)
+			StatusConflict.Serve(err)(w, r)
+			return
+		}
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	ar.saveRole(w, r, admin, "create_role", def)
+}
+
+// UpdateRoleHandler replaces the description and permissions of the custom role in the url
+func (ar *adminRouter) UpdateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	admin, _ := r.Context().Value(ContextUserKey).(*models.User)
+	def, err := decodeRoleDefinition(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	def.Name = models.Role(mux.Vars(r)["role"])
+	existing, err := ar.rbac.Role(r.Context(), def.Name)
+	if err != nil {
+		serveRoleError(err)(w, r)
+		return
+	}
+	if existing.BuiltIn {
+		StatusBadRequest.Serve(fmt.Errorf("built in roles can't be changed"))(w, r)
+		return
+	}
+	ar.saveRole(w, r, admin, "update_role", def)
+}
+
+// DeleteRoleHandler removes the custom role in the url, and takes it away from every user
+func (ar *adminRouter) DeleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	admin, _ := ctx.Value(ContextUserKey).(*models.User)
+	role := models.Role(mux.Vars(r)["role"])
+	if _, ok := models.BuiltInRole(role); ok {
+		StatusBadRequest.Serve(fmt.Errorf("built in roles can't be deleted"))(w, r)
+		return
+	}
+
+	if err := ar.rbac.roles.Delete(ctx, role); err != nil {
+		serveRoleError(err)(w, r)
+		return
+	}
+	if err := ar.userStorage.UnassignRoleFromAll(ctx, role); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	ar.record(ctx, admin, "delete_role", "", map[string]string{"role": string(role)})
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// saveRole validates and stores a custom role, and responds with it
+func (ar *adminRouter) saveRole(w http.ResponseWriter, r *http.Request, admin *models.User, action string, def models.RoleDefinition) {
+	if err := validateRoleDefinition(&def); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	if err := ar.rbac.roles.Save(r.Context(), def); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	permissions := make([]string, len(def.Permissions))
+	for i, p := range def.Permissions {
+		permissions[i] = string(p)
+	}
+	ar.record(r.Context(), admin, action, "", map[string]string{
+		"role":        string(def.Name),
+		"permissions": strings.Join(permissions, ","),
+	})
+	StatusOK.Serve(def)(w, r)
+}
+
+// validateRoleDefinition checks the name and permissions of a custom role, and removes duplicate permissions
+func validateRoleDefinition(def *models.RoleDefinition) error {
+	if !def.Name.IsValid() {
+		return fmt.Errorf("role names must be lower case letters, digits, dashes and underscores")
+	}
+	if _, ok := models.BuiltInRole(def.Name); ok {
+		return fmt.Errorf("%s is a built in role", def.Name)
+	}
+	seen := map[models.Permission]bool{}
+	permissions := []models.Permission{}
+	for _, p := range def.Permissions {
+		if !p.IsValid() {
+			return fmt.Errorf("unknown permission %s", p)
+		}
+		if !seen[p] {
+			seen[p] = true
+			permissions = append(permissions, p)
+		}
+	}
+	def.Permissions = permissions
+	def.BuiltIn = false
+	return nil
+}
+
+// serveRoleError serves missing roles as a 404 and anything else as an internal error
+func serveRoleError(err error) http.HandlerFunc {
+	if err == storage.ErrRoleNotFound {
+		return StatusNotFound.Serve(err)
+	}
+	return StatusInternalServerError.Serve(err)
+}
+
+// decodeRoleDefinition decodes a RoleDefinition from the json body
+func decodeRoleDefinition(r *http.Request) (models.RoleDefinition, error) {
+	var def models.RoleDefinition
+	if r.Body == nil {
+		return def, fmt.Errorf("no request body")
+	}
+	err := json.NewDecoder(r.Body).Decode(&def)
+	return def, err
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/storage"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// impersonationTTL is how long impersonation tokens work
+	impersonationTTL = time.Hour
+	// defaultPageLimit and maxPageLimit bound the size of paginated responses
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+// adminRouter handles the admin routes
+type adminRouter struct {
+	userStorage storage.UserStorage
+	jwtCoder    *JWTCoder
+	throttle    *LoginThrottle
+	audit       storage.AuditStorage
+	rbac        *RBAC
+	oauth       storage.OAuthStorage
+}
+
+// ImpersonationToken is a JWTToken acting as another user, and when it stops working
+type ImpersonationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AuditPage is one page of the audit log
+type AuditPage struct {
+	Entries []models.AuditEntry `json:"entries"`
+	Total   int                 `json:"total"`
+	Offset  int                 `json:"offset"`
+	Limit   int                 `json:"limit"`
+}
+
+// NewAdminRouter creates a new adminRouter. Every route requires the admin scope, and the permissions it lists from the user's roles
+func NewAdminRouter(u storage.UserStorage, config ServerConfig, router *mux.Router) *mux.Router {
+	jwtCoder := NewJWTCoder(config.JWTSecret)
+	audit := config.auditLog()
+	rbac := config.rbac()
+	adminRouter := adminRouter{
+		userStorage: u,
+		jwtCoder:    jwtCoder,
+		throttle:    config.loginThrottle(),
+		audit:       audit,
+		rbac:        rbac,
+		oauth:       config.oauthStorage(),
+	}
+	admin := func(next http.HandlerFunc, permissions ...models.Permission) http.HandlerFunc {
+		return LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(rbac.RequirePermissions(next, permissions...), models.ScopeAdmin))
+	}
+
+	router.HandleFunc("/users", admin(adminRouter.ListUsersHandler, models.PermissionUsersRead)).Methods("GET")
+	router.HandleFunc("/users/{username}/contacts", admin(adminRouter.ListUserContactsHandler, models.PermissionUsersContacts)).Methods("GET")
+	router.HandleFunc("/users/{username}/disable", admin(adminRouter.DisableUserHandler, models.PermissionUsersManage)).Methods("POST")
+	router.HandleFunc("/users/{username}/enable", admin(adminRouter.EnableUserHandler, models.PermissionUsersManage)).Methods("POST")
+	router.HandleFunc("/users/{username}/reset-password", admin(adminRouter.ForcePasswordResetHandler, models.PermissionUsersManage)).Methods("POST")
+	router.HandleFunc("/users/{username}/unlock", admin(adminRouter.UnlockHandler, models.PermissionUsersManage)).Methods("POST")
+	router.HandleFunc("/users/{username}/impersonate", admin(adminRouter.ImpersonateHandler, models.PermissionUsersImpersonate)).Methods("POST")
+	// roles
+	router.HandleFunc("/users/{username}/roles/{role}", admin(adminRouter.AssignRoleHandler, models.PermissionRolesManage)).Methods("PUT")
+	router.HandleFunc("/users/{username}/roles/{role}", admin(adminRouter.UnassignRoleHandler, models.PermissionRolesManage)).Methods("DELETE")
+	router.HandleFunc("/roles", admin(adminRouter.ListRolesHandler, models.PermissionRolesManage)).Methods("GET")
+	router.HandleFunc("/roles", admin(adminRouter.CreateRoleHandler, models.PermissionRolesManage)).Methods("POST")
+	router.HandleFunc("/roles/{role}", admin(adminRouter.UpdateRoleHandler, models.PermissionRolesManage)).Methods("PUT")
+	router.HandleFunc("/roles/{role}", admin(adminRouter.DeleteRoleHandler, models.PermissionRolesManage)).Methods("DELETE")
+	// third party apps
+	router.HandleFunc("/clients", admin(adminRouter.ListClientsHandler, models.PermissionClientsManage)).Methods("GET")
+	router.HandleFunc("/clients", admin(adminRouter.CreateClientHandler, models.PermissionClientsManage)).Methods("POST")
+	router.HandleFunc("/clients/{id}", admin(adminRouter.DeleteClientHandler, models.PermissionClientsManage)).Methods("DELETE")
+	router.HandleFunc("/audit", admin(adminRouter.ListAuditHandler, models.PermissionAuditRead)).Methods("GET")
+	return router
+}
+
+// ListUsersHandler lists users a page at a time with their contact counts. The q query parameter searches usernames and emails
+func (ar *adminRouter) ListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	query := models.UserQuery{
+		Search: r.URL.Query().Get("q"),
+		Offset: offset,
+		Limit:  limit,
+	}
+
+	users, total, err := ar.userStorage.SearchUsers(r.Context(), query)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(models.UserPage{Users: users, Total: total, Offset: offset, Limit: limit})(w, r)
+}
+
+// DisableUserHandler stops a user from logging in and revokes their sessions
+func (ar *adminRouter) DisableUserHandler(w http.ResponseWriter, r *http.Request) {
+	ar.setDisabled(w, r, true)
+}
+
+// EnableUserHandler lets a disabled user log in again
+func (ar *adminRouter) EnableUserHandler(w http.ResponseWriter, r *http.Request) {
+	ar.setDisabled(w, r, false)
+}
+
+// setDisabled disables or enables the user in the url
+func (ar *adminRouter) setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	admin, target, ok := ar.findTarget(w, r)
+	if !ok {
+		return
+	}
+	if disabled && admin.Username == target.Username {
+		StatusBadRequest.Serve(fmt.Errorf("admins can't disable themselves"))(w, r)
+		return
+	}
+
+	if err := ar.userStorage.SetDisabled(r.Context(), target.Username, disabled); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	action := "enable_user"
+	if disabled {
+		action = "disable_user"
+	}
+	ar.record(r.Context(), admin, action, target.Username, nil)
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// ForcePasswordResetHandler revokes the user's sessions and makes them set a new password. Their next password login is refused with
+// password_reset_required, and a reset link is emailed to their verified email
+func (ar *adminRouter) ForcePasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	admin, target, ok := ar.findTarget(w, r)
+	if !ok {
+		return
+	}
+
+	if err := ar.userStorage.RequirePasswordReset(r.Context(), target.Username); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	ar.record(r.Context(), admin, "force_password_reset", target.Username, nil)
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// ImpersonateHandler issues a token acting as the user in the url. The token expires after an hour, can't change the account, and every request made with it is audited
+func (ar *adminRouter) ImpersonateHandler(w http.ResponseWriter, r *http.Request) {
+	admin, target, ok := ar.findTarget(w, r)
+	if !ok {
+		return
+	}
+	if target.Disabled || target.DeletedAt != nil {
+		StatusBadRequest.Serve(fmt.Errorf("can't impersonate a disabled or deleted user"))(w, r)
+		return
+	}
+
+	expiresAt := time.Now().Add(impersonationTTL)
+	token, err := ar.jwtCoder.CreateImpersonation(models.Credentials{
+		Username:       target.Username,
+		UserID:         target.UserID,
+		Scopes:         models.ImpersonationScopes,
+		SessionVersion: target.SessionVersion,
+		Impersonator:   admin.Username,
+	}, impersonationTTL)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	ar.record(r.Context(), admin, "impersonate_user", target.Username, map[string]string{"reason": reason})
+	StatusOK.Serve(ImpersonationToken{Token: token.Token, ExpiresAt: expiresAt})(w, r)
+}
+
+// UnlockHandler lifts a lockout from too many failed logins
+func (ar *adminRouter) UnlockHandler(w http.ResponseWriter, r *http.Request) {
+	admin, target, ok := ar.findTarget(w, r)
+	if !ok {
+		return
+	}
+
+	if err := ar.throttle.Unlock(r.Context(), target.Username); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	ar.record(r.Context(), admin, "unlock_user", target.Username, nil)
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// ListUserContactsHandler lists the contacts of the user in the url. Reading another user's contacts is audited
+func (ar *adminRouter) ListUserContactsHandler(w http.ResponseWriter, r *http.Request) {
+	admin, target, ok := ar.findTarget(w, r)
+	if !ok {
+		return
+	}
+	contacts := target.Contacts
+	if contacts == nil {
+		contacts = []models.Contact{}
+	}
+	ar.record(r.Context(), admin, "read_contacts", target.Username, nil)
+	StatusOK.Serve(contacts)(w, r)
+}
+
+// ListAuditHandler lists the audit log a page at a time, newest first
+func (ar *adminRouter) ListAuditHandler(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+
+	entries, total, err := ar.audit.List(r.Context(), offset, limit)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(AuditPage{Entries: entries, Total: total, Offset: offset, Limit: limit})(w, r)
+}
+
+// findTarget returns the logged in admin and the user in the url. Serves a 404 and returns false if the user doesn't exist
+func (ar *adminRouter) findTarget(w http.ResponseWriter, r *http.Request) (*models.User, *models.User, bool) {
+	admin, _ := r.Context().Value(ContextUserKey).(*models.User)
+	target, err := ar.userStorage.FindByUsername(r.Context(), mux.Vars(r)["username"])
+	if err != nil {
+		StatusNotFound.Serve(fmt.Errorf("user not found"))(w, r)
+		return nil, nil, false
+	}
+	return admin, target, true
+}
+
+// record adds an admin action to the audit log. Failures are logged, the action already happened
+func (ar *adminRouter) record(ctx context.Context, admin *models.User, action string, target string, details map[string]string) {
+	recordAudit(ctx, ar.audit, admin.Username, action, target, details)
+}
+
+// recordAudit adds an action of actor to the audit log. Failures are logged, the action already happened
+func recordAudit(ctx context.Context, audit storage.AuditStorage, actor string, action string, target string, details map[string]string) {
+	err := audit.Record(ctx, models.AuditEntry{
+		Actor:   actor,
+		Action:  action,
+		Target:  target,
+		Details: details,
+		At:      time.Now(),
+	})
+	if err != nil {
+		log.Printf("Unable to record %s of %s by %s: %s", action, target, actor, err)
+	}
+}
+
+// BootstrapAdmin makes username an admin if there are no admins yet. The user is created with password if they don't exist
+func BootstrapAdmin(ctx context.Context, u storage.UserStorage, username string, password string) error {
+	admins, err := u.CountByRole(ctx, models.RoleAdmin)
+	if err != nil || admins > 0 {
+		return err
+	}
+	if _, err = u.FindByUsername(ctx, username); err != nil {
+		if password == "" {
+			return fmt.Errorf("%s doesn't exist and no password was configured to create them", username)
+		}
+		if err = u.Insert(ctx, models.User{Username: username, Password: password}); err != nil {
+			return err
+		}
+	}
+	log.Printf("Made %s the first admin", username)
+	return u.AssignRole(ctx, username, models.RoleAdmin)
+}
+
+// pageParams reads the offset and limit query parameters. The limit defaults to 50 and is capped at 200
+func pageParams(r *http.Request) (int, int, error) {
+	offset, limit := 0, defaultPageLimit
+	var err error
+	if s := r.URL.Query().Get("offset"); s != "" {
+		offset, err = strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a positive number")
+		}
+	}
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("limit must be a positive number")
+		}
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return offset, limit, nil
+}
@@ -0,0 +1,231 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Dacode45/addressbook/mailer"
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/server"
+	"github.com/Dacode45/addressbook/storage"
+)
+
+func Test_AdminRouter(t *testing.T) {
+	t.Run("test admin bootstrap", should_bootstrap_admin)
+	t.Run("test user management", should_manage_users)
+	t.Run("test impersonation", should_impersonate_users)
+	t.Run("test roles", should_manage_roles)
+}
+
+func should_bootstrap_admin(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	ctx := context.Background()
+	assert.Error(t, server.BootstrapAdmin(ctx, uStorage, "root", ""), "Missing users need a password")
+	assert.NoError(t, server.BootstrapAdmin(ctx, uStorage, "root", "c0ntacts-Are-gr8"), "Failed to bootstrap admin")
+	root, err := uStorage.FindByUsername(ctx, "root")
+	assert.NoError(t, err, "Admin should be created")
+	assert.True(t, root.HasRole(models.RoleAdmin), "User should be an admin")
+
+	// only the first admin is bootstrapped
+	assert.NoError(t, uStorage.Insert(ctx, models.User{Username: "other", Password: "other"}), "Failed to create user")
+	assert.NoError(t, server.BootstrapAdmin(ctx, uStorage, "other", ""), "Failed to bootstrap admin")
+	other, _ := uStorage.FindByUsername(ctx, "other")
+	assert.False(t, other.HasRole(models.RoleAdmin), "Admins already exist")
+}
+
+func should_manage_users(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	ctx := context.Background()
+	var mail bytes.Buffer
+	mailConfig := config
+	mailConfig.Mailer = mailer.NewLogMailer(&mail)
+	aRouter := server.NewAdminRouter(uStorage, config, mux.NewRouter())
+	uRouter := server.NewUserRouter(uStorage, mailConfig, mux.NewRouter())
+	assert.NoError(t, server.BootstrapAdmin(ctx, uStorage, "root", "c0ntacts-Are-gr8"), "Failed to bootstrap admin")
+	adminToken, _ := newToken(uStorage, models.Credentials{Username: "root"})
+	user, contacts := populateDatabase(uStorage, 3)
+	assert.NoError(t, uStorage.SetEmail(ctx, user.Username, "user@example.com"), "Failed to set email")
+	assert.NoError(t, uStorage.MarkEmailVerified(ctx, user.Username, "user@example.com"), "Failed to verify email")
+	userToken, _ := newToken(uStorage, models.Credentials{Username: user.Username})
+
+	res := testEndpoint("GET", "/users", nil, aRouter, userToken)
+	assert.Equal(t, http.StatusForbidden, res.Code, "Admin api should require an admin")
+
+	res = testEndpoint("GET", "/users?limit=1", nil, aRouter, adminToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var page models.UserPage
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&page), "Failed to parse response")
+	assert.Equal(t, 2, page.Total, "Unexpected number of users")
+	assert.Len(t, page.Users, 1, "Page should be limited")
+
+	res = testEndpoint("GET", "/users?q="+url.QueryEscape(user.Username[1:]), nil, aRouter, adminToken)
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&page), "Failed to parse response")
+	assert.Equal(t, 1, page.Total, "Search should match one user")
+	assert.Equal(t, user.Username, page.Users[0].Username, "Unexpected user")
+	assert.Equal(t, len(contacts), page.Users[0].ContactCount, "Unexpected contact count")
+
+	// disabling revokes sessions and stops logins
+	res = testEndpoint("POST", "/users/root/disable", nil, aRouter, adminToken)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Admins should not disable themselves")
+	res = testEndpoint("POST", "/users/"+user.Username+"/disable", nil, aRouter, adminToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.Equal(t, http.StatusUnauthorized, testEndpoint("GET", "/me", nil, uRouter, userToken).Code, "Sessions should be revoked")
+	creds, _ := json.Marshal(models.Credentials{Username: user.Username, Password: user.Password})
+	res = testEndpoint("POST", "/login", bytes.NewBuffer(creds), uRouter, server.JWTToken{})
+	assert.Equal(t, http.StatusForbidden, res.Code, "Disabled users should not log in")
+	res = testEndpoint("POST", "/users/"+user.Username+"/enable", nil, aRouter, adminToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("POST", "/login", bytes.NewBuffer(creds), uRouter, server.JWTToken{})
+	assert.Equal(t, http.StatusOK, res.Code, "Enabled users should log in")
+
+	// forced resets email a reset link at the next login, since whoever knows the old password may not be the user
+	res = testEndpoint("POST", "/users/"+user.Username+"/reset-password", nil, aRouter, adminToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("POST", "/login", bytes.NewBuffer(creds), uRouter, server.JWTToken{})
+	assert.Equal(t, http.StatusForbidden, res.Code, "Password reset should be required")
+	var details struct {
+		Code    string
+		Details map[string]string
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&details), "Failed to parse response")
+	assert.Equal(t, "password_reset_required", details.Code, "Unexpected error code")
+	assert.Empty(t, details.Details, "Reset token should not be in the response")
+	resetToken := strings.TrimPrefix(regexp.MustCompile(`token=\S+`).FindString(mail.String()), "token=")
+	assert.NotEmpty(t, resetToken, "Reset email expected")
+	reset, _ := json.Marshal(map[string]string{"token": resetToken, "password": "Tr0ub4dor&3"})
+	res = testEndpoint("POST", "/password/reset", bytes.NewBuffer(reset), uRouter, server.JWTToken{})
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	creds, _ = json.Marshal(models.Credentials{Username: user.Username, Password: "Tr0ub4dor&3"})
+	res = testEndpoint("POST", "/login", bytes.NewBuffer(creds), uRouter, server.JWTToken{})
+	assert.Equal(t, http.StatusOK, res.Code, "New password should work")
+
+	res = testEndpoint("GET", "/audit", nil, aRouter, adminToken)
+	var audit server.AuditPage
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&audit), "Failed to parse response")
+	assert.Equal(t, 3, audit.Total, "Every admin action should be audited")
+	assert.Equal(t, "force_password_reset", audit.Entries[0].Action, "Newest entry should be first")
+}
+
+func should_impersonate_users(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	ctx := context.Background()
+	auditConfig := config
+	auditConfig.Audit = storage.NewMemoryAuditStorage()
+	aRouter := server.NewAdminRouter(uStorage, auditConfig, mux.NewRouter())
+	uRouter := server.NewUserRouter(uStorage, auditConfig, mux.NewRouter())
+	cRouter := server.NewContactRouter(uStorage, auditConfig, mux.NewRouter())
+	assert.NoError(t, server.BootstrapAdmin(ctx, uStorage, "root", "c0ntacts-Are-gr8"), "Failed to bootstrap admin")
+	adminToken, _ := newToken(uStorage, models.Credentials{Username: "root"})
+	user, contacts := populateDatabase(uStorage, 2)
+
+	res := testEndpoint("POST", "/users/"+user.Username+"/impersonate?reason=support", nil, aRouter, adminToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var impersonation server.ImpersonationToken
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&impersonation), "Failed to parse response")
+	token := server.JWTToken{Token: impersonation.Token}
+
+	res = testEndpoint("GET", "/", nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "Impersonation should read contacts")
+	var fetched []models.Contact
+	json.NewDecoder(res.Body).Decode(&fetched)
+	assert.Len(t, fetched, len(contacts), "Unexpected contacts")
+
+	res = testEndpoint("DELETE", "/me", bytes.NewBufferString(`{"password": "x"}`), uRouter, token)
+	assert.Equal(t, http.StatusForbidden, res.Code, "Impersonation should not change the account")
+	res = testEndpoint("GET", "/users", nil, aRouter, token)
+	assert.Equal(t, http.StatusForbidden, res.Code, "Impersonation should not use the admin api")
+
+	res = testEndpoint("GET", "/audit", nil, aRouter, adminToken)
+	var audit server.AuditPage
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&audit), "Failed to parse response")
+	assert.Equal(t, 4, audit.Total, "Impersonation and every request made with it should be audited")
+	assert.Equal(t, "impersonate_user", audit.Entries[3].Action, "Unexpected action")
+	assert.Equal(t, "support", audit.Entries[3].Details["reason"], "Unexpected reason")
+	assert.Equal(t, "impersonated_request", audit.Entries[2].Action, "Unexpected action")
+	assert.Equal(t, "root", audit.Entries[2].Actor, "The admin should be the actor")
+	assert.Equal(t, user.Username, audit.Entries[2].Target, "The user should be the target")
+	assert.Equal(t, "GET", audit.Entries[2].Details["method"], "Unexpected method")
+}
+
+func should_manage_roles(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	ctx := context.Background()
+	aRouter := server.NewAdminRouter(uStorage, config, mux.NewRouter())
+	assert.NoError(t, server.BootstrapAdmin(ctx, uStorage, "root", "c0ntacts-Are-gr8"), "Failed to bootstrap admin")
+	adminToken, _ := newToken(uStorage, models.Credentials{Username: "root"})
+	user, contacts := populateDatabase(uStorage, 2)
+	assert.NoError(t, uStorage.Insert(ctx, models.User{Username: "helper", Password: "helper"}), "Failed to create user")
+	helperToken, _ := newToken(uStorage, models.Credentials{Username: "helper"})
+
+	res := testEndpoint("GET", "/users/"+user.Username+"/contacts", nil, aRouter, helperToken)
+	assert.Equal(t, http.StatusForbidden, res.Code, "Users should not read other contacts")
+
+	// support reads, but doesn't change
+	res = testEndpoint("PUT", "/users/helper/roles/support", nil, aRouter, adminToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("GET", "/users/"+user.Username+"/contacts", nil, aRouter, helperToken)
+	assert.Equal(t, http.StatusOK, res.Code, "Support should read contacts")
+	var fetched []models.Contact
+	json.NewDecoder(res.Body).Decode(&fetched)
+	assert.Len(t, fetched, len(contacts), "Unexpected contacts")
+	res = testEndpoint("POST", "/users/"+user.Username+"/disable", nil, aRouter, helperToken)
+	assert.Equal(t, http.StatusForbidden, res.Code, "Support should not disable users")
+	var details struct {
+		Code    string
+		Details map[string][]models.Permission
+	}
+	json.NewDecoder(res.Body).Decode(&details)
+	assert.Equal(t, "insufficient_permission", details.Code, "Unexpected error code")
+	assert.Equal(t, []models.Permission{models.PermissionUsersManage}, details.Details["missing_permissions"], "Unexpected missing permissions")
+
+	// custom roles
+	res = testEndpoint("POST", "/roles", bytes.NewBufferString(`{"name": "support", "permissions": []}`), aRouter, adminToken)
+	assert.Equal(t, http.StatusConflict, res.Code, "Built in roles should not be redefined")
+	res = testEndpoint("POST", "/roles", bytes.NewBufferString(`{"name": "unlocker", "permissions": ["users:everything"]}`), aRouter, adminToken)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Unknown permissions should be rejected")
+	res = testEndpoint("POST", "/roles", bytes.NewBufferString(`{"name": "unlocker", "permissions": ["users:manage"]}`), aRouter, adminToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("PUT", "/users/helper/roles/unlocker", nil, aRouter, adminToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("POST", "/users/"+user.Username+"/unlock", nil, aRouter, helperToken)
+	assert.Equal(t, http.StatusOK, res.Code, "Custom role should grant its permissions")
+
+	res = testEndpoint("DELETE", "/roles/unlocker", nil, aRouter, adminToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	helper, _ := uStorage.FindByUsername(ctx, "helper")
+	assert.False(t, helper.HasRole("unlocker"), "Deleted roles should be unassigned")
+	res = testEndpoint("POST", "/users/"+user.Username+"/unlock", nil, aRouter, helperToken)
+	assert.Equal(t, http.StatusForbidden, res.Code, "Deleted roles should grant nothing")
+
+	res = testEndpoint("DELETE", "/users/root/roles/admin", nil, aRouter, adminToken)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Admins should keep their own admin role")
+}
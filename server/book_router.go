@@ -0,0 +1,338 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/storage"
+	"github.com/gorilla/mux"
+)
+
+// maxBookNameLength bounds the names of books
+const maxBookNameLength = 100
+
+type bookRouter struct {
+	userStorage storage.UserStorage
+	jwtCoder    *JWTCoder
+	audit       storage.AuditStorage
+	names       models.NameFormat
+	blobs       storage.BlobStore
+	// attachmentLimits bound the attachments of contacts moved or copied to other books
+	attachmentLimits AttachmentLimits
+}
+
+// contactTransfer is the body of moving or copying a contact to another book
+type contactTransfer struct {
+	BookID string `json:"book_id"`
+}
+
+// NewBookRouter generates a router for the address books api. The contacts of a book are served like the contacts api.
+// Storage checks the user owns the book or was granted enough access
+func NewBookRouter(u storage.UserStorage, config ServerConfig, router *mux.Router) *mux.Router {
+	jwtCoder := NewJWTCoder(config.JWTSecret)
+	audit := config.auditLog()
+	blobs := config.blobStore()
+	attachmentLimits := config.AttachmentLimits.withDefaults()
+	br := bookRouter{u, jwtCoder, audit, config.NameFormat, blobs, attachmentLimits}
+	cr := contactRouter{u, jwtCoder, config.NameFormat, blobs, config.photoLimits(), attachmentLimits}
+
+	router.HandleFunc("/", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(br.AllBooksHandler, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(br.CreateBookHandler, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/{book}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(br.FindBookHandler, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{book}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(br.UpdateBookHandler, models.ScopeContactsWrite))).Methods("PUT")
+	router.HandleFunc("/{book}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(br.DeleteBookHandler, models.ScopeContactsDelete))).Methods("DELETE")
+	router.HandleFunc("/{book}/fields", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(br.UpdateBookFieldsHandler, models.ScopeContactsWrite))).Methods("PUT")
+	// sharing
+	router.HandleFunc("/{book}/shares", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(br.ShareBookHandler, models.ScopeContactsWrite))).Methods("PUT")
+	router.HandleFunc("/{book}/shares/users/{username}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(br.UnshareBookHandler, models.ScopeContactsWrite))).Methods("DELETE")
+	router.HandleFunc("/{book}/shares/groups/{group}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(br.UnshareBookHandler, models.ScopeContactsWrite))).Methods("DELETE")
+
+	router.HandleFunc("/{book}/tags", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.AllTagsEndPoint, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{book}/tags", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.CreateTagEndPoint, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/{book}/tags/bulk", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.BulkTagEndPoint, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/{book}/tags/{tag}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.RenameTagEndPoint, models.ScopeContactsWrite))).Methods("PUT")
+	router.HandleFunc("/{book}/tags/{tag}/merge", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.MergeTagEndPoint, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/{book}/tags/{tag}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.DeleteTagEndPoint, models.ScopeContactsWrite))).Methods("DELETE")
+
+	router.HandleFunc("/{book}/contacts", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.AllContactsEndPoint, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{book}/contacts", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.CreateContactEndPoint, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/{book}/contacts/export", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.ExportAllContactsEndpoint, models.ScopeContactsExport))).Methods("GET")
+	router.HandleFunc("/{book}/contacts/import", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.ImportContactsEndPoint, models.ScopeContactsImport))).Methods("POST")
+	router.HandleFunc("/{book}/contacts/{id}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.FindContactEndPoint, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{book}/contacts/{id}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.UpdateContactEndPoint, models.ScopeContactsWrite))).Methods("PUT")
+	router.HandleFunc("/{book}/contacts/{id}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.DeleteContactEndPoint, models.ScopeContactsDelete))).Methods("DELETE")
+	router.HandleFunc("/{book}/contacts/{id}/photo", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.PhotoEndPoint, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{book}/contacts/{id}/photo", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.UploadPhotoEndPoint, models.ScopeContactsWrite))).Methods("PUT")
+	router.HandleFunc("/{book}/contacts/{id}/photo", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.DeletePhotoEndPoint, models.ScopeContactsWrite))).Methods("DELETE")
+	router.HandleFunc("/{book}/contacts/{id}/avatar", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.AvatarEndPoint, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{book}/contacts/{id}/attachments", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.AttachmentsEndPoint, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{book}/contacts/{id}/attachments", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.UploadAttachmentEndPoint, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/{book}/contacts/{id}/attachments/{attachment}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.AttachmentEndPoint, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{book}/contacts/{id}/attachments/{attachment}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.DeleteAttachmentEndPoint, models.ScopeContactsWrite))).Methods("DELETE")
+	router.HandleFunc("/{book}/contacts/{id}/interactions", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.TimelineEndPoint, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{book}/contacts/{id}/interactions", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.LogInteractionEndPoint, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/{book}/contacts/{id}/interactions/{interaction}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.DeleteInteractionEndPoint, models.ScopeContactsWrite))).Methods("DELETE")
+	router.HandleFunc("/{book}/contacts/{id}/move", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(br.MoveContactHandler, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/{book}/contacts/{id}/copy", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(br.CopyContactHandler, models.ScopeContactsWrite))).Methods("POST")
+	return router
+}
+
+// AllBooksHandler lists the user's books, starting with the default book
+func (br *bookRouter) AllBooksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	books, err := br.userStorage.FindBooks(ctx, user.Username)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(books)(w, r)
+}
+
+// FindBookHandler gets the book in the url
+func (br *bookRouter) FindBookHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	book, err := br.userStorage.FindBook(ctx, user.Username, bookID(r))
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(book)(w, r)
+}
+
+// CreateBookHandler creates a book from a json body, with its custom fields. Names are unique per user
+func (br *bookRouter) CreateBookHandler(w http.ResponseWriter, r *http.Request) {
+	book, err := decodeBook(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	created, err := br.userStorage.CreateBook(ctx, user.Username, book)
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	StatusCreated.Serve(created)(w, r)
+}
+
+// UpdateBookHandler renames the book in the url. Custom fields are changed through UpdateBookFieldsHandler
+func (br *bookRouter) UpdateBookHandler(w http.ResponseWriter, r *http.Request) {
+	book, err := decodeBook(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	book.ID = bookID(r)
+	if err = br.userStorage.UpdateBook(ctx, user.Username, book); err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	updated, err := br.userStorage.FindBook(ctx, user.Username, book.ID)
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(updated)(w, r)
+}
+
+// UpdateBookFieldsHandler replaces the custom fields of the book in the url with a json list.
+// Values that don't fit the new fields are dropped from the book's contacts
+func (br *bookRouter) UpdateBookFieldsHandler(w http.ResponseWriter, r *http.Request) {
+	var fields models.FieldDefinitions
+	if r.Body == nil {
+		StatusBadRequest.Serve(fmt.Errorf("no request body"))(w, r)
+		return
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	fields = fields.Normalize()
+	if err := fields.Validate(); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	if err := br.userStorage.UpdateBookFields(ctx, user.Username, bookID(r), fields); err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	updated, err := br.userStorage.FindBook(ctx, user.Username, bookID(r))
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(updated)(w, r)
+}
+
+// DeleteBookHandler deletes the book in the url with its contacts
+func (br *bookRouter) DeleteBookHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	contacts, err := br.userStorage.FindBookContacts(ctx, user.Username, bookID(r))
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	if err = br.userStorage.DeleteBook(ctx, user.Username, bookID(r)); err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	for _, c := range contacts {
+		releaseContactFiles(ctx, br.userStorage, br.blobs, c)
+	}
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// MoveContactHandler moves the contact in the url to the book in the body
+func (br *bookRouter) MoveContactHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	transfer, err := decodeTransfer(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	contactID := mux.Vars(r)["id"]
+	if err = br.userStorage.MoveContact(ctx, user.Username, bookID(r), contactID, transfer.BookID, br.attachmentLimits.Quota); err != nil {
+		serveAttachmentError(err, br.attachmentLimits)(w, r)
+		return
+	}
+	contact, err := br.userStorage.FindBookContact(ctx, user.Username, transfer.BookID, contactID)
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(presentContact(br.names, r, contact))(w, r)
+}
+
+// CopyContactHandler copies the contact in the url to the book in the body, and returns the copy
+func (br *bookRouter) CopyContactHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	transfer, err := decodeTransfer(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	duplicate, err := br.userStorage.CopyContact(ctx, user.Username, bookID(r), mux.Vars(r)["id"], transfer.BookID, br.attachmentLimits.Quota)
+	if err != nil {
+		serveAttachmentError(err, br.attachmentLimits)(w, r)
+		return
+	}
+	StatusCreated.Serve(presentContact(br.names, r, duplicate))(w, r)
+}
+
+// ShareBookHandler grants the user or group of users in the body access to the book in the url. Sharing is audited
+func (br *bookRouter) ShareBookHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	var share models.BookShare
+	if r.Body == nil {
+		StatusBadRequest.Serve(fmt.Errorf("no request body"))(w, r)
+		return
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&share); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	if (share.Username == "") == (share.GroupID == "") {
+		StatusBadRequest.Serve(fmt.Errorf("share with either a username or a group_id"))(w, r)
+		return
+	}
+	if !share.Permission.Grantable() {
+		StatusBadRequest.Serve(fmt.Errorf("permission must be read, edit or manage"))(w, r)
+		return
+	}
+	if share.Username != "" {
+		if share.Username == user.Username {
+			StatusBadRequest.Serve(fmt.Errorf("can't share a book with yourself"))(w, r)
+			return
+		}
+		if _, err := br.userStorage.FindByUsername(ctx, share.Username); err != nil {
+			StatusNotFound.Serve(fmt.Errorf("No user with that username"))(w, r)
+			return
+		}
+	}
+
+	book := bookID(r)
+	if err := br.userStorage.ShareBook(ctx, user.Username, book, share); err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	recordAudit(ctx, br.audit, user.Username, "share_book", share.Grantee(), map[string]string{"book": book, "permission": string(share.Permission)})
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// UnshareBookHandler revokes the share of the user or group of users in the url. Users can also leave books shared with them
+func (br *bookRouter) UnshareBookHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	params := mux.Vars(r)
+	share := models.BookShare{Username: params["username"], GroupID: params["group"]}
+
+	book := bookID(r)
+	if err := br.userStorage.UnshareBook(ctx, user.Username, book, share); err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	recordAudit(ctx, br.audit, user.Username, "unshare_book", share.Grantee(), map[string]string{"book": book})
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// decodeTransfer decodes where a contact goes from a json body
+func decodeTransfer(r *http.Request) (contactTransfer, error) {
+	var transfer contactTransfer
+	if r.Body == nil {
+		return transfer, fmt.Errorf("no request body")
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&transfer); err != nil || transfer.BookID == "" {
+		return transfer, fmt.Errorf("book_id is required")
+	}
+	return transfer, nil
+}
+
+// serveBookError serves errors about books with a fitting status
+func serveBookError(err error) http.HandlerFunc {
+	switch err {
+	case storage.ErrBookNotFound, storage.ErrContactNotFound, storage.ErrGroupNotFound, storage.ErrShareNotFound, storage.ErrTagNotFound:
+		return StatusNotFound.Serve(err)
+	case storage.ErrBookForbidden:
+		return StatusForbidden.Serve(err)
+	case storage.ErrBookNameTaken, storage.ErrTagExists:
+		return StatusConflict.Serve(err)
+	case storage.ErrDefaultBook, storage.ErrTooManyTags:
+		return StatusBadRequest.Serve(err)
+	}
+	return StatusInternalServerError.Serve(err)
+}
+
+// decodeBook decodes a book from a json body and checks its name and custom fields
+func decodeBook(r *http.Request) (models.Book, error) {
+	var book models.Book
+	if r.Body == nil {
+		return book, fmt.Errorf("no request body")
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&book); err != nil {
+		return book, err
+	}
+	book.Name = strings.TrimSpace(book.Name)
+	if book.Name == "" || len(book.Name) > maxBookNameLength {
+		return book, fmt.Errorf("name must be between 1 and %d characters", maxBookNameLength)
+	}
+	book.Fields = book.Fields.Normalize()
+	return book, book.Fields.Validate()
+}
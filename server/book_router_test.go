@@ -0,0 +1,279 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Dacode45/addressbook/mock"
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/server"
+	"github.com/Dacode45/addressbook/storage"
+)
+
+func Test_BookRouter(t *testing.T) {
+	t.Run("test address books", should_manage_books)
+	t.Run("test sharing address books", should_share_books)
+	t.Run("test custom fields", should_use_custom_fields)
+}
+
+func should_manage_books(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	user, contacts := populateDatabase(uStorage, 2)
+	token, _ := newToken(uStorage, models.Credentials{Username: user.Username})
+	bRouter := server.NewBookRouter(uStorage, config, mux.NewRouter())
+	cRouter := server.NewContactRouter(uStorage, config, mux.NewRouter())
+
+	// existing contacts are in the default book
+	res := testEndpoint("GET", "/", nil, bRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var books []models.Book
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&books), "Failed to parse response")
+	assert.Len(t, books, 1, "Only the default book is expected")
+	assert.True(t, books[0].Default, "The first book should be the default book")
+	assert.Equal(t, 2, books[0].ContactCount, "Unexpected contact count")
+
+	res = testEndpoint("POST", "/", strings.NewReader(`{"name": "Work"}`), bRouter, token)
+	assert.Equal(t, http.StatusCreated, res.Code, "Created response is expected")
+	var work models.Book
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&work), "Failed to parse response")
+	res = testEndpoint("POST", "/", strings.NewReader(`{"name": "work"}`), bRouter, token)
+	assert.Equal(t, http.StatusConflict, res.Code, "Book names should be unique")
+	res = testEndpoint("DELETE", "/"+models.DefaultBookID, nil, bRouter, token)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "The default book can't be deleted")
+
+	// contacts created in a book stay out of the contacts api
+	newContactStr, _ := json.Marshal(mock.FakeContacts(1)[0])
+	res = testEndpoint("POST", fmt.Sprintf("/%s/contacts", work.ID), bytes.NewBuffer(newContactStr), bRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var colleague models.Contact
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&colleague), "Failed to parse response")
+	assert.Equal(t, work.ID, colleague.BookID, "Contact should be in the book")
+	res = testEndpoint("GET", "/"+colleague.ID, nil, cRouter, token)
+	assert.Equal(t, http.StatusNotFound, res.Code, "The contacts api only sees the default book")
+
+	// move a contact into the book and copy it back
+	res = testEndpoint("POST", fmt.Sprintf("/%s/contacts/%s/move", models.DefaultBookID, contacts[0].ID), strings.NewReader(fmt.Sprintf(`{"book_id": %q}`, work.ID)), bRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("POST", fmt.Sprintf("/%s/contacts/%s/copy", work.ID, contacts[0].ID), strings.NewReader(fmt.Sprintf(`{"book_id": %q}`, models.DefaultBookID)), bRouter, token)
+	assert.Equal(t, http.StatusCreated, res.Code, "Created response is expected")
+	var duplicate models.Contact
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&duplicate), "Failed to parse response")
+	assert.NotEqual(t, contacts[0].ID, duplicate.ID, "Copies should get a new id")
+	assert.Equal(t, contacts[0].Emails, duplicate.Emails, "Copies should keep their fields")
+
+	res = testEndpoint("GET", fmt.Sprintf("/%s/contacts", work.ID), nil, bRouter, token)
+	var workContacts []models.Contact
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&workContacts), "Failed to parse response")
+	assert.Len(t, workContacts, 2, "The book should have the created and moved contacts")
+	res = testEndpoint("GET", "/", nil, cRouter, token)
+	var defaultContacts []models.Contact
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&defaultContacts), "Failed to parse response")
+	assert.Len(t, defaultContacts, 2, "The default book should have the copy and the other contact")
+
+	// deleting a book deletes its contacts
+	res = testEndpoint("DELETE", "/"+work.ID, nil, bRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("GET", fmt.Sprintf("/%s/contacts", work.ID), nil, bRouter, token)
+	assert.Equal(t, http.StatusNotFound, res.Code, "Deleted books should not be found")
+	all, _ := uStorage.FindAllContacts(context.Background(), user.Username)
+	assert.Len(t, all, 2, "Contacts of the deleted book should be deleted")
+}
+
+func should_share_books(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	ctx := context.Background()
+	audit := storage.NewMemoryAuditStorage()
+	auditConfig := config
+	auditConfig.Audit = audit
+	owner, _ := populateDatabase(uStorage, 0)
+	friend, _ := populateDatabase(uStorage, 0)
+	ownerToken, _ := newToken(uStorage, models.Credentials{Username: owner.Username})
+	friendToken, _ := newToken(uStorage, models.Credentials{Username: friend.Username})
+	bRouter := server.NewBookRouter(uStorage, auditConfig, mux.NewRouter())
+	uRouter := server.NewUserRouter(uStorage, auditConfig, mux.NewRouter())
+
+	res := testEndpoint("POST", "/", strings.NewReader(`{"name": "Clients"}`), bRouter, ownerToken)
+	var clients models.Book
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&clients), "Failed to parse response")
+	newContactStr, _ := json.Marshal(mock.FakeContacts(1)[0])
+	res = testEndpoint("POST", fmt.Sprintf("/%s/contacts", clients.ID), bytes.NewBuffer(newContactStr), bRouter, ownerToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+
+	// books that aren't shared don't exist for other users
+	res = testEndpoint("GET", fmt.Sprintf("/%s/contacts", clients.ID), nil, bRouter, friendToken)
+	assert.Equal(t, http.StatusNotFound, res.Code, "Unshared books should not be found")
+	res = testEndpoint("PUT", fmt.Sprintf("/%s/shares", clients.ID), strings.NewReader(fmt.Sprintf(`{"username": %q, "permission": "read"}`, owner.Username)), bRouter, friendToken)
+	assert.Equal(t, http.StatusNotFound, res.Code, "Only users who can see the book share it")
+
+	// read access
+	res = testEndpoint("PUT", fmt.Sprintf("/%s/shares", clients.ID), strings.NewReader(fmt.Sprintf(`{"username": %q, "permission": "read"}`, friend.Username)), bRouter, ownerToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("GET", "/", nil, bRouter, friendToken)
+	var books []models.Book
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&books), "Failed to parse response")
+	assert.Len(t, books, 2, "Shared books should be listed")
+	assert.Equal(t, owner.Username, books[1].Owner, "Unexpected owner")
+	assert.Equal(t, models.BookRead, books[1].Permission, "Unexpected permission")
+	assert.Empty(t, books[1].Shares, "Shares are only shown to managers")
+	res = testEndpoint("GET", fmt.Sprintf("/%s/contacts", clients.ID), nil, bRouter, friendToken)
+	var shared []models.Contact
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&shared), "Failed to parse response")
+	assert.Len(t, shared, 1, "Shared contacts should be readable")
+	res = testEndpoint("POST", fmt.Sprintf("/%s/contacts", clients.ID), bytes.NewBuffer(newContactStr), bRouter, friendToken)
+	assert.Equal(t, http.StatusForbidden, res.Code, "Readers should not add contacts")
+	res = testEndpoint("DELETE", fmt.Sprintf("/%s/contacts/%s", clients.ID, shared[0].ID), nil, bRouter, friendToken)
+	assert.Equal(t, http.StatusForbidden, res.Code, "Readers should not delete contacts")
+
+	// edit access through a group
+	res = testEndpoint("POST", "/me/groups", strings.NewReader(fmt.Sprintf(`{"name": "Team", "members": [%q]}`, friend.Username)), uRouter, ownerToken)
+	assert.Equal(t, http.StatusCreated, res.Code, "Created response is expected")
+	var team models.UserGroup
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&team), "Failed to parse response")
+	res = testEndpoint("PUT", fmt.Sprintf("/%s/shares", clients.ID), strings.NewReader(fmt.Sprintf(`{"group_id": %q, "permission": "edit"}`, team.ID)), bRouter, ownerToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("POST", fmt.Sprintf("/%s/contacts", clients.ID), bytes.NewBuffer(newContactStr), bRouter, friendToken)
+	assert.Equal(t, http.StatusOK, res.Code, "Group members should add contacts")
+	res = testEndpoint("DELETE", "/"+clients.ID, nil, bRouter, friendToken)
+	assert.Equal(t, http.StatusForbidden, res.Code, "Only owners delete books")
+
+	// revoking both shares takes access away
+	res = testEndpoint("DELETE", fmt.Sprintf("/%s/shares/groups/%s", clients.ID, team.ID), nil, bRouter, ownerToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("DELETE", fmt.Sprintf("/%s/shares/users/%s", clients.ID, friend.Username), nil, bRouter, ownerToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("GET", fmt.Sprintf("/%s/contacts", clients.ID), nil, bRouter, friendToken)
+	assert.Equal(t, http.StatusNotFound, res.Code, "Revoked books should not be found")
+
+	// grants to a purged user aren't inherited by the next user with the username
+	res = testEndpoint("PUT", fmt.Sprintf("/%s/shares", clients.ID), strings.NewReader(fmt.Sprintf(`{"username": %q, "permission": "read"}`, friend.Username)), bRouter, ownerToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("PUT", fmt.Sprintf("/%s/shares", clients.ID), strings.NewReader(fmt.Sprintf(`{"group_id": %q, "permission": "edit"}`, team.ID)), bRouter, ownerToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.NoError(t, uStorage.ScheduleDeletion(ctx, friend.Username, time.Now().Add(-time.Hour)), "Failed to delete user")
+	_, err := uStorage.PurgeDeletedUsers(ctx, time.Now())
+	assert.NoError(t, err, "Failed to purge users")
+	assert.NoError(t, uStorage.Insert(ctx, models.User{Username: friend.Username, Password: "c0ntacts-Are-gr8"}), "Failed to create user")
+	newcomerToken, _ := newToken(uStorage, models.Credentials{Username: friend.Username})
+	res = testEndpoint("GET", fmt.Sprintf("/%s/contacts", clients.ID), nil, bRouter, newcomerToken)
+	assert.Equal(t, http.StatusNotFound, res.Code, "Books shared with a purged user should not be found")
+	res = testEndpoint("GET", "/me/groups", nil, uRouter, ownerToken)
+	var groups []models.UserGroup
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&groups), "Failed to parse response")
+	assert.Len(t, groups, 1, "Unexpected group count")
+	assert.Empty(t, groups[0].Members, "Purged users should leave groups")
+
+	entries, _, _ := audit.List(ctx, 0, 10)
+	actions := []string{}
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	assert.Contains(t, actions, "share_book", "Sharing should be audited")
+	assert.Contains(t, actions, "unshare_book", "Revoking should be audited")
+}
+
+func should_use_custom_fields(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	user, _ := populateDatabase(uStorage, 0)
+	token, _ := newToken(uStorage, models.Credentials{Username: user.Username})
+	bRouter := server.NewBookRouter(uStorage, config, mux.NewRouter())
+
+	res := testEndpoint("POST", "/", strings.NewReader(`{"name": "Customers", "fields": [{"key": "tier", "type": "colour"}]}`), bRouter, token)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Field types should be checked")
+	res = testEndpoint("POST", "/", strings.NewReader(`{"name": "Customers", "fields": [
+		{"key": "tier", "type": "enum", "options": ["Gold", "Silver"], "required": true},
+		{"key": "deal_size", "label": "Deal size", "type": "number"},
+		{"key": "renewal", "type": "date"},
+		{"key": "account_manager", "type": "string"},
+		{"key": "active", "type": "boolean"}
+	]}`), bRouter, token)
+	assert.Equal(t, http.StatusCreated, res.Code, "Created response is expected")
+	var book models.Book
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&book), "Failed to parse response")
+	assert.Len(t, book.Fields, 5, "The fields should be kept")
+	assert.Equal(t, "tier", book.Fields[0].Label, "Fields without a label should be labelled by their key")
+
+	contacts := fmt.Sprintf("/%s/contacts", book.ID)
+	for body, reason := range map[string]string{
+		`{"first_name": "Ada", "custom": {"deal_size": 10}}`:                    "Required fields should be checked",
+		`{"first_name": "Ada", "custom": {"tier": "bronze"}}`:                   "Enum values should be checked",
+		`{"first_name": "Ada", "custom": {"tier": "gold", "deal_size": "ten"}}`: "Numbers should be checked",
+		`{"first_name": "Ada", "custom": {"tier": "gold", "slack": "@ada"}}`:    "Undefined fields should be refused",
+	} {
+		res = testEndpoint("POST", contacts, strings.NewReader(body), bRouter, token)
+		assert.Equal(t, http.StatusBadRequest, res.Code, reason)
+	}
+	res = testEndpoint("POST", contacts, strings.NewReader(`{"first_name": "Ada", "custom": {"tier": "gold", "deal_size": 1500.0, "renewal": "2030-01-31", "active": true}}`), bRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var ada models.Contact
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&ada), "Failed to parse response")
+	assert.Equal(t, models.CustomFields{"tier": "Gold", "deal_size": "1500", "renewal": "2030-01-31", "active": "true"}, ada.Custom, "Values should be normalized")
+	res = testEndpoint("POST", contacts, strings.NewReader(`{"first_name": "Grace", "custom": {"tier": "Silver", "deal_size": "200", "account_manager": "Linus"}}`), bRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+
+	// filters and search
+	names := func(query string) []string {
+		res := testEndpoint("GET", contacts+query, nil, bRouter, token)
+		assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+		var found []models.Contact
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&found), "Failed to parse response")
+		names := []string{}
+		for _, c := range found {
+			names = append(names, c.FirstName)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"Ada"}, names("?custom.tier=gold"), "Enum filters should ignore case")
+	assert.Equal(t, []string{"Ada"}, names("?custom.deal_size.gte=1000"), "Numbers should be compared as numbers")
+	assert.Equal(t, []string{"Grace"}, names("?custom.deal_size.lte=999&custom.tier=silver"), "Filters should all apply")
+	assert.Equal(t, []string{"Grace"}, names("?q=linus"), "Search should include custom values")
+	res = testEndpoint("GET", contacts+"?custom.tier.gte=gold", nil, bRouter, token)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Only numbers and dates have bounds")
+
+	// exports
+	res = testEndpoint("GET", contacts+"/export", nil, bRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	csv := res.Body.String()
+	assert.Contains(t, csv, "x-tier,x-deal_size,x-renewal,x-account_manager,x-active", "Custom fields should be csv columns")
+	res = testEndpoint("POST", contacts+"/import", strings.NewReader(csv), bRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "Exports should import")
+	var imported []models.Contact
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&imported), "Failed to parse response")
+	assert.Equal(t, ada.Custom, imported[0].Custom, "Imports should read custom columns")
+	res = testEndpoint("GET", contacts+"/export?format=vcard&q=ada", nil, bRouter, token)
+	assert.Equal(t, "text/vcard", res.Header().Get("Content-Type"), "Unexpected content type")
+	assert.Contains(t, res.Body.String(), "X-DEAL-SIZE;VALUE=float:1500\r\n", "Custom fields should be X- properties")
+	assert.Contains(t, res.Body.String(), "X-RENEWAL;VALUE=date:20300131\r\n", "Dates should be written as vCard dates")
+
+	// changing the fields drops the values that don't fit
+	res = testEndpoint("PUT", fmt.Sprintf("/%s/fields", book.ID), strings.NewReader(`[{"key": "deal_size", "type": "enum", "options": ["200"]}]`), bRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("GET", fmt.Sprintf("%s/%s", contacts, ada.ID), nil, bRouter, token)
+	var updated models.Contact
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&updated), "Failed to parse response")
+	assert.Nil(t, updated.Custom, "Values that don't fit should be dropped")
+	assert.Equal(t, []string{"Grace", "Grace"}, names("?custom.deal_size=200"), "Values that fit should be kept, on Grace and the imported copy")
+}
@@ -1,6 +1,188 @@
 package server
 
-// ServerConfig is special parameters for the server. In this case it only expects a secret for jwt encoding
+import (
+	"os"
+	"time"
+
+	"github.com/Dacode45/addressbook/common"
+	"github.com/Dacode45/addressbook/mailer"
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/password"
+	"github.com/Dacode45/addressbook/photo"
+	"github.com/Dacode45/addressbook/storage"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// ServerConfig is special parameters for the server. JWTSecret is required, everything else has a default
 type ServerConfig struct {
 	JWTSecret string
+	// TOTPIssuer names the service in authenticator apps. Defaults to addressbook
+	TOTPIssuer string
+	// WebAuthnRPID is the domain passkeys are bound to. Defaults to localhost
+	WebAuthnRPID string
+	// WebAuthnOrigins are the origins browsers may run webauthn ceremonies from. Defaults to http://localhost:8080
+	WebAuthnOrigins []string
+	// PublicURL is where links in emails point. Defaults to http://localhost:8080
+	PublicURL string
+	// Mailer sends verification and password reset emails. Defaults to writing them to stdout
+	Mailer common.Mailer
+	// Throttle stores failed logins. Defaults to memory, which isn't shared between servers
+	Throttle storage.ThrottleStorage
+	// ThrottlePolicy configures login backoff and lockout
+	ThrottlePolicy ThrottlePolicy
+	// TrustProxy reads client ips from X-Forwarded-For. Only enable behind a proxy that sets it
+	TrustProxy bool
+	// PasswordPolicy is checked whenever a password is set. Defaults to password.DefaultPolicy
+	PasswordPolicy *password.Policy
+	// DeletionGracePeriod is how long deleted accounts can be restored. Defaults to 30 days
+	DeletionGracePeriod time.Duration
+	// AdminUsername is made an admin on start if there are no admins. It is created with AdminPassword if it doesn't exist
+	AdminUsername string
+	AdminPassword string
+	// Audit stores the audit log of admin actions. Defaults to memory, which is lost on restart
+	Audit storage.AuditStorage
+	// Roles stores the custom roles defined through the admin api. Defaults to memory, which is lost on restart
+	Roles storage.RoleStorage
+	// OAuth stores the third party apps and their authorization codes. Defaults to memory, which is lost on restart
+	OAuth storage.OAuthStorage
+	// NameFormat builds the display and sort names of contacts. The zero value writes family names first
+	// for Chinese, Japanese and Korean locales and names, and sorts by family name
+	NameFormat models.NameFormat
+	// Orgs stores the organisations, their company directories and invites. Defaults to memory, which is lost on restart
+	Orgs storage.OrgStorage
+	// OIDCIssuer is the url of an OpenID Connect provider users can log in with. OIDC login is disabled without it
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	// OIDCRedirectURL is where the provider sends users back to. Defaults to the callback route under PublicURL
+	OIDCRedirectURL string
+	// Blobs stores contact photos and attachments. Defaults to memory, which is lost on restart
+	Blobs storage.BlobStore
+	// PhotoLimits bound the photos uploaded. Defaults to photo.DefaultLimits
+	PhotoLimits *photo.Limits
+	// AttachmentLimits bound the files attached to contacts
+	AttachmentLimits AttachmentLimits
+}
+
+// totpIssuer returns the configured issuer or the default
+func (c ServerConfig) totpIssuer() string {
+	if c.TOTPIssuer == "" {
+		return "addressbook"
+	}
+	return c.TOTPIssuer
+}
+
+// webAuthnConfig returns the relying party configuration for webauthn
+func (c ServerConfig) webAuthnConfig() *webauthn.Config {
+	rpID := c.WebAuthnRPID
+	if rpID == "" {
+		rpID = "localhost"
+	}
+	origins := c.WebAuthnOrigins
+	if len(origins) == 0 {
+		origins = []string{"http://localhost:8080"}
+	}
+	return &webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: c.totpIssuer(),
+		RPOrigins:     origins,
+	}
+}
+
+// publicURL returns the configured public url or the default
+func (c ServerConfig) publicURL() string {
+	if c.PublicURL == "" {
+		return "http://localhost:8080"
+	}
+	return c.PublicURL
+}
+
+// mailer returns the configured mailer or one that logs to stdout
+func (c ServerConfig) mailer() common.Mailer {
+	if c.Mailer == nil {
+		return mailer.NewLogMailer(os.Stdout)
+	}
+	return c.Mailer
+}
+
+// loginThrottle creates the LoginThrottle for the configured storage and policy
+func (c ServerConfig) loginThrottle() *LoginThrottle {
+	throttle := c.Throttle
+	if throttle == nil {
+		throttle = storage.NewMemoryThrottleStorage()
+	}
+	return NewLoginThrottle(throttle, c.ThrottlePolicy, c.TrustProxy)
+}
+
+// passwordPolicy returns the configured policy or the default
+func (c ServerConfig) passwordPolicy() *password.Policy {
+	if c.PasswordPolicy == nil {
+		return password.DefaultPolicy()
+	}
+	return c.PasswordPolicy
+}
+
+// deletionGracePeriod returns the configured grace period or the default
+func (c ServerConfig) deletionGracePeriod() time.Duration {
+	if c.DeletionGracePeriod <= 0 {
+		return 30 * 24 * time.Hour
+	}
+	return c.DeletionGracePeriod
+}
+
+// auditLog returns the configured audit storage or an in memory one
+func (c ServerConfig) auditLog() storage.AuditStorage {
+	if c.Audit == nil {
+		return storage.NewMemoryAuditStorage()
+	}
+	return c.Audit
+}
+
+// rbac creates the RBAC for the configured role storage
+func (c ServerConfig) rbac() *RBAC {
+	roles := c.Roles
+	if roles == nil {
+		roles = storage.NewMemoryRoleStorage()
+	}
+	return NewRBAC(roles)
+}
+
+// oauthStorage returns the configured oauth storage or an in memory one
+func (c ServerConfig) oauthStorage() storage.OAuthStorage {
+	if c.OAuth == nil {
+		return storage.NewMemoryOAuthStorage()
+	}
+	return c.OAuth
+}
+
+// orgStorage returns the configured organisation storage or an in memory one
+func (c ServerConfig) orgStorage() storage.OrgStorage {
+	if c.Orgs == nil {
+		return storage.NewMemoryOrgStorage()
+	}
+	return c.Orgs
+}
+
+// oidcRedirectURL returns the configured oidc redirect url or the callback route under the public url
+func (c ServerConfig) oidcRedirectURL() string {
+	if c.OIDCRedirectURL == "" {
+		return c.publicURL() + "/api/v1/users/login/oidc/callback"
+	}
+	return c.OIDCRedirectURL
+}
+
+// blobStore returns the configured blob store or an in memory one
+func (c ServerConfig) blobStore() storage.BlobStore {
+	if c.Blobs == nil {
+		return storage.NewMemoryBlobStore()
+	}
+	return c.Blobs
+}
+
+// photoLimits returns the configured photo limits or the default
+func (c ServerConfig) photoLimits() photo.Limits {
+	if c.PhotoLimits == nil {
+		return photo.DefaultLimits()
+	}
+	return *c.PhotoLimits
 }
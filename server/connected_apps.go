@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/gorilla/mux"
+)
+
+// ListOAuthGrantsHandler lists the third party apps the user granted access, and their scopes
+func (ur *userRouter) ListOAuthGrantsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	grants := user.OAuthGrants
+	if grants == nil {
+		grants = []models.OAuthGrant{}
+	}
+	StatusOK.Serve(grants)(w, r)
+}
+
+// RevokeOAuthGrantHandler takes access away from the third party app in the url. Its tokens stop working
+func (ur *userRouter) RevokeOAuthGrantHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	clientID := mux.Vars(r)["client_id"]
+	if _, ok = user.OAuthGrant(clientID); !ok {
+		StatusNotFound.Serve(fmt.Errorf("app doesn't have access"))(w, r)
+		return
+	}
+
+	if err := ur.userStorage.RemoveOAuthGrant(ctx, user.Username, clientID); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
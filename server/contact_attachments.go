@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/storage"
+	"github.com/gorilla/mux"
+)
+
+// AttachmentLimits bound the files attached to contacts. Zero fields take the default
+type AttachmentLimits struct {
+	// MaxBytes bounds the size of a file. Defaults to 25 MB
+	MaxBytes int64
+	// Quota bounds the size of the files attached to the contacts of a user, counting the contacts of their books shared
+	// with others. Defaults to 1 GB
+	Quota int64
+}
+
+// withDefaults fills in the zero fields
+func (l AttachmentLimits) withDefaults() AttachmentLimits {
+	if l.MaxBytes == 0 {
+		l.MaxBytes = 25 << 20
+	}
+	if l.Quota == 0 {
+		l.Quota = 1 << 30
+	}
+	return l
+}
+
+// maxFilenameBytes bounds the names of attachments
+const maxFilenameBytes = 255
+
+// AttachmentsEndPoint lists the files attached to a contact
+func (cr *contactRouter) AttachmentsEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	contact, err := cr.userStorage.FindBookContact(ctx, user.Username, bookID(r), mux.Vars(r)["id"])
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	attachments := contact.Attachments
+	if attachments == nil {
+		attachments = []models.Attachment{}
+	}
+	StatusOK.Serve(attachments)(w, r)
+}
+
+// UploadAttachmentEndPoint attaches a file to a contact, either the body named by the filename parameter, or the file
+// field of a multipart form. The file is streamed to the blob store, and its content type is sniffed from its first bytes
+func (cr *contactRouter) UploadAttachmentEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	tooLarge := fmt.Errorf("attachments must be at most %d bytes", cr.attachmentLimits.MaxBytes)
+	if r.ContentLength > cr.attachmentLimits.MaxBytes && !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		StatusRequestEntityTooLarge.Serve(tooLarge)(w, r)
+		return
+	}
+	if _, err := cr.userStorage.FindBookContact(ctx, user.Username, bookID(r), mux.Vars(r)["id"]); err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	body, filename, err := uploadBody(r, "file")
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	if filename == "" {
+		filename = r.URL.Query().Get("filename")
+	}
+
+	attachment := models.Attachment{
+		ID:        newAttachmentID(),
+		Filename:  attachmentFilename(filename),
+		CreatedAt: time.Now().UTC(),
+	}
+	file := bufio.NewReaderSize(io.LimitReader(body, cr.attachmentLimits.MaxBytes+1), 512)
+	head, _ := file.Peek(512)
+	attachment.ContentType = http.DetectContentType(head)
+	hash := sha256.New()
+	var size byteCounter
+	err = cr.blobs.Put(ctx, attachmentKey(attachment.ID), io.TeeReader(file, io.MultiWriter(hash, &size)))
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	attachment.Size, attachment.Hash = int64(size), hex.EncodeToString(hash.Sum(nil))
+	if attachment.Size > cr.attachmentLimits.MaxBytes {
+		cr.discardAttachment(ctx, attachment)
+		StatusRequestEntityTooLarge.Serve(tooLarge)(w, r)
+		return
+	}
+	if attachment.Size == 0 {
+		cr.discardAttachment(ctx, attachment)
+		StatusBadRequest.Serve(fmt.Errorf("attachments can't be empty"))(w, r)
+		return
+	}
+	err = cr.userStorage.AddAttachment(ctx, user.Username, bookID(r), mux.Vars(r)["id"], attachment, cr.attachmentLimits.Quota)
+	if err != nil {
+		cr.discardAttachment(ctx, attachment)
+		serveAttachmentError(err, cr.attachmentLimits)(w, r)
+		return
+	}
+	StatusCreated.Serve(attachment)(w, r)
+}
+
+// AttachmentEndPoint downloads a file attached to a contact. It is streamed from the blob store, with Range requests
+// for parts of it, and always as a download so uploaded html doesn't run on our origin
+func (cr *contactRouter) AttachmentEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	contact, err := cr.userStorage.FindBookContact(ctx, user.Username, bookID(r), mux.Vars(r)["id"])
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	attachment := findAttachment(contact.Attachments, mux.Vars(r)["attachment"])
+	if attachment == nil {
+		StatusNotFound.Serve(storage.ErrAttachmentNotFound)(w, r)
+		return
+	}
+	blob, err := cr.blobs.Get(ctx, attachmentKey(attachment.ID))
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	defer blob.Close()
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, attachment.Hash))
+	http.ServeContent(w, r, "", attachment.CreatedAt, blob)
+}
+
+// DeleteAttachmentEndPoint removes a file from a contact
+func (cr *contactRouter) DeleteAttachmentEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	removed, err := cr.userStorage.RemoveAttachment(ctx, user.Username, bookID(r), mux.Vars(r)["id"], mux.Vars(r)["attachment"])
+	if err != nil {
+		serveAttachmentError(err, cr.attachmentLimits)(w, r)
+		return
+	}
+	releaseAttachment(ctx, cr.userStorage, cr.blobs, *removed)
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// discardAttachment deletes the file of an upload that wasn't attached
+func (cr *contactRouter) discardAttachment(ctx context.Context, a models.Attachment) {
+	if err := cr.blobs.Delete(ctx, attachmentKey(a.ID)); err != nil {
+		log.Printf("Unable to delete attachment %s: %s", a.ID, err)
+	}
+}
+
+// serveAttachmentError maps the errors of attaching files to their status, and the rest like serveBookError
+func serveAttachmentError(err error, limits AttachmentLimits) http.HandlerFunc {
+	switch err {
+	case storage.ErrAttachmentNotFound:
+		return StatusNotFound.Serve(err)
+	case storage.ErrAttachmentQuota:
+		return StatusRequestEntityTooLarge.Serve(ErrorDetails{
+			Message: err.Error(),
+			Code:    "attachment_quota",
+			Details: map[string]int64{"quota": limits.Quota},
+		})
+	}
+	return serveBookError(err)
+}
+
+// releaseContactFiles deletes the photo and attachments of a deleted contact that no other contact has
+func releaseContactFiles(ctx context.Context, u storage.UserStorage, blobs storage.BlobStore, contact models.Contact) {
+	releasePhoto(ctx, u, blobs, contact.Photo)
+	for _, a := range contact.Attachments {
+		releaseAttachment(ctx, u, blobs, a)
+	}
+}
+
+// releaseAttachment deletes the file of an attachment once no contact has it. Copies of a contact share their files.
+// Failures are only logged, leaving the file behind
+func releaseAttachment(ctx context.Context, u storage.UserStorage, blobs storage.BlobStore, a models.Attachment) {
+	inUse, err := u.AttachmentInUse(ctx, a.ID)
+	if err != nil {
+		log.Printf("Unable to check if attachment %s is in use: %s", a.ID, err)
+		return
+	}
+	if inUse {
+		return
+	}
+	if err = blobs.Delete(ctx, attachmentKey(a.ID)); err != nil {
+		log.Printf("Unable to delete attachment %s: %s", a.ID, err)
+	}
+}
+
+// findAttachment finds an attachment by id, nil if there is none
+func findAttachment(attachments []models.Attachment, id string) *models.Attachment {
+	for i := range attachments {
+		if attachments[i].ID == id {
+			return &attachments[i]
+		}
+	}
+	return nil
+}
+
+// newAttachmentID returns 16 random bytes, hex encoded
+func newAttachmentID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("unable to read random bytes: %s", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// attachmentKey is the blob key of an attachment. Keys start with two characters of the id, so no directory holds
+// every attachment
+func attachmentKey(id string) string {
+	return "attachments/" + id[:2] + "/" + id
+}
+
+// attachmentFilename keeps the last element of the name of an uploaded file, without control characters and cut to
+// maxFilenameBytes
+func attachmentFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimSpace(name)
+	for len(name) > maxFilenameBytes {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" || name == "." || name == ".." {
+		return "attachment"
+	}
+	return name
+}
+
+// byteCounter counts the bytes written to it
+type byteCounter int64
+
+// Write satisfies the io.Writer interface
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/storage"
+	"github.com/gorilla/mux"
+)
+
+// TimelineEndPoint lists the timeline of a contact a page at a time, newest first. It has the calls, meetings, emails
+// and notes logged against the contact and those linking it
+func (cr *contactRouter) TimelineEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	interactions, total, err := cr.userStorage.FindInteractions(ctx, user.Username, bookID(r), mux.Vars(r)["id"], offset, limit)
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(models.InteractionPage{Interactions: interactions, Total: total, Offset: offset, Limit: limit})(w, r)
+}
+
+// LogInteractionEndPoint logs a call, meeting, email or note against a contact. at defaults to now
+func (cr *contactRouter) LogInteractionEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	var interaction models.Interaction
+	if r.Body == nil {
+		StatusBadRequest.Serve(fmt.Errorf("no request body"))(w, r)
+		return
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&interaction); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	interaction.ContactID = mux.Vars(r)["id"]
+	interaction.Author = user.Username
+	if interaction.At.IsZero() {
+		interaction.At = time.Now().UTC()
+	}
+	interaction.Normalize()
+	if err := interaction.Validate(); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	created, err := cr.userStorage.AddInteraction(ctx, user.Username, bookID(r), interaction.ContactID, interaction)
+	if err != nil {
+		serveInteractionError(err)(w, r)
+		return
+	}
+	StatusCreated.Serve(created)(w, r)
+}
+
+// DeleteInteractionEndPoint deletes an interaction logged against a contact
+func (cr *contactRouter) DeleteInteractionEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	params := mux.Vars(r)
+	if err := cr.userStorage.DeleteInteraction(ctx, user.Username, bookID(r), params["id"], params["interaction"]); err != nil {
+		serveInteractionError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// serveInteractionError maps the errors of the timeline to their status, and the rest like serveBookError
+func serveInteractionError(err error) http.HandlerFunc {
+	switch err {
+	case storage.ErrInteractionNotFound:
+		return StatusNotFound.Serve(err)
+	case storage.ErrInteractionLink:
+		return StatusBadRequest.Serve(err)
+	}
+	return serveBookError(err)
+}
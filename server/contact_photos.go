@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/photo"
+	"github.com/Dacode45/addressbook/storage"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// vcardPhotoSize is the thumbnail embedded in vCard exports, the photos themselves can be megabytes
+	vcardPhotoSize = 256
+	// avatarSize is the size of PNG avatars without a size asked for
+	avatarSize = 128
+)
+
+// errUploadTooLarge is returned by readUpload for files above its limit
+var errUploadTooLarge = errors.New("upload too large")
+
+// UploadPhotoEndPoint sets the photo of a contact from a JPEG, PNG or WebP body, or the photo field of a multipart form.
+// The photo is stripped of its metadata and thumbnails are made of it
+func (cr *contactRouter) UploadPhotoEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	data, err := readUpload(r, "photo", cr.photoLimits.MaxBytes)
+	if err == errUploadTooLarge {
+		StatusRequestEntityTooLarge.Serve(fmt.Errorf("photos must be at most %d bytes", cr.photoLimits.MaxBytes))(w, r)
+		return
+	}
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	p, err := photo.Process(data, cr.photoLimits)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+
+	contactPhoto, err := cr.savePhoto(ctx, p)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	old, err := cr.userStorage.SetContactPhoto(ctx, user.Username, bookID(r), mux.Vars(r)["id"], contactPhoto)
+	if err != nil {
+		releasePhoto(ctx, cr.userStorage, cr.blobs, contactPhoto)
+		serveBookError(err)(w, r)
+		return
+	}
+	if old != nil && old.Hash != contactPhoto.Hash {
+		releasePhoto(ctx, cr.userStorage, cr.blobs, old)
+	}
+	StatusOK.Serve(contactPhoto)(w, r)
+}
+
+// PhotoEndPoint serves the photo of a contact, or with size=64, 128 or 256 a square JPEG thumbnail of it.
+// Clients revalidate with the ETag, which changes with the photo
+func (cr *contactRouter) PhotoEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	contact, err := cr.userStorage.FindBookContact(ctx, user.Username, bookID(r), mux.Vars(r)["id"])
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	if contact.Photo == nil {
+		StatusNotFound.Serve(fmt.Errorf("the contact has no photo"))(w, r)
+		return
+	}
+	size, contentType := 0, contact.Photo.ContentType
+	if s := r.URL.Query().Get("size"); s != "" {
+		if size, err = strconv.Atoi(s); err != nil || !isThumbnailSize(size) {
+			StatusBadRequest.Serve(fmt.Errorf("size must be one of %v", photo.ThumbnailSizes))(w, r)
+			return
+		}
+		contentType = photo.ContentTypeJPEG
+	}
+	blob, err := cr.blobs.Get(ctx, photoKey(contact.Photo.Hash, size))
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	defer blob.Close()
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, contact.Photo.Hash, size))
+	http.ServeContent(w, r, "", contact.Photo.UpdatedAt, blob)
+}
+
+// DeletePhotoEndPoint removes the photo of a contact
+func (cr *contactRouter) DeletePhotoEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	old, err := cr.userStorage.SetContactPhoto(ctx, user.Username, bookID(r), mux.Vars(r)["id"], nil)
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	if old == nil {
+		StatusNotFound.Serve(fmt.Errorf("the contact has no photo"))(w, r)
+		return
+	}
+	releasePhoto(ctx, cr.userStorage, cr.blobs, old)
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// AvatarEndPoint draws the initials of a contact on a color following its id, for contacts without a photo. format=svg,
+// the default, or png with size=64, 128 or 256. The ETag changes with the initials and color
+func (cr *contactRouter) AvatarEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	contact, err := cr.userStorage.FindBookContact(ctx, user.Username, bookID(r), mux.Vars(r)["id"])
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	avatar := cr.avatar(r, contact)
+	format, size := r.URL.Query().Get("format"), avatarSize
+	if s := r.URL.Query().Get("size"); s != "" {
+		if size, err = strconv.Atoi(s); err != nil || !isThumbnailSize(size) {
+			StatusBadRequest.Serve(fmt.Errorf("size must be one of %v", photo.ThumbnailSizes))(w, r)
+			return
+		}
+	}
+	var data []byte
+	contentType := photo.ContentTypeSVG
+	switch format {
+	case "", "svg":
+		format, data = "svg", avatar.SVG()
+	case "png":
+		contentType = photo.ContentTypePNG
+		if data, err = avatar.PNG(size); err != nil {
+			StatusInternalServerError.Serve(err)(w, r)
+			return
+		}
+	default:
+		StatusBadRequest.Serve(fmt.Errorf("format must be svg or png"))(w, r)
+		return
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s %d %s %s", format, size, avatar.Initials, avatar.Hex())))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	// the initials follow the name order of the locale
+	w.Header().Set("Vary", "Accept-Language")
+	w.Header().Set("ETag", fmt.Sprintf(`"avatar-%s"`, hex.EncodeToString(sum[:8])))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// avatar is the initials avatar of a contact, from its name in the locale of the request without honorifics
+func (cr *contactRouter) avatar(r *http.Request, c *models.Contact) photo.Avatar {
+	names := cr.names
+	names.HideHonorifics = true
+	return photo.NewAvatar(c.ID, names.DisplayName(*c, requestLocale(r)))
+}
+
+// savePhoto stores a processed photo and its thumbnails under its hash
+func (cr *contactRouter) savePhoto(ctx context.Context, p *photo.Photo) (*models.ContactPhoto, error) {
+	hash := p.Hash()
+	if err := cr.blobs.Put(ctx, photoKey(hash, 0), bytes.NewReader(p.Data)); err != nil {
+		return nil, err
+	}
+	for size, thumbnail := range p.Thumbnails {
+		if err := cr.blobs.Put(ctx, photoKey(hash, size), bytes.NewReader(thumbnail)); err != nil {
+			return nil, err
+		}
+	}
+	return &models.ContactPhoto{
+		Hash:        hash,
+		ContentType: p.ContentType,
+		Width:       p.Width,
+		Height:      p.Height,
+		Size:        int64(len(p.Data)),
+		UpdatedAt:   time.Now().UTC(),
+	}, nil
+}
+
+// readPhoto reads a photo, or its thumbnail of a size
+func (cr *contactRouter) readPhoto(ctx context.Context, p *models.ContactPhoto, size int) ([]byte, error) {
+	blob, err := cr.blobs.Get(ctx, photoKey(p.Hash, size))
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	return ioutil.ReadAll(blob)
+}
+
+// releasePhoto deletes a photo and its thumbnails once no contact has it. Failures are only logged, leaving the files behind
+func releasePhoto(ctx context.Context, u storage.UserStorage, blobs storage.BlobStore, p *models.ContactPhoto) {
+	if p == nil {
+		return
+	}
+	inUse, err := u.PhotoInUse(ctx, p.Hash)
+	if err != nil {
+		log.Printf("Unable to check if photo %s is in use: %s", p.Hash, err)
+		return
+	}
+	if inUse {
+		return
+	}
+	for _, size := range append([]int{0}, photo.ThumbnailSizes...) {
+		if err = blobs.Delete(ctx, photoKey(p.Hash, size)); err != nil {
+			log.Printf("Unable to delete photo %s: %s", p.Hash, err)
+		}
+	}
+}
+
+// photoKey is the blob key of a photo, or of its thumbnail of a size. Keys start with two characters of the hash,
+// so no directory holds every photo
+func photoKey(hash string, size int) string {
+	key := "photos/" + hash[:2] + "/" + hash
+	if size > 0 {
+		key += "-" + strconv.Itoa(size)
+	}
+	return key
+}
+
+// isThumbnailSize checks thumbnails are made in a size
+func isThumbnailSize(size int) bool {
+	for _, s := range photo.ThumbnailSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// readUpload reads an uploaded file, either the whole body or a field of a multipart form. Files above maxBytes
+// fail with errUploadTooLarge
+func readUpload(r *http.Request, field string, maxBytes int64) ([]byte, error) {
+	body, _, err := uploadBody(r, field)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, errUploadTooLarge
+	}
+	return data, nil
+}
+
+// uploadBody finds an uploaded file to stream, either the whole body or a field of a multipart form, with the filename
+// the form gives it. The body is closed with the request
+func uploadBody(r *http.Request, field string) (io.Reader, string, error) {
+	if r.Body == nil {
+		return nil, "", fmt.Errorf("no request body")
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "multipart/form-data" {
+		return r.Body, "", nil
+	}
+	form, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			return nil, "", fmt.Errorf("no %s in the form", field)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if part.FormName() == field {
+			return part, part.FileName(), nil
+		}
+	}
+}
@@ -1,39 +1,103 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/photo"
+	"github.com/Dacode45/addressbook/vcard"
 	"github.com/gocarina/gocsv"
 
 	"github.com/Dacode45/addressbook/storage"
 	"github.com/gorilla/mux"
 )
 
+const (
+	// customColumnPrefix starts the csv columns of custom fields, like x-account_manager
+	customColumnPrefix = "x-"
+	// customFilterPrefix starts the query parameters filtering on custom fields, like custom.tier=gold or custom.deal_size.gte=1000
+	customFilterPrefix = "custom."
+	// maxCSVImportBytes and maxVCardImportBytes bound imports. vCards can hold photos
+	maxCSVImportBytes   = 1000000
+	maxVCardImportBytes = 20 << 20
+	// maxBulkTagContacts bounds the contacts tagged at once
+	maxBulkTagContacts = 1000
+)
+
+// tagRequest is the body of making, renaming and merging tags
+type tagRequest struct {
+	Name string `json:"name"`
+	Into string `json:"into"`
+}
+
+// bulkTagRequest is the body of adding and removing tags on many contacts at once
+type bulkTagRequest struct {
+	ContactIDs []string `json:"contact_ids"`
+	Add        []string `json:"add"`
+	Remove     []string `json:"remove"`
+}
+
 type contactRouter struct {
-	userStorage storage.UserStorage
-	jwtCoder    *JWTCoder
+	userStorage      storage.UserStorage
+	jwtCoder         *JWTCoder
+	names            models.NameFormat
+	blobs            storage.BlobStore
+	photoLimits      photo.Limits
+	attachmentLimits AttachmentLimits
 }
 
 // NewContactRouter generates a router for handling the contacts api. Requires access to our user storage
 func NewContactRouter(u storage.UserStorage, config ServerConfig, router *mux.Router) *mux.Router {
 	jwtCoder := NewJWTCoder(config.JWTSecret)
-	cr := contactRouter{u, jwtCoder}
+	audit := config.auditLog()
+	cr := contactRouter{u, jwtCoder, config.NameFormat, config.blobStore(), config.photoLimits(), config.AttachmentLimits.withDefaults()}
 
-	router.HandleFunc("/", LoggedInMiddleware(jwtCoder, u, cr.AllContactsEndPoint)).Methods("GET")
+	router.HandleFunc("/", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.AllContactsEndPoint, models.ScopeContactsRead))).Methods("GET")
 	// export import csv
-	router.HandleFunc("/export", LoggedInMiddleware(jwtCoder, u, cr.ExportAllContactsEndpoint)).Methods("GET")
-	router.HandleFunc("/{id}", LoggedInMiddleware(jwtCoder, u, cr.FindContactEndPoint)).Methods("GET")
-	router.HandleFunc("/", LoggedInMiddleware(jwtCoder, u, cr.CreateContactEndPoint)).Methods("POST")
-	router.HandleFunc("/import", LoggedInMiddleware(jwtCoder, u, cr.ImportContactsEndPoint)).Methods("POST")
-	router.HandleFunc("/{id}", LoggedInMiddleware(jwtCoder, u, cr.UpdateContactEndPoint)).Methods("PUT")
-	router.HandleFunc("/{id}", LoggedInMiddleware(jwtCoder, u, cr.DeleteContactEndPoint)).Methods("DELETE")
+	router.HandleFunc("/export", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.ExportAllContactsEndpoint, models.ScopeContactsExport))).Methods("GET")
+	// tags
+	router.HandleFunc("/tags", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.AllTagsEndPoint, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/tags", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.CreateTagEndPoint, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/tags/bulk", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.BulkTagEndPoint, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/tags/{tag}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.RenameTagEndPoint, models.ScopeContactsWrite))).Methods("PUT")
+	router.HandleFunc("/tags/{tag}/merge", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.MergeTagEndPoint, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/tags/{tag}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.DeleteTagEndPoint, models.ScopeContactsWrite))).Methods("DELETE")
+	router.HandleFunc("/{id}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.FindContactEndPoint, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.CreateContactEndPoint, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/import", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.ImportContactsEndPoint, models.ScopeContactsImport))).Methods("POST")
+	router.HandleFunc("/{id}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.UpdateContactEndPoint, models.ScopeContactsWrite))).Methods("PUT")
+	router.HandleFunc("/{id}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.DeleteContactEndPoint, models.ScopeContactsDelete))).Methods("DELETE")
+	// photos
+	router.HandleFunc("/{id}/photo", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.PhotoEndPoint, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{id}/photo", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.UploadPhotoEndPoint, models.ScopeContactsWrite))).Methods("PUT")
+	router.HandleFunc("/{id}/photo", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.DeletePhotoEndPoint, models.ScopeContactsWrite))).Methods("DELETE")
+	router.HandleFunc("/{id}/avatar", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.AvatarEndPoint, models.ScopeContactsRead))).Methods("GET")
+	// attachments
+	router.HandleFunc("/{id}/attachments", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.AttachmentsEndPoint, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{id}/attachments", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.UploadAttachmentEndPoint, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/{id}/attachments/{attachment}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.AttachmentEndPoint, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{id}/attachments/{attachment}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.DeleteAttachmentEndPoint, models.ScopeContactsWrite))).Methods("DELETE")
+	// timeline
+	router.HandleFunc("/{id}/interactions", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.TimelineEndPoint, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{id}/interactions", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.LogInteractionEndPoint, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/{id}/interactions/{interaction}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(cr.DeleteInteractionEndPoint, models.ScopeContactsWrite))).Methods("DELETE")
 	return router
 }
 
-// ExportAllContactsEndpoints exports all user contacts as csv. Limits to 1000000 byte body
+// ExportAllContactsEndpoints exports the contacts of the book as csv, or as vCards with format=vcard.
+// Takes the same filters as listing contacts. With avatars=true, vCards of contacts without a photo get their
+// initials avatar instead
 func (cr *contactRouter) ExportAllContactsEndpoint(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user, ok := ctx.Value(ContextUserKey).(*models.User)
@@ -42,15 +106,59 @@ func (cr *contactRouter) ExportAllContactsEndpoint(w http.ResponseWriter, r *htt
 		return
 	}
 
-	contacts, err := cr.userStorage.FindAllContacts(ctx, user.Username)
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "csv" && format != "vcard" {
+		StatusBadRequest.Serve(fmt.Errorf("format must be csv or vcard"))(w, r)
+		return
+	}
+	fields, err := cr.bookFields(ctx, user.Username, r)
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	contacts, err := cr.userStorage.FindBookContacts(ctx, user.Username, bookID(r))
 	if err != nil {
-		StatusInternalServerError.Serve(err)(w, r)
+		serveBookError(err)(w, r)
 		return
 	}
-	StatusOKCSV.Serve("contacts.csv", contacts)(w, r)
+	if contacts, err = filterContacts(r, fields, contacts); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	contacts = presentContacts(cr.names, r, contacts)
+	if format == "vcard" {
+		cards := make([]vcard.Card, len(contacts))
+		for i, c := range contacts {
+			cards[i] = vcard.FromContact(c, fields)
+			if c.Photo == nil {
+				if r.URL.Query().Get("avatars") != "true" {
+					continue
+				}
+				avatar, err := cr.avatar(r, &c).PNG(vcardPhotoSize)
+				if err != nil {
+					StatusInternalServerError.Serve(err)(w, r)
+					return
+				}
+				cards[i].AddPhoto(photo.ContentTypePNG, avatar)
+				continue
+			}
+			thumbnail, err := cr.readPhoto(ctx, c.Photo, vcardPhotoSize)
+			if err != nil {
+				StatusInternalServerError.Serve(err)(w, r)
+				return
+			}
+			cards[i].AddPhoto(photo.ContentTypeJPEG, thumbnail)
+		}
+		StatusOKVCard.Serve("contacts.vcf", cards)(w, r)
+		return
+	}
+	StatusOKCSV.Serve("contacts.csv", contactsCSV{contacts, fields})(w, r)
 }
 
-// AllContactsEndPoint retrieves all user contacts as json
+// AllContactsEndPoint retrieves the contacts of the book as json. q searches the contacts, tag keeps the contacts
+// with every tag given, or any of them with tag_mode=any, custom.<key>, custom.<key>.gte and custom.<key>.lte
+// filter on the values of custom fields, and not_contacted_days keeps the contacts not called, met or emailed in as
+// many days
 func (cr *contactRouter) AllContactsEndPoint(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user, ok := ctx.Value(ContextUserKey).(*models.User)
@@ -59,12 +167,21 @@ func (cr *contactRouter) AllContactsEndPoint(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	contacts, err := cr.userStorage.FindAllContacts(ctx, user.Username)
+	fields, err := cr.bookFields(ctx, user.Username, r)
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	contacts, err := cr.userStorage.FindBookContacts(ctx, user.Username, bookID(r))
 	if err != nil {
-		StatusInternalServerError.Serve(err)(w, r)
+		serveBookError(err)(w, r)
+		return
+	}
+	if contacts, err = filterContacts(r, fields, contacts); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
 		return
 	}
-	StatusOK.Serve(contacts)(w, r)
+	StatusOK.Serve(presentContacts(cr.names, r, contacts))(w, r)
 }
 
 // FindContactEndPoint searches for a given contact
@@ -77,12 +194,12 @@ func (cr *contactRouter) FindContactEndPoint(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	contact, err := cr.userStorage.FindContactById(ctx, user.Username, params["id"])
+	contact, err := cr.userStorage.FindBookContact(ctx, user.Username, bookID(r), params["id"])
 	if err != nil {
-		StatusNotFound.Serve(err)(w, r)
+		serveBookError(err)(w, r)
 		return
 	}
-	StatusOK.Serve(contact)(w, r)
+	StatusOK.Serve(presentContact(cr.names, r, contact))(w, r)
 }
 
 // CreateContactEndPoint creates a given contact from a json body
@@ -100,39 +217,78 @@ func (cr *contactRouter) CreateContactEndPoint(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	var newContact *models.Contact
-	newContact, err = cr.userStorage.CreateContact(ctx, user.Username, contact)
+	fields, err := cr.bookFields(ctx, user.Username, r)
 	if err != nil {
-		StatusInternalServerError.Serve(err)(w, r)
+		serveBookError(err)(w, r)
+		return
+	}
+	if contact.Custom, err = fields.Apply(contact.Custom); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
 		return
 	}
-	StatusOK.Serve(newContact)(w, r)
-}
 
-// ImportContactsEndPoint imports a csv file for contacts
-func (cr *contactRouter) ImportContactsEndPoint(w http.ResponseWriter, r *http.Request) {
-	r.Body = http.MaxBytesReader(w, r.Body, 1000000)
-	contacts, err := decodeContacts(r)
+	var newContact *models.Contact
+	contact.BookID = bookID(r)
+	newContact, err = cr.userStorage.CreateContact(ctx, user.Username, contact)
 	if err != nil {
-		StatusBadRequest.Serve(err)(w, r)
+		serveBookError(err)(w, r)
 		return
 	}
+	StatusOK.Serve(presentContact(cr.names, r, newContact))(w, r)
+}
 
+// ImportContactsEndPoint imports contacts from a csv file, or from vCards with format=vcard or a text/vcard body.
+// Photos of vCards that can't be used, like photos linked by url or too large, are left out
+func (cr *contactRouter) ImportContactsEndPoint(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user, ok := ctx.Value(ContextUserKey).(*models.User)
 	if !ok || user == nil {
 		StatusUnauthorized.Serve(fmt.Errorf("Unautorized"))(w, r)
 		return
 	}
+	fields, err := cr.bookFields(ctx, user.Username, r)
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+
+	var contacts []models.Contact
+	var photos map[int]*photo.Photo
+	if isVCardImport(r) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxVCardImportBytes)
+		if contacts, photos, err = cr.decodeVCards(r, fields); err != nil {
+			StatusBadRequest.Serve(err)(w, r)
+			return
+		}
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, maxCSVImportBytes)
+		if contacts, err = decodeContacts(r); err != nil {
+			StatusBadRequest.Serve(err)(w, r)
+			return
+		}
+	}
+	for i := range contacts {
+		if contacts[i].Custom, err = fields.Apply(contacts[i].Custom); err != nil {
+			StatusBadRequest.Serve(fmt.Errorf("row %d: %s", i+1, err))(w, r)
+			return
+		}
+	}
 	var newContacts = make([]*models.Contact, len(contacts))
 	for i, contact := range contacts {
+		if p, ok := photos[i]; ok {
+			if contact.Photo, err = cr.savePhoto(ctx, p); err != nil {
+				StatusInternalServerError.Serve(err)(w, r)
+				return
+			}
+		}
 		var newContact *models.Contact
+		contact.BookID = bookID(r)
 		newContact, err = cr.userStorage.CreateContact(ctx, user.Username, contact)
 		if err != nil {
-			StatusInternalServerError.Serve(err)(w, r)
+			serveBookError(err)(w, r)
 			return
 		}
-		newContacts[i] = newContact
+		newContacts[i] = presentContact(cr.names, r, newContact)
 	}
 	StatusOK.Serve(newContacts)(w, r)
 }
@@ -152,12 +308,23 @@ func (cr *contactRouter) UpdateContactEndPoint(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	err = cr.userStorage.UpdateContact(ctx, user.Username, contact)
+	fields, err := cr.bookFields(ctx, user.Username, r)
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	if contact.Custom, err = fields.Apply(contact.Custom); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+
+	contact.BookID = bookID(r)
+	err = cr.userStorage.UpdateBookContact(ctx, user.Username, contact.BookID, contact)
 	if err != nil {
-		StatusInternalServerError.Serve(err)(w, r)
+		serveBookError(err)(w, r)
 		return
 	}
-	StatusOK.Serve(contact)(w, r)
+	StatusOK.Serve(presentContact(cr.names, r, &contact))(w, r)
 }
 
 // DelecteContactEndPoint removes a contact
@@ -170,32 +337,372 @@ func (cr *contactRouter) DeleteContactEndPoint(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	err := cr.userStorage.DeleteContact(ctx, user.Username, params["id"])
+	contact, err := cr.userStorage.FindBookContact(ctx, user.Username, bookID(r), params["id"])
 	if err != nil {
-		StatusInternalServerError.Serve(err)(w, r)
+		serveBookError(err)(w, r)
 		return
 	}
+	if err = cr.userStorage.DeleteBookContact(ctx, user.Username, bookID(r), params["id"]); err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	releaseContactFiles(ctx, cr.userStorage, cr.blobs, *contact)
 	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
 }
 
-// decodeContact returns a contact from a json body
+// AllTagsEndPoint lists the tags of the book with the number of contacts tagged with each
+func (cr *contactRouter) AllTagsEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	tags, err := cr.userStorage.FindTags(ctx, user.Username, bookID(r))
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(tags)(w, r)
+}
+
+// CreateTagEndPoint makes a tag from a json body, so it is listed before any contact has it
+func (cr *contactRouter) CreateTagEndPoint(w http.ResponseWriter, r *http.Request) {
+	body, err := decodeTagRequest(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	name := models.NormalizeTag(body.Name)
+	if err = models.ValidateTag(name); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	if err = cr.userStorage.CreateTag(ctx, user.Username, bookID(r), name); err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	StatusCreated.Serve(models.Tag{Name: name})(w, r)
+}
+
+// RenameTagEndPoint renames the tag in the url to the name in the json body, on every contact with it.
+// Renaming to another tag conflicts, merge the tags instead
+func (cr *contactRouter) RenameTagEndPoint(w http.ResponseWriter, r *http.Request) {
+	body, err := decodeTagRequest(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	name := models.NormalizeTag(body.Name)
+	if err = models.ValidateTag(name); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	if err = cr.userStorage.RenameTag(ctx, user.Username, bookID(r), mux.Vars(r)["tag"], name); err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// MergeTagEndPoint merges the tag in the url into the tag in the json body. Contacts with the tag get the other one
+func (cr *contactRouter) MergeTagEndPoint(w http.ResponseWriter, r *http.Request) {
+	body, err := decodeTagRequest(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	from, into := mux.Vars(r)["tag"], models.NormalizeTag(body.Into)
+	if into == "" || strings.EqualFold(from, into) {
+		StatusBadRequest.Serve(fmt.Errorf("into must be another tag"))(w, r)
+		return
+	}
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	if err = cr.userStorage.MergeTags(ctx, user.Username, bookID(r), from, into); err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// DeleteTagEndPoint removes the tag in the url from the book and every contact with it. The contacts are kept
+func (cr *contactRouter) DeleteTagEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	if err := cr.userStorage.DeleteTag(ctx, user.Username, bookID(r), mux.Vars(r)["tag"]); err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// BulkTagEndPoint adds and removes tags on the contacts in the json body, all at once. Responds with the number of contacts changed
+func (cr *contactRouter) BulkTagEndPoint(w http.ResponseWriter, r *http.Request) {
+	var body bulkTagRequest
+	if r.Body == nil {
+		StatusBadRequest.Serve(fmt.Errorf("no request body"))(w, r)
+		return
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	if len(body.ContactIDs) == 0 || len(body.ContactIDs) > maxBulkTagContacts {
+		StatusBadRequest.Serve(fmt.Errorf("contact_ids must list between 1 and %d contacts", maxBulkTagContacts))(w, r)
+		return
+	}
+	for _, tags := range []*[]string{&body.Add, &body.Remove} {
+		for i, tag := range *tags {
+			(*tags)[i] = models.NormalizeTag(tag)
+			if err := models.ValidateTag((*tags)[i]); err != nil {
+				StatusBadRequest.Serve(err)(w, r)
+				return
+			}
+		}
+	}
+	if len(body.Add)+len(body.Remove) == 0 {
+		StatusBadRequest.Serve(fmt.Errorf("add or remove some tags"))(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	updated, err := cr.userStorage.TagContacts(ctx, user.Username, bookID(r), body.ContactIDs, body.Add, body.Remove)
+	if err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(map[string]int{"updated": updated})(w, r)
+}
+
+// bookID is the book in the url. The contacts api works against the default book
+func bookID(r *http.Request) string {
+	if book, ok := mux.Vars(r)["book"]; ok {
+		return book
+	}
+	return models.DefaultBookID
+}
+
+// bookFields finds the custom fields of the book in the url
+func (cr *contactRouter) bookFields(ctx context.Context, username string, r *http.Request) (models.FieldDefinitions, error) {
+	book, err := cr.userStorage.FindBook(ctx, username, bookID(r))
+	if err != nil {
+		return nil, err
+	}
+	return book.Fields, nil
+}
+
+// filterContacts keeps the contacts matching the q query parameter and the filters on tags, custom fields and the
+// last contact
+func filterContacts(r *http.Request, fields models.FieldDefinitions, contacts []models.Contact) ([]models.Contact, error) {
+	query := r.URL.Query()
+	filters := []models.FieldFilter{}
+	for param, values := range query {
+		if !strings.HasPrefix(param, customFilterPrefix) {
+			continue
+		}
+		key, op := strings.TrimPrefix(param, customFilterPrefix), ""
+		if i := strings.Index(key, "."); i >= 0 {
+			key, op = key[:i], key[i+1:]
+		}
+		field, ok := fields.Find(key)
+		if !ok {
+			return nil, fmt.Errorf("the book has no field %s", key)
+		}
+		for _, value := range values {
+			filter, err := models.NewFieldFilter(field, op, value)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, filter)
+		}
+	}
+
+	tagFilter := models.TagFilter{Any: query.Get("tag_mode") == "any"}
+	if mode := query.Get("tag_mode"); mode != "" && mode != "all" && mode != "any" {
+		return nil, fmt.Errorf("tag_mode must be all or any")
+	}
+	for _, tag := range query["tag"] {
+		tagFilter.Tags = append(tagFilter.Tags, models.NormalizeTag(tag))
+	}
+
+	var contactedSince *time.Time
+	if s := query.Get("not_contacted_days"); s != "" {
+		days, err := strconv.Atoi(s)
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("not_contacted_days must be a non-negative number")
+		}
+		since := time.Now().AddDate(0, 0, -days)
+		contactedSince = &since
+	}
+
+	filtered := []models.Contact{}
+	for _, c := range contacts {
+		matches := c.Matches(query.Get("q")) && tagFilter.Matches(c)
+		if contactedSince != nil {
+			matches = matches && !c.ContactedSince(*contactedSince)
+		}
+		for _, filter := range filters {
+			matches = matches && filter.Matches(c)
+		}
+		if matches {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered, nil
+}
+
+// contactsCSV writes contacts to csv with an x- column for each custom field of their book
+type contactsCSV struct {
+	contacts []models.Contact
+	fields   models.FieldDefinitions
+}
+
+// Records writes the contacts by their csv tags and adds the custom fields
+func (t contactsCSV) Records() ([][]string, error) {
+	msg, err := gocsv.MarshalString(t.contacts)
+	if err != nil {
+		return nil, err
+	}
+	records, err := csv.NewReader(strings.NewReader(msg)).ReadAll()
+	if err != nil || len(records) != len(t.contacts)+1 {
+		return nil, fmt.Errorf("failed to write contacts: %v", err)
+	}
+	for _, f := range t.fields {
+		records[0] = append(records[0], customColumnPrefix+f.Key)
+		for i, c := range t.contacts {
+			records[i+1] = append(records[i+1], c.Custom[f.Key])
+		}
+	}
+	return records, nil
+}
+
+// requestLocale is the locale contacts are presented in: the locale query parameter, or the first language the client accepts
+func requestLocale(r *http.Request) string {
+	if locale := r.URL.Query().Get("locale"); locale != "" {
+		return locale
+	}
+	first := strings.SplitN(r.Header.Get("Accept-Language"), ",", 2)[0]
+	return strings.TrimSpace(strings.SplitN(first, ";", 2)[0])
+}
+
+// presentContacts sets the display names of contacts and sorts them by sort name, in the locale of the request
+func presentContacts(names models.NameFormat, r *http.Request, contacts []models.Contact) []models.Contact {
+	names.Present(contacts, requestLocale(r))
+	return contacts
+}
+
+// presentContact sets the display name of a contact in the locale of the request
+func presentContact(names models.NameFormat, r *http.Request, contact *models.Contact) *models.Contact {
+	contact.DisplayName = names.DisplayName(*contact, requestLocale(r))
+	return contact
+}
+
+// decodeTagRequest decodes the name of a tag, or the tag to merge into, from a json body
+func decodeTagRequest(r *http.Request) (tagRequest, error) {
+	var body tagRequest
+	if r.Body == nil {
+		return body, fmt.Errorf("no request body")
+	}
+	defer r.Body.Close()
+	err := json.NewDecoder(r.Body).Decode(&body)
+	return body, err
+}
+
+// decodeContact returns a contact from a json body, normalized and validated
 func decodeContact(r *http.Request) (models.Contact, error) {
 	defer r.Body.Close()
 	var c models.Contact
 	if r.Body == nil {
 		return c, fmt.Errorf("no request body")
 	}
-	err := json.NewDecoder(r.Body).Decode(&c)
-	return c, err
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		return c, err
+	}
+	// photos and attachments are uploaded on their own, and the last contact comes from the timeline
+	c.Photo = nil
+	c.Attachments = nil
+	c.LastContacted = nil
+	c.Normalize()
+	return c, c.Validate()
 }
 
-// decodeContacts returns several contacts from a csv body
+// decodeContacts returns several contacts from a csv body, normalized and validated. x- columns are read as custom fields
 func decodeContacts(r *http.Request) ([]models.Contact, error) {
 	defer r.Body.Close()
 	var c []models.Contact
 	if r.Body == nil {
 		return c, fmt.Errorf("no request body")
 	}
-	err := gocsv.Unmarshal(r.Body, &c)
-	return c, err
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return c, err
+	}
+	if err = gocsv.UnmarshalBytes(body, &c); err != nil {
+		return c, err
+	}
+	records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil || len(records) != len(c)+1 {
+		return c, fmt.Errorf("failed to read custom fields: %v", err)
+	}
+	for column, header := range records[0] {
+		if !strings.HasPrefix(strings.ToLower(header), customColumnPrefix) {
+			continue
+		}
+		for i := range c {
+			if c[i].Custom == nil {
+				c[i].Custom = models.CustomFields{}
+			}
+			c[i].Custom[strings.ToLower(header[len(customColumnPrefix):])] = records[i+1][column]
+		}
+	}
+	for i := range c {
+		c[i].Normalize()
+		if err := c[i].Validate(); err != nil {
+			return c, fmt.Errorf("row %d: %s", i+1, err)
+		}
+	}
+	return c, nil
+}
+
+// isVCardImport checks if an import is vCards, with format=vcard or a text/vcard body
+func isVCardImport(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "vcard" {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "text/vcard" || mediaType == "text/x-vcard" || mediaType == "text/directory"
+}
+
+// decodeVCards returns the contacts of vCards, normalized and validated, and the photos of the cards with usable ones by index
+func (cr *contactRouter) decodeVCards(r *http.Request, fields models.FieldDefinitions) ([]models.Contact, map[int]*photo.Photo, error) {
+	defer r.Body.Close()
+	contacts, photos := []models.Contact{}, map[int]*photo.Photo{}
+	decoder := vcard.NewDecoder(r.Body)
+	for {
+		card, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		c := vcard.ToContact(card, fields)
+		c.Normalize()
+		if err = c.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("card %d: %s", len(contacts)+1, err)
+		}
+		if data, ok := vcard.PhotoData(card); ok {
+			if p, err := photo.Process(data, cr.photoLimits); err == nil {
+				photos[len(contacts)] = p
+			}
+		}
+		contacts = append(contacts, c)
+	}
+	if len(contacts) == 0 {
+		return nil, nil, fmt.Errorf("no vCards in the request body")
+	}
+	return contacts, photos, nil
 }
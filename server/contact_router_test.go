@@ -5,10 +5,17 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gocarina/gocsv"
 
@@ -20,12 +27,21 @@ import (
 	"github.com/Dacode45/addressbook/server"
 
 	"github.com/Dacode45/addressbook/mock"
+	"github.com/Dacode45/addressbook/photo"
 	"github.com/Dacode45/addressbook/storage"
 )
 
 func Test_ContactRouter(t *testing.T) {
 	t.Run("test contact api", should_retrieve_contacts)
 	t.Run("test csv functionality", should_read_csv)
+	t.Run("test labelled contact fields", should_keep_contact_fields)
+	t.Run("test display and sort names", should_sort_by_name)
+	t.Run("test tags", should_tag_contacts)
+	t.Run("test photos", should_manage_photos)
+	t.Run("test avatars", should_render_avatars)
+	t.Run("test attachments", should_manage_attachments)
+	t.Run("test interaction timeline", should_log_interactions)
+	t.Run("test scoped tokens", should_enforce_scopes)
 }
 
 func should_retrieve_contacts(t *testing.T) {
@@ -65,12 +81,13 @@ func should_retrieve_contacts(t *testing.T) {
 	assert.Equal(t, 10, len(fetchedContacts), "Failed to fetched contacts")
 
 	// Test finding one contact
-	res = testEndpoint("GET", fmt.Sprintf("/%s", fetchedContacts[0].ID), nil, cRouter, token)
+	res = testEndpoint("GET", fmt.Sprintf("/%s", fakeContacts[0].ID), nil, cRouter, token)
 	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
 
 	var fetchedContact models.Contact
 	err = json.NewDecoder(res.Body).Decode(&fetchedContact)
 	assert.NoError(t, err, "Failed to parse response")
+	fakeContacts[0].DisplayName = config.NameFormat.DisplayName(fakeContacts[0], "")
 	assert.Equal(t, fakeContacts[0], fetchedContact, "contacts aren't equal")
 
 	// Test creating a new contact
@@ -82,12 +99,15 @@ func should_retrieve_contacts(t *testing.T) {
 	var parsedContact models.Contact
 	err = json.NewDecoder(res.Body).Decode(&parsedContact)
 	newContact.ID = parsedContact.ID
+	newContact.BookID = models.DefaultBookID
+	newContact.DisplayName = config.NameFormat.DisplayName(newContact, "")
 	assert.NoError(t, err, "Failed to parse the response")
 	assert.Equal(t, newContact, parsedContact, "Contacts aren't equal")
 
 	// Test updating contact
 	newContact.FirstName = "test"
 	newContact.LastName = "user"
+	newContact.DisplayName = "test user"
 	newContactStr, _ = json.Marshal(newContact)
 	res = testEndpoint("PUT", fmt.Sprintf("/%s", newContact.ID), bytes.NewBuffer(newContactStr), cRouter, token)
 	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
@@ -137,6 +157,8 @@ func should_read_csv(t *testing.T) {
 	err = json.NewDecoder(res.Body).Decode(&uploadedContacts)
 	assert.NoError(t, err, "Failed to parse response")
 	assert.Equal(t, 10, len(uploadedContacts), "Failed to fetched contacts")
+	assert.Equal(t, models.ContactValues{{Value: "ipsam@Browsebug.edu"}}, uploadedContacts[0].Emails, "The email column should be read as an email")
+	assert.Equal(t, models.ContactValues{{Value: "4-118-596-51-16"}}, uploadedContacts[0].Phones, "The phone column should be read as a phone")
 
 	// Test the download all contacts route
 	res = testEndpoint("GET", "/export", nil, cRouter, token)
@@ -148,6 +170,562 @@ func should_read_csv(t *testing.T) {
 	assert.Equal(t, 10, len(fetchedContacts), "Failed to fetched contacts")
 }
 
+func should_keep_contact_fields(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	user, _ := populateDatabase(uStorage, 0)
+	token, _ := newToken(uStorage, models.Credentials{Username: user.Username})
+	cRouter := server.NewContactRouter(uStorage, config, mux.NewRouter())
+
+	res := testEndpoint("POST", "/", strings.NewReader(`{
+		"first_name": "Ada",
+		"emails": [{"label": "Work", "value": " ada@example.com ", "preferred": true}, {"label": "home", "value": "ada@home.net", "preferred": true}, {"value": ""}],
+		"phones": [{"label": "mobile", "value": "555-0100"}],
+		"addresses": [{"label": "home", "street": "12 Main St", "locality": "Springfield", "region": "IL", "postcode": "62701", "country": "US"}],
+		"organization": "Analytical Engines",
+		"birthday": "--12-10",
+		"urls": ["https://example.com/ada"]
+	}`), cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var ada models.Contact
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&ada), "Failed to parse response")
+	assert.Equal(t, models.ContactValues{
+		{Label: models.LabelWork, Value: "ada@example.com", Preferred: true},
+		{Label: models.LabelHome, Value: "ada@home.net"},
+	}, ada.Emails, "Values should be trimmed, with a single preferred value")
+	assert.Equal(t, "ada@example.com", ada.PreferredEmail(), "Unexpected preferred email")
+
+	for _, invalid := range []string{
+		`{"first_name": "Ada", "birthday": "1815-13-10"}`,
+		`{"first_name": "Ada", "urls": ["javascript:alert(1)"]}`,
+		`{"first_name": "Ada", "phones": [{"label": "a:b", "value": "555-0100"}]}`,
+	} {
+		res = testEndpoint("POST", "/", strings.NewReader(invalid), cRouter, token)
+		assert.Equal(t, http.StatusBadRequest, res.Code, "Invalid contacts should be rejected: %s", invalid)
+	}
+
+	// lists survive an export and import
+	res = testEndpoint("GET", "/export", nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	exported := res.Body.String()
+	assert.Contains(t, exported, "*work:ada@example.com; home:ada@home.net", "Unexpected csv cell")
+	var imported []models.Contact
+	assert.NoError(t, gocsv.UnmarshalString(exported, &imported), "Failed to parse export")
+	assert.Len(t, imported, 1, "Unexpected contact count")
+	ada.BookID = ""
+	assert.Equal(t, ada, imported[0], "Contacts should round trip through csv")
+}
+
+func should_sort_by_name(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	user, _ := populateDatabase(uStorage, 0)
+	token, _ := newToken(uStorage, models.Credentials{Username: user.Username})
+	cRouter := server.NewContactRouter(uStorage, config, mux.NewRouter())
+	for _, contact := range []string{
+		`{"first_name": "Taro", "last_name": "Zed"}`,
+		`{"first_name": "太郎", "last_name": "山田", "phonetic_first_name": "たろう", "phonetic_last_name": "やまだ"}`,
+		`{"prefix": "Dr.", "first_name": "María", "middle_name": "José", "last_name": "García-López", "suffix": "Jr."}`,
+		`{"organization": "Acme"}`,
+	} {
+		res := testEndpoint("POST", "/", strings.NewReader(contact), cRouter, token)
+		assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	}
+
+	displayNames := func(locale string) []string {
+		res := testEndpoint("GET", "/?locale="+locale, nil, cRouter, token)
+		var contacts []models.Contact
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&contacts), "Failed to parse response")
+		names := []string{}
+		for _, c := range contacts {
+			names = append(names, c.DisplayName)
+		}
+		return names
+	}
+	// sorted by family name, or phonetic family name, and names without a family name by what they are displayed as
+	assert.Equal(t, []string{"Acme", "Dr. María José García-López Jr.", "Taro Zed", "山田太郎"}, displayNames("en-US"), "Unexpected names")
+	assert.Equal(t, []string{"Acme", "Dr. García-López María José Jr.", "Zed Taro", "山田太郎"}, displayNames("ja"), "Family names should come first in Japanese")
+
+	res := testEndpoint("GET", "/export", nil, cRouter, token)
+	var exported []models.Contact
+	assert.NoError(t, gocsv.Unmarshal(res.Body, &exported), "Failed to parse export")
+	assert.Len(t, exported, 4, "Unexpected contact count")
+	assert.Equal(t, "Acme", exported[0].DisplayName, "Exports should be sorted with display names")
+}
+
+func should_tag_contacts(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	user, _ := populateDatabase(uStorage, 0)
+	token, _ := newToken(uStorage, models.Credentials{Username: user.Username})
+	cRouter := server.NewContactRouter(uStorage, config, mux.NewRouter())
+	ids := map[string]string{}
+	for name, tags := range map[string]string{"Ada": `["VIP", " customer  ", "vip"]`, "Grace": `["customer"]`, "Linus": `[]`} {
+		res := testEndpoint("POST", "/", strings.NewReader(fmt.Sprintf(`{"first_name": %q, "tags": %s}`, name, tags)), cRouter, token)
+		assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+		var c models.Contact
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&c), "Failed to parse response")
+		ids[name] = c.ID
+	}
+	res := testEndpoint("POST", "/", strings.NewReader(`{"first_name": "Bad", "tags": ["a/b"]}`), cRouter, token)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Tags should be checked")
+
+	tags := func() []models.Tag {
+		res := testEndpoint("GET", "/tags", nil, cRouter, token)
+		assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+		var tags []models.Tag
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&tags), "Failed to parse response")
+		return tags
+	}
+	names := func(query string) []string {
+		res := testEndpoint("GET", "/"+query, nil, cRouter, token)
+		assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+		var found []models.Contact
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&found), "Failed to parse response")
+		names := []string{}
+		for _, c := range found {
+			names = append(names, c.FirstName)
+		}
+		return names
+	}
+	assert.Equal(t, []models.Tag{{Name: "customer", Count: 2}, {Name: "VIP", Count: 1}}, tags(), "Tags should be counted once per contact")
+	assert.Equal(t, []string{"Ada"}, names("?tag=customer&tag=vip"), "Tags should all match by default")
+	assert.Equal(t, []string{"Ada", "Grace"}, names("?tag=vip&tag=customer&tag_mode=any"), "Any tag should match with tag_mode=any")
+
+	// bulk tagging
+	res = testEndpoint("POST", "/tags/bulk", strings.NewReader(fmt.Sprintf(`{"contact_ids": [%q, %q], "add": ["lead"], "remove": ["customer"]}`, ids["Grace"], ids["Linus"])), cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.Equal(t, []string{"Grace", "Linus"}, names("?tag=lead"), "Bulk tags should be added")
+	assert.Equal(t, []string{"Ada"}, names("?tag=customer"), "Bulk tags should be removed")
+	res = testEndpoint("POST", "/tags/bulk", strings.NewReader(`{"contact_ids": ["nope"], "add": ["lead"]}`), cRouter, token)
+	assert.Equal(t, http.StatusNotFound, res.Code, "Unknown contacts should not be tagged")
+
+	// renaming and merging cascade to the contacts
+	res = testEndpoint("PUT", "/tags/lead", strings.NewReader(`{"name": "VIP"}`), cRouter, token)
+	assert.Equal(t, http.StatusConflict, res.Code, "Renaming to another tag should conflict")
+	res = testEndpoint("PUT", "/tags/lead", strings.NewReader(`{"name": "prospect"}`), cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.Equal(t, []string{"Grace", "Linus"}, names("?tag=prospect"), "Renames should cascade")
+	res = testEndpoint("POST", "/tags/prospect/merge", strings.NewReader(`{"into": "vip"}`), cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.Equal(t, []models.Tag{{Name: "customer", Count: 1}, {Name: "VIP", Count: 3}}, tags(), "Merges should cascade")
+
+	// tags can exist without contacts until they are deleted
+	res = testEndpoint("POST", "/tags", strings.NewReader(`{"name": "partner"}`), cRouter, token)
+	assert.Equal(t, http.StatusCreated, res.Code, "Created response is expected")
+	res = testEndpoint("DELETE", "/tags/vip", nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.Equal(t, []models.Tag{{Name: "customer", Count: 1}, {Name: "partner", Count: 0}}, tags(), "Deleted tags should be gone from contacts")
+	res = testEndpoint("DELETE", "/tags/vip", nil, cRouter, token)
+	assert.Equal(t, http.StatusNotFound, res.Code, "Deleted tags should not be found")
+}
+
+func should_enforce_scopes(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	fakeUser, _ := populateDatabase(uStorage, 1)
+
+	cRouter := server.NewContactRouter(uStorage, config, mux.NewRouter())
+	uRouter := server.NewUserRouter(uStorage, config, mux.NewRouter())
+
+	// login asking only for read access
+	creds, _ := json.Marshal(models.Credentials{
+		Username: fakeUser.Username,
+		Password: fakeUser.Password,
+		Scopes:   []models.Scope{models.ScopeContactsRead},
+	})
+	req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(creds))
+	res := httptest.NewRecorder()
+	uRouter.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+
+	var token server.JWTToken
+	err := json.NewDecoder(res.Body).Decode(&token)
+	assert.NoError(t, err, "Failed to parse response")
+
+	res = testEndpoint("GET", "/", nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+
+	newContactStr, _ := json.Marshal(mock.FakeContacts(1)[0])
+	res = testEndpoint("POST", "/", bytes.NewBuffer(newContactStr), cRouter, token)
+	assert.Equal(t, http.StatusForbidden, res.Code, "Forbidden response is expected")
+
+	var details struct {
+		Code    string
+		Details map[string][]models.Scope
+	}
+	err = json.NewDecoder(res.Body).Decode(&details)
+	assert.NoError(t, err, "Failed to parse response")
+	assert.Equal(t, "insufficient_scope", details.Code, "Unexpected error code")
+	assert.Equal(t, []models.Scope{models.ScopeContactsWrite}, details.Details["missing_scopes"], "Unexpected missing scopes")
+
+	// unknown scopes are rejected at login
+	creds, _ = json.Marshal(models.Credentials{
+		Username: fakeUser.Username,
+		Password: fakeUser.Password,
+		Scopes:   []models.Scope{"contacts:everything"},
+	})
+	req, _ = http.NewRequest("POST", "/login", bytes.NewBuffer(creds))
+	res = httptest.NewRecorder()
+	uRouter.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Bad request response is expected")
+}
+
+func should_manage_photos(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	photoConfig := config
+	photoConfig.Blobs = storage.NewFSBlobStore(t.TempDir())
+	user, contacts := populateDatabase(uStorage, 2)
+	token, _ := newToken(uStorage, models.Credentials{Username: user.Username})
+	cRouter := server.NewContactRouter(uStorage, photoConfig, mux.NewRouter())
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for x := 0; x < 64; x++ {
+		img.Set(x, x%48, color.RGBA{0, 0, 255, 255})
+	}
+	var upload bytes.Buffer
+	assert.NoError(t, png.Encode(&upload, img), "Encode failed")
+
+	res := testEndpoint("PUT", "/"+contacts[0].ID+"/photo", strings.NewReader("not a photo"), cRouter, token)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Only images are accepted")
+	res = testEndpoint("PUT", "/"+contacts[0].ID+"/photo", bytes.NewReader(upload.Bytes()), cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var uploaded models.ContactPhoto
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&uploaded), "Failed to parse response")
+	assert.Equal(t, "image/png", uploaded.ContentType, "Unexpected content type")
+	assert.Equal(t, 64, uploaded.Width, "Unexpected width")
+
+	// updating a contact keeps its photo
+	update, _ := json.Marshal(contacts[0])
+	res = testEndpoint("PUT", "/"+contacts[0].ID, bytes.NewReader(update), cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("GET", "/"+contacts[0].ID, nil, cRouter, token)
+	var found models.Contact
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&found), "Failed to parse response")
+	assert.NotNil(t, found.Photo, "Updates should keep the photo")
+
+	res = testEndpoint("GET", "/"+contacts[0].ID+"/photo", nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.Equal(t, "image/png", res.Header().Get("Content-Type"), "Unexpected content type")
+	req, _ := http.NewRequest("GET", "/"+contacts[0].ID+"/photo", nil)
+	req.Header.Set("authorization", fmt.Sprintf("Bearer %s", token.Token))
+	req.Header.Set("If-None-Match", res.Header().Get("ETag"))
+	cached := httptest.NewRecorder()
+	cRouter.ServeHTTP(cached, req)
+	assert.Equal(t, http.StatusNotModified, cached.Code, "Unchanged photos should be revalidated")
+
+	res = testEndpoint("GET", "/"+contacts[0].ID+"/photo?size=64", nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	thumbnail, format, err := image.DecodeConfig(res.Body)
+	assert.NoError(t, err, "Thumbnails should decode")
+	assert.Equal(t, "jpeg", format, "Thumbnails are JPEGs")
+	assert.Equal(t, 64, thumbnail.Width, "Unexpected thumbnail size")
+	res = testEndpoint("GET", "/"+contacts[0].ID+"/photo?size=50", nil, cRouter, token)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Thumbnails are only made in some sizes")
+
+	// photos are exported and imported with vCards
+	res = testEndpoint("GET", "/export?format=vcard", nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.Contains(t, res.Body.String(), "PHOTO:data:image/jpeg;base64,", "Photos should be exported")
+	res = testEndpoint("POST", "/import?format=vcard", strings.NewReader(res.Body.String()), cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var imported []models.Contact
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&imported), "Failed to parse response")
+	photos := 0
+	for _, c := range imported {
+		if c.Photo != nil {
+			photos++
+		}
+	}
+	assert.Equal(t, 1, photos, "Imported photos should be kept")
+
+	// removing the photo deletes it once no contact has it
+	res = testEndpoint("DELETE", "/"+contacts[0].ID+"/photo", nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("GET", "/"+contacts[0].ID+"/photo", nil, cRouter, token)
+	assert.Equal(t, http.StatusNotFound, res.Code, "Not found response is expected")
+	_, err = photoConfig.Blobs.Get(context.Background(), "photos/"+uploaded.Hash[:2]+"/"+uploaded.Hash)
+	assert.Equal(t, storage.ErrBlobNotFound, err, "Unused photos should be deleted")
+
+	photoConfig.PhotoLimits = &photo.Limits{MaxBytes: 100, MaxDimension: 4096, MinDimension: 16}
+	cRouter = server.NewContactRouter(uStorage, photoConfig, mux.NewRouter())
+	res = testEndpoint("PUT", "/"+contacts[1].ID+"/photo", bytes.NewReader(upload.Bytes()), cRouter, token)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code, "Photos above the limit should be rejected")
+}
+
+func should_render_avatars(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	user, contacts := populateDatabase(uStorage, 1)
+	token, _ := newToken(uStorage, models.Credentials{Username: user.Username})
+	cRouter := server.NewContactRouter(uStorage, config, mux.NewRouter())
+	contact := contacts[0]
+	contact.Prefix, contact.FirstName, contact.LastName = "Dr", "ada", "Lovelace"
+	update, _ := json.Marshal(contact)
+	res := testEndpoint("PUT", "/"+contact.ID, bytes.NewReader(update), cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+
+	res = testEndpoint("GET", "/"+contact.ID+"/avatar", nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.Equal(t, "image/svg+xml", res.Header().Get("Content-Type"), "Avatars are SVGs by default")
+	assert.Contains(t, res.Body.String(), ">AL</text>", "Avatars show the initials without honorifics")
+	assert.Contains(t, res.Body.String(), photo.NewAvatar(contact.ID, "").Hex(), "The color should follow the contact id")
+	assert.NotEmpty(t, res.Header().Get("Cache-Control"), "Avatars should be cacheable")
+	req, _ := http.NewRequest("GET", "/"+contact.ID+"/avatar", nil)
+	req.Header.Set("authorization", fmt.Sprintf("Bearer %s", token.Token))
+	req.Header.Set("If-None-Match", res.Header().Get("ETag"))
+	cached := httptest.NewRecorder()
+	cRouter.ServeHTTP(cached, req)
+	assert.Equal(t, http.StatusNotModified, cached.Code, "Unchanged avatars should be revalidated")
+
+	res = testEndpoint("GET", "/"+contact.ID+"/avatar?format=png&size=64", nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	avatar, format, err := image.DecodeConfig(res.Body)
+	assert.NoError(t, err, "Avatars should decode")
+	assert.Equal(t, "png", format, "Unexpected format")
+	assert.Equal(t, 64, avatar.Width, "Unexpected avatar size")
+	res = testEndpoint("GET", "/"+contact.ID+"/avatar?format=gif", nil, cRouter, token)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Avatars are SVGs or PNGs")
+
+	res = testEndpoint("GET", "/export?format=vcard&avatars=true", nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.Contains(t, res.Body.String(), "PHOTO:data:image/png;base64,", "Avatars should be exported when asked for")
+}
+
+func should_manage_attachments(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	attachmentConfig := config
+	attachmentConfig.Blobs = storage.NewMemoryBlobStore()
+	attachmentConfig.AttachmentLimits = server.AttachmentLimits{MaxBytes: 64, Quota: 100}
+	user, contacts := populateDatabase(uStorage, 2)
+	token, _ := newToken(uStorage, models.Credentials{Username: user.Username})
+	cRouter := server.NewContactRouter(uStorage, attachmentConfig, mux.NewRouter())
+	nda := "%PDF-1.4 signed non disclosure agreement"
+
+	res := testEndpoint("POST", "/"+contacts[0].ID+"/attachments?filename=../nda.pdf", strings.NewReader(nda), cRouter, token)
+	assert.Equal(t, http.StatusCreated, res.Code, "Created response is expected")
+	var attachment models.Attachment
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&attachment), "Failed to parse response")
+	assert.Equal(t, "nda.pdf", attachment.Filename, "Paths should be dropped from filenames")
+	assert.Equal(t, "application/pdf", attachment.ContentType, "The content type should be sniffed")
+	assert.Equal(t, int64(len(nda)), attachment.Size, "Unexpected size")
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	part, _ := writer.CreateFormFile("file", "card.txt")
+	part.Write([]byte("Ada Lovelace, Analytical Engines"))
+	writer.Close()
+	req, _ := http.NewRequest("POST", "/"+contacts[0].ID+"/attachments", &form)
+	req.Header.Set("authorization", fmt.Sprintf("Bearer %s", token.Token))
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	res = httptest.NewRecorder()
+	cRouter.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusCreated, res.Code, "Multipart uploads should be accepted")
+
+	res = testEndpoint("GET", "/"+contacts[0].ID+"/attachments", nil, cRouter, token)
+	var attachments []models.Attachment
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&attachments), "Failed to parse response")
+	assert.Len(t, attachments, 2, "Both files should be attached")
+
+	// downloads are streamed, and parts of them can be asked for
+	res = testEndpoint("GET", "/"+contacts[0].ID+"/attachments/"+attachment.ID, nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.Equal(t, nda, res.Body.String(), "The file should be downloaded")
+	assert.Equal(t, "application/pdf", res.Header().Get("Content-Type"), "Unexpected content type")
+	assert.Equal(t, `attachment; filename=nda.pdf`, res.Header().Get("Content-Disposition"), "Files should be downloaded")
+	req, _ = http.NewRequest("GET", "/"+contacts[0].ID+"/attachments/"+attachment.ID, nil)
+	req.Header.Set("authorization", fmt.Sprintf("Bearer %s", token.Token))
+	req.Header.Set("Range", "bytes=0-3")
+	res = httptest.NewRecorder()
+	cRouter.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusPartialContent, res.Code, "Ranges should be served")
+	assert.Equal(t, "%PDF", res.Body.String(), "Unexpected range")
+
+	res = testEndpoint("POST", "/"+contacts[1].ID+"/attachments", strings.NewReader(strings.Repeat("a", 65)), cRouter, token)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code, "Files above the limit should be rejected")
+	res = testEndpoint("POST", "/"+contacts[1].ID+"/attachments", strings.NewReader(strings.Repeat("a", 60)), cRouter, token)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code, "Files above the quota should be rejected")
+	assert.Contains(t, res.Body.String(), "attachment_quota", "Unexpected error code")
+	res = testEndpoint("POST", "/"+contacts[1].ID+"/attachments", strings.NewReader(""), cRouter, token)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Empty files should be rejected")
+
+	// concurrent uploads can't both take the last of the quota
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- uStorage.AddAttachment(ctx, user.Username, models.DefaultBookID, contacts[1].ID, models.Attachment{ID: fmt.Sprintf("concurrent-%d", i), Size: 20}, 100)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	added := 0
+	for err := range errs {
+		if err == nil {
+			added++
+		} else {
+			assert.Equal(t, storage.ErrAttachmentQuota, err, "Unexpected error")
+		}
+	}
+	assert.Equal(t, 1, added, "Only one upload should fit in the quota")
+
+	// contacts moved to another user's book count against their quota
+	friend, friendContacts := populateDatabase(uStorage, 1)
+	err := uStorage.AddAttachment(ctx, friend.Username, models.DefaultBookID, friendContacts[0].ID, models.Attachment{ID: "friend", Size: 90}, 100)
+	assert.NoError(t, err, "Failed to attach file")
+	shared, err := uStorage.CreateBook(ctx, friend.Username, models.Book{Name: "Shared"})
+	assert.NoError(t, err, "Failed to create book")
+	assert.NoError(t, uStorage.ShareBook(ctx, friend.Username, shared.ID, models.BookShare{Username: user.Username, Permission: models.BookEdit}), "Failed to share book")
+	bRouter := server.NewBookRouter(uStorage, attachmentConfig, mux.NewRouter())
+	res = testEndpoint("POST", fmt.Sprintf("/%s/contacts/%s/move", models.DefaultBookID, contacts[0].ID), strings.NewReader(fmt.Sprintf(`{"book_id": %q}`, shared.ID)), bRouter, token)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code, "Moves above the other user's quota should be rejected")
+	assert.Contains(t, res.Body.String(), "attachment_quota", "Unexpected error code")
+	res = testEndpoint("GET", "/"+contacts[0].ID, nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "Rejected moves should keep the contact")
+
+	// copies count again, in another user's book or the user's own
+	res = testEndpoint("POST", fmt.Sprintf("/%s/contacts/%s/copy", models.DefaultBookID, contacts[0].ID), strings.NewReader(fmt.Sprintf(`{"book_id": %q}`, shared.ID)), bRouter, token)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code, "Copies above the other user's quota should be rejected")
+	assert.Contains(t, res.Body.String(), "attachment_quota", "Unexpected error code")
+	res = testEndpoint("POST", fmt.Sprintf("/%s/contacts/%s/copy", models.DefaultBookID, contacts[0].ID), strings.NewReader(fmt.Sprintf(`{"book_id": %q}`, models.DefaultBookID)), bRouter, token)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code, "Copies above the user's own quota should be rejected")
+	res = testEndpoint("GET", "/", nil, cRouter, token)
+	var all []models.Contact
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&all), "Failed to parse response")
+	assert.Len(t, all, 2, "Rejected copies should not be added")
+
+	// files are deleted with their attachment or contact
+	res = testEndpoint("DELETE", "/"+contacts[0].ID+"/attachments/"+attachment.ID, nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("GET", "/"+contacts[0].ID+"/attachments/"+attachment.ID, nil, cRouter, token)
+	assert.Equal(t, http.StatusNotFound, res.Code, "Not found response is expected")
+	_, err = attachmentConfig.Blobs.Get(context.Background(), "attachments/"+attachment.ID[:2]+"/"+attachment.ID)
+	assert.Equal(t, storage.ErrBlobNotFound, err, "Removed attachments should be deleted")
+	res = testEndpoint("DELETE", "/"+contacts[0].ID, nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	_, err = attachmentConfig.Blobs.Get(context.Background(), "attachments/"+attachments[1].ID[:2]+"/"+attachments[1].ID)
+	assert.Equal(t, storage.ErrBlobNotFound, err, "Attachments of deleted contacts should be deleted")
+}
+
+func should_log_interactions(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	user, contacts := populateDatabase(uStorage, 3)
+	token, _ := newToken(uStorage, models.Credentials{Username: user.Username})
+	cRouter := server.NewContactRouter(uStorage, config, mux.NewRouter())
+	logInteraction := func(contactID string, interaction map[string]interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(interaction)
+		return testEndpoint("POST", "/"+contactID+"/interactions", bytes.NewReader(body), cRouter, token)
+	}
+
+	call := time.Now().AddDate(0, 0, -40).UTC().Truncate(time.Second)
+	res := logInteraction(contacts[0].ID, map[string]interface{}{"kind": "call", "at": call, "text": "Intro call", "links": []string{contacts[1].ID}})
+	assert.Equal(t, http.StatusCreated, res.Code, "Created response is expected")
+	var logged models.Interaction
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&logged), "Failed to parse response")
+	assert.Equal(t, user.Username, logged.Author, "The author should be the user")
+	res = logInteraction(contacts[0].ID, map[string]interface{}{"kind": "note", "text": "Prefers email"})
+	assert.Equal(t, http.StatusCreated, res.Code, "Created response is expected")
+	res = logInteraction(contacts[2].ID, map[string]interface{}{"kind": "meeting", "at": time.Now().AddDate(0, 0, -2)})
+	assert.Equal(t, http.StatusCreated, res.Code, "Created response is expected")
+	res = logInteraction(contacts[2].ID, map[string]interface{}{"kind": "fax"})
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Unknown kinds should be rejected")
+	res = logInteraction(contacts[2].ID, map[string]interface{}{"kind": "call", "links": []string{"5a1b2c3d4e5f6a7b8c9d0e1f"}})
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Links should be contacts of the book")
+
+	// timelines are newest first, and show the interactions linking the contact
+	res = testEndpoint("GET", "/"+contacts[0].ID+"/interactions?limit=1", nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var page models.InteractionPage
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&page), "Failed to parse response")
+	assert.Equal(t, 2, page.Total, "Unexpected timeline length")
+	assert.Len(t, page.Interactions, 1, "Timelines should be paginated")
+	assert.Equal(t, models.InteractionNote, page.Interactions[0].Kind, "Timelines should be newest first")
+	res = testEndpoint("GET", "/"+contacts[1].ID+"/interactions", nil, cRouter, token)
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&page), "Failed to parse response")
+	assert.Equal(t, 1, page.Total, "Linked interactions should be on the timeline")
+
+	// notes don't count as contacting someone
+	res = testEndpoint("GET", "/"+contacts[0].ID, nil, cRouter, token)
+	var found models.Contact
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&found), "Failed to parse response")
+	if assert.NotNil(t, found.LastContacted, "The last contact should be set") {
+		assert.True(t, call.Equal(*found.LastContacted), "The last contact should be the call")
+	}
+
+	res = testEndpoint("GET", "/?not_contacted_days=30", nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var stale []models.Contact
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&stale), "Failed to parse response")
+	ids := []string{}
+	for _, c := range stale {
+		ids = append(ids, c.ID)
+	}
+	assert.ElementsMatch(t, []string{contacts[0].ID, contacts[1].ID}, ids, "Contacts met recently should be left out")
+	res = testEndpoint("GET", "/?not_contacted_days=soon", nil, cRouter, token)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Days should be a number")
+
+	// users a book is shared with don't see the interactions of contacts in other books
+	ctx := context.Background()
+	friend, _ := populateDatabase(uStorage, 0)
+	friendToken, _ := newToken(uStorage, models.Credentials{Username: friend.Username})
+	shared, err := uStorage.CreateBook(ctx, user.Username, models.Book{Name: "Shared"})
+	assert.NoError(t, err, "Failed to create book")
+	assert.NoError(t, uStorage.ShareBook(ctx, user.Username, shared.ID, models.BookShare{Username: friend.Username, Permission: models.BookRead}), "Failed to share book")
+	assert.NoError(t, uStorage.MoveContact(ctx, user.Username, models.DefaultBookID, contacts[1].ID, shared.ID, 1<<30), "Failed to move contact")
+	bRouter := server.NewBookRouter(uStorage, config, mux.NewRouter())
+	res = testEndpoint("GET", fmt.Sprintf("/%s/contacts/%s/interactions", shared.ID, contacts[1].ID), nil, bRouter, friendToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&page), "Failed to parse response")
+	assert.Equal(t, 0, page.Total, "Interactions from other books should be left out")
+	res = testEndpoint("GET", fmt.Sprintf("/%s/contacts/%s", shared.ID, contacts[1].ID), nil, bRouter, friendToken)
+	found = models.Contact{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&found), "Failed to parse response")
+	assert.Nil(t, found.LastContacted, "Interactions from other books should not set the last contact")
+
+	res = testEndpoint("DELETE", "/"+contacts[0].ID+"/interactions/"+logged.ID, nil, cRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("DELETE", "/"+contacts[0].ID+"/interactions/"+logged.ID, nil, cRouter, token)
+	assert.Equal(t, http.StatusNotFound, res.Code, "Not found response is expected")
+}
+
 func testEndpoint(method string, url string, body io.Reader, router *mux.Router, token server.JWTToken) *httptest.ResponseRecorder {
 	req, _ := http.NewRequest(method, url, body)
 	req.Header.Set("authorization", fmt.Sprintf("Bearer %s", token.Token))
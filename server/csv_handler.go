@@ -1,6 +1,8 @@
 package server
 
 import (
+	"bytes"
+	"encoding/csv"
 	"fmt"
 	"net/http"
 
@@ -10,10 +12,17 @@ import (
 // CSVHandler serves responses as csv files. Status code can be set at compile time
 type CSVHandler int
 
-// Serve serves a payload as the filename. It sets Content-Type and Content-Disposition so that files get downloaded
+// CSVRecords is a payload whose columns aren't known at compile time, like the custom fields of contacts
+type CSVRecords interface {
+	// Records are the rows of the file, starting with the header
+	Records() ([][]string, error)
+}
+
+// Serve serves a payload as the filename. It sets Content-Type and Content-Disposition so that files get downloaded.
+// Payloads are marshaled by their csv tags, or written as their Records
 func (c CSVHandler) Serve(filename string, payload interface{}) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		msg, err := gocsv.MarshalString(payload)
+		msg, err := marshalCSV(payload)
 		if err != nil {
 			ServerErrorHandler.Serve(w, r)
 			return
@@ -25,3 +34,21 @@ func (c CSVHandler) Serve(filename string, payload interface{}) http.HandlerFunc
 		w.Write([]byte(msg))
 	}
 }
+
+// marshalCSV writes a payload as csv
+func marshalCSV(payload interface{}) (string, error) {
+	table, ok := payload.(CSVRecords)
+	if !ok {
+		return gocsv.MarshalString(payload)
+	}
+	records, err := table.Records()
+	if err != nil {
+		return "", err
+	}
+	var msg bytes.Buffer
+	writer := csv.NewWriter(&msg)
+	if err = writer.WriteAll(records); err != nil {
+		return "", err
+	}
+	return msg.String(), nil
+}
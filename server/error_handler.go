@@ -7,8 +7,11 @@ import (
 // ErrorHandler provides a consistent way of sending errors as json
 type ErrorHandler int
 
-// Serve serves an error in the format {"error": "<error>"}
+// Serve serves an error in the format {"error": "<error>"}. ErrorDetails are served with their code and details
 func (e ErrorHandler) Serve(err error) http.HandlerFunc {
+	if details, ok := err.(ErrorDetails); ok {
+		return e.ServeDetails(details)
+	}
 	handler := JSONHandler(e)
 	return handler.Serve(map[string]string{"error": err.Error()})
 }
@@ -22,4 +25,28 @@ var (
 	StatusNotFound = ErrorHandler(http.StatusNotFound)
 	// StatusUnauthorized sets the StatusUnauthorized
 	StatusUnauthorized = ErrorHandler(http.StatusUnauthorized)
+	// StatusForbidden sets the StatusForbidden
+	StatusForbidden = ErrorHandler(http.StatusForbidden)
+	// StatusConflict sets the StatusConflict
+	StatusConflict = ErrorHandler(http.StatusConflict)
+	// StatusRequestEntityTooLarge sets the StatusRequestEntityTooLarge
+	StatusRequestEntityTooLarge = ErrorHandler(http.StatusRequestEntityTooLarge)
 )
+
+// ErrorDetails is an error with a machine readable code, and optionally more information for clients to act on
+type ErrorDetails struct {
+	Message string      `json:"error"`
+	Code    string      `json:"code"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Error satisfies the error interface
+func (e ErrorDetails) Error() string {
+	return e.Message
+}
+
+// ServeDetails serves a detailed error in the format {"error": "<error>", "code": "<code>", "details": <details>}
+func (e ErrorHandler) ServeDetails(err ErrorDetails) http.HandlerFunc {
+	handler := JSONHandler(e)
+	return handler.Serve(err)
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/storage"
+	"github.com/Dacode45/addressbook/vcard"
+	"github.com/gorilla/mux"
+)
+
+// maxContactGroupNameLength bounds the names of groups of contacts
+const maxContactGroupNameLength = 100
+
+type groupRouter struct {
+	userStorage storage.UserStorage
+	jwtCoder    *JWTCoder
+	names       models.NameFormat
+}
+
+// NewGroupRouter generates a router for groups of the user's contacts, which can be expanded to mailing lists
+func NewGroupRouter(u storage.UserStorage, config ServerConfig, router *mux.Router) *mux.Router {
+	jwtCoder := NewJWTCoder(config.JWTSecret)
+	audit := config.auditLog()
+	gr := groupRouter{u, jwtCoder, config.NameFormat}
+
+	router.HandleFunc("/", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(gr.AllGroupsHandler, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(gr.CreateGroupHandler, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/{group}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(gr.FindGroupHandler, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{group}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(gr.UpdateGroupHandler, models.ScopeContactsWrite))).Methods("PUT")
+	router.HandleFunc("/{group}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(gr.DeleteGroupHandler, models.ScopeContactsWrite))).Methods("DELETE")
+	router.HandleFunc("/{group}/expand", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(gr.ExpandGroupHandler, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{group}/export", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(gr.ExportGroupHandler, models.ScopeContactsExport))).Methods("GET")
+	return router
+}
+
+// AllGroupsHandler lists the user's groups of contacts
+func (gr *groupRouter) AllGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	groups, err := gr.userStorage.FindContactGroups(ctx, user.Username)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(groups)(w, r)
+}
+
+// FindGroupHandler gets the group in the url
+func (gr *groupRouter) FindGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	groups, err := gr.userStorage.FindContactGroups(ctx, user.Username)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	group, ok := findContactGroup(groups, mux.Vars(r)["group"])
+	if !ok {
+		StatusNotFound.Serve(storage.ErrContactGroupNotFound)(w, r)
+		return
+	}
+	StatusOK.Serve(group)(w, r)
+}
+
+// CreateGroupHandler creates a group of contacts from a json body
+func (gr *groupRouter) CreateGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	group, err := gr.decodeGroup(ctx, r, user.Username, "")
+	if err != nil {
+		serveGroupError(err)(w, r)
+		return
+	}
+	created, err := gr.userStorage.CreateContactGroup(ctx, user.Username, group)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusCreated.Serve(created)(w, r)
+}
+
+// UpdateGroupHandler renames the group in the url and replaces its contacts and nested groups
+func (gr *groupRouter) UpdateGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	group, err := gr.decodeGroup(ctx, r, user.Username, mux.Vars(r)["group"])
+	if err != nil {
+		serveGroupError(err)(w, r)
+		return
+	}
+	if err = gr.userStorage.UpdateContactGroup(ctx, user.Username, group); err != nil {
+		serveGroupError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(group)(w, r)
+}
+
+// DeleteGroupHandler deletes the group in the url. Its contacts are kept, and it is taken out of the groups it was nested in
+func (gr *groupRouter) DeleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	if err := gr.userStorage.DeleteContactGroup(ctx, user.Username, mux.Vars(r)["group"]); err != nil {
+		serveGroupError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// ExpandGroupHandler flattens the group in the url and its nested groups to the emails of their contacts, each listed once
+func (gr *groupRouter) ExpandGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	_, expansion, err := gr.expand(ctx, r, user.Username)
+	if err != nil {
+		serveGroupError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(expansion)(w, r)
+}
+
+// ExportGroupHandler exports the expanded group in the url as a vCard of KIND group, or with format=mailto as a mailto: link,
+// or with format=rfc5322 as an address list like "Ada Lovelace" <ada@example.com>, Grace Hopper <grace@example.com>
+func (gr *groupRouter) ExportGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "vcard" && format != "mailto" && format != "rfc5322" {
+		StatusBadRequest.Serve(fmt.Errorf("format must be vcard, mailto or rfc5322"))(w, r)
+		return
+	}
+	group, expansion, err := gr.expand(ctx, r, user.Username)
+	if err != nil {
+		serveGroupError(err)(w, r)
+		return
+	}
+	switch format {
+	case "mailto":
+		emails := make([]string, len(expansion.Emails))
+		for i, email := range expansion.Emails {
+			emails[i] = url.PathEscape(email)
+		}
+		StatusOKText.Serve("mailto:"+strings.Join(emails, ","))(w, r)
+	case "rfc5322":
+		StatusOKText.Serve(strings.Join(expansion.Recipients, ", "))(w, r)
+	default:
+		StatusOKVCard.Serve("group.vcf", []vcard.Card{vcard.FromGroup(group.ID, group.Name, expansion.Emails)})(w, r)
+	}
+}
+
+// expand finds the group in the url and flattens it to the emails of its contacts
+func (gr *groupRouter) expand(ctx context.Context, r *http.Request, username string) (models.ContactGroup, models.GroupExpansion, error) {
+	expansion := models.GroupExpansion{Emails: []string{}, Recipients: []string{}, WithoutEmail: []string{}}
+	groups, err := gr.userStorage.FindContactGroups(ctx, username)
+	if err != nil {
+		return models.ContactGroup{}, expansion, err
+	}
+	group, ok := findContactGroup(groups, mux.Vars(r)["group"])
+	if !ok {
+		return group, expansion, storage.ErrContactGroupNotFound
+	}
+	ids, err := models.ExpandGroup(groups, group.ID)
+	if err != nil {
+		return group, expansion, err
+	}
+	contacts, err := gr.userStorage.FindAllContacts(ctx, username)
+	if err != nil {
+		return group, expansion, err
+	}
+	byID := map[string]models.Contact{}
+	for _, c := range presentContacts(gr.names, r, contacts) {
+		byID[c.ID] = c
+	}
+
+	expansion.GroupID = group.ID
+	seen := map[string]bool{}
+	for _, id := range ids {
+		// contacts deleted since they were added are skipped
+		c, ok := byID[id]
+		if !ok {
+			continue
+		}
+		email := c.PreferredEmail()
+		if email == "" {
+			expansion.WithoutEmail = append(expansion.WithoutEmail, c.ID)
+			continue
+		}
+		if seen[strings.ToLower(email)] {
+			continue
+		}
+		seen[strings.ToLower(email)] = true
+		name := c.DisplayName
+		if name == email {
+			name = ""
+		}
+		expansion.Emails = append(expansion.Emails, email)
+		expansion.Recipients = append(expansion.Recipients, (&mail.Address{Name: name, Address: email}).String())
+	}
+	return group, expansion, nil
+}
+
+// decodeGroup decodes a group of contacts from a json body and checks its contacts are the user's and its nested groups
+// exist and don't contain it. id is the group being updated
+func (gr *groupRouter) decodeGroup(ctx context.Context, r *http.Request, username string, id string) (models.ContactGroup, error) {
+	var group models.ContactGroup
+	if r.Body == nil {
+		return group, errBadGroup(fmt.Errorf("no request body"))
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		return group, errBadGroup(err)
+	}
+	group.ID = id
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" || len(group.Name) > maxContactGroupNameLength {
+		return group, errBadGroup(fmt.Errorf("name must be between 1 and %d characters", maxContactGroupNameLength))
+	}
+
+	contacts, err := gr.userStorage.FindAllContacts(ctx, username)
+	if err != nil {
+		return group, err
+	}
+	owned := map[string]bool{}
+	for _, c := range contacts {
+		owned[c.ID] = true
+	}
+	group.Contacts = uniqueStrings(group.Contacts)
+	for _, c := range group.Contacts {
+		if !owned[c] {
+			return group, errBadGroup(fmt.Errorf("no contact with the id %s", c))
+		}
+	}
+
+	groups, err := gr.userStorage.FindContactGroups(ctx, username)
+	if err != nil {
+		return group, err
+	}
+	existing, ok := findContactGroup(groups, id)
+	if id != "" && !ok {
+		return group, storage.ErrContactGroupNotFound
+	}
+	group.CreatedAt = existing.CreatedAt
+	group.Groups = uniqueStrings(group.Groups)
+	for _, nested := range group.Groups {
+		if _, ok := findContactGroup(groups, nested); !ok {
+			return group, errBadGroup(fmt.Errorf("no group with the id %s", nested))
+		}
+	}
+	// checks the group as it would be saved doesn't contain itself
+	if id != "" {
+		for i := range groups {
+			if groups[i].ID == id {
+				groups[i] = group
+			}
+		}
+		if _, err = models.ExpandGroup(groups, id); err != nil {
+			return group, errBadGroup(err)
+		}
+	}
+	return group, nil
+}
+
+// badGroupError is a group of contacts that can't be saved
+type badGroupError struct {
+	err error
+}
+
+func (e badGroupError) Error() string {
+	return e.err.Error()
+}
+
+// errBadGroup marks an error as a bad request
+func errBadGroup(err error) error {
+	return badGroupError{err}
+}
+
+// serveGroupError serves errors about groups of contacts with a fitting status
+func serveGroupError(err error) http.HandlerFunc {
+	switch err.(type) {
+	case badGroupError:
+		return StatusBadRequest.Serve(err)
+	case models.GroupCycleError:
+		return StatusConflict.Serve(err)
+	}
+	if err == storage.ErrContactGroupNotFound {
+		return StatusNotFound.Serve(err)
+	}
+	return StatusInternalServerError.Serve(err)
+}
+
+// findContactGroup finds a group of contacts by id
+func findContactGroup(groups []models.ContactGroup, id string) (models.ContactGroup, bool) {
+	for _, g := range groups {
+		if g.ID == id {
+			return g, true
+		}
+	}
+	return models.ContactGroup{}, false
+}
+
+// uniqueStrings drops repeated strings, keeping the first of each
+func uniqueStrings(values []string) []string {
+	unique := []string{}
+	seen := map[string]bool{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
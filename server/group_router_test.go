@@ -0,0 +1,88 @@
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/server"
+)
+
+func Test_GroupRouter(t *testing.T) {
+	t.Run("test expanding contact groups", should_expand_groups)
+}
+
+func should_expand_groups(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	user, _ := populateDatabase(uStorage, 0)
+	token, _ := newToken(uStorage, models.Credentials{Username: user.Username})
+	gRouter := server.NewGroupRouter(uStorage, config, mux.NewRouter())
+	cRouter := server.NewContactRouter(uStorage, config, mux.NewRouter())
+
+	createContact := func(body string) models.Contact {
+		res := testEndpoint("POST", "/", strings.NewReader(body), cRouter, token)
+		assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+		var contact models.Contact
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&contact), "Failed to parse response")
+		return contact
+	}
+	ada := createContact(`{"first_name": "Ada", "last_name": "Lovelace", "emails": [{"value": "ada@example.com"}]}`)
+	grace := createContact(`{"first_name": "Grace", "last_name": "Hopper", "emails": [{"value": "grace@example.com"}]}`)
+	again := createContact(`{"first_name": "Ada", "emails": [{"value": "ADA@example.com"}]}`)
+	noEmail := createContact(`{"first_name": "Alan"}`)
+
+	createGroup := func(body string) models.ContactGroup {
+		res := testEndpoint("POST", "/", strings.NewReader(body), gRouter, token)
+		assert.Equal(t, http.StatusCreated, res.Code, "Created response is expected")
+		var group models.ContactGroup
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&group), "Failed to parse response")
+		return group
+	}
+	team := createGroup(fmt.Sprintf(`{"name": "Team", "contacts": [%q, %q]}`, grace.ID, noEmail.ID))
+	all := createGroup(fmt.Sprintf(`{"name": "All", "contacts": [%q, %q], "groups": [%q]}`, ada.ID, again.ID, team.ID))
+
+	res := testEndpoint("POST", "/", strings.NewReader(`{"name": "Strangers", "contacts": ["missing"]}`), gRouter, token)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Groups can only contain the user's contacts")
+	res = testEndpoint("PUT", "/"+team.ID, strings.NewReader(fmt.Sprintf(`{"name": "Team", "groups": [%q]}`, all.ID)), gRouter, token)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Groups can't contain themselves")
+
+	// nested groups are flattened and emails listed once, ignoring case
+	res = testEndpoint("GET", "/"+all.ID+"/expand", nil, gRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var expansion models.GroupExpansion
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&expansion), "Failed to parse response")
+	assert.Equal(t, []string{"ada@example.com", "grace@example.com"}, expansion.Emails, "Unexpected emails")
+	assert.Equal(t, []string{noEmail.ID}, expansion.WithoutEmail, "Contacts without emails should be listed")
+	res = testEndpoint("GET", "/missing/expand", nil, gRouter, token)
+	assert.Equal(t, http.StatusNotFound, res.Code, "Not found response is expected")
+
+	res = testEndpoint("GET", "/"+all.ID+"/export?format=mailto", nil, gRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.Equal(t, "mailto:ada@example.com,grace@example.com", res.Body.String(), "Unexpected mailto link")
+	res = testEndpoint("GET", "/"+all.ID+"/export?format=rfc5322", nil, gRouter, token)
+	assert.Equal(t, `"Ada Lovelace" <ada@example.com>, "Grace Hopper" <grace@example.com>`, res.Body.String(), "Unexpected address list")
+	res = testEndpoint("GET", "/"+all.ID+"/export", nil, gRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	for _, line := range []string{"KIND:group", "FN:All", "MEMBER:mailto:ada@example.com", "MEMBER:mailto:grace@example.com"} {
+		assert.Contains(t, res.Body.String(), line+"\r\n", "Missing line")
+	}
+
+	// deleting a nested group takes it out of the groups containing it
+	res = testEndpoint("DELETE", "/"+team.ID, nil, gRouter, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("GET", "/"+all.ID, nil, gRouter, token)
+	var updated models.ContactGroup
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&updated), "Failed to parse response")
+	assert.Empty(t, updated.Groups, "Deleted groups should be taken out of other groups")
+}
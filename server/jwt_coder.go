@@ -2,12 +2,31 @@ package server
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/Dacode45/addressbook/models"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/mitchellh/mapstructure"
 )
 
+const (
+	// mfaChallengeClaim marks tokens that only prove the password was correct. They can't be used to authenticate requests
+	mfaChallengeClaim = "mfa_challenge"
+	// purposeClaim marks single purpose tokens, like password resets. They can't be used to authenticate requests
+	purposeClaim = "purpose"
+)
+
+// ActionClaims are carried by single purpose tokens. Nonce is stored with the user so each token can only be used once
+type ActionClaims struct {
+	Username string `mapstructure:"username"`
+	Purpose  string `mapstructure:"purpose"`
+	Nonce    string `mapstructure:"nonce"`
+	Email    string `mapstructure:"email"`
+	// State and Verifier are only carried by OIDC login tokens, which are only tied to a user when linking an account
+	State    string `mapstructure:"state"`
+	Verifier string `mapstructure:"verifier"`
+}
+
 // JWTToken is a wrapper around an actual jwt. Useful object for serialization
 type JWTToken struct {
 	Token string `json:"token"`
@@ -27,16 +46,112 @@ func NewJWTCoder(secret string) *JWTCoder {
 
 // Create encodes a Credential object into a JWTToken
 func (j *JWTCoder) Create(c models.Credentials) (JWTToken, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": c.Username,
-		"password": c.Password,
-	})
-	tokenString, err := token.SignedString([]byte(j.secret))
-	return JWTToken{tokenString}, err
+	return j.sign(credentialClaims(c))
+}
+
+// CreateChallenge encodes a Credential object into a token that expires after ttl, and can only be exchanged for a full token by passing a second factor
+func (j *JWTCoder) CreateChallenge(c models.Credentials, ttl time.Duration) (JWTToken, error) {
+	claims := credentialClaims(c)
+	claims[mfaChallengeClaim] = true
+	claims["exp"] = time.Now().Add(ttl).Unix()
+	return j.sign(claims)
+}
+
+// CreateImpersonation encodes a Credential object with an Impersonator into a token that expires after ttl
+func (j *JWTCoder) CreateImpersonation(c models.Credentials, ttl time.Duration) (JWTToken, error) {
+	claims := credentialClaims(c)
+	claims["exp"] = time.Now().Add(ttl).Unix()
+	return j.sign(claims)
+}
+
+// CreateAccessToken encodes the Credentials of a third party app into a token that expires after ttl
+func (j *JWTCoder) CreateAccessToken(c models.Credentials, ttl time.Duration) (JWTToken, error) {
+	now := time.Now()
+	claims := credentialClaims(c)
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(ttl).Unix()
+	return j.sign(claims)
 }
 
 // Decode decodes a jwt token into a Credentials object
 func (j *JWTCoder) Decode(str string) (*models.Credentials, error) {
+	claims, err := j.parse(str)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := claims[mfaChallengeClaim]; ok {
+		return nil, fmt.Errorf("Token requires a second factor")
+	}
+	if _, ok := claims[purposeClaim]; ok {
+		return nil, fmt.Errorf("Token can't be used for authorization")
+	}
+	return claimsToCredentials(claims), nil
+}
+
+// CreateAction encodes ActionClaims into a token that expires after ttl
+func (j *JWTCoder) CreateAction(a ActionClaims, ttl time.Duration) (JWTToken, error) {
+	claims := jwt.MapClaims{
+		"username":   a.Username,
+		purposeClaim: a.Purpose,
+		"nonce":      a.Nonce,
+		"email":      a.Email,
+		"exp":        time.Now().Add(ttl).Unix(),
+	}
+	if a.State != "" {
+		claims["state"] = a.State
+	}
+	if a.Verifier != "" {
+		claims["verifier"] = a.Verifier
+	}
+	return j.sign(claims)
+}
+
+// DecodeAction decodes a token made with CreateAction. Fails if the token was made for another purpose
+func (j *JWTCoder) DecodeAction(str string, purpose string) (*ActionClaims, error) {
+	claims, err := j.parse(str)
+	if err != nil {
+		return nil, err
+	}
+	var a ActionClaims
+	mapstructure.Decode(claims, &a)
+	if a.Purpose != purpose || a.Nonce == "" {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	return &a, nil
+}
+
+// Lifetime returns when a valid token was issued and when it expires, as unix times. Zero for tokens without those claims
+func (j *JWTCoder) Lifetime(str string) (int64, int64, error) {
+	claims, err := j.parse(str)
+	if err != nil {
+		return 0, 0, err
+	}
+	issuedAt, _ := claims["iat"].(float64)
+	expiresAt, _ := claims["exp"].(float64)
+	return int64(issuedAt), int64(expiresAt), nil
+}
+
+// DecodeChallenge decodes a token made with CreateChallenge into a Credentials object
+func (j *JWTCoder) DecodeChallenge(str string) (*models.Credentials, error) {
+	claims, err := j.parse(str)
+	if err != nil {
+		return nil, err
+	}
+	if challenge, ok := claims[mfaChallengeClaim].(bool); !ok || !challenge {
+		return nil, fmt.Errorf("Not a challenge token")
+	}
+	return claimsToCredentials(claims), nil
+}
+
+// sign signs the claims with the secret
+func (j *JWTCoder) sign(claims jwt.MapClaims) (JWTToken, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString([]byte(j.secret))
+	return JWTToken{tokenString}, err
+}
+
+// parse verifies the signature, and expiration if set, and returns the claims
+func (j *JWTCoder) parse(str string) (jwt.MapClaims, error) {
 	token, err := jwt.Parse(str, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("Invalid token")
@@ -46,11 +161,41 @@ func (j *JWTCoder) Decode(str string) (*models.Credentials, error) {
 	if err != nil {
 		return nil, err
 	}
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		var creds models.Credentials
-		mapstructure.Decode(claims, &creds)
-		return &creds, nil
-	} else {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
 		return nil, fmt.Errorf("Invalid authorization token")
 	}
+	return claims, nil
+}
+
+// credentialClaims are the claims every token carries
+func credentialClaims(c models.Credentials) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"username": c.Username,
+		"password": c.Password,
+	}
+	if c.UserID != "" {
+		claims["user_id"] = c.UserID
+	}
+	if c.Scopes != nil {
+		claims["scopes"] = c.Scopes
+	}
+	if c.SessionVersion != 0 {
+		claims["session_version"] = c.SessionVersion
+	}
+	if c.Impersonator != "" {
+		claims["impersonator"] = c.Impersonator
+	}
+	if c.ClientID != "" {
+		claims["client_id"] = c.ClientID
+		claims["grant_id"] = c.GrantID
+	}
+	return claims
+}
+
+// claimsToCredentials reads the Credentials back out of the claims
+func claimsToCredentials(claims jwt.MapClaims) *models.Credentials {
+	var creds models.Credentials
+	mapstructure.Decode(claims, &creds)
+	return &creds
 }
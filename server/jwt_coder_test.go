@@ -2,6 +2,7 @@ package server_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -11,6 +12,10 @@ import (
 
 func Test_JWTCoder(t *testing.T) {
 	t.Run("jwt coder test", should_code_and_decode)
+	t.Run("jwt coder keeps scopes", should_code_and_decode_scopes)
+	t.Run("jwt coder keeps the user id and session version", should_code_and_decode_session_version)
+	t.Run("challenge tokens aren't full tokens", should_separate_challenges)
+	t.Run("access tokens carry the app and expire", should_code_and_decode_access_tokens)
 }
 
 func should_code_and_decode(t *testing.T) {
@@ -27,3 +32,85 @@ func should_code_and_decode(t *testing.T) {
 	assert.NoError(t, err, "Failed to decode jwt")
 	assert.Equal(t, *decoded, creds, "Encoding missmatch")
 }
+
+func should_code_and_decode_scopes(t *testing.T) {
+	coder := server.NewJWTCoder("secret")
+	creds := models.Credentials{
+		Username: "testUser",
+		Password: "testPassword",
+		Scopes:   []models.Scope{models.ScopeContactsRead},
+	}
+	token, err := coder.Create(creds)
+	assert.NoError(t, err, "Failed to sign jwt")
+
+	var decoded *models.Credentials
+	decoded, err = coder.Decode(token.Token)
+	assert.NoError(t, err, "Failed to decode jwt")
+	assert.Equal(t, creds, *decoded, "Encoding missmatch")
+	assert.Equal(t, []models.Scope{models.ScopeContactsWrite}, decoded.MissingScopes(models.ScopeContactsRead, models.ScopeContactsWrite), "Unexpected missing scopes")
+}
+
+func should_code_and_decode_session_version(t *testing.T) {
+	coder := server.NewJWTCoder("secret")
+	creds := models.Credentials{
+		Username:       "testUser",
+		UserID:         "5a0c1f6e9d3b2a0001000001",
+		SessionVersion: 3,
+	}
+	token, err := coder.Create(creds)
+	assert.NoError(t, err, "Failed to sign jwt")
+
+	var decoded *models.Credentials
+	decoded, err = coder.Decode(token.Token)
+	assert.NoError(t, err, "Failed to decode jwt")
+	assert.Equal(t, creds, *decoded, "Encoding missmatch")
+}
+
+func should_code_and_decode_access_tokens(t *testing.T) {
+	coder := server.NewJWTCoder("secret")
+	creds := models.Credentials{
+		Username: "testUser",
+		Scopes:   []models.Scope{models.ScopeContactsRead},
+		ClientID: "client",
+		GrantID:  "grant",
+	}
+	token, err := coder.CreateAccessToken(creds, time.Hour)
+	assert.NoError(t, err, "Failed to sign jwt")
+
+	decoded, err := coder.Decode(token.Token)
+	assert.NoError(t, err, "Failed to decode jwt")
+	assert.Equal(t, creds, *decoded, "Encoding missmatch")
+	issuedAt, expiresAt, err := coder.Lifetime(token.Token)
+	assert.NoError(t, err, "Failed to read lifetime")
+	assert.Equal(t, int64(time.Hour.Seconds()), expiresAt-issuedAt, "Token should expire after an hour")
+
+	expired, _ := coder.CreateAccessToken(creds, -time.Minute)
+	_, err = coder.Decode(expired.Token)
+	assert.Error(t, err, "Expired tokens should be rejected")
+}
+
+func should_separate_challenges(t *testing.T) {
+	coder := server.NewJWTCoder("secret")
+	creds := models.Credentials{
+		Username: "testUser",
+		Password: "testPassword",
+	}
+	challenge, err := coder.CreateChallenge(creds, time.Minute)
+	assert.NoError(t, err, "Failed to sign challenge")
+
+	_, err = coder.Decode(challenge.Token)
+	assert.Error(t, err, "Challenge should not decode as a full token")
+
+	var decoded *models.Credentials
+	decoded, err = coder.DecodeChallenge(challenge.Token)
+	assert.NoError(t, err, "Failed to decode challenge")
+	assert.Equal(t, creds, *decoded, "Encoding missmatch")
+
+	token, _ := coder.Create(creds)
+	_, err = coder.DecodeChallenge(token.Token)
+	assert.Error(t, err, "Full token should not decode as a challenge")
+
+	expired, _ := coder.CreateChallenge(creds, -time.Minute)
+	_, err = coder.DecodeChallenge(expired.Token)
+	assert.Error(t, err, "Expired challenge should not decode")
+}
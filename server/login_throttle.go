@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Dacode45/addressbook/storage"
+)
+
+// ThrottlePolicy configures how failed logins are slowed down. Zero fields take the default
+type ThrottlePolicy struct {
+	// FreeAttempts is how many failures a username gets before it has to wait
+	FreeAttempts int
+	// IPFreeAttempts is how many failures an ip gets before it has to wait. Higher than FreeAttempts since users share ips
+	IPFreeAttempts int
+	// BaseDelay is the wait after the first failure past the free ones. It doubles with every failure after that
+	BaseDelay time.Duration
+	// MaxDelay caps the wait
+	MaxDelay time.Duration
+	// LockoutThreshold is how many failures lock a username out
+	LockoutThreshold int
+	// LockoutDuration is how long a lockout lasts. Must be under a day
+	LockoutDuration time.Duration
+	// ResetAfter is how long after the last failure failures are forgotten
+	ResetAfter time.Duration
+}
+
+// withDefaults fills in the zero fields
+func (p ThrottlePolicy) withDefaults() ThrottlePolicy {
+	if p.FreeAttempts == 0 {
+		p.FreeAttempts = 3
+	}
+	if p.IPFreeAttempts == 0 {
+		p.IPFreeAttempts = 20
+	}
+	if p.BaseDelay == 0 {
+		p.BaseDelay = time.Second
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = 5 * time.Minute
+	}
+	if p.LockoutThreshold == 0 {
+		p.LockoutThreshold = 10
+	}
+	if p.LockoutDuration == 0 {
+		p.LockoutDuration = 30 * time.Minute
+	}
+	if p.ResetAfter == 0 {
+		p.ResetAfter = time.Hour
+	}
+	return p
+}
+
+// ThrottleError tells a client how long to wait before logging in again
+type ThrottleError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+// Error satisfies the error interface
+func (e ThrottleError) Error() string {
+	if e.Locked {
+		return "account is temporarily locked after too many failed logins"
+	}
+	return "too many failed logins, try again later"
+}
+
+// Serve serves the error as a 429 with a Retry-After header in seconds
+func (e ThrottleError) Serve(w http.ResponseWriter, r *http.Request) {
+	seconds := int(math.Ceil(e.RetryAfter.Seconds()))
+	code := "login_throttled"
+	if e.Locked {
+		code = "account_locked"
+	}
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", seconds))
+	ErrorHandler(http.StatusTooManyRequests).ServeDetails(ErrorDetails{
+		Message: e.Error(),
+		Code:    code,
+		Details: map[string]int{"retry_after": seconds},
+	})(w, r)
+}
+
+// serveThrottleError serves ThrottleErrors with their Retry-After header, and anything else as an internal error
+func serveThrottleError(err error) http.HandlerFunc {
+	if throttled, ok := err.(ThrottleError); ok {
+		return throttled.Serve
+	}
+	return StatusInternalServerError.Serve(err)
+}
+
+// LoginThrottle slows down repeated failed logins with exponential backoff per username and per ip, and locks usernames out after too many
+type LoginThrottle struct {
+	storage    storage.ThrottleStorage
+	policy     ThrottlePolicy
+	trustProxy bool
+	now        func() time.Time
+}
+
+// NewLoginThrottle creates a LoginThrottle. trustProxy reads the client ip from X-Forwarded-For, which is only safe behind a proxy that sets it
+func NewLoginThrottle(s storage.ThrottleStorage, policy ThrottlePolicy, trustProxy bool) *LoginThrottle {
+	return &LoginThrottle{
+		storage:    s,
+		policy:     policy.withDefaults(),
+		trustProxy: trustProxy,
+		now:        time.Now,
+	}
+}
+
+// Check returns a ThrottleError if the username or ip has to wait before trying again
+func (t *LoginThrottle) Check(r *http.Request, username string) error {
+	ctx := r.Context()
+	now := t.now()
+	var wait ThrottleError
+	for _, k := range t.keys(r, username) {
+		attempts, err := t.storage.Get(ctx, k.key)
+		if err != nil {
+			return err
+		}
+		if attempts.LockedUntil.After(now) && attempts.LockedUntil.Sub(now) > wait.RetryAfter {
+			wait = ThrottleError{RetryAfter: attempts.LockedUntil.Sub(now), Locked: true}
+		}
+		if now.Sub(attempts.LastFailure) > t.policy.ResetAfter {
+			continue
+		}
+		retryAt := attempts.LastFailure.Add(t.delay(attempts.Failures, k.free))
+		if retryAt.After(now) && retryAt.Sub(now) > wait.RetryAfter {
+			wait = ThrottleError{RetryAfter: retryAt.Sub(now)}
+		}
+	}
+	if wait.RetryAfter > 0 {
+		return wait
+	}
+	return nil
+}
+
+// Failure records a failed login, locking the username out once it reaches the threshold
+func (t *LoginThrottle) Failure(r *http.Request, username string) error {
+	ctx := r.Context()
+	now := t.now()
+	for _, k := range t.keys(r, username) {
+		attempts, err := t.storage.Get(ctx, k.key)
+		if err != nil {
+			return err
+		}
+		// forget old failures, but not a lockout that's still running
+		if now.Sub(attempts.LastFailure) > t.policy.ResetAfter && !attempts.LockedUntil.After(now) {
+			if err = t.storage.Reset(ctx, k.key); err != nil {
+				return err
+			}
+		}
+		attempts, err = t.storage.RecordFailure(ctx, k.key, now)
+		if err != nil {
+			return err
+		}
+		if k.lockable && attempts.Failures >= t.policy.LockoutThreshold && !attempts.LockedUntil.After(now) {
+			if err = t.storage.Lock(ctx, k.key, now.Add(t.policy.LockoutDuration)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Success forgets the failures of a username. The ip keeps its failures so one good account can't be used to reset them
+func (t *LoginThrottle) Success(r *http.Request, username string) error {
+	return t.storage.Reset(r.Context(), usernameThrottleKey(username))
+}
+
+// Unlock lifts a lockout and forgets the failures of a username
+func (t *LoginThrottle) Unlock(ctx context.Context, username string) error {
+	return t.storage.Reset(ctx, usernameThrottleKey(username))
+}
+
+// delay is the exponential backoff after failures
+func (t *LoginThrottle) delay(failures int, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+	exponent := failures - free
+	if exponent > 30 {
+		return t.policy.MaxDelay
+	}
+	delay := t.policy.BaseDelay * time.Duration(1<<uint(exponent))
+	if delay > t.policy.MaxDelay {
+		return t.policy.MaxDelay
+	}
+	return delay
+}
+
+// throttleKey is a storage key and how it is throttled
+type throttleKey struct {
+	key      string
+	free     int
+	lockable bool
+}
+
+// keys are the username and ip keys of a request
+func (t *LoginThrottle) keys(r *http.Request, username string) []throttleKey {
+	return []throttleKey{
+		{usernameThrottleKey(username), t.policy.FreeAttempts, true},
+		{"ip:" + t.clientIP(r), t.policy.IPFreeAttempts, false},
+	}
+}
+
+// clientIP is the ip the request came from
+func (t *LoginThrottle) clientIP(r *http.Request) string {
+	if t.trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// usernameThrottleKey is the storage key of a username
+func usernameThrottleKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Dacode45/addressbook/storage"
+)
+
+func Test_LoginThrottle(t *testing.T) {
+	t.Run("backs off exponentially", should_back_off)
+	t.Run("locks usernames out", should_lock_out)
+	t.Run("throttles ips across usernames", should_throttle_ips)
+}
+
+// newTestThrottle creates a throttle whose clock only moves when the test moves it
+func newTestThrottle(policy ThrottlePolicy) (*LoginThrottle, *time.Time) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	throttle := NewLoginThrottle(storage.NewMemoryThrottleStorage(), policy, false)
+	throttle.now = func() time.Time { return now }
+	return throttle, &now
+}
+
+func newLoginRequest(ip string) *http.Request {
+	req, _ := http.NewRequest("POST", "/login", nil)
+	req.RemoteAddr = ip + ":1234"
+	return req
+}
+
+func should_back_off(t *testing.T) {
+	throttle, now := newTestThrottle(ThrottlePolicy{FreeAttempts: 2, BaseDelay: time.Second})
+	req := newLoginRequest("10.0.0.1")
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, throttle.Check(req, "testUser"), "Free attempts should not be throttled")
+		assert.NoError(t, throttle.Failure(req, "testUser"))
+	}
+	err := throttle.Check(req, "testUser")
+	assert.Equal(t, ThrottleError{RetryAfter: time.Second}, err, "First delay expected")
+
+	*now = now.Add(time.Second)
+	assert.NoError(t, throttle.Check(req, "TESTUSER"), "Delay should be over")
+	assert.NoError(t, throttle.Failure(req, "testUser"))
+	assert.Equal(t, ThrottleError{RetryAfter: 2 * time.Second}, throttle.Check(req, "testUser"), "Delay should double")
+
+	assert.NoError(t, throttle.Success(req, "testUser"))
+	assert.NoError(t, throttle.Check(req, "testUser"), "Success should reset the username")
+}
+
+func should_lock_out(t *testing.T) {
+	throttle, now := newTestThrottle(ThrottlePolicy{FreeAttempts: 100, LockoutThreshold: 3, LockoutDuration: time.Minute})
+	req := newLoginRequest("10.0.0.1")
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, throttle.Failure(req, "testUser"))
+	}
+	err := throttle.Check(newLoginRequest("10.0.0.2"), "testUser")
+	assert.Equal(t, ThrottleError{RetryAfter: time.Minute, Locked: true}, err, "Username should be locked from any ip")
+
+	*now = now.Add(30 * time.Second)
+	assert.Equal(t, ThrottleError{RetryAfter: 30 * time.Second, Locked: true}, throttle.Check(req, "testUser"), "Lock should count down")
+
+	assert.NoError(t, throttle.Unlock(req.Context(), "testUser"))
+	assert.NoError(t, throttle.Check(req, "testUser"), "Unlock should lift the lock")
+}
+
+func should_throttle_ips(t *testing.T) {
+	throttle, _ := newTestThrottle(ThrottlePolicy{IPFreeAttempts: 3, BaseDelay: time.Second})
+	req := newLoginRequest("10.0.0.1")
+
+	users := []string{"a", "b", "c"}
+	for _, u := range users {
+		assert.NoError(t, throttle.Failure(req, u))
+	}
+	assert.Error(t, throttle.Check(req, "d"), "IP should be throttled for every username")
+	assert.NoError(t, throttle.Check(newLoginRequest("10.0.0.2"), "d"), "Other ips should not be throttled")
+}
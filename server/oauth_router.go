@@ -0,0 +1,493 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/storage"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// oauthCodeTTL is how long apps have to exchange an authorization code
+	oauthCodeTTL = 5 * time.Minute
+	// accessTokenTTL is how long access tokens issued to apps work. Apps send the user through authorization again for a new one
+	accessTokenTTL = time.Hour
+)
+
+// oauthRouter handles the routes third party apps use to get access to a user's account
+type oauthRouter struct {
+	userStorage storage.UserStorage
+	oauth       storage.OAuthStorage
+	jwtCoder    *JWTCoder
+}
+
+// authorizeRequest is a validated request from an app for access to the user's account
+type authorizeRequest struct {
+	client        models.OAuthClient
+	redirectURI   string
+	scopes        []models.Scope
+	state         string
+	codeChallenge string
+}
+
+// ConsentRequest describes what an app asks for, for the consent screen
+type ConsentRequest struct {
+	ClientID    string         `json:"client_id"`
+	ClientName  string         `json:"client_name"`
+	Scopes      []models.Scope `json:"scopes"`
+	RedirectURI string         `json:"redirect_uri"`
+	// Granted is true if the user already granted the app every scope, so the consent screen can be skipped
+	Granted bool `json:"granted"`
+}
+
+// consentAnswer is the body of the consent request
+type consentAnswer struct {
+	Approve bool `json:"approve"`
+}
+
+// OAuthRedirect is where the browser goes after the consent screen, back to the app with a code or an error
+type OAuthRedirect struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+// AccessToken is the response of the token endpoint
+type AccessToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// Introspection is the response of the introspection endpoint. Only Active is set for tokens that don't work
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+// oauthError is an error of the token, introspection and revocation endpoints, in the format apps expect
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// NewOAuthRouter creates a new oauthRouter. The consent routes are for the logged in user, the others for apps
+func NewOAuthRouter(u storage.UserStorage, config ServerConfig, router *mux.Router) *mux.Router {
+	jwtCoder := NewJWTCoder(config.JWTSecret)
+	audit := config.auditLog()
+	oauthRouter := oauthRouter{
+		userStorage: u,
+		oauth:       config.oauthStorage(),
+		jwtCoder:    jwtCoder,
+	}
+
+	router.HandleFunc("/authorize", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(oauthRouter.AuthorizeHandler, models.ScopeProfileWrite))).Methods("GET")
+	router.HandleFunc("/authorize", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(oauthRouter.ConsentHandler, models.ScopeProfileWrite))).Methods("POST")
+	router.HandleFunc("/token", oauthRouter.TokenHandler).Methods("POST")
+	router.HandleFunc("/introspect", oauthRouter.IntrospectHandler).Methods("POST")
+	router.HandleFunc("/revoke", oauthRouter.RevokeHandler).Methods("POST")
+	return router
+}
+
+// AuthorizeHandler validates an app's authorization request and describes it for the consent screen
+func (or *oauthRouter) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := or.consentingUser(w, r)
+	if !ok {
+		return
+	}
+	req, err := or.parseAuthorizeRequest(r)
+	if err != nil {
+		serveAuthorizeError(err)(w, r)
+		return
+	}
+
+	grant, granted := user.OAuthGrant(req.client.ID)
+	StatusOK.Serve(ConsentRequest{
+		ClientID:    req.client.ID,
+		ClientName:  req.client.Name,
+		Scopes:      req.scopes,
+		RedirectURI: req.redirectURI,
+		Granted:     granted && scopesCover(grant.Scopes, req.scopes),
+	})(w, r)
+}
+
+// ConsentHandler answers an app's authorization request with the user's decision. Approving grants the scopes and
+// redirects back with an authorization code, denying redirects back with the access_denied error
+func (or *oauthRouter) ConsentHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := or.consentingUser(w, r)
+	if !ok {
+		return
+	}
+	req, err := or.parseAuthorizeRequest(r)
+	if err != nil {
+		serveAuthorizeError(err)(w, r)
+		return
+	}
+	var answer consentAnswer
+	if r.Body == nil {
+		StatusBadRequest.Serve(fmt.Errorf("no request body"))(w, r)
+		return
+	}
+	if err = json.NewDecoder(r.Body).Decode(&answer); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+
+	params := url.Values{}
+	if req.state != "" {
+		params.Set("state", req.state)
+	}
+	if !answer.Approve {
+		params.Set("error", "access_denied")
+		StatusOK.Serve(OAuthRedirect{RedirectTo: withQuery(req.redirectURI, params)})(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	grant, err := or.grant(ctx, user, req)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	code := randomToken()
+	err = or.oauth.SaveCode(ctx, models.OAuthCode{
+		CodeHash:      hashSecret(code),
+		ClientID:      req.client.ID,
+		Username:      user.Username,
+		GrantID:       grant.ID,
+		RedirectURI:   req.redirectURI,
+		Scopes:        req.scopes,
+		CodeChallenge: req.codeChallenge,
+		ExpiresAt:     time.Now().Add(oauthCodeTTL),
+	})
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	params.Set("code", code)
+	StatusOK.Serve(OAuthRedirect{RedirectTo: withQuery(req.redirectURI, params)})(w, r)
+}
+
+// TokenHandler exchanges an authorization code and its pkce verifier for an access token
+func (or *oauthRouter) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	ctx := r.Context()
+	client, err := or.authenticateClient(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		serveOAuthError(http.StatusUnauthorized, "invalid_client", err.Error())(w, r)
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		serveOAuthError(http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")(w, r)
+		return
+	}
+
+	code, err := or.oauth.TakeCode(ctx, hashSecret(r.PostForm.Get("code")))
+	if err != nil && err != storage.ErrCodeNotFound {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	if err != nil || code.ClientID != client.ID || time.Now().After(code.ExpiresAt) {
+		serveOAuthError(http.StatusBadRequest, "invalid_grant", "authorization code is invalid, expired or was already used")(w, r)
+		return
+	}
+	if code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		serveOAuthError(http.StatusBadRequest, "invalid_grant", "redirect_uri doesn't match the authorization request")(w, r)
+		return
+	}
+	if !verifyCodeChallenge(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+		serveOAuthError(http.StatusBadRequest, "invalid_grant", "code_verifier doesn't match the code_challenge")(w, r)
+		return
+	}
+	user, err := or.userStorage.FindByUsername(ctx, code.Username)
+	if err != nil || user.DeletedAt != nil || user.Disabled {
+		serveOAuthError(http.StatusBadRequest, "invalid_grant", "user can no longer grant access")(w, r)
+		return
+	}
+	// the user may have revoked access since approving
+	if grant, ok := user.OAuthGrant(client.ID); !ok || grant.ID != code.GrantID {
+		serveOAuthError(http.StatusBadRequest, "invalid_grant", "access was revoked")(w, r)
+		return
+	}
+
+	token, err := or.jwtCoder.CreateAccessToken(models.Credentials{
+		Username:       user.Username,
+		UserID:         user.UserID,
+		Scopes:         code.Scopes,
+		SessionVersion: user.SessionVersion,
+		ClientID:       client.ID,
+		GrantID:        code.GrantID,
+	}, accessTokenTTL)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(AccessToken{
+		AccessToken: token.Token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(accessTokenTTL.Seconds()),
+		Scope:       joinScopes(code.Scopes),
+	})(w, r)
+}
+
+// IntrospectHandler tells a confidential app whether one of its access tokens still works, and what it grants
+func (or *oauthRouter) IntrospectHandler(w http.ResponseWriter, r *http.Request) {
+	client, err := or.authenticateClient(r)
+	if err == nil && !client.Confidential {
+		err = fmt.Errorf("only confidential clients can introspect tokens")
+	}
+	if err != nil {
+		serveOAuthError(http.StatusUnauthorized, "invalid_client", err.Error())(w, r)
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	creds, user := or.clientToken(r.Context(), client, token)
+	if user == nil {
+		StatusOK.Serve(Introspection{Active: false})(w, r)
+		return
+	}
+	issuedAt, expiresAt, _ := or.jwtCoder.Lifetime(token)
+	StatusOK.Serve(Introspection{
+		Active:    true,
+		Scope:     joinScopes(creds.Scopes),
+		ClientID:  creds.ClientID,
+		Username:  user.Username,
+		TokenType: "Bearer",
+		ExpiresAt: expiresAt,
+		IssuedAt:  issuedAt,
+	})(w, r)
+}
+
+// RevokeHandler lets an app give up one of its access tokens. The user's grant to the app is removed, which revokes
+// every token issued with it. Succeeds for tokens that already don't work
+func (or *oauthRouter) RevokeHandler(w http.ResponseWriter, r *http.Request) {
+	client, err := or.authenticateClient(r)
+	if err != nil {
+		serveOAuthError(http.StatusUnauthorized, "invalid_client", err.Error())(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	if _, user := or.clientToken(ctx, client, r.PostForm.Get("token")); user != nil {
+		if err = or.userStorage.RemoveOAuthGrant(ctx, user.Username, client.ID); err != nil {
+			StatusInternalServerError.Serve(err)(w, r)
+			return
+		}
+	}
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// consentingUser returns the logged in user. Apps and impersonating admins can't grant access for the user
+func (or *oauthRouter) consentingUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	user, ok := r.Context().Value(ContextUserKey).(*models.User)
+	creds, _ := r.Context().Value(ContextCredentialsKey).(*models.Credentials)
+	if !ok || user == nil || creds == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return nil, false
+	}
+	if creds.ClientID != "" || creds.Impersonator != "" {
+		StatusForbidden.Serve(fmt.Errorf("only the user can grant apps access"))(w, r)
+		return nil, false
+	}
+	return user, true
+}
+
+// parseAuthorizeRequest validates the query parameters of an authorization request. Invalid requests return ErrorDetails
+func (or *oauthRouter) parseAuthorizeRequest(r *http.Request) (authorizeRequest, error) {
+	query := r.URL.Query()
+	var req authorizeRequest
+	client, err := or.oauth.FindClient(r.Context(), query.Get("client_id"))
+	if err == storage.ErrClientNotFound {
+		return req, ErrorDetails{Message: "unknown client_id", Code: "invalid_client"}
+	}
+	if err != nil {
+		return req, err
+	}
+	req.client = client
+
+	req.redirectURI = query.Get("redirect_uri")
+	if !client.HasRedirectURI(req.redirectURI) {
+		return req, ErrorDetails{Message: "redirect_uri isn't registered for the client", Code: "invalid_request"}
+	}
+	if query.Get("response_type") != "code" {
+		return req, ErrorDetails{Message: "response_type must be code", Code: "unsupported_response_type"}
+	}
+	req.codeChallenge = query.Get("code_challenge")
+	if req.codeChallenge == "" || query.Get("code_challenge_method") != "S256" {
+		return req, ErrorDetails{Message: "pkce with the S256 method is required", Code: "invalid_request"}
+	}
+
+	req.scopes = client.Scopes
+	if requested := strings.Fields(query.Get("scope")); len(requested) > 0 {
+		req.scopes = nil
+		for _, s := range requested {
+			scope := models.Scope(s)
+			if !client.AllowsScope(scope) {
+				return req, ErrorDetails{
+					Message: fmt.Sprintf("client can't ask for the %s scope", scope),
+					Code:    "invalid_scope",
+					Details: map[string][]models.Scope{"allowed_scopes": client.Scopes},
+				}
+			}
+			req.scopes = append(req.scopes, scope)
+		}
+	}
+	req.state = query.Get("state")
+	return req, nil
+}
+
+// grant stores the user's consent to the request. Earlier grants to the client keep their id, so tokens issued with them keep working
+func (or *oauthRouter) grant(ctx context.Context, user *models.User, req authorizeRequest) (models.OAuthGrant, error) {
+	grant, ok := user.OAuthGrant(req.client.ID)
+	if !ok {
+		grant = models.OAuthGrant{ID: uuid.New().String(), ClientID: req.client.ID}
+	}
+	grant.ClientName = req.client.Name
+	grant.GrantedAt = time.Now()
+	for _, s := range req.scopes {
+		if !scopesCover(grant.Scopes, []models.Scope{s}) {
+			grant.Scopes = append(grant.Scopes, s)
+		}
+	}
+	return grant, or.userStorage.SaveOAuthGrant(ctx, user.Username, grant)
+}
+
+// authenticateClient finds the app making the request from http basic auth or the client_id and client_secret form fields.
+// Confidential apps must send their secret, public apps must not send one
+func (or *oauthRouter) authenticateClient(r *http.Request) (models.OAuthClient, error) {
+	if err := r.ParseForm(); err != nil {
+		return models.OAuthClient{}, err
+	}
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		// basic auth credentials are form encoded first
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	client, err := or.oauth.FindClient(r.Context(), id)
+	if err != nil {
+		return client, fmt.Errorf("unknown client")
+	}
+	if client.Confidential {
+		if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(client.SecretHash)) != 1 {
+			return client, fmt.Errorf("incorrect client secret")
+		}
+	} else if secret != "" {
+		return client, fmt.Errorf("public clients don't have a secret")
+	}
+	return client, nil
+}
+
+// clientToken decodes an access token issued to the client. Returns a nil user if the token doesn't work
+func (or *oauthRouter) clientToken(ctx context.Context, client models.OAuthClient, token string) (*models.Credentials, *models.User) {
+	creds, err := or.jwtCoder.Decode(token)
+	if err != nil || creds.ClientID != client.ID {
+		return nil, nil
+	}
+	user, err := authenticate(ctx, or.userStorage, *creds)
+	if err != nil {
+		return nil, nil
+	}
+	return creds, user
+}
+
+// serveAuthorizeError serves invalid authorization requests as a 400 and anything else as an internal error.
+// Errors aren't sent to the redirect uri, the consent screen shows them
+func serveAuthorizeError(err error) http.HandlerFunc {
+	if _, ok := err.(ErrorDetails); ok {
+		return StatusBadRequest.Serve(err)
+	}
+	return StatusInternalServerError.Serve(err)
+}
+
+// serveOAuthError serves an error in the format of the oauth2 spec
+func serveOAuthError(status int, code string, description string) http.HandlerFunc {
+	return JSONHandler(status).Serve(oauthError{Code: code, Description: description})
+}
+
+// verifyCodeChallenge checks a pkce verifier against the S256 challenge from the authorization request
+func verifyCodeChallenge(verifier string, challenge string) bool {
+	if verifier == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// scopesCover checks that granted includes every one of the requested scopes
+func scopesCover(granted []models.Scope, requested []models.Scope) bool {
+	for _, r := range requested {
+		found := false
+		for _, g := range granted {
+			if g == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// joinScopes formats scopes as a space separated list
+func joinScopes(scopes []models.Scope) string {
+	s := make([]string, len(scopes))
+	for i, scope := range scopes {
+		s[i] = string(scope)
+	}
+	return strings.Join(s, " ")
+}
+
+// withQuery adds params to the query of uri
+func withQuery(uri string, params url.Values) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	query := u.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// randomToken returns 32 random bytes, base64url encoded. Used for authorization codes and client secrets
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("unable to read random bytes: %s", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashSecret hashes authorization codes and client secrets for storage. They are random, so a fast hash is enough
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
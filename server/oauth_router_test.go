@@ -0,0 +1,157 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/server"
+	"github.com/Dacode45/addressbook/storage"
+)
+
+func Test_OAuthRouter(t *testing.T) {
+	t.Run("test authorization code flow", should_authorize_apps)
+}
+
+func should_authorize_apps(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	ctx := context.Background()
+	oauthConfig := config
+	oauthConfig.OAuth = storage.NewMemoryOAuthStorage()
+	aRouter := server.NewAdminRouter(uStorage, oauthConfig, mux.NewRouter())
+	oRouter := server.NewOAuthRouter(uStorage, oauthConfig, mux.NewRouter())
+	uRouter := server.NewUserRouter(uStorage, oauthConfig, mux.NewRouter())
+	cRouter := server.NewContactRouter(uStorage, oauthConfig, mux.NewRouter())
+	assert.NoError(t, server.BootstrapAdmin(ctx, uStorage, "root", "c0ntacts-Are-gr8"), "Failed to bootstrap admin")
+	adminToken, _ := newToken(uStorage, models.Credentials{Username: "root"})
+	user, _ := populateDatabase(uStorage, 2)
+	userToken, _ := newToken(uStorage, models.Credentials{Username: user.Username})
+
+	// register an app that can only read contacts
+	registration, _ := json.Marshal(map[string]interface{}{
+		"name":          "CRM",
+		"redirect_uris": []string{"https://crm.example.com/callback"},
+		"scopes":        []models.Scope{models.ScopeContactsRead},
+		"confidential":  true,
+	})
+	res := testEndpoint("POST", "/clients", bytes.NewBuffer(registration), aRouter, adminToken)
+	assert.Equal(t, http.StatusCreated, res.Code, "Created response is expected")
+	var client server.RegisteredClient
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&client), "Failed to parse response")
+	assert.NotEmpty(t, client.ClientSecret, "Confidential clients get a secret")
+
+	verifier := "a-pkce-verifier-that-is-long-enough-to-be-valid-1234567890"
+	sum := sha256.Sum256([]byte(verifier))
+	authorize := "/authorize?" + url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID},
+		"redirect_uri":          {"https://crm.example.com/callback"},
+		"scope":                 {"contacts:read"},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}.Encode()
+
+	res = testEndpoint("GET", strings.Replace(authorize, "contacts%3Aread", "profile%3Awrite", 1), nil, oRouter, userToken)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Scopes the app can't have should be rejected")
+
+	res = testEndpoint("GET", authorize, nil, oRouter, userToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var consent server.ConsentRequest
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&consent), "Failed to parse response")
+	assert.Equal(t, "CRM", consent.ClientName, "Unexpected client")
+	assert.False(t, consent.Granted, "Nothing was granted yet")
+
+	res = testEndpoint("POST", authorize, strings.NewReader(`{"approve": false}`), oRouter, userToken)
+	var redirect server.OAuthRedirect
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&redirect), "Failed to parse response")
+	denied, _ := url.Parse(redirect.RedirectTo)
+	assert.Equal(t, "access_denied", denied.Query().Get("error"), "Denying should redirect with an error")
+
+	res = testEndpoint("POST", authorize, strings.NewReader(`{"approve": true}`), oRouter, userToken)
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&redirect), "Failed to parse response")
+	approved, _ := url.Parse(redirect.RedirectTo)
+	assert.Equal(t, "xyz", approved.Query().Get("state"), "State should be passed back")
+	code := approved.Query().Get("code")
+	assert.NotEmpty(t, code, "Approving should redirect with a code")
+
+	// exchange the code
+	exchange := func(code string, verifier string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {"https://crm.example.com/callback"},
+			"code_verifier": {verifier},
+		}
+		req, _ := http.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.ClientSecret)
+		res := httptest.NewRecorder()
+		oRouter.ServeHTTP(res, req)
+		return res
+	}
+	res = exchange(code, verifier)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var accessToken server.AccessToken
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&accessToken), "Failed to parse response")
+	assert.Equal(t, "contacts:read", accessToken.Scope, "Unexpected scope")
+	res = exchange(code, verifier)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Codes can only be exchanged once")
+
+	// the token only has the granted scopes
+	appToken := server.JWTToken{Token: accessToken.AccessToken}
+	res = testEndpoint("GET", "/", nil, cRouter, appToken)
+	assert.Equal(t, http.StatusOK, res.Code, "App should read contacts")
+	res = testEndpoint("POST", "/", strings.NewReader(`{"first_name": "a"}`), cRouter, appToken)
+	assert.Equal(t, http.StatusForbidden, res.Code, "App should not write contacts")
+	res = testEndpoint("GET", authorize, nil, oRouter, appToken)
+	assert.Equal(t, http.StatusForbidden, res.Code, "Apps should not grant access")
+
+	introspect := func() server.Introspection {
+		form := url.Values{"token": {accessToken.AccessToken}}
+		req, _ := http.NewRequest("POST", "/introspect", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.ClientSecret)
+		res := httptest.NewRecorder()
+		oRouter.ServeHTTP(res, req)
+		var introspection server.Introspection
+		json.NewDecoder(res.Body).Decode(&introspection)
+		return introspection
+	}
+	introspection := introspect()
+	assert.True(t, introspection.Active, "Token should be active")
+	assert.Equal(t, user.Username, introspection.Username, "Unexpected user")
+
+	res = testEndpoint("GET", "/me/apps", nil, uRouter, userToken)
+	var grants []models.OAuthGrant
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&grants), "Failed to parse response")
+	assert.Len(t, grants, 1, "One app should have access")
+
+	// revoking the token removes the grant
+	form := url.Values{"token": {accessToken.AccessToken}}
+	req, _ := http.NewRequest("POST", "/revoke", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.ID, client.ClientSecret)
+	res = httptest.NewRecorder()
+	oRouter.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.False(t, introspect().Active, "Revoked tokens should be inactive")
+	res = testEndpoint("GET", "/", nil, cRouter, appToken)
+	assert.Equal(t, http.StatusUnauthorized, res.Code, "Revoked tokens should not authenticate")
+}
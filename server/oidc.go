@@ -0,0 +1,352 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/storage"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// purposeOIDCLogin is the purpose of the tokens kept in the oidc login cookie
+	purposeOIDCLogin = "oidc_login"
+	// oidcLoginCookie holds the state, nonce and pkce verifier between the redirect to the provider and the callback
+	oidcLoginCookie = "oidc_login"
+	// oidcLoginTTL is how long users have to log in at the provider
+	oidcLoginTTL = 10 * time.Minute
+	// oidcDiscoveryTimeout bounds fetching the provider's discovery document
+	oidcDiscoveryTimeout = 10 * time.Second
+)
+
+// usernameInvalidChars are replaced when making a username from the claims of an ID token
+var usernameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// oidcClaims are the claims of an ID token used to provision users
+type oidcClaims struct {
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// OIDCLogin logs users in with an external OpenID Connect provider.
+// The provider is discovered from its issuer url on first use, so the server starts while the provider is down
+type OIDCLogin struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDCLogin creates an OIDCLogin for the configured provider. Returns nil if no provider is configured
+func NewOIDCLogin(config ServerConfig) *OIDCLogin {
+	if config.OIDCIssuer == "" {
+		return nil
+	}
+	return &OIDCLogin{
+		issuer:       config.OIDCIssuer,
+		clientID:     config.OIDCClientID,
+		clientSecret: config.OIDCClientSecret,
+		redirectURL:  config.oidcRedirectURL(),
+	}
+}
+
+// discover fetches the provider's discovery document once it succeeds, and returns the oauth2 config and ID token verifier
+func (o *OIDCLogin) discover() (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.oauth != nil {
+		return o.oauth, o.verifier, nil
+	}
+
+	// the provider keeps using the context to fetch signing keys, so it can't be the request's
+	ctx, cancel := context.WithTimeout(context.Background(), oidcDiscoveryTimeout)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, o.issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	o.oauth = &oauth2.Config{
+		ClientID:     o.clientID,
+		ClientSecret: o.clientSecret,
+		RedirectURL:  o.redirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+	}
+	o.verifier = provider.Verifier(&oidc.Config{ClientID: o.clientID})
+	return o.oauth, o.verifier, nil
+}
+
+// OIDCLinkStart is returned when linking an identity provider account starts. The client sends the user to URL to log in at the provider
+type OIDCLinkStart struct {
+	URL string `json:"url"`
+}
+
+// BeginOIDCLoginHandler redirects to the provider's login page. The state, nonce and pkce verifier are kept in a signed cookie until the callback
+func (ur *userRouter) BeginOIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	authURL, handler := ur.beginOIDC(w, "")
+	if handler != nil {
+		handler(w, r)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// LinkOIDCHandler starts linking an account at the provider to the logged in user. The provider redirects to the same callback as logins,
+// which links the account instead of logging in. Users with a second factor can only link their accounts this way
+func (ur *userRouter) LinkOIDCHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	authURL, handler := ur.beginOIDC(w, user.Username)
+	if handler != nil {
+		handler(w, r)
+		return
+	}
+	StatusOK.Serve(OIDCLinkStart{URL: authURL})(w, r)
+}
+
+// beginOIDC sets the oidc login cookie and returns the url of the provider's login page, or the handler to serve if it failed.
+// Logins started with a username link the account at the provider to that user
+func (ur *userRouter) beginOIDC(w http.ResponseWriter, username string) (string, http.HandlerFunc) {
+	if ur.oidc == nil {
+		return "", NotImplementedHandler.Serve
+	}
+	oauth, _, err := ur.oidc.discover()
+	if err != nil {
+		return "", StatusInternalServerError.Serve(fmt.Errorf("Unable to reach the identity provider: %s", err))
+	}
+
+	claims := ActionClaims{
+		Username: username,
+		Purpose:  purposeOIDCLogin,
+		Nonce:    uuid.New().String(),
+		State:    uuid.New().String(),
+		Verifier: oauth2.GenerateVerifier(),
+	}
+	token, err := ur.jwtCoder.CreateAction(claims, oidcLoginTTL)
+	if err != nil {
+		return "", StatusInternalServerError.Serve(err)
+	}
+	http.SetCookie(w, ur.oidcCookie(token.Token, int(oidcLoginTTL.Seconds())))
+	return oauth.AuthCodeURL(claims.State, oidc.Nonce(claims.Nonce), oauth2.S256ChallengeOption(claims.Verifier)), nil
+}
+
+// OIDCCallbackHandler finishes logging in after the provider redirects back. The ID token is verified, the user is found or provisioned,
+// and the same JWTToken as LoginHandler is returned. Second factors are left to the provider. Links started with LinkOIDCHandler finish here too
+func (ur *userRouter) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if ur.oidc == nil {
+		NotImplementedHandler.Serve(w, r)
+		return
+	}
+	ctx := r.Context()
+	query := r.URL.Query()
+	// the login cookie is single use
+	http.SetCookie(w, ur.oidcCookie("", -1))
+	if providerErr := query.Get("error"); providerErr != "" {
+		StatusUnauthorized.Serve(fmt.Errorf("Identity provider refused the login: %s %s", providerErr, query.Get("error_description")))(w, r)
+		return
+	}
+	cookie, err := r.Cookie(oidcLoginCookie)
+	if err != nil {
+		StatusBadRequest.Serve(fmt.Errorf("OIDC login was not started or has expired"))(w, r)
+		return
+	}
+	login, err := ur.jwtCoder.DecodeAction(cookie.Value, purposeOIDCLogin)
+	if err != nil || subtle.ConstantTimeCompare([]byte(login.State), []byte(query.Get("state"))) != 1 {
+		StatusBadRequest.Serve(fmt.Errorf("Invalid or expired OIDC login"))(w, r)
+		return
+	}
+
+	oauth, verifier, err := ur.oidc.discover()
+	if err != nil {
+		StatusInternalServerError.Serve(fmt.Errorf("Unable to reach the identity provider: %s", err))(w, r)
+		return
+	}
+	token, err := oauth.Exchange(ctx, query.Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		StatusUnauthorized.Serve(fmt.Errorf("Unable to exchange the authorization code: %s", err))(w, r)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		StatusUnauthorized.Serve(fmt.Errorf("Identity provider returned no ID token"))(w, r)
+		return
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		StatusUnauthorized.Serve(fmt.Errorf("Invalid ID token: %s", err))(w, r)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(login.Nonce)) != 1 {
+		StatusUnauthorized.Serve(fmt.Errorf("Invalid ID token: nonce doesn't match"))(w, r)
+		return
+	}
+	var claims oidcClaims
+	if err = idToken.Claims(&claims); err != nil {
+		StatusUnauthorized.Serve(fmt.Errorf("Invalid ID token: %s", err))(w, r)
+		return
+	}
+
+	identity := models.OIDCIdentity{Issuer: idToken.Issuer, Subject: idToken.Subject}
+	if login.Username != "" {
+		ur.linkOIDC(ctx, login.Username, identity)(w, r)
+		return
+	}
+	user, err := ur.oidcUser(ctx, identity, claims)
+	if err != nil {
+		if _, ok := err.(ErrorDetails); ok {
+			StatusConflict.Serve(err)(w, r)
+			return
+		}
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	ur.serveToken(user, models.Credentials{Scopes: models.DefaultScopes})(w, r)
+}
+
+// linkOIDC links the identity to the user who started the link, and logs them in like a login with the identity would
+func (ur *userRouter) linkOIDC(ctx context.Context, username string, identity models.OIDCIdentity) http.HandlerFunc {
+	if _, err := ur.userStorage.FindByUsername(ctx, username); err != nil {
+		return StatusBadRequest.Serve(fmt.Errorf("User no longer exists"))
+	}
+	err := ur.userStorage.AddOIDCIdentity(ctx, username, identity)
+	if err == storage.ErrOIDCIdentityLinked {
+		return StatusConflict.Serve(err)
+	}
+	if err != nil {
+		return StatusInternalServerError.Serve(err)
+	}
+	user, err := ur.userStorage.FindByOIDCIdentity(ctx, identity)
+	if err != nil {
+		return StatusInternalServerError.Serve(err)
+	}
+	return ur.serveToken(user, models.Credentials{Scopes: models.DefaultScopes})
+}
+
+// oidcUser finds the user linked to the identity. Otherwise the identity is linked to the user with the same verified email,
+// or a new user is provisioned. Emails only match if both the provider and this service verified them, and the user has no second factor
+func (ur *userRouter) oidcUser(ctx context.Context, identity models.OIDCIdentity, claims oidcClaims) (*models.User, error) {
+	user, err := ur.userStorage.FindByOIDCIdentity(ctx, identity)
+	if err == nil {
+		return user, nil
+	}
+
+	email := ""
+	if claims.EmailVerified {
+		email, err = normalizeEmail(claims.Email)
+		if err != nil {
+			email = ""
+		}
+	}
+	if email != "" {
+		user, err = ur.userStorage.FindByEmail(ctx, email)
+		if err == nil {
+			// anyone can sign up with an email they don't own, so only verified accounts are linked
+			if !user.EmailVerified {
+				return nil, ErrorDetails{
+					Message: "An account with this email exists but hasn't verified it",
+					Code:    "oidc_email_conflict",
+				}
+			}
+			// logging in at the provider would skip the second factor, so the user has to link the account while logged in
+			if user.TwoFactorEnabled || len(user.WebAuthnCredentials) > 0 {
+				return nil, ErrorDetails{
+					Message: "An account with this email uses a second factor, link the identity provider from its settings",
+					Code:    "oidc_link_required",
+				}
+			}
+			if err = ur.userStorage.AddOIDCIdentity(ctx, user.Username, identity); err != nil {
+				return nil, err
+			}
+			return ur.userStorage.FindByOIDCIdentity(ctx, identity)
+		}
+	}
+
+	username, err := ur.oidcUsername(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+	password := make([]byte, 32)
+	if _, err = rand.Read(password); err != nil {
+		return nil, err
+	}
+	// the password is never shown, users who want one use the password reset. The identity is inserted with the user,
+	// so the user can always log in once it exists
+	err = ur.userStorage.Insert(ctx, models.User{
+		Username:       username,
+		Password:       hex.EncodeToString(password),
+		Email:          email,
+		OIDCIdentities: []models.OIDCIdentity{identity},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if email != "" {
+		if err = ur.userStorage.MarkEmailVerified(ctx, username, email); err != nil {
+			return nil, err
+		}
+	}
+	return ur.userStorage.FindByOIDCIdentity(ctx, identity)
+}
+
+// oidcUsername picks an unused username for a provisioned user from the preferred username or email, adding a suffix if it is taken
+func (ur *userRouter) oidcUsername(ctx context.Context, claims oidcClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	base = strings.Trim(usernameInvalidChars.ReplaceAllString(base, "_"), "_")
+	if base == "" {
+		base = "user"
+	}
+
+	username := base
+	for i := 0; i < 10; i++ {
+		if _, err := ur.userStorage.FindByUsername(ctx, username); err != nil {
+			return username, nil
+		}
+		suffix := make([]byte, 3)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", err
+		}
+		username = base + "-" + hex.EncodeToString(suffix)
+	}
+	return "", storage.ErrUsernameTaken
+}
+
+// oidcCookie creates the oidc login cookie. It is only sent to the callback, and a negative maxAge removes it
+func (ur *userRouter) oidcCookie(value string, maxAge int) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     oidcLoginCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		// the callback is a top level navigation from the provider
+		SameSite: http.SameSiteLaxMode,
+	}
+	if callback, err := url.Parse(ur.oidc.redirectURL); err == nil {
+		cookie.Path = callback.Path
+		cookie.Secure = callback.Scheme == "https"
+	}
+	return cookie
+}
@@ -0,0 +1,665 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/storage"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxOrgNameLength bounds the names of organisations
+	maxOrgNameLength = 100
+	// orgInviteTTL is how long users have to accept an invite into an organisation
+	orgInviteTTL = 7 * 24 * time.Hour
+)
+
+const (
+	// SearchSourceContacts marks search results from the user's own contacts
+	SearchSourceContacts = "contacts"
+	// SearchSourceDirectory marks search results from the company directory
+	SearchSourceDirectory = "directory"
+)
+
+var (
+	// errOrgAdminOnly is returned when a member who isn't an admin tries to curate or manage an organisation
+	errOrgAdminOnly = fmt.Errorf("Only admins of the organisation can do that")
+	// errNotOrgMember is returned when managing a user who isn't a member of the organisation
+	errNotOrgMember = fmt.Errorf("That user isn't a member of the organisation")
+)
+
+// orgRouter handles organisations, their members and invites, and their company directory.
+// Members read the directory and invite others, admins curate the directory and manage the members
+type orgRouter struct {
+	userStorage storage.UserStorage
+	orgs        storage.OrgStorage
+	jwtCoder    *JWTCoder
+	audit       storage.AuditStorage
+	names       models.NameFormat
+}
+
+// orgRequest is the body of creating or renaming an organisation
+type orgRequest struct {
+	Name string `json:"name"`
+}
+
+// inviteRequest is the body of inviting a user into an organisation. Role defaults to member
+type inviteRequest struct {
+	Username string         `json:"username"`
+	Role     models.OrgRole `json:"role"`
+}
+
+// roleRequest is the body of changing a member's role
+type roleRequest struct {
+	Role models.OrgRole `json:"role"`
+}
+
+// OrgSearchResult is a contact found by searching an organisation, with where it was found
+type OrgSearchResult struct {
+	Source string `json:"source"`
+	models.Contact
+}
+
+// NewOrgRouter generates a router for organisations. Users only see the organisations they are members of
+func NewOrgRouter(u storage.UserStorage, config ServerConfig, router *mux.Router) *mux.Router {
+	jwtCoder := NewJWTCoder(config.JWTSecret)
+	audit := config.auditLog()
+	or := orgRouter{u, config.orgStorage(), jwtCoder, audit, config.NameFormat}
+
+	router.HandleFunc("/", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.ListOrgsHandler, models.ScopeProfileRead))).Methods("GET")
+	router.HandleFunc("/", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.CreateOrgHandler, models.ScopeProfileWrite))).Methods("POST")
+	// the user's own invites
+	router.HandleFunc("/invites", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.ListUserInvitesHandler, models.ScopeProfileRead))).Methods("GET")
+	router.HandleFunc("/invites/{invite}/accept", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.AcceptInviteHandler, models.ScopeProfileWrite))).Methods("POST")
+	router.HandleFunc("/invites/{invite}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.DeclineInviteHandler, models.ScopeProfileWrite))).Methods("DELETE")
+
+	router.HandleFunc("/{org}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.FindOrgHandler, models.ScopeProfileRead))).Methods("GET")
+	router.HandleFunc("/{org}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.RenameOrgHandler, models.ScopeProfileWrite))).Methods("PUT")
+	router.HandleFunc("/{org}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.DeleteOrgHandler, models.ScopeProfileWrite))).Methods("DELETE")
+	// members and invites
+	router.HandleFunc("/{org}/members", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.ListMembersHandler, models.ScopeProfileRead))).Methods("GET")
+	router.HandleFunc("/{org}/members/{username}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.SetMemberRoleHandler, models.ScopeProfileWrite))).Methods("PUT")
+	router.HandleFunc("/{org}/members/{username}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.RemoveMemberHandler, models.ScopeProfileWrite))).Methods("DELETE")
+	router.HandleFunc("/{org}/invites", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.ListOrgInvitesHandler, models.ScopeProfileRead))).Methods("GET")
+	router.HandleFunc("/{org}/invites", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.InviteHandler, models.ScopeProfileWrite))).Methods("POST")
+	router.HandleFunc("/{org}/invites/{invite}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.RevokeInviteHandler, models.ScopeProfileWrite))).Methods("DELETE")
+	// company directory
+	router.HandleFunc("/{org}/directory", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.DirectoryHandler, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{org}/directory", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.CreateDirectoryContactHandler, models.ScopeContactsWrite))).Methods("POST")
+	router.HandleFunc("/{org}/directory/{id}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.FindDirectoryContactHandler, models.ScopeContactsRead))).Methods("GET")
+	router.HandleFunc("/{org}/directory/{id}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.UpdateDirectoryContactHandler, models.ScopeContactsWrite))).Methods("PUT")
+	router.HandleFunc("/{org}/directory/{id}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.DeleteDirectoryContactHandler, models.ScopeContactsDelete))).Methods("DELETE")
+	router.HandleFunc("/{org}/search", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(or.SearchHandler, models.ScopeContactsRead))).Methods("GET")
+	return router
+}
+
+// ListOrgsHandler lists the organisations the user is a member of, with their role in each
+func (or *orgRouter) ListOrgsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	orgs := []models.Org{}
+	for _, membership := range user.Orgs {
+		org, err := or.orgs.FindOrg(ctx, membership.OrgID)
+		if err == storage.ErrOrgNotFound {
+			continue
+		}
+		if err != nil {
+			StatusInternalServerError.Serve(err)(w, r)
+			return
+		}
+		org.Role = membership.Role
+		orgs = append(orgs, *org)
+	}
+	StatusOK.Serve(orgs)(w, r)
+}
+
+// CreateOrgHandler creates an organisation from a json body. The user is its first admin
+func (or *orgRouter) CreateOrgHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	name, err := decodeOrgName(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	org, err := or.orgs.CreateOrg(ctx, models.Org{Name: name, CreatedBy: user.Username})
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	membership := models.OrgMembership{OrgID: org.ID, Role: models.OrgRoleAdmin, JoinedAt: org.CreatedAt}
+	if err = or.userStorage.SaveOrgMembership(ctx, user.Username, membership); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	recordAudit(ctx, or.audit, user.Username, "create_org", "org:"+org.ID, map[string]string{"name": org.Name})
+	org.Role = models.OrgRoleAdmin
+	StatusCreated.Serve(org)(w, r)
+}
+
+// FindOrgHandler gets the organisation in the url
+func (or *orgRouter) FindOrgHandler(w http.ResponseWriter, r *http.Request) {
+	org, err := or.orgAccess(r, models.OrgRoleMember)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(org)(w, r)
+}
+
+// RenameOrgHandler renames the organisation in the url. Admins only
+func (or *orgRouter) RenameOrgHandler(w http.ResponseWriter, r *http.Request) {
+	org, err := or.orgAccess(r, models.OrgRoleAdmin)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	name, err := decodeOrgName(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	if err = or.orgs.RenameOrg(r.Context(), org.ID, name); err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	org.Name = name
+	StatusOK.Serve(org)(w, r)
+}
+
+// DeleteOrgHandler deletes the organisation in the url with its directory, members and invites. Admins only
+func (or *orgRouter) DeleteOrgHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	org, err := or.orgAccess(r, models.OrgRoleAdmin)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	if err = or.orgs.DeleteOrg(ctx, org.ID); err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	if err = or.userStorage.RemoveOrgMembershipFromAll(ctx, org.ID); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	recordAudit(ctx, or.audit, user.Username, "delete_org", "org:"+org.ID, map[string]string{"name": org.Name})
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// ListMembersHandler lists the members of the organisation in the url
+func (or *orgRouter) ListMembersHandler(w http.ResponseWriter, r *http.Request) {
+	org, err := or.orgAccess(r, models.OrgRoleMember)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	members, err := or.userStorage.FindOrgMembers(r.Context(), org.ID)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(members)(w, r)
+}
+
+// SetMemberRoleHandler changes the role of the member in the url. Admins only, and the last admin can't be demoted
+func (or *orgRouter) SetMemberRoleHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	org, err := or.orgAccess(r, models.OrgRoleAdmin)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	var body roleRequest
+	if r.Body == nil {
+		StatusBadRequest.Serve(fmt.Errorf("no request body"))(w, r)
+		return
+	}
+	defer r.Body.Close()
+	if err = json.NewDecoder(r.Body).Decode(&body); err != nil || !body.Role.Valid() {
+		StatusBadRequest.Serve(fmt.Errorf("role must be member or admin"))(w, r)
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	membership, err := or.findMembership(r, org.ID, username)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	if membership.Role == models.OrgRoleAdmin && body.Role != models.OrgRoleAdmin {
+		if err = or.keepAnAdmin(r, org.ID); err != nil {
+			StatusBadRequest.Serve(err)(w, r)
+			return
+		}
+	}
+	membership.Role = body.Role
+	if err = or.userStorage.SaveOrgMembership(ctx, username, *membership); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	recordAudit(ctx, or.audit, user.Username, "set_org_role", "user:"+username, map[string]string{"org": org.ID, "role": string(body.Role)})
+	StatusOK.Serve(models.OrgMember{Username: username, Role: membership.Role, JoinedAt: membership.JoinedAt})(w, r)
+}
+
+// RemoveMemberHandler removes the member in the url. Admins remove anyone, members can remove themselves to leave.
+// The last admin can't leave
+func (or *orgRouter) RemoveMemberHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	username := mux.Vars(r)["username"]
+	need := models.OrgRoleAdmin
+	if username == user.Username {
+		need = models.OrgRoleMember
+	}
+	org, err := or.orgAccess(r, need)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	membership, err := or.findMembership(r, org.ID, username)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	if membership.Role == models.OrgRoleAdmin {
+		if err = or.keepAnAdmin(r, org.ID); err != nil {
+			StatusBadRequest.Serve(err)(w, r)
+			return
+		}
+	}
+	if err = or.userStorage.RemoveOrgMembership(ctx, username, org.ID); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	action := "remove_org_member"
+	if username == user.Username {
+		action = "leave_org"
+	}
+	recordAudit(ctx, or.audit, user.Username, action, "user:"+username, map[string]string{"org": org.ID})
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// ListOrgInvitesHandler lists the pending invites into the organisation in the url. Admins only
+func (or *orgRouter) ListOrgInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	org, err := or.orgAccess(r, models.OrgRoleAdmin)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	invites, err := or.orgs.FindOrgInvites(r.Context(), org.ID)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(invites)(w, r)
+}
+
+// InviteHandler invites the user in the body into the organisation in the url. Any member can invite members,
+// only admins can invite admins. Inviting a user again replaces their invite
+func (or *orgRouter) InviteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	org, err := or.orgAccess(r, models.OrgRoleMember)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	var body inviteRequest
+	if r.Body == nil {
+		StatusBadRequest.Serve(fmt.Errorf("no request body"))(w, r)
+		return
+	}
+	defer r.Body.Close()
+	if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	if body.Role == "" {
+		body.Role = models.OrgRoleMember
+	}
+	if !body.Role.Valid() {
+		StatusBadRequest.Serve(fmt.Errorf("role must be member or admin"))(w, r)
+		return
+	}
+	if body.Role == models.OrgRoleAdmin && org.Role != models.OrgRoleAdmin {
+		StatusForbidden.Serve(errOrgAdminOnly)(w, r)
+		return
+	}
+	invitee, err := or.userStorage.FindByUsername(ctx, body.Username)
+	if err != nil {
+		StatusNotFound.Serve(fmt.Errorf("No user with that username"))(w, r)
+		return
+	}
+	if _, ok := invitee.OrgRole(org.ID); ok {
+		StatusConflict.Serve(fmt.Errorf("%s is already a member", invitee.Username))(w, r)
+		return
+	}
+
+	now := time.Now().UTC()
+	invite, err := or.orgs.SaveOrgInvite(ctx, models.OrgInvite{
+		OrgID:     org.ID,
+		OrgName:   org.Name,
+		Username:  invitee.Username,
+		Role:      body.Role,
+		InvitedBy: user.Username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(orgInviteTTL),
+	})
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	recordAudit(ctx, or.audit, user.Username, "invite_org_member", "user:"+invitee.Username, map[string]string{"org": org.ID, "role": string(body.Role)})
+	StatusCreated.Serve(invite)(w, r)
+}
+
+// RevokeInviteHandler removes a pending invite into the organisation in the url. Admins only
+func (or *orgRouter) RevokeInviteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	org, err := or.orgAccess(r, models.OrgRoleAdmin)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	inviteID := mux.Vars(r)["invite"]
+	if err = or.orgs.DeleteOrgInvite(ctx, org.ID, inviteID); err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	recordAudit(ctx, or.audit, user.Username, "revoke_org_invite", "invite:"+inviteID, map[string]string{"org": org.ID})
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// ListUserInvitesHandler lists the pending invites to the user
+func (or *orgRouter) ListUserInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	invites, err := or.orgs.FindUserInvites(ctx, user.Username)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(invites)(w, r)
+}
+
+// AcceptInviteHandler accepts the invite in the url, making the user a member with the invited role
+func (or *orgRouter) AcceptInviteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	invite, err := or.userInvite(r)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	if invite, err = or.orgs.TakeOrgInvite(ctx, invite.ID); err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	org, err := or.orgs.FindOrg(ctx, invite.OrgID)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	if role, ok := user.OrgRole(org.ID); ok {
+		org.Role = role
+		StatusOK.Serve(org)(w, r)
+		return
+	}
+	membership := models.OrgMembership{OrgID: org.ID, Role: invite.Role, JoinedAt: time.Now().UTC()}
+	if err = or.userStorage.SaveOrgMembership(ctx, user.Username, membership); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	recordAudit(ctx, or.audit, user.Username, "join_org", "org:"+org.ID, map[string]string{"role": string(invite.Role), "invited_by": invite.InvitedBy})
+	org.Role = invite.Role
+	StatusOK.Serve(org)(w, r)
+}
+
+// DeclineInviteHandler removes the invite in the url without joining
+func (or *orgRouter) DeclineInviteHandler(w http.ResponseWriter, r *http.Request) {
+	invite, err := or.userInvite(r)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	if err = or.orgs.DeleteOrgInvite(r.Context(), invite.OrgID, invite.ID); err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// DirectoryHandler lists the company directory of the organisation in the url
+func (or *orgRouter) DirectoryHandler(w http.ResponseWriter, r *http.Request) {
+	org, err := or.orgAccess(r, models.OrgRoleMember)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	contacts, err := or.orgs.FindDirectory(r.Context(), org.ID)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(presentContacts(or.names, r, contacts))(w, r)
+}
+
+// FindDirectoryContactHandler gets a contact of the company directory
+func (or *orgRouter) FindDirectoryContactHandler(w http.ResponseWriter, r *http.Request) {
+	org, err := or.orgAccess(r, models.OrgRoleMember)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	contact, err := or.orgs.FindDirectoryContact(r.Context(), org.ID, mux.Vars(r)["id"])
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(presentContact(or.names, r, contact))(w, r)
+}
+
+// CreateDirectoryContactHandler adds a contact from a json body to the company directory. Admins only
+func (or *orgRouter) CreateDirectoryContactHandler(w http.ResponseWriter, r *http.Request) {
+	org, err := or.orgAccess(r, models.OrgRoleAdmin)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	contact, err := decodeContact(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	// the directory isn't a book, it has no custom fields
+	if contact.Custom, err = models.FieldDefinitions(nil).Apply(contact.Custom); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	created, err := or.orgs.CreateDirectoryContact(r.Context(), org.ID, contact)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(presentContact(or.names, r, created))(w, r)
+}
+
+// UpdateDirectoryContactHandler replaces a contact of the company directory with a json body. Admins only
+func (or *orgRouter) UpdateDirectoryContactHandler(w http.ResponseWriter, r *http.Request) {
+	org, err := or.orgAccess(r, models.OrgRoleAdmin)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	contact, err := decodeContact(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	if contact.Custom, err = models.FieldDefinitions(nil).Apply(contact.Custom); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	contact.ID = mux.Vars(r)["id"]
+	contact.BookID = ""
+	if err = or.orgs.UpdateDirectoryContact(r.Context(), org.ID, contact); err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(presentContact(or.names, r, &contact))(w, r)
+}
+
+// DeleteDirectoryContactHandler removes a contact from the company directory. Admins only
+func (or *orgRouter) DeleteDirectoryContactHandler(w http.ResponseWriter, r *http.Request) {
+	org, err := or.orgAccess(r, models.OrgRoleAdmin)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	if err = or.orgs.DeleteDirectoryContact(r.Context(), org.ID, mux.Vars(r)["id"]); err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// SearchHandler searches the user's own contacts and the company directory of the organisation in the url together.
+// The q query parameter matches names, emails and phones. The user's contacts come first, each sorted by sort name
+func (or *orgRouter) SearchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	org, err := or.orgAccess(r, models.OrgRoleMember)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+	own, err := or.userStorage.FindAllContacts(ctx, user.Username)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	directory, err := or.orgs.FindDirectory(ctx, org.ID)
+	if err != nil {
+		serveOrgError(err)(w, r)
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	results := []OrgSearchResult{}
+	for _, c := range presentContacts(or.names, r, own) {
+		if c.Matches(query) {
+			results = append(results, OrgSearchResult{SearchSourceContacts, c})
+		}
+	}
+	for _, c := range presentContacts(or.names, r, directory) {
+		if c.Matches(query) {
+			results = append(results, OrgSearchResult{SearchSourceDirectory, c})
+		}
+	}
+	StatusOK.Serve(results)(w, r)
+}
+
+// orgAccess finds the organisation in the url with the user's role in it, if the user has at least the needed role.
+// Organisations the user isn't a member of aren't found
+func (or *orgRouter) orgAccess(r *http.Request, need models.OrgRole) (*models.Org, error) {
+	user, _ := r.Context().Value(ContextUserKey).(*models.User)
+	orgID := mux.Vars(r)["org"]
+	role, ok := user.OrgRole(orgID)
+	if !ok {
+		return nil, storage.ErrOrgNotFound
+	}
+	org, err := or.orgs.FindOrg(r.Context(), orgID)
+	if err != nil {
+		return nil, err
+	}
+	if need == models.OrgRoleAdmin && role != models.OrgRoleAdmin {
+		return nil, errOrgAdminOnly
+	}
+	org.Role = role
+	return org, nil
+}
+
+// findMembership finds a member's membership of an organisation. Users who aren't members aren't found
+func (or *orgRouter) findMembership(r *http.Request, orgID string, username string) (*models.OrgMembership, error) {
+	member, err := or.userStorage.FindByUsername(r.Context(), username)
+	if err != nil {
+		return nil, errNotOrgMember
+	}
+	for _, m := range member.Orgs {
+		if m.OrgID == orgID {
+			return &m, nil
+		}
+	}
+	return nil, errNotOrgMember
+}
+
+// keepAnAdmin fails if the organisation has a single admin, before an admin is demoted or removed
+func (or *orgRouter) keepAnAdmin(r *http.Request, orgID string) error {
+	members, err := or.userStorage.FindOrgMembers(r.Context(), orgID)
+	if err != nil {
+		return err
+	}
+	admins := 0
+	for _, m := range members {
+		if m.Role == models.OrgRoleAdmin {
+			admins++
+		}
+	}
+	if admins <= 1 {
+		return fmt.Errorf("an organisation needs at least one admin")
+	}
+	return nil
+}
+
+// userInvite finds the pending invite in the url among the user's invites
+func (or *orgRouter) userInvite(r *http.Request) (*models.OrgInvite, error) {
+	user, _ := r.Context().Value(ContextUserKey).(*models.User)
+	invites, err := or.orgs.FindUserInvites(r.Context(), user.Username)
+	if err != nil {
+		return nil, err
+	}
+	inviteID := mux.Vars(r)["invite"]
+	for _, invite := range invites {
+		if invite.ID == inviteID {
+			return &invite, nil
+		}
+	}
+	return nil, storage.ErrInviteNotFound
+}
+
+// serveOrgError serves errors about organisations with a fitting status
+func serveOrgError(err error) http.HandlerFunc {
+	switch err {
+	case storage.ErrOrgNotFound, storage.ErrInviteNotFound, storage.ErrContactNotFound, errNotOrgMember:
+		return StatusNotFound.Serve(err)
+	case errOrgAdminOnly:
+		return StatusForbidden.Serve(err)
+	}
+	return StatusInternalServerError.Serve(err)
+}
+
+// decodeOrgName decodes and checks the name of an organisation from a json body
+func decodeOrgName(r *http.Request) (string, error) {
+	var body orgRequest
+	if r.Body == nil {
+		return "", fmt.Errorf("no request body")
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" || len(name) > maxOrgNameLength {
+		return "", fmt.Errorf("name must be between 1 and %d characters", maxOrgNameLength)
+	}
+	return name, nil
+}
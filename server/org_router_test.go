@@ -0,0 +1,119 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/server"
+	"github.com/Dacode45/addressbook/storage"
+)
+
+func Test_OrgRouter(t *testing.T) {
+	t.Run("test organisations", should_manage_orgs)
+}
+
+func should_manage_orgs(t *testing.T) {
+	session, uStorage := newStorage()
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	ctx := context.Background()
+	audit := storage.NewMemoryAuditStorage()
+	orgConfig := config
+	orgConfig.Audit = audit
+	orgConfig.Orgs = storage.NewMemoryOrgStorage()
+	admin, _ := populateDatabase(uStorage, 0)
+	member, own := populateDatabase(uStorage, 1)
+	adminToken, _ := newToken(uStorage, models.Credentials{Username: admin.Username})
+	memberToken, _ := newToken(uStorage, models.Credentials{Username: member.Username})
+	oRouter := server.NewOrgRouter(uStorage, orgConfig, mux.NewRouter())
+
+	res := testEndpoint("POST", "/", strings.NewReader(`{"name": "Acme"}`), oRouter, adminToken)
+	assert.Equal(t, http.StatusCreated, res.Code, "Created response is expected")
+	var org models.Org
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&org), "Failed to parse response")
+	assert.Equal(t, models.OrgRoleAdmin, org.Role, "Creators should be admins")
+	colleague := models.Contact{
+		FirstName: "Wile",
+		LastName:  "Coyote",
+		Emails:    models.ContactValues{{Label: models.LabelWork, Value: "wile@acme.com"}},
+		Phones:    models.ContactValues{{Label: models.LabelWork, Value: "555-0100"}},
+	}
+	colleagueStr, _ := json.Marshal(colleague)
+	res = testEndpoint("POST", fmt.Sprintf("/%s/directory", org.ID), bytes.NewBuffer(colleagueStr), oRouter, adminToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+
+	// organisations are hidden from users who aren't members
+	res = testEndpoint("GET", fmt.Sprintf("/%s/directory", org.ID), nil, oRouter, memberToken)
+	assert.Equal(t, http.StatusNotFound, res.Code, "Only members should see the directory")
+
+	// invites
+	res = testEndpoint("POST", fmt.Sprintf("/%s/invites", org.ID), strings.NewReader(fmt.Sprintf(`{"username": %q}`, member.Username)), oRouter, adminToken)
+	assert.Equal(t, http.StatusCreated, res.Code, "Created response is expected")
+	res = testEndpoint("GET", "/invites", nil, oRouter, memberToken)
+	var invites []models.OrgInvite
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&invites), "Failed to parse response")
+	assert.Len(t, invites, 1, "The invite should be pending")
+	assert.Equal(t, models.OrgRoleMember, invites[0].Role, "Invites should default to members")
+	res = testEndpoint("POST", fmt.Sprintf("/invites/%s/accept", invites[0].ID), nil, oRouter, adminToken)
+	assert.Equal(t, http.StatusNotFound, res.Code, "Only the invited user accepts an invite")
+	res = testEndpoint("POST", fmt.Sprintf("/invites/%s/accept", invites[0].ID), nil, oRouter, memberToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("POST", fmt.Sprintf("/invites/%s/accept", invites[0].ID), nil, oRouter, memberToken)
+	assert.Equal(t, http.StatusNotFound, res.Code, "Invites are used once")
+
+	// members read the directory, admins curate it
+	res = testEndpoint("GET", fmt.Sprintf("/%s/directory", org.ID), nil, oRouter, memberToken)
+	var directory []models.Contact
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&directory), "Failed to parse response")
+	assert.Len(t, directory, 1, "Members should read the directory")
+	res = testEndpoint("POST", fmt.Sprintf("/%s/directory", org.ID), bytes.NewBuffer(colleagueStr), oRouter, memberToken)
+	assert.Equal(t, http.StatusForbidden, res.Code, "Members should not curate the directory")
+	res = testEndpoint("POST", fmt.Sprintf("/%s/invites", org.ID), strings.NewReader(fmt.Sprintf(`{"username": %q, "role": "admin"}`, admin.Username)), oRouter, memberToken)
+	assert.Equal(t, http.StatusForbidden, res.Code, "Members should not invite admins")
+
+	// search combines the member's contacts with the directory
+	res = testEndpoint("GET", fmt.Sprintf("/%s/search", org.ID), nil, oRouter, memberToken)
+	var results []server.OrgSearchResult
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&results), "Failed to parse response")
+	assert.Len(t, results, 2, "An empty search should find everything")
+	assert.Equal(t, own[0].ID, results[0].ID, "The member's contacts should come first")
+	assert.Equal(t, server.SearchSourceContacts, results[0].Source, "Unexpected source")
+	assert.Equal(t, server.SearchSourceDirectory, results[1].Source, "Unexpected source")
+	res = testEndpoint("GET", fmt.Sprintf("/%s/search?q=COYOTE", org.ID), nil, oRouter, memberToken)
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&results), "Failed to parse response")
+	assert.Len(t, results, 1, "Search should ignore case")
+	assert.Equal(t, colleague.PreferredEmail(), results[0].PreferredEmail(), "Unexpected result")
+
+	// the last admin stays
+	res = testEndpoint("DELETE", fmt.Sprintf("/%s/members/%s", org.ID, admin.Username), nil, oRouter, adminToken)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "The last admin should not leave")
+	res = testEndpoint("PUT", fmt.Sprintf("/%s/members/%s", org.ID, member.Username), strings.NewReader(`{"role": "admin"}`), oRouter, adminToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = testEndpoint("DELETE", fmt.Sprintf("/%s/members/%s", org.ID, admin.Username), nil, oRouter, adminToken)
+	assert.Equal(t, http.StatusOK, res.Code, "Admins should leave once there is another admin")
+	res = testEndpoint("GET", fmt.Sprintf("/%s/members", org.ID), nil, oRouter, memberToken)
+	var members []models.OrgMember
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&members), "Failed to parse response")
+	assert.Len(t, members, 1, "Only the new admin should be left")
+
+	entries, _, _ := audit.List(ctx, 0, 10)
+	actions := []string{}
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	assert.Contains(t, actions, "join_org", "Joining should be audited")
+	assert.Contains(t, actions, "set_org_role", "Role changes should be audited")
+	assert.Contains(t, actions, "leave_org", "Leaving should be audited")
+}
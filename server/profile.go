@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/gorilla/mux"
+)
+
+// profileRequest is the body of UpdateProfileHandler
+type profileRequest struct {
+	ProfileVisibility models.ProfileVisibility `json:"profile_visibility"`
+}
+
+// GetUserHandler serves the profile of the user in the url as the logged in user is allowed to see it.
+// Private profiles are not found for other users, and contacts are only included for the owner and users granted access
+func (ur *userRouter) GetUserHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	caller, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || caller == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	username := mux.Vars(r)["username"]
+
+	user, err := ur.userStorage.FindByUsername(ctx, username)
+	if err != nil || user.DeletedAt != nil {
+		StatusNotFound.Serve(fmt.Errorf("user not found"))(w, r)
+		return
+	}
+	canViewContacts := user.CanViewContacts(caller.Username)
+	// private profiles look the same as missing ones
+	if user.Visibility() == models.VisibilityPrivate && !canViewContacts {
+		StatusNotFound.Serve(fmt.Errorf("user not found"))(w, r)
+		return
+	}
+
+	profile := models.Profile{Username: user.Username}
+	if user.Visibility() == models.VisibilityPublic && user.EmailVerified {
+		profile.Email = user.Email
+	}
+	if user.Username == caller.Username {
+		profile.ProfileVisibility = user.Visibility()
+	}
+	creds, _ := ctx.Value(ContextCredentialsKey).(*models.Credentials)
+	if canViewContacts && creds != nil && len(creds.MissingScopes(models.ScopeContactsRead)) == 0 {
+		profile.Contacts = user.Contacts
+	}
+	StatusOK.Serve(profile)(w, r)
+}
+
+// UpdateProfileHandler changes the logged in user's profile visibility
+func (ur *userRouter) UpdateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	var body profileRequest
+	if r.Body == nil {
+		StatusBadRequest.Serve(fmt.Errorf("no request body"))(w, r)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	if !body.ProfileVisibility.IsValid() {
+		StatusBadRequest.Serve(fmt.Errorf("profile_visibility must be public, users or private"))(w, r)
+		return
+	}
+
+	if err := ur.userStorage.SetProfileVisibility(ctx, user.Username, body.ProfileVisibility); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(models.Profile{
+		Username:          user.Username,
+		ProfileVisibility: body.ProfileVisibility,
+	})(w, r)
+}
+
+// ListContactViewersHandler lists the usernames granted access to the logged in user's contacts
+func (ur *userRouter) ListContactViewersHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	viewers := user.ContactViewers
+	if viewers == nil {
+		viewers = []string{}
+	}
+	StatusOK.Serve(viewers)(w, r)
+}
+
+// AddContactViewerHandler grants the user in the url read access to the logged in user's contacts
+func (ur *userRouter) AddContactViewerHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	viewer := mux.Vars(r)["username"]
+	if viewer == user.Username {
+		StatusBadRequest.Serve(fmt.Errorf("users can always see their own contacts"))(w, r)
+		return
+	}
+	found, err := ur.userStorage.FindByUsername(ctx, viewer)
+	if err != nil || found.DeletedAt != nil {
+		StatusNotFound.Serve(fmt.Errorf("user not found"))(w, r)
+		return
+	}
+
+	if err = ur.userStorage.AddContactViewer(ctx, user.Username, viewer); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(map[string]string{"msg": "Access granted"})(w, r)
+}
+
+// RemoveContactViewerHandler revokes the access of the user in the url to the logged in user's contacts
+func (ur *userRouter) RemoveContactViewerHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	viewer := mux.Vars(r)["username"]
+
+	if err := ur.userStorage.RemoveContactViewer(ctx, user.Username, viewer); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(map[string]string{"msg": "Access revoked"})(w, r)
+}
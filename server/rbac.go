@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/storage"
+)
+
+// RBAC resolves what users may do from the roles assigned to them. Built in roles come from models.BuiltInRoles, custom roles from storage
+type RBAC struct {
+	roles storage.RoleStorage
+}
+
+// NewRBAC creates an RBAC reading custom roles from roles
+func NewRBAC(roles storage.RoleStorage) *RBAC {
+	return &RBAC{roles}
+}
+
+// Role finds a built in or custom role by name
+func (rb *RBAC) Role(ctx context.Context, name models.Role) (models.RoleDefinition, error) {
+	if def, ok := models.BuiltInRole(name); ok {
+		return def, nil
+	}
+	return rb.roles.Find(ctx, name)
+}
+
+// Roles lists the built in roles followed by the custom roles
+func (rb *RBAC) Roles(ctx context.Context) ([]models.RoleDefinition, error) {
+	custom, err := rb.roles.FindAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]models.RoleDefinition{}, models.BuiltInRoles...), custom...), nil
+}
+
+// Permissions returns every permission granted by the user's roles. Roles that no longer exist grant nothing
+func (rb *RBAC) Permissions(ctx context.Context, user *models.User) (map[models.Permission]bool, error) {
+	granted := map[models.Permission]bool{}
+	for _, name := range user.Roles {
+		def, err := rb.Role(ctx, name)
+		if err == storage.ErrRoleNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range def.Permissions {
+			granted[p] = true
+		}
+	}
+	return granted, nil
+}
+
+// MissingPermissions returns the permissions from required that the user's roles don't grant
+func (rb *RBAC) MissingPermissions(ctx context.Context, user *models.User, required ...models.Permission) ([]models.Permission, error) {
+	granted, err := rb.Permissions(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	var missing []models.Permission
+	for _, p := range required {
+		if !granted[p] {
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
+
+// RequirePermissions only lets the request through if the user's roles grant every one of the permissions.
+// Tokens from impersonation and third party apps are turned away, whatever the roles of the user.
+// Must be wrapped by LoggedInMiddleware so the user is in the context
+func (rb *RBAC) RequirePermissions(next http.HandlerFunc, permissions ...models.Permission) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		user, ok := ctx.Value(ContextUserKey).(*models.User)
+		if !ok || user == nil {
+			StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+			return
+		}
+		creds, _ := ctx.Value(ContextCredentialsKey).(*models.Credentials)
+		if creds == nil || creds.Impersonator != "" || creds.ClientID != "" {
+			StatusForbidden.Serve(fmt.Errorf("impersonation and third party apps can't use the admin api"))(w, r)
+			return
+		}
+		missing, err := rb.MissingPermissions(ctx, user, permissions...)
+		if err != nil {
+			StatusInternalServerError.Serve(err)(w, r)
+			return
+		}
+		if len(missing) > 0 {
+			StatusForbidden.ServeDetails(ErrorDetails{
+				Message: fmt.Sprintf("route requires the %s permission", missing[0]),
+				Code:    "insufficient_permission",
+				Details: map[string][]models.Permission{"missing_permissions": missing},
+			})(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
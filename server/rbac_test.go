@@ -0,0 +1,83 @@
+package server_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/server"
+	"github.com/Dacode45/addressbook/storage"
+)
+
+func Test_RBAC(t *testing.T) {
+	t.Run("built in roles grant permissions", should_grant_built_in_permissions)
+	t.Run("custom roles grant permissions", should_grant_custom_permissions)
+	t.Run("middleware checks permissions", should_require_permissions)
+}
+
+func should_grant_built_in_permissions(t *testing.T) {
+	ctx := context.Background()
+	rbac := server.NewRBAC(storage.NewMemoryRoleStorage())
+
+	missing, err := rbac.MissingPermissions(ctx, &models.User{Roles: []models.Role{models.RoleAdmin}}, models.Permissions...)
+	assert.NoError(t, err, "Failed to resolve permissions")
+	assert.Empty(t, missing, "Admins should have every permission")
+
+	support := &models.User{Roles: []models.Role{models.RoleSupport}}
+	missing, _ = rbac.MissingPermissions(ctx, support, models.PermissionUsersRead, models.PermissionUsersContacts, models.PermissionUsersManage)
+	assert.Equal(t, []models.Permission{models.PermissionUsersManage}, missing, "Support should be read only")
+
+	auditor := &models.User{Roles: []models.Role{models.RoleAuditor}}
+	missing, _ = rbac.MissingPermissions(ctx, auditor, models.PermissionAuditRead, models.PermissionUsersRead)
+	assert.Equal(t, []models.Permission{models.PermissionUsersRead}, missing, "Auditors should only read the audit log")
+
+	missing, _ = rbac.MissingPermissions(ctx, &models.User{}, models.PermissionUsersRead)
+	assert.Equal(t, []models.Permission{models.PermissionUsersRead}, missing, "Users should have no permissions")
+}
+
+func should_grant_custom_permissions(t *testing.T) {
+	ctx := context.Background()
+	roles := storage.NewMemoryRoleStorage()
+	rbac := server.NewRBAC(roles)
+	user := &models.User{Roles: []models.Role{"unlocker"}}
+
+	missing, err := rbac.MissingPermissions(ctx, user, models.PermissionUsersManage)
+	assert.NoError(t, err, "Missing roles should grant nothing")
+	assert.Len(t, missing, 1, "Missing roles should grant nothing")
+
+	assert.NoError(t, roles.Save(ctx, models.RoleDefinition{
+		Name:        "unlocker",
+		Permissions: []models.Permission{models.PermissionUsersManage},
+	}), "Failed to save role")
+	missing, _ = rbac.MissingPermissions(ctx, user, models.PermissionUsersManage)
+	assert.Empty(t, missing, "Custom role should grant its permissions")
+
+	all, err := rbac.Roles(ctx)
+	assert.NoError(t, err, "Failed to list roles")
+	assert.Len(t, all, len(models.BuiltInRoles)+1, "Roles should list built in and custom roles")
+}
+
+func should_require_permissions(t *testing.T) {
+	rbac := server.NewRBAC(storage.NewMemoryRoleStorage())
+	handler := rbac.RequirePermissions(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}, models.PermissionAuditRead)
+	serve := func(user *models.User, creds *models.Credentials) int {
+		req, _ := http.NewRequest("GET", "/", nil)
+		ctx := context.WithValue(req.Context(), server.ContextUserKey, user)
+		ctx = context.WithValue(ctx, server.ContextCredentialsKey, creds)
+		res := httptest.NewRecorder()
+		handler(res, req.WithContext(ctx))
+		return res.Code
+	}
+
+	auditor := &models.User{Username: "auditor", Roles: []models.Role{models.RoleAuditor}}
+	assert.Equal(t, http.StatusOK, serve(auditor, &models.Credentials{Username: "auditor"}), "Auditor should be let through")
+	assert.Equal(t, http.StatusForbidden, serve(&models.User{Username: "user"}, &models.Credentials{Username: "user"}), "Users should be turned away")
+	impersonated := &models.Credentials{Username: "auditor", Impersonator: "root"}
+	assert.Equal(t, http.StatusForbidden, serve(auditor, impersonated), "Impersonation should be turned away")
+}
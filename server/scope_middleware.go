@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Dacode45/addressbook/models"
+)
+
+// RequireScopes only lets the request through if its credentials carry every one of the scopes.
+// Must be wrapped by TokenAuthMiddleware or LoggedInMiddleware so the credentials are in the context
+func RequireScopes(next http.HandlerFunc, scopes ...models.Scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		creds, ok := r.Context().Value(ContextCredentialsKey).(*models.Credentials)
+		if !ok || creds == nil {
+			StatusUnauthorized.Serve(fmt.Errorf("no jwt passed"))(w, r)
+			return
+		}
+		missing := creds.MissingScopes(scopes...)
+		if len(missing) > 0 {
+			StatusForbidden.ServeDetails(ErrorDetails{
+				Message: fmt.Sprintf("token is missing the %s scope", missing[0]),
+				Code:    "insufficient_scope",
+				Details: map[string][]models.Scope{"missing_scopes": missing},
+			})(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// validateScopes checks that requested scopes are known. No requested scopes means the DefaultScopes
+func validateScopes(requested []models.Scope) ([]models.Scope, error) {
+	if len(requested) == 0 {
+		return models.DefaultScopes, nil
+	}
+	var unknown []models.Scope
+	for _, s := range requested {
+		if !s.IsValid() {
+			unknown = append(unknown, s)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, ErrorDetails{
+			Message: fmt.Sprintf("unknown scope %s", unknown[0]),
+			Code:    "invalid_scope",
+			Details: map[string][]models.Scope{"unknown_scopes": unknown},
+		}
+	}
+	return requested, nil
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
@@ -18,9 +19,38 @@ type Server struct {
 
 // NewServer creates a new Server given a storage backend and configuration
 func NewServer(u storage.UserStorage, config ServerConfig) *Server {
+	// routers must share the throttle storage so that lockouts can be lifted, the audit log so it is complete, the custom roles, the third party apps, and the photos
+	if config.Throttle == nil {
+		config.Throttle = storage.NewMemoryThrottleStorage()
+	}
+	if config.Audit == nil {
+		config.Audit = storage.NewMemoryAuditStorage()
+	}
+	if config.Roles == nil {
+		config.Roles = storage.NewMemoryRoleStorage()
+	}
+	if config.OAuth == nil {
+		config.OAuth = storage.NewMemoryOAuthStorage()
+	}
+	if config.Orgs == nil {
+		config.Orgs = storage.NewMemoryOrgStorage()
+	}
+	if config.Blobs == nil {
+		config.Blobs = storage.NewMemoryBlobStore()
+	}
+	if config.AdminUsername != "" {
+		if err := BootstrapAdmin(context.Background(), u, config.AdminUsername, config.AdminPassword); err != nil {
+			log.Printf("Unable to bootstrap the admin: %s", err)
+		}
+	}
 	s := Server{router: mux.NewRouter(), config: config}
 	NewUserRouter(u, config, s.newSubrouter("/api/v1/users"))
 	NewContactRouter(u, config, s.newSubrouter("/api/v1/contacts"))
+	NewBookRouter(u, config, s.newSubrouter("/api/v1/books"))
+	NewGroupRouter(u, config, s.newSubrouter("/api/v1/groups"))
+	NewOrgRouter(u, config, s.newSubrouter("/api/v1/orgs"))
+	NewAdminRouter(u, config, s.newSubrouter("/api/v1/admin"))
+	NewOAuthRouter(u, config, s.newSubrouter("/api/v1/oauth"))
 	return &s
 }
 
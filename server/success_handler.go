@@ -11,4 +11,8 @@ var (
 	StatusOK = JSONHandler(http.StatusOK)
 	// StatusOkCSV serves csv with the StatusOkCSVCode
 	StatusOKCSV = CSVHandler(http.StatusOK)
+	// StatusOKVCard serves vCards with the StatusOK code
+	StatusOKVCard = VCardHandler(http.StatusOK)
+	// StatusOKText serves plain text with the StatusOK code
+	StatusOKText = TextHandler(http.StatusOK)
 )
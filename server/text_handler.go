@@ -0,0 +1,19 @@
+package server
+
+import (
+	"io"
+	"net/http"
+)
+
+// TextHandler serves responses as plain text, like lists of addresses to paste in a mail client
+type TextHandler int
+
+// Serve serves text as text/plain
+func (t TextHandler) Serve(text string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := int(t)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		io.WriteString(w, text)
+	}
+}
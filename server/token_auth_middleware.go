@@ -35,8 +35,8 @@ func (coder *JWTCoder) TokenAuthMiddleware(next http.HandlerFunc) http.HandlerFu
 	}
 }
 
-// LoggedInMiddleware logs the user in based of their jwt token
-func LoggedInMiddleware(jwtCoder *JWTCoder, userStorage storage.UserStorage, next http.HandlerFunc) http.HandlerFunc {
+// LoggedInMiddleware logs the user in based of their jwt token. Every request made with an impersonation token is added to the audit log
+func LoggedInMiddleware(jwtCoder *JWTCoder, userStorage storage.UserStorage, audit storage.AuditStorage, next http.HandlerFunc) http.HandlerFunc {
 	return jwtCoder.TokenAuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		creds, ok := ctx.Value(ContextCredentialsKey).(*models.Credentials)
@@ -44,13 +44,50 @@ func LoggedInMiddleware(jwtCoder *JWTCoder, userStorage storage.UserStorage, nex
 			StatusUnauthorized.Serve(fmt.Errorf("no jwt passed"))(w, r)
 			return
 		}
-		user, err := userStorage.Login(r.Context(), *creds)
+		user, err := authenticate(ctx, userStorage, *creds)
 		if err != nil {
 			StatusUnauthorized.Serve(err)(w, r)
 			return
 		}
+		if creds.Impersonator != "" {
+			recordAudit(ctx, audit, creds.Impersonator, "impersonated_request", user.Username, map[string]string{"method": r.Method, "path": r.URL.Path})
+		}
 		ctx = context.WithValue(ctx, ContextUserKey, user)
 		r = r.WithContext(ctx)
 		next(w, r)
 	})
 }
+
+// authenticate finds the user a token was issued to. Tokens issued before tokens stopped carrying the password still have their password checked,
+// other tokens must carry the id of the user, since usernames are reused after renames and deletions.
+// Tokens of deleted accounts, tokens issued before the user's sessions were revoked, and tokens of third party apps the user revoked are rejected
+func authenticate(ctx context.Context, userStorage storage.UserStorage, creds models.Credentials) (*models.User, error) {
+	var user *models.User
+	var err error
+	if creds.Password != "" {
+		user, err = userStorage.Login(ctx, creds)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		user, err = userStorage.FindByUsername(ctx, creds.Username)
+		if err != nil || creds.UserID == "" || creds.UserID != user.UserID {
+			return nil, fmt.Errorf("user no longer exists")
+		}
+	}
+	if user.DeletedAt != nil {
+		return nil, fmt.Errorf("account is scheduled for deletion")
+	}
+	if user.Disabled {
+		return nil, fmt.Errorf("account is disabled")
+	}
+	if creds.SessionVersion != user.SessionVersion {
+		return nil, fmt.Errorf("session was revoked")
+	}
+	if creds.ClientID != "" {
+		if grant, ok := user.OAuthGrant(creds.ClientID); !ok || grant.ID != creds.GrantID {
+			return nil, fmt.Errorf("access was revoked")
+		}
+	}
+	return user, nil
+}
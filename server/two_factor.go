@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Dacode45/addressbook/crypto"
+	"github.com/Dacode45/addressbook/models"
+)
+
+const (
+	// mfaChallengeTTL is how long a user has to enter their second factor after their password
+	mfaChallengeTTL = 5 * time.Minute
+	// recoveryCodeCount is how many recovery codes are issued when two factor is enabled
+	recoveryCodeCount = 10
+	// qrCodeSize is the width and height of the enrollment qr code in pixels
+	qrCodeSize = 256
+)
+
+// MFAChallenge is returned by login instead of a JWTToken when the user has two factor enabled
+type MFAChallenge struct {
+	MFARequired    bool   `json:"mfa_required"`
+	ChallengeToken string `json:"challenge_token"`
+}
+
+// TwoFactorEnrollment is the secret and uri an authenticator app needs to enroll
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// twoFactorRequest is the body of the two factor endpoints. Code is either a totp code or a recovery code
+type twoFactorRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+// EnrollTwoFactorHandler starts two factor enrollment by generating a new secret. Two factor isn't enabled until a code is verified
+func (ur *userRouter) EnrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	if user.TwoFactorEnabled {
+		StatusBadRequest.Serve(fmt.Errorf("two factor is already enabled"))(w, r)
+		return
+	}
+
+	secret, err := ur.totp.GenerateSecret()
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	err = ur.userStorage.SetTOTPSecret(ctx, user.Username, secret)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(TwoFactorEnrollment{
+		Secret: secret,
+		URI:    ur.totp.URI(user.Username, secret),
+	})(w, r)
+}
+
+// TwoFactorQRHandler serves the pending enrollment as a png qr code
+func (ur *userRouter) TwoFactorQRHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	if user.TwoFactorEnabled || user.TOTPSecret == "" {
+		StatusNotFound.Serve(fmt.Errorf("no pending two factor enrollment"))(w, r)
+		return
+	}
+
+	png, err := ur.totp.QRCode(user.Username, user.TOTPSecret, qrCodeSize)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(png)
+}
+
+// VerifyTwoFactorHandler enables two factor once the user proves their app generates valid codes. Responds with the recovery codes, which are never shown again
+func (ur *userRouter) VerifyTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := decodeTwoFactorRequest(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	user, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	if user.TwoFactorEnabled || user.TOTPSecret == "" {
+		StatusBadRequest.Serve(fmt.Errorf("no pending two factor enrollment"))(w, r)
+		return
+	}
+
+	step, err := ur.totp.Validate(user.TOTPSecret, body.Code, time.Now())
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	err = ur.userStorage.ConsumeTOTPStep(ctx, user.Username, step)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+
+	codes, err := crypto.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	err = ur.userStorage.EnableTwoFactor(ctx, user.Username, codes)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(map[string][]string{"recovery_codes": codes})(w, r)
+}
+
+// DisableTwoFactorHandler turns two factor off. Requires a current code or a recovery code, throttled like MFALoginHandler
+func (ur *userRouter) DisableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := decodeTwoFactorRequest(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	user, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	if !user.TwoFactorEnabled {
+		StatusBadRequest.Serve(fmt.Errorf("two factor is not enabled"))(w, r)
+		return
+	}
+
+	// a stolen session could otherwise guess codes until two factor is off
+	if err = ur.throttle.Check(r, user.Username); err != nil {
+		serveThrottleError(err)(w, r)
+		return
+	}
+	err = ur.verifySecondFactor(ctx, user, body.Code)
+	if err != nil {
+		if ferr := ur.throttle.Failure(r, user.Username); ferr != nil {
+			log.Printf("Unable to record failed login: %s", ferr)
+		}
+		StatusUnauthorized.Serve(err)(w, r)
+		return
+	}
+	if err = ur.throttle.Success(r, user.Username); err != nil {
+		log.Printf("Unable to reset failed logins: %s", err)
+	}
+	err = ur.userStorage.DisableTwoFactor(ctx, user.Username)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// MFALoginHandler exchanges a challenge token from LoginHandler and a second factor for a JWT token
+func (ur *userRouter) MFALoginHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := decodeTwoFactorRequest(r)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+
+	credentials, err := ur.jwtCoder.DecodeChallenge(body.ChallengeToken)
+	if err != nil {
+		StatusUnauthorized.Serve(err)(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	user, err := authenticate(ctx, ur.userStorage, *credentials)
+	if err != nil {
+		StatusUnauthorized.Serve(err)(w, r)
+		return
+	}
+	if user.TwoFactorEnabled {
+		// codes are short, so guesses are throttled like passwords
+		if err = ur.throttle.Check(r, user.Username); err != nil {
+			serveThrottleError(err)(w, r)
+			return
+		}
+		err = ur.verifySecondFactor(ctx, user, body.Code)
+		if err != nil {
+			if ferr := ur.throttle.Failure(r, user.Username); ferr != nil {
+				log.Printf("Unable to record failed login: %s", ferr)
+			}
+			StatusUnauthorized.Serve(err)(w, r)
+			return
+		}
+		if err = ur.throttle.Success(r, user.Username); err != nil {
+			log.Printf("Unable to reset failed logins: %s", err)
+		}
+	}
+	ur.serveToken(user, *credentials)(w, r)
+}
+
+// serveMFAChallenge responds to a correct password with a challenge token instead of a JWTToken
+func (ur *userRouter) serveMFAChallenge(user *models.User, credentials models.Credentials) http.HandlerFunc {
+	credentials, err := ur.sessionCredentials(user, credentials)
+	if err != nil {
+		return StatusForbidden.Serve(err)
+	}
+	token, err := ur.jwtCoder.CreateChallenge(credentials, mfaChallengeTTL)
+	if err != nil {
+		return StatusInternalServerError.Serve(err)
+	}
+	return StatusOK.Serve(MFAChallenge{
+		MFARequired:    true,
+		ChallengeToken: token.Token,
+	})
+}
+
+// verifySecondFactor accepts either an unused totp code or a recovery code, which is used up
+func (ur *userRouter) verifySecondFactor(ctx context.Context, user *models.User, code string) error {
+	if step, err := ur.totp.Validate(user.TOTPSecret, code, time.Now()); err == nil {
+		return ur.userStorage.ConsumeTOTPStep(ctx, user.Username, step)
+	}
+	code = strings.ToLower(strings.TrimSpace(code))
+	if code == "" {
+		return fmt.Errorf("Invalid code")
+	}
+	return ur.userStorage.ConsumeRecoveryCode(ctx, user.Username, code)
+}
+
+// decodeTwoFactorRequest decodes a twoFactorRequest from the json body
+func decodeTwoFactorRequest(r *http.Request) (twoFactorRequest, error) {
+	var t twoFactorRequest
+	if r.Body == nil {
+		return t, fmt.Errorf("no request body")
+	}
+	err := json.NewDecoder(r.Body).Decode(&t)
+	return t, err
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxGroupNameLength bounds the names of groups of users
+	maxGroupNameLength = 100
+	// maxGroupMembers bounds how many users are in a group
+	maxGroupMembers = 500
+)
+
+// ListUserGroupsHandler lists the groups of users the user owns or is a member of
+func (ur *userRouter) ListUserGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	groups, err := ur.userStorage.FindUserGroups(ctx, user.Username)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(groups)(w, r)
+}
+
+// CreateUserGroupHandler creates a group of users from a json body. Books shared with the group are shared with its members
+func (ur *userRouter) CreateUserGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	group, err := ur.decodeUserGroup(r, user)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	created, err := ur.userStorage.CreateUserGroup(ctx, user.Username, group)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	recordAudit(ctx, ur.audit, user.Username, "create_user_group", "group:"+created.ID, map[string]string{"members": strings.Join(created.Members, ",")})
+	StatusCreated.Serve(created)(w, r)
+}
+
+// UpdateUserGroupHandler renames the group in the url and replaces its members. Removed members lose the access shared with the group
+func (ur *userRouter) UpdateUserGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	group, err := ur.decodeUserGroup(r, user)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	group.ID = mux.Vars(r)["group"]
+	group.Owner = user.Username
+	if err = ur.userStorage.UpdateUserGroup(ctx, user.Username, group); err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	recordAudit(ctx, ur.audit, user.Username, "update_user_group", "group:"+group.ID, map[string]string{"members": strings.Join(group.Members, ",")})
+	StatusOK.Serve(group)(w, r)
+}
+
+// DeleteUserGroupHandler deletes the group in the url. Books shared with the group stop being shared with its members
+func (ur *userRouter) DeleteUserGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, _ := ctx.Value(ContextUserKey).(*models.User)
+	groupID := mux.Vars(r)["group"]
+	if err := ur.userStorage.DeleteUserGroup(ctx, user.Username, groupID); err != nil {
+		serveBookError(err)(w, r)
+		return
+	}
+	recordAudit(ctx, ur.audit, user.Username, "delete_user_group", "group:"+groupID, nil)
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// decodeUserGroup decodes a group of users from a json body. Members must exist, and the owner isn't listed
+func (ur *userRouter) decodeUserGroup(r *http.Request, owner *models.User) (models.UserGroup, error) {
+	var group models.UserGroup
+	if r.Body == nil {
+		return group, fmt.Errorf("no request body")
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		return group, err
+	}
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" || len(group.Name) > maxGroupNameLength {
+		return group, fmt.Errorf("name must be between 1 and %d characters", maxGroupNameLength)
+	}
+	if len(group.Members) > maxGroupMembers {
+		return group, fmt.Errorf("groups can have at most %d members", maxGroupMembers)
+	}
+
+	members := []string{}
+	seen := map[string]bool{owner.Username: true}
+	for _, member := range group.Members {
+		if seen[member] {
+			continue
+		}
+		seen[member] = true
+		if _, err := ur.userStorage.FindByUsername(r.Context(), member); err != nil {
+			return group, fmt.Errorf("no user named %s", member)
+		}
+		members = append(members, member)
+	}
+	group.Members = members
+	return group, nil
+}
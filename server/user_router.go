@@ -3,10 +3,16 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"time"
 
+	"github.com/Dacode45/addressbook/common"
+	"github.com/Dacode45/addressbook/crypto"
 	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/password"
 	"github.com/Dacode45/addressbook/storage"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/gorilla/mux"
 )
 
@@ -14,17 +20,83 @@ import (
 type userRouter struct {
 	userStorage storage.UserStorage
 	jwtCoder    *JWTCoder
+	totp        *crypto.TOTP
+	webAuthn    *webauthn.WebAuthn
+	mailer      common.Mailer
+	publicURL   string
+	throttle    *LoginThrottle
+	policy      *password.Policy
+	gracePeriod time.Duration
+	oidc        *OIDCLogin
+	audit       storage.AuditStorage
 }
 
 // NewUserRouter creates a new userRouter
 func NewUserRouter(u storage.UserStorage, config ServerConfig, router *mux.Router) *mux.Router {
 	jwtCoder := NewJWTCoder(config.JWTSecret)
-	userRouter := userRouter{u, jwtCoder}
+	audit := config.auditLog()
+	webAuthn, err := webauthn.New(config.webAuthnConfig())
+	if err != nil {
+		log.Printf("Passkeys are disabled: %s", err)
+	}
+	userRouter := userRouter{
+		userStorage: u,
+		jwtCoder:    jwtCoder,
+		totp:        crypto.NewTOTP(config.totpIssuer()),
+		webAuthn:    webAuthn,
+		mailer:      config.mailer(),
+		publicURL:   config.publicURL(),
+		throttle:    config.loginThrottle(),
+		policy:      config.passwordPolicy(),
+		gracePeriod: config.deletionGracePeriod(),
+		oidc:        NewOIDCLogin(config),
+		audit:       audit,
+	}
 
 	router.HandleFunc("/", userRouter.CreateUserHandler).Methods("POST")
 	router.HandleFunc("/login", userRouter.LoginHandler).Methods("POST")
-	router.HandleFunc("/me", LoggedInMiddleware(jwtCoder, u, userRouter.GetLoggedInUser)).Methods("GET")
-	router.HandleFunc("/{username}", userRouter.GetUserHandler).Methods("GET")
+	router.HandleFunc("/login/mfa", userRouter.MFALoginHandler).Methods("POST")
+	router.HandleFunc("/login/webauthn/begin", userRouter.BeginWebAuthnLoginHandler).Methods("POST")
+	router.HandleFunc("/login/webauthn/finish", userRouter.FinishWebAuthnLoginHandler).Methods("POST")
+	router.HandleFunc("/login/oidc", userRouter.BeginOIDCLoginHandler).Methods("GET")
+	router.HandleFunc("/login/oidc/callback", userRouter.OIDCCallbackHandler).Methods("GET")
+	router.HandleFunc("/me", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.GetLoggedInUser, models.ScopeProfileRead))).Methods("GET")
+	// account management
+	router.HandleFunc("/me/password", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.ChangePasswordHandler, models.ScopeProfileWrite))).Methods("PUT")
+	router.HandleFunc("/me/username", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.ChangeUsernameHandler, models.ScopeProfileWrite))).Methods("PUT")
+	router.HandleFunc("/me", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.DeleteAccountHandler, models.ScopeProfileWrite))).Methods("DELETE")
+	router.HandleFunc("/me/oidc", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.LinkOIDCHandler, models.ScopeProfileWrite))).Methods("POST")
+	router.HandleFunc("/restore", userRouter.RestoreAccountHandler).Methods("POST")
+	// email verification and password reset
+	router.HandleFunc("/email/verify", userRouter.VerifyEmailHandler).Methods("POST")
+	router.HandleFunc("/password/forgot", userRouter.ForgotPasswordHandler).Methods("POST")
+	router.HandleFunc("/password/reset", userRouter.ResetPasswordHandler).Methods("POST")
+	router.HandleFunc("/me/email", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.ChangeEmailHandler, models.ScopeProfileWrite))).Methods("PUT")
+	router.HandleFunc("/me/email/verify", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.ResendVerificationHandler, models.ScopeProfileWrite))).Methods("POST")
+	// two factor
+	router.HandleFunc("/me/2fa", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.EnrollTwoFactorHandler, models.ScopeProfileWrite))).Methods("POST")
+	router.HandleFunc("/me/2fa/qr", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.TwoFactorQRHandler, models.ScopeProfileWrite))).Methods("GET")
+	router.HandleFunc("/me/2fa/verify", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.VerifyTwoFactorHandler, models.ScopeProfileWrite))).Methods("POST")
+	router.HandleFunc("/me/2fa", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.DisableTwoFactorHandler, models.ScopeProfileWrite))).Methods("DELETE")
+	// passkeys
+	router.HandleFunc("/me/webauthn", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.ListWebAuthnCredentialsHandler, models.ScopeProfileRead))).Methods("GET")
+	router.HandleFunc("/me/webauthn/register/begin", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.BeginWebAuthnRegistrationHandler, models.ScopeProfileWrite))).Methods("POST")
+	router.HandleFunc("/me/webauthn/register/finish", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.FinishWebAuthnRegistrationHandler, models.ScopeProfileWrite))).Methods("POST")
+	router.HandleFunc("/me/webauthn/{id}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.DeleteWebAuthnCredentialHandler, models.ScopeProfileWrite))).Methods("DELETE")
+	// profiles
+	router.HandleFunc("/me/profile", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.UpdateProfileHandler, models.ScopeProfileWrite))).Methods("PUT")
+	router.HandleFunc("/me/viewers", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.ListContactViewersHandler, models.ScopeProfileRead))).Methods("GET")
+	router.HandleFunc("/me/viewers/{username}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.AddContactViewerHandler, models.ScopeProfileWrite))).Methods("PUT")
+	router.HandleFunc("/me/viewers/{username}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.RemoveContactViewerHandler, models.ScopeProfileWrite))).Methods("DELETE")
+	// third party apps
+	router.HandleFunc("/me/apps", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.ListOAuthGrantsHandler, models.ScopeProfileRead))).Methods("GET")
+	router.HandleFunc("/me/apps/{client_id}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.RevokeOAuthGrantHandler, models.ScopeProfileWrite))).Methods("DELETE")
+	// groups of users to share books with
+	router.HandleFunc("/me/groups", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.ListUserGroupsHandler, models.ScopeProfileRead))).Methods("GET")
+	router.HandleFunc("/me/groups", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.CreateUserGroupHandler, models.ScopeProfileWrite))).Methods("POST")
+	router.HandleFunc("/me/groups/{group}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.UpdateUserGroupHandler, models.ScopeProfileWrite))).Methods("PUT")
+	router.HandleFunc("/me/groups/{group}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.DeleteUserGroupHandler, models.ScopeProfileWrite))).Methods("DELETE")
+	router.HandleFunc("/{username}", LoggedInMiddleware(jwtCoder, u, audit, RequireScopes(userRouter.GetUserHandler, models.ScopeProfileRead))).Methods("GET")
 	return router
 }
 
@@ -35,28 +107,37 @@ func (ur *userRouter) CreateUserHandler(w http.ResponseWriter, r *http.Request)
 		StatusBadRequest.Serve(err)(w, r)
 		return
 	}
-
-	err = ur.userStorage.Insert(r.Context(), user)
+	if err = validateUsername(user.Username); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	user.Email, err = normalizeEmail(user.Email)
 	if err != nil {
-		StatusInternalServerError.Serve(err)(w, r)
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	if err = ur.checkPassword(user.Password, user.Username, user.Email); err != nil {
+		servePasswordError(err)(w, r)
 		return
 	}
-	user.Password = ""
-
-	StatusOK.Serve(user)(w, r)
-}
 
-// GetUserHandler gets a
-func (ur *userRouter) GetUserHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	username := vars["username"]
+	// only admins can change these
+	user.Roles = nil
+	user.Disabled = false
+	user.PasswordResetRequired = false
+	// identities are only linked by logging in at the provider
+	user.OIDCIdentities = nil
 
-	user, err := ur.userStorage.FindByUsername(r.Context(), username)
+	err = ur.userStorage.Insert(r.Context(), user)
 	if err != nil {
-		StatusNotFound.Serve(err)(w, r)
+		StatusInternalServerError.Serve(err)(w, r)
 		return
 	}
 	user.Password = ""
+	user.EmailVerified = false
+	if user.Email != "" {
+		ur.sendVerification(r.Context(), user.Username, user.Email)
+	}
 
 	StatusOK.Serve(user)(w, r)
 }
@@ -81,18 +162,103 @@ func (ur *userRouter) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = ur.userStorage.Login(r.Context(), credentials)
+	credentials.Scopes, err = validateScopes(credentials.Scopes)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+
+	// throttled requests are turned away before the password is hashed
+	if err = ur.throttle.Check(r, credentials.Username); err != nil {
+		serveThrottleError(err)(w, r)
+		return
+	}
+
+	var user *models.User
+	user, err = ur.userStorage.Login(r.Context(), credentials)
 	if err != nil {
+		if err = ur.throttle.Failure(r, credentials.Username); err != nil {
+			log.Printf("Unable to record failed login: %s", err)
+		}
 		StatusUnauthorized.Serve(fmt.Errorf("Incorrect password"))(w, r)
 		return
 	}
-	// User is logged in send jwt token
-	var token JWTToken
-	token, err = ur.jwtCoder.Create(credentials)
+	// users with two factor aren't logged in until MFALoginHandler accepts their code, which shares the username's failures.
+	// Forgetting them here would let anyone with the password guess codes forever
+	if !user.TwoFactorEnabled {
+		if err = ur.throttle.Success(r, credentials.Username); err != nil {
+			log.Printf("Unable to reset failed logins: %s", err)
+		}
+	}
+	ur.serveLogin(user, credentials)(w, r)
+}
+
+// serveLogin responds to a correct password with a JWTToken, or a challenge token if the user has two factor enabled.
+// Users who must reset their password are emailed a reset link instead
+func (ur *userRouter) serveLogin(user *models.User, credentials models.Credentials) http.HandlerFunc {
+	if user.PasswordResetRequired && !user.Disabled && user.DeletedAt == nil {
+		return ur.servePasswordResetRequired(user)
+	}
+	if user.TwoFactorEnabled {
+		return ur.serveMFAChallenge(user, credentials)
+	}
+	return ur.serveToken(user, credentials)
+}
+
+// serveToken responds with the JWTToken for the logged in user. Every way of logging in ends here
+func (ur *userRouter) serveToken(user *models.User, credentials models.Credentials) http.HandlerFunc {
+	credentials, err := ur.sessionCredentials(user, credentials)
 	if err != nil {
-		StatusInternalServerError.Serve(err)(w, r)
+		return StatusForbidden.Serve(err)
+	}
+	token, err := ur.jwtCoder.Create(credentials)
+	if err != nil {
+		return StatusInternalServerError.Serve(err)
+	}
+	return StatusOK.Serve(token)
+}
+
+// sessionCredentials ties credentials to the user's current session version. Deleted accounts can't start sessions
+func (ur *userRouter) sessionCredentials(user *models.User, credentials models.Credentials) (models.Credentials, error) {
+	if user.DeletedAt != nil {
+		return credentials, ur.accountDeletedError(user)
+	}
+	if user.Disabled {
+		return credentials, ErrorDetails{Message: "Account is disabled", Code: "account_disabled"}
+	}
+	if user.PasswordResetRequired {
+		return credentials, ErrorDetails{Message: "Password must be reset", Code: "password_reset_required"}
+	}
+	// the password was checked, tokens only need to identify the user
+	credentials.Username = user.Username
+	credentials.UserID = user.UserID
+	credentials.Password = ""
+	credentials.SessionVersion = user.SessionVersion
+	return credentials, nil
+}
+
+// checkPassword returns ErrorDetails listing the violations if the password breaks the policy
+func (ur *userRouter) checkPassword(newPassword string, username string, userInputs ...string) error {
+	violations, err := ur.policy.Check(newPassword, username, userInputs...)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return ErrorDetails{
+			Message: violations[0].Message,
+			Code:    "password_policy",
+			Details: map[string][]password.Violation{"violations": violations},
+		}
+	}
+	return nil
+}
+
+// servePasswordError serves policy violations as a 400 and anything else as an internal error
+func servePasswordError(err error) http.HandlerFunc {
+	if _, ok := err.(ErrorDetails); ok {
+		return StatusBadRequest.Serve(err)
 	}
-	StatusOK.Serve(token)(w, r)
+	return StatusInternalServerError.Serve(err)
 }
 
 // decodeUser decodes a user from the json body
@@ -8,12 +8,18 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/Dacode45/addressbook/crypto"
+	"github.com/Dacode45/addressbook/mailer"
+	"github.com/Dacode45/addressbook/mock"
 	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/password"
 
 	"github.com/gorilla/mux"
 
@@ -35,6 +41,14 @@ func Test_UserRouter(t *testing.T) {
 	t.Run("test user creation", should_create_user)
 	t.Run("test user retrieval", should_retrieve_user)
 	t.Run("test should login", should_login_user)
+	t.Run("test two factor login", should_require_two_factor)
+	t.Run("test two factor throttling", should_throttle_two_factor)
+	t.Run("test passkey login", should_login_with_passkey)
+	t.Run("test oidc login", should_login_with_oidc)
+	t.Run("test email verification and password reset", should_recover_account)
+	t.Run("test password policy", should_enforce_password_policy)
+	t.Run("test account management", should_manage_account)
+	t.Run("test profile privacy", should_enforce_profile_privacy)
 }
 
 func should_create_user(t *testing.T) {
@@ -49,7 +63,7 @@ func should_create_user(t *testing.T) {
 
 	user := models.User{
 		Username: "testUser",
-		Password: "testPassword",
+		Password: "c0ntacts-Are-gr8",
 	}
 	u, _ := json.Marshal(user)
 	req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(u))
@@ -62,6 +76,13 @@ func should_create_user(t *testing.T) {
 	dbUser, err = uStorage.FindByUsername(context.Background(), user.Username)
 	t.Log(dbUser)
 	assert.NoError(t, err, "Failed to retrieve user")
+
+	// usernames are used in urls, like when renaming
+	u, _ = json.Marshal(models.User{Username: "test/user", Password: user.Password})
+	req, _ = http.NewRequest("POST", "/", bytes.NewBuffer(u))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Usernames with slashes should be rejected")
 }
 
 func should_retrieve_user(t *testing.T) {
@@ -76,7 +97,7 @@ func should_retrieve_user(t *testing.T) {
 
 	user := models.User{
 		Username: "testUser",
-		Password: "testPassword",
+		Password: "c0ntacts-Are-gr8",
 	}
 	u, _ := json.Marshal(user)
 	req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(u))
@@ -93,9 +114,13 @@ func should_retrieve_user(t *testing.T) {
 	req, _ = http.NewRequest("GET", fmt.Sprintf("/%s", dbUser.Username), nil)
 	res = httptest.NewRecorder()
 	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusUnauthorized, res.Code, "Unauthorized response is expected")
+
+	token, _ := newToken(uStorage, models.Credentials{Username: user.Username})
+	res = testEndpoint("GET", fmt.Sprintf("/%s", dbUser.Username), nil, router, token)
 	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
 
-	var fetched models.User
+	var fetched models.Profile
 	err = json.NewDecoder(res.Body).Decode(&fetched)
 	assert.NoError(t, err, "Failed to parse response")
 	assert.Equal(t, fetched.Username, dbUser.Username, "Unexpected result when fetching")
@@ -113,7 +138,7 @@ func should_login_user(t *testing.T) {
 
 	user := models.User{
 		Username: "testUser",
-		Password: "testPassword",
+		Password: "c0ntacts-Are-gr8",
 	}
 
 	// Ensure that you can't log in first
@@ -168,6 +193,615 @@ func should_login_user(t *testing.T) {
 	assert.Equal(t, decodedCreds.Username, fetched.Username, "Unexpected result when fetching")
 }
 
+func should_require_two_factor(t *testing.T) {
+	session, uStorage := newStorage()
+
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	router := server.NewUserRouter(uStorage, config, mux.NewRouter())
+
+	user := models.User{
+		Username: "testUser",
+		Password: "c0ntacts-Are-gr8",
+	}
+	u, _ := json.Marshal(user)
+	req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(u))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+
+	creds, _ := json.Marshal(models.Credentials{
+		Username: user.Username,
+		Password: user.Password,
+	})
+	req, _ = http.NewRequest("POST", "/login", bytes.NewBuffer(creds))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	var token server.JWTToken
+	err := json.NewDecoder(res.Body).Decode(&token)
+	assert.NoError(t, err, "Failed to parse response")
+
+	// enroll and verify
+	res = testEndpoint("POST", "/me/2fa", nil, router, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var enrollment server.TwoFactorEnrollment
+	err = json.NewDecoder(res.Body).Decode(&enrollment)
+	assert.NoError(t, err, "Failed to parse response")
+
+	res = testEndpoint("GET", "/me/2fa/qr", nil, router, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.Equal(t, "image/png", res.Header().Get("Content-Type"), "QR code should be a png")
+
+	totp := crypto.NewTOTP("addressbook")
+	code, _ := totp.Code(enrollment.Secret, time.Now().Add(-30*time.Second))
+	verify, _ := json.Marshal(map[string]string{"code": code})
+	res = testEndpoint("POST", "/me/2fa/verify", bytes.NewBuffer(verify), router, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var recovery map[string][]string
+	err = json.NewDecoder(res.Body).Decode(&recovery)
+	assert.NoError(t, err, "Failed to parse response")
+	assert.Len(t, recovery["recovery_codes"], 10, "Recovery codes expected")
+
+	// login now returns a challenge
+	req, _ = http.NewRequest("POST", "/login", bytes.NewBuffer(creds))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var challenge server.MFAChallenge
+	err = json.NewDecoder(res.Body).Decode(&challenge)
+	assert.NoError(t, err, "Failed to parse response")
+	assert.True(t, challenge.MFARequired, "Challenge expected")
+
+	res = testEndpoint("GET", "/me", nil, router, server.JWTToken{Token: challenge.ChallengeToken})
+	assert.NotEqual(t, http.StatusOK, res.Code, "Challenge token should not authenticate")
+
+	// the code used to enroll can't be replayed
+	exchange, _ := json.Marshal(map[string]string{"challenge_token": challenge.ChallengeToken, "code": code})
+	req, _ = http.NewRequest("POST", "/login/mfa", bytes.NewBuffer(exchange))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusUnauthorized, res.Code, "Replayed code should be rejected")
+
+	// recovery codes work once
+	exchange, _ = json.Marshal(map[string]string{"challenge_token": challenge.ChallengeToken, "code": recovery["recovery_codes"][0]})
+	req, _ = http.NewRequest("POST", "/login/mfa", bytes.NewBuffer(exchange))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	err = json.NewDecoder(res.Body).Decode(&token)
+	assert.NoError(t, err, "Failed to parse response")
+
+	req, _ = http.NewRequest("POST", "/login/mfa", bytes.NewBuffer(exchange))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusUnauthorized, res.Code, "Used recovery code should be rejected")
+
+	// disable with another recovery code
+	disable, _ := json.Marshal(map[string]string{"code": recovery["recovery_codes"][1]})
+	res = testEndpoint("DELETE", "/me/2fa", bytes.NewBuffer(disable), router, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+
+	dbUser, err := uStorage.FindByUsername(context.Background(), user.Username)
+	assert.NoError(t, err, "Failed to retrieve user")
+	assert.False(t, dbUser.TwoFactorEnabled, "Two factor should be disabled")
+}
+
+func should_throttle_two_factor(t *testing.T) {
+	session, uStorage := newStorage()
+
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	throttleConfig := config
+	throttleConfig.ThrottlePolicy = server.ThrottlePolicy{FreeAttempts: 100, IPFreeAttempts: 100, LockoutThreshold: 3}
+	router := server.NewUserRouter(uStorage, throttleConfig, mux.NewRouter())
+
+	user := models.User{
+		Username: "testUser",
+		Password: "c0ntacts-Are-gr8",
+	}
+	u, _ := json.Marshal(user)
+	req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(u))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+
+	creds, _ := json.Marshal(models.Credentials{Username: user.Username, Password: user.Password})
+	login := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(creds))
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+	var token server.JWTToken
+	json.NewDecoder(login().Body).Decode(&token)
+
+	// enroll turns two factor on for the user of the token, and returns the secret
+	enroll := func(token server.JWTToken) string {
+		res := testEndpoint("POST", "/me/2fa", nil, router, token)
+		var enrollment server.TwoFactorEnrollment
+		json.NewDecoder(res.Body).Decode(&enrollment)
+		code, _ := crypto.NewTOTP("addressbook").Code(enrollment.Secret, time.Now())
+		verify, _ := json.Marshal(map[string]string{"code": code})
+		res = testEndpoint("POST", "/me/2fa/verify", bytes.NewBuffer(verify), router, token)
+		assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+		return enrollment.Secret
+	}
+	enroll(token)
+
+	// a correct password before every guess must not forget the wrong codes
+	for i := 0; i < 3; i++ {
+		res = login()
+		assert.Equal(t, http.StatusOK, res.Code, "Password should be accepted")
+		var challenge server.MFAChallenge
+		json.NewDecoder(res.Body).Decode(&challenge)
+		exchange, _ := json.Marshal(map[string]string{"challenge_token": challenge.ChallengeToken, "code": "000000"})
+		req, _ = http.NewRequest("POST", "/login/mfa", bytes.NewBuffer(exchange))
+		res = httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusUnauthorized, res.Code, "Wrong code should be rejected")
+
+		// nor must the password check of restoring an account
+		req, _ = http.NewRequest("POST", "/restore", bytes.NewBuffer(creds))
+		res = httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusBadRequest, res.Code, "Accounts that aren't deleted can't be restored")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, login().Code, "Username should be locked after wrong codes")
+
+	// turning two factor off with a session is throttled the same way
+	assert.NoError(t, uStorage.Insert(context.Background(), models.User{Username: "otherUser", Password: user.Password}), "Failed to create user")
+	otherToken, _ := newToken(uStorage, models.Credentials{Username: "otherUser"})
+	secret := enroll(otherToken)
+	wrong, _ := json.Marshal(map[string]string{"code": "000000"})
+	for i := 0; i < 3; i++ {
+		res = testEndpoint("DELETE", "/me/2fa", bytes.NewBuffer(wrong), router, otherToken)
+		assert.Equal(t, http.StatusUnauthorized, res.Code, "Wrong code should be rejected")
+	}
+	code, _ := crypto.NewTOTP("addressbook").Code(secret, time.Now())
+	right, _ := json.Marshal(map[string]string{"code": code})
+	res = testEndpoint("DELETE", "/me/2fa", bytes.NewBuffer(right), router, otherToken)
+	assert.Equal(t, http.StatusTooManyRequests, res.Code, "Username should be locked after wrong codes")
+}
+
+func should_login_with_passkey(t *testing.T) {
+	session, uStorage := newStorage()
+
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	router := server.NewUserRouter(uStorage, config, mux.NewRouter())
+
+	user := models.User{
+		Username: "testUser",
+		Password: "c0ntacts-Are-gr8",
+	}
+	u, _ := json.Marshal(user)
+	req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(u))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+
+	creds, _ := json.Marshal(models.Credentials{
+		Username: user.Username,
+		Password: user.Password,
+	})
+	req, _ = http.NewRequest("POST", "/login", bytes.NewBuffer(creds))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	var token server.JWTToken
+	err := json.NewDecoder(res.Body).Decode(&token)
+	assert.NoError(t, err, "Failed to parse response")
+
+	// register a passkey from a software authenticator
+	authenticator := mock.NewAuthenticator("http://localhost:8080")
+	res = testEndpoint("POST", "/me/webauthn/register/begin", nil, router, token)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	attestation, err := authenticator.Register(res.Body.Bytes())
+	assert.NoError(t, err, "Authenticator failed to register")
+
+	res = testEndpoint("POST", "/me/webauthn/register/finish?name=laptop", bytes.NewBuffer(attestation), router, token)
+	assert.Equal(t, http.StatusCreated, res.Code, "Created response is expected")
+
+	res = testEndpoint("GET", "/me/webauthn", nil, router, token)
+	var registered []models.WebAuthnCredential
+	err = json.NewDecoder(res.Body).Decode(&registered)
+	assert.NoError(t, err, "Failed to parse response")
+	assert.Len(t, registered, 1, "One passkey expected")
+	assert.Equal(t, "laptop", registered[0].Name, "Unexpected passkey name")
+
+	// log in with it
+	begin, _ := json.Marshal(map[string]string{"username": user.Username})
+	req, _ = http.NewRequest("POST", "/login/webauthn/begin", bytes.NewBuffer(begin))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assertion, err := authenticator.Login(res.Body.Bytes())
+	assert.NoError(t, err, "Authenticator failed to sign")
+
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/login/webauthn/finish?username=%s", user.Username), bytes.NewBuffer(assertion))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var passkeyToken server.JWTToken
+	err = json.NewDecoder(res.Body).Decode(&passkeyToken)
+	assert.NoError(t, err, "Failed to parse response")
+
+	res = testEndpoint("GET", "/me", nil, router, passkeyToken)
+	assert.Equal(t, http.StatusOK, res.Code, "Passkey token should authenticate")
+
+	// the ceremony can't be finished twice
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/login/webauthn/finish?username=%s", user.Username), bytes.NewBuffer(assertion))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusUnauthorized, res.Code, "Replayed assertion should be rejected")
+}
+
+func should_login_with_oidc(t *testing.T) {
+	session, uStorage := newStorage()
+	provider, err := mock.NewOIDCProvider("addressbook", "client-secret")
+	assert.NoError(t, err, "Failed to start the oidc provider")
+
+	defer func() {
+		provider.Close()
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	oidcConfig := config
+	oidcConfig.OIDCIssuer = provider.Issuer()
+	oidcConfig.OIDCClientID = provider.ClientID
+	oidcConfig.OIDCClientSecret = provider.ClientSecret
+	oidcConfig.OIDCRedirectURL = "http://localhost:8080/login/oidc/callback"
+	router := server.NewUserRouter(uStorage, oidcConfig, mux.NewRouter())
+
+	// follow follows the redirects through the provider from the start of a login, and returns the response of the callback
+	follow := func(start *httptest.ResponseRecorder, authURL string) *httptest.ResponseRecorder {
+		client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+		authorized, err := client.Get(authURL)
+		assert.NoError(t, err, "Provider failed to authorize")
+		authorized.Body.Close()
+		callback, _ := url.Parse(authorized.Header.Get("Location"))
+
+		req, _ := http.NewRequest("GET", callback.RequestURI(), nil)
+		for _, cookie := range start.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+	login := func(user mock.OIDCUser) *httptest.ResponseRecorder {
+		provider.Login(user)
+		req, _ := http.NewRequest("GET", "/login/oidc", nil)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusFound, res.Code, "Redirect to the provider is expected")
+		return follow(res, res.Header().Get("Location"))
+	}
+
+	// the first login provisions a user
+	res := login(mock.OIDCUser{Subject: "1234", Email: "Jane@example.com", EmailVerified: true, PreferredUsername: "jane"})
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var token server.JWTToken
+	err = json.NewDecoder(res.Body).Decode(&token)
+	assert.NoError(t, err, "Failed to parse response")
+
+	res = testEndpoint("GET", "/me", nil, router, token)
+	var me models.User
+	json.NewDecoder(res.Body).Decode(&me)
+	assert.Equal(t, "jane", me.Username, "Username should come from the preferred username")
+	assert.Equal(t, "jane@example.com", me.Email, "Verified email should be kept")
+	assert.True(t, me.EmailVerified, "Email should be verified")
+
+	// logging in again finds the same user, even if the email changed
+	res = login(mock.OIDCUser{Subject: "1234", Email: "other@example.com", PreferredUsername: "jane2"})
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	users, _ := uStorage.FindAll(context.Background())
+	assert.Len(t, users, 1, "No new user expected")
+
+	// another subject with a taken username gets a suffix
+	res = login(mock.OIDCUser{Subject: "5678", PreferredUsername: "jane"})
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	users, _ = uStorage.FindAll(context.Background())
+	assert.Len(t, users, 2, "A new user is expected")
+
+	// unverified local accounts aren't linked by email
+	uStorage.Insert(context.Background(), models.User{Username: "squatter", Password: "c0ntacts-Are-gr8", Email: "victim@example.com"})
+	res = login(mock.OIDCUser{Subject: "9999", Email: "victim@example.com", EmailVerified: true})
+	assert.Equal(t, http.StatusConflict, res.Code, "Conflict response is expected")
+
+	// accounts with a second factor aren't linked by email, they link the provider while logged in
+	ctx := context.Background()
+	uStorage.Insert(ctx, models.User{Username: "careful", Password: "c0ntacts-Are-gr8", Email: "careful@example.com"})
+	uStorage.MarkEmailVerified(ctx, "careful", "careful@example.com")
+	uStorage.SetTOTPSecret(ctx, "careful", "JBSWY3DPEHPK3PXP")
+	uStorage.EnableTwoFactor(ctx, "careful", []string{"recovery-code"})
+	careful := mock.OIDCUser{Subject: "4242", Email: "careful@example.com", EmailVerified: true}
+	res = login(careful)
+	assert.Equal(t, http.StatusConflict, res.Code, "Accounts with a second factor shouldn't be linked by email")
+
+	provider.Login(careful)
+	carefulToken, _ := newToken(uStorage, models.Credentials{Username: "careful"})
+	start := testEndpoint("POST", "/me/oidc", nil, router, carefulToken)
+	assert.Equal(t, http.StatusOK, start.Code, "OK response is expected")
+	var link server.OIDCLinkStart
+	assert.NoError(t, json.NewDecoder(start.Body).Decode(&link), "Failed to parse response")
+	res = follow(start, link.URL)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	linked, err := uStorage.FindByOIDCIdentity(ctx, models.OIDCIdentity{Issuer: provider.Issuer(), Subject: "4242"})
+	assert.NoError(t, err, "The identity should be linked")
+	assert.Equal(t, "careful", linked.Username, "The identity should be linked to the logged in user")
+
+	// the callback needs the cookie from the start of the login
+	req, _ := http.NewRequest("GET", "/login/oidc/callback?code=abc&state=def", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Bad request response is expected")
+}
+
+func should_recover_account(t *testing.T) {
+	session, uStorage := newStorage()
+
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	var mail bytes.Buffer
+	mailConfig := config
+	mailConfig.Mailer = mailer.NewLogMailer(&mail)
+	router := server.NewUserRouter(uStorage, mailConfig, mux.NewRouter())
+	lastToken := func() string {
+		matches := regexp.MustCompile(`token=(\S+)`).FindAllStringSubmatch(mail.String(), -1)
+		if len(matches) == 0 {
+			return ""
+		}
+		return matches[len(matches)-1][1]
+	}
+	post := func(url string, body interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", url, bytes.NewBuffer(b))
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	user := models.User{
+		Username: "testUser",
+		Password: "c0ntacts-Are-gr8",
+		Email:    "Test@Example.com",
+	}
+	res := post("/", user)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	verifyToken := lastToken()
+	assert.NotEmpty(t, verifyToken, "Verification email expected")
+
+	// resets aren't sent to unverified emails
+	res = post("/password/forgot", map[string]string{"email": "test@example.com"})
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.Equal(t, verifyToken, lastToken(), "No reset email expected")
+
+	res = post("/email/verify", map[string]string{"token": verifyToken})
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = post("/email/verify", map[string]string{"token": verifyToken})
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Verification token should only work once")
+
+	dbUser, err := uStorage.FindByUsername(context.Background(), user.Username)
+	assert.NoError(t, err, "Failed to retrieve user")
+	assert.Equal(t, "test@example.com", dbUser.Email, "Email should be normalized")
+	assert.True(t, dbUser.EmailVerified, "Email should be verified")
+
+	// verification tokens can't reset passwords
+	res = post("/password/reset", map[string]string{"token": verifyToken, "password": "Tr0ub4dor&3"})
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Bad request response is expected")
+
+	res = post("/password/forgot", map[string]string{"email": "test@example.com"})
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	resetToken := lastToken()
+	assert.NotEqual(t, verifyToken, resetToken, "Reset email expected")
+
+	res = post("/password/reset", map[string]string{"token": resetToken, "password": "Tr0ub4dor&3"})
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	res = post("/password/reset", map[string]string{"token": resetToken, "password": "wMkRqz7-Xq8$v"})
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Reset token should only work once")
+
+	res = post("/login", models.Credentials{Username: user.Username, Password: "Tr0ub4dor&3"})
+	assert.Equal(t, http.StatusOK, res.Code, "New password should work")
+	res = post("/login", models.Credentials{Username: user.Username, Password: user.Password})
+	assert.Equal(t, http.StatusUnauthorized, res.Code, "Old password should not work")
+}
+
+func should_enforce_password_policy(t *testing.T) {
+	session, uStorage := newStorage()
+
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	router := server.NewUserRouter(uStorage, config, mux.NewRouter())
+
+	u, _ := json.Marshal(models.User{
+		Username: "testUser",
+		Password: "testUser1",
+	})
+	req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(u))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Bad request response is expected")
+
+	var details struct {
+		Code    string
+		Details map[string][]password.Violation
+	}
+	err := json.NewDecoder(res.Body).Decode(&details)
+	assert.NoError(t, err, "Failed to parse response")
+	assert.Equal(t, "password_policy", details.Code, "Unexpected error code")
+	assert.Equal(t, "contains_username", details.Details["violations"][0].Code, "Unexpected violation")
+
+	_, err = uStorage.FindByUsername(context.Background(), "testUser")
+	assert.Error(t, err, "User should not be created")
+}
+
+func should_manage_account(t *testing.T) {
+	session, uStorage := newStorage()
+
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	router := server.NewUserRouter(uStorage, config, mux.NewRouter())
+	do := func(method string, url string, token string, body interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, url, bytes.NewBuffer(b))
+		if token != "" {
+			req.Header.Set("authorization", "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+	login := func(username string, password string) string {
+		res := do("POST", "/login", "", models.Credentials{Username: username, Password: password})
+		var token server.JWTToken
+		json.NewDecoder(res.Body).Decode(&token)
+		return token.Token
+	}
+
+	user := models.User{
+		Username: "testUser",
+		Password: "c0ntacts-Are-gr8",
+	}
+	res := do("POST", "/", "", user)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	oldToken := login(user.Username, user.Password)
+	token := login(user.Username, user.Password)
+
+	// password changes need the current password, and revoke every session
+	res = do("PUT", "/me/password", token, map[string]string{"current_password": "wrong", "password": "Tr0ub4dor&3"})
+	assert.Equal(t, http.StatusUnauthorized, res.Code, "Current password should be required")
+	res = do("PUT", "/me/password", token, map[string]string{"current_password": user.Password, "password": "Tr0ub4dor&3"})
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	var renewed server.JWTToken
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&renewed), "Failed to parse token")
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/me", oldToken, nil).Code, "Old sessions should be revoked")
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/me", token, nil).Code, "Current session should be revoked")
+	assert.Equal(t, http.StatusOK, do("GET", "/me", renewed.Token, nil).Code, "New token should work")
+	token = renewed.Token
+
+	// renaming
+	assert.Equal(t, http.StatusOK, do("POST", "/", "", models.User{Username: "otherUser", Password: "wMkRqz7-Xq8$v"}).Code, "OK response is expected")
+	res = do("PUT", "/me/username", token, map[string]string{"username": "otherUser"})
+	assert.Equal(t, http.StatusConflict, res.Code, "Taken usernames should be rejected")
+	res = do("PUT", "/me/username", token, map[string]string{"username": "renamedUser"})
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&renewed), "Failed to parse token")
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/me", token, nil).Code, "Tokens for the old username should stop working")
+	assert.Equal(t, http.StatusOK, do("POST", "/", "", models.User{Username: user.Username, Password: "Gq7-vPz2$nWk"}).Code, "Old username should be free")
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/me", token, nil).Code, "Tokens for the old username should not work for its new owner")
+	token = renewed.Token
+	_, err := uStorage.FindByUsername(context.Background(), "renamedUser")
+	assert.NoError(t, err, "User should be renamed")
+
+	// deletion can be undone during the grace period
+	res = do("DELETE", "/me", token, map[string]string{"password": "wrong"})
+	assert.Equal(t, http.StatusUnauthorized, res.Code, "Password should be required")
+	res = do("DELETE", "/me", token, map[string]string{"password": "Tr0ub4dor&3"})
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/me", token, nil).Code, "Sessions should be revoked")
+	assert.Equal(t, http.StatusNotFound, do("GET", "/renamedUser", "", nil).Code, "Deleted users should be hidden")
+	res = do("POST", "/login", "", models.Credentials{Username: "renamedUser", Password: "Tr0ub4dor&3"})
+	assert.Equal(t, http.StatusForbidden, res.Code, "Deleted users should not log in")
+
+	res = do("POST", "/restore", "", models.Credentials{Username: "renamedUser", Password: "Tr0ub4dor&3"})
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&renewed), "Failed to parse token")
+	assert.Equal(t, http.StatusOK, do("GET", "/me", renewed.Token, nil).Code, "Restored users should log in")
+
+	// once the grace period is over the account is gone
+	assert.NoError(t, uStorage.ScheduleDeletion(context.Background(), "renamedUser", time.Now().Add(-time.Hour)), "Failed to delete user")
+	removed, err := uStorage.PurgeDeletedUsers(context.Background(), time.Now())
+	assert.NoError(t, err, "Failed to purge users")
+	assert.Len(t, removed, 1, "Deleted user should be purged")
+}
+
+func should_enforce_profile_privacy(t *testing.T) {
+	session, uStorage := newStorage()
+
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	ctx := context.Background()
+	router := server.NewUserRouter(uStorage, config, mux.NewRouter())
+	owner, contacts := populateDatabase(uStorage, 2)
+	assert.NoError(t, uStorage.SetEmail(ctx, owner.Username, "owner@example.com"), "Failed to set email")
+	assert.NoError(t, uStorage.MarkEmailVerified(ctx, owner.Username, "owner@example.com"), "Failed to verify email")
+	assert.NoError(t, uStorage.Insert(ctx, models.User{Username: "viewer", Password: "viewer"}), "Failed to create user")
+	ownerToken, _ := newToken(uStorage, models.Credentials{Username: owner.Username})
+	viewerToken, _ := newToken(uStorage, models.Credentials{Username: "viewer"})
+	profileOnlyToken, _ := newToken(uStorage, models.Credentials{Username: "viewer", Scopes: []models.Scope{models.ScopeProfileRead}})
+	url := fmt.Sprintf("/%s", owner.Username)
+	fetch := func(token server.JWTToken) (int, models.Profile) {
+		var profile models.Profile
+		res := testEndpoint("GET", url, nil, router, token)
+		json.NewDecoder(res.Body).Decode(&profile)
+		return res.Code, profile
+	}
+
+	// users only by default
+	code, profile := fetch(viewerToken)
+	assert.Equal(t, http.StatusOK, code, "OK response is expected")
+	assert.Equal(t, owner.Username, profile.Username, "Unexpected profile")
+	assert.Empty(t, profile.Email, "Email should be hidden")
+	assert.Empty(t, profile.Contacts, "Contacts should be hidden")
+
+	code, profile = fetch(ownerToken)
+	assert.Equal(t, http.StatusOK, code, "OK response is expected")
+	assert.Len(t, profile.Contacts, len(contacts), "Owner should see their contacts")
+	assert.Equal(t, models.VisibilityUsers, profile.ProfileVisibility, "Owner should see their visibility")
+
+	res := testEndpoint("PUT", "/me/profile", bytes.NewBufferString(`{"profile_visibility": "everyone"}`), router, ownerToken)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "Unknown visibility should be rejected")
+	res = testEndpoint("PUT", "/me/profile", bytes.NewBufferString(`{"profile_visibility": "public"}`), router, ownerToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	code, profile = fetch(viewerToken)
+	assert.Equal(t, "owner@example.com", profile.Email, "Public profiles show their verified email")
+	assert.Empty(t, profile.Contacts, "Contacts should be hidden")
+
+	res = testEndpoint("PUT", "/me/profile", bytes.NewBufferString(`{"profile_visibility": "private"}`), router, ownerToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	code, _ = fetch(viewerToken)
+	assert.Equal(t, http.StatusNotFound, code, "Private profiles should be hidden")
+
+	// granted users see the contacts, if their token can read contacts
+	res = testEndpoint("PUT", "/me/viewers/viewer", nil, router, ownerToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	code, profile = fetch(viewerToken)
+	assert.Equal(t, http.StatusOK, code, "Granted users should see private profiles")
+	assert.Len(t, profile.Contacts, len(contacts), "Granted users should see the contacts")
+	code, profile = fetch(profileOnlyToken)
+	assert.Equal(t, http.StatusOK, code, "OK response is expected")
+	assert.Empty(t, profile.Contacts, "Contacts need the contacts:read scope")
+
+	res = testEndpoint("DELETE", "/me/viewers/viewer", nil, router, ownerToken)
+	assert.Equal(t, http.StatusOK, res.Code, "OK response is expected")
+	code, _ = fetch(viewerToken)
+	assert.Equal(t, http.StatusNotFound, code, "Revoked users should not see private profiles")
+}
+
 func newStorage() (*storage.MongoSession, storage.UserStorage) {
 	session, err := storage.NewMongoSession(mongoUrl)
 	if err != nil {
@@ -178,3 +812,14 @@ func newStorage() (*storage.MongoSession, storage.UserStorage) {
 	uStorage := storage.NewMongoUserStorage(session.Copy(), dbName, userCollectionName, &mockHash)
 	return session, uStorage
 }
+
+// newToken creates a token for an existing user, tied to their id and session like the tokens logging in issues
+func newToken(uStorage storage.UserStorage, creds models.Credentials) (server.JWTToken, error) {
+	user, err := uStorage.FindByUsername(context.Background(), creds.Username)
+	if err != nil {
+		return server.JWTToken{}, err
+	}
+	creds.UserID = user.UserID
+	creds.SessionVersion = user.SessionVersion
+	return server.NewJWTCoder(config.JWTSecret).Create(creds)
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/Dacode45/addressbook/vcard"
+)
+
+// VCardHandler serves responses as vCard files. Status code can be set at compile time
+type VCardHandler int
+
+// Serve serves cards as the filename. It sets Content-Type and Content-Disposition so that files get downloaded
+func (v VCardHandler) Serve(filename string, cards []vcard.Card) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var msg bytes.Buffer
+		encoder := vcard.NewEncoder(&msg)
+		for _, card := range cards {
+			if err := encoder.Encode(card); err != nil {
+				ServerErrorHandler.Serve(w, r)
+				return
+			}
+		}
+		code := int(v)
+		w.Header().Set("Content-Type", "text/vcard")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment;filename=%s", filename))
+		w.WriteHeader(code)
+		w.Write(msg.Bytes())
+	}
+}
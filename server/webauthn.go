@@ -0,0 +1,297 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/mux"
+)
+
+// webAuthnUser adapts a User to the interface the webauthn library expects
+type webAuthnUser struct {
+	*models.User
+}
+
+// WebAuthnID is the user handle. The user id never changes, unlike the username
+func (u webAuthnUser) WebAuthnID() []byte {
+	return []byte(u.UserID)
+}
+
+// WebAuthnName is the name authenticators show
+func (u webAuthnUser) WebAuthnName() string {
+	return u.Username
+}
+
+// WebAuthnDisplayName is the name authenticators show
+func (u webAuthnUser) WebAuthnDisplayName() string {
+	return u.Username
+}
+
+// WebAuthnIcon is deprecated in the spec
+func (u webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+// WebAuthnCredentials converts the stored credentials for the library
+func (u webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.User.WebAuthnCredentials))
+	for i, c := range u.User.WebAuthnCredentials {
+		transports := make([]protocol.AuthenticatorTransport, len(c.Transports))
+		for j, t := range c.Transports {
+			transports[j] = protocol.AuthenticatorTransport(t)
+		}
+		credentials[i] = webauthn.Credential{
+			ID:              c.ID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: c.BackupEligible,
+				BackupState:    c.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:       c.AAGUID,
+				SignCount:    c.SignCount,
+				CloneWarning: c.CloneWarning,
+			},
+		}
+	}
+	return credentials
+}
+
+// webAuthnLoginRequest is the body of BeginWebAuthnLoginHandler
+type webAuthnLoginRequest struct {
+	Username string `json:"username"`
+}
+
+// BeginWebAuthnRegistrationHandler starts registering a passkey to the logged in user
+func (ur *userRouter) BeginWebAuthnRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if ur.webAuthn == nil {
+		NotImplementedHandler.Serve(w, r)
+		return
+	}
+	ctx := r.Context()
+	user, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+
+	wUser := webAuthnUser{user}
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(user.WebAuthnCredentials))
+	for _, c := range wUser.WebAuthnCredentials() {
+		exclusions = append(exclusions, c.Descriptor())
+	}
+	creation, session, err := ur.webAuthn.BeginRegistration(
+		wUser,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	if err = ur.saveWebAuthnSession(r, user.Username, models.WebAuthnRegistration, session); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(creation)(w, r)
+}
+
+// FinishWebAuthnRegistrationHandler verifies the authenticator's attestation and saves the passkey. The name query parameter labels it
+func (ur *userRouter) FinishWebAuthnRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if ur.webAuthn == nil {
+		NotImplementedHandler.Serve(w, r)
+		return
+	}
+	ctx := r.Context()
+	user, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+
+	session, err := ur.takeWebAuthnSession(r, user.Username, models.WebAuthnRegistration)
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	credential, err := ur.webAuthn.FinishRegistration(webAuthnUser{user}, *session, r)
+	if err != nil {
+		StatusBadRequest.Serve(webAuthnError(err))(w, r)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "Passkey"
+	}
+	transports := make([]string, len(credential.Transport))
+	for i, t := range credential.Transport {
+		transports[i] = string(t)
+	}
+	model := models.WebAuthnCredential{
+		ID:              credential.ID,
+		Name:            name,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      transports,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+		CreatedAt:       time.Now(),
+	}
+	err = ur.userStorage.AddWebAuthnCredential(ctx, user.Username, model)
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusCreated.Serve(model)(w, r)
+}
+
+// ListWebAuthnCredentialsHandler lists the passkeys of the logged in user
+func (ur *userRouter) ListWebAuthnCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	StatusOK.Serve(user.WebAuthnCredentials)(w, r)
+}
+
+// DeleteWebAuthnCredentialHandler removes a passkey. The id is the base64 url encoded credential id
+func (ur *userRouter) DeleteWebAuthnCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := ctx.Value(ContextUserKey).(*models.User)
+	if !ok || user == nil {
+		StatusUnauthorized.Serve(fmt.Errorf("authentication failed"))(w, r)
+		return
+	}
+	id, err := base64.RawURLEncoding.DecodeString(mux.Vars(r)["id"])
+	if err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+	err = ur.userStorage.RemoveWebAuthnCredential(ctx, user.Username, id)
+	if err != nil {
+		StatusNotFound.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(map[string]string{"msg": "Success"})(w, r)
+}
+
+// BeginWebAuthnLoginHandler starts logging a user in with one of their passkeys
+func (ur *userRouter) BeginWebAuthnLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if ur.webAuthn == nil {
+		NotImplementedHandler.Serve(w, r)
+		return
+	}
+	var body webAuthnLoginRequest
+	if r.Body == nil {
+		StatusBadRequest.Serve(fmt.Errorf("no request body"))(w, r)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		StatusBadRequest.Serve(err)(w, r)
+		return
+	}
+
+	user, err := ur.userStorage.FindByUsername(r.Context(), body.Username)
+	if err != nil || len(user.WebAuthnCredentials) == 0 {
+		StatusBadRequest.Serve(fmt.Errorf("no passkeys registered"))(w, r)
+		return
+	}
+	assertion, session, err := ur.webAuthn.BeginLogin(webAuthnUser{user})
+	if err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	if err = ur.saveWebAuthnSession(r, user.Username, models.WebAuthnLogin, session); err != nil {
+		StatusInternalServerError.Serve(err)(w, r)
+		return
+	}
+	StatusOK.Serve(assertion)(w, r)
+}
+
+// FinishWebAuthnLoginHandler verifies the assertion for the user in the username query parameter, and responds with the same JWTToken as LoginHandler
+func (ur *userRouter) FinishWebAuthnLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if ur.webAuthn == nil {
+		NotImplementedHandler.Serve(w, r)
+		return
+	}
+	ctx := r.Context()
+	username := r.URL.Query().Get("username")
+	user, err := ur.userStorage.FindByUsername(ctx, username)
+	if err != nil {
+		StatusUnauthorized.Serve(fmt.Errorf("passkey login failed"))(w, r)
+		return
+	}
+
+	session, err := ur.takeWebAuthnSession(r, user.Username, models.WebAuthnLogin)
+	if err != nil {
+		StatusUnauthorized.Serve(err)(w, r)
+		return
+	}
+	credential, err := ur.webAuthn.FinishLogin(webAuthnUser{user}, *session, r)
+	if err != nil {
+		StatusUnauthorized.Serve(webAuthnError(err))(w, r)
+		return
+	}
+
+	for _, c := range user.WebAuthnCredentials {
+		if string(c.ID) != string(credential.ID) {
+			continue
+		}
+		c.SignCount = credential.Authenticator.SignCount
+		c.CloneWarning = credential.Authenticator.CloneWarning
+		c.BackupState = credential.Flags.BackupState
+		c.LastUsedAt = time.Now()
+		if err = ur.userStorage.UpdateWebAuthnCredential(ctx, user.Username, c); err != nil {
+			StatusInternalServerError.Serve(err)(w, r)
+			return
+		}
+	}
+	// a counter that went backwards means the key may have been copied
+	if credential.Authenticator.CloneWarning {
+		StatusUnauthorized.Serve(fmt.Errorf("passkey may have been cloned"))(w, r)
+		return
+	}
+
+	ur.serveToken(user, models.Credentials{Scopes: models.DefaultScopes})(w, r)
+}
+
+// saveWebAuthnSession stores the session of a ceremony until it is finished. Registrations and logins keep separate
+// sessions, since anyone can start a login for a username
+func (ur *userRouter) saveWebAuthnSession(r *http.Request, username string, ceremony models.WebAuthnCeremony, session *webauthn.SessionData) error {
+	encoded, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return ur.userStorage.SetWebAuthnSession(r.Context(), username, ceremony, encoded)
+}
+
+// takeWebAuthnSession loads and removes the session of the ceremony of a kind in progress
+func (ur *userRouter) takeWebAuthnSession(r *http.Request, username string, ceremony models.WebAuthnCeremony) (*webauthn.SessionData, error) {
+	encoded, err := ur.userStorage.TakeWebAuthnSession(r.Context(), username, ceremony)
+	if err != nil {
+		return nil, err
+	}
+	var session webauthn.SessionData
+	err = json.Unmarshal(encoded, &session)
+	return &session, err
+}
+
+// webAuthnError includes the details the library attaches to protocol errors
+func webAuthnError(err error) error {
+	if perr, ok := err.(*protocol.Error); ok && perr.Details != "" {
+		return fmt.Errorf("%s: %s", perr.Error(), perr.Details)
+	}
+	return err
+}
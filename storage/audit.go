@@ -0,0 +1,14 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/Dacode45/addressbook/models"
+)
+
+// AuditStorage keeps the audit log. Entries are never changed or removed through it
+type AuditStorage interface {
+	Record(context.Context, models.AuditEntry) error
+	// List returns a page of entries, newest first, and the total number of entries
+	List(context.Context, int, int) ([]models.AuditEntry, int, error)
+}
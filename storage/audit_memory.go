@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Dacode45/addressbook/models"
+)
+
+// MemoryAuditStorage keeps the audit log in memory. Only suitable for a single server, and lost on restart
+type MemoryAuditStorage struct {
+	mu      sync.Mutex
+	entries []models.AuditEntry
+}
+
+// NewMemoryAuditStorage creates an empty MemoryAuditStorage
+func NewMemoryAuditStorage() AuditStorage {
+	return &MemoryAuditStorage{}
+}
+
+// Record appends an entry
+func (s *MemoryAuditStorage) Record(ctx context.Context, entry models.AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+// List returns a page of entries, newest first
+func (s *MemoryAuditStorage) List(ctx context.Context, offset int, limit int) ([]models.AuditEntry, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := len(s.entries)
+	page := []models.AuditEntry{}
+	for i := total - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, s.entries[i])
+	}
+	return page, total, nil
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/Dacode45/addressbook/models"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mongoAuditEntry is a mongodb specific implementation of the AuditEntry struct
+type mongoAuditEntry struct {
+	ID      bson.ObjectId     `bson:"_id,omitempty"`
+	Actor   string            `bson:"actor"`
+	Action  string            `bson:"action"`
+	Target  string            `bson:"target,omitempty"`
+	Details map[string]string `bson:"details,omitempty"`
+	At      time.Time         `bson:"at"`
+}
+
+// newMongoAuditEntry creates a mongoAuditEntry from an AuditEntry
+func newMongoAuditEntry(e models.AuditEntry) mongoAuditEntry {
+	return mongoAuditEntry{
+		Actor:   e.Actor,
+		Action:  e.Action,
+		Target:  e.Target,
+		Details: e.Details,
+		At:      e.At,
+	}
+}
+
+// toModel converts to the AuditEntry struct
+func (e mongoAuditEntry) toModel() models.AuditEntry {
+	return models.AuditEntry{
+		Actor:   e.Actor,
+		Action:  e.Action,
+		Target:  e.Target,
+		Details: e.Details,
+		At:      e.At,
+	}
+}
+
+// auditAtIndex sorts the audit log by time
+func auditAtIndex() mgo.Index {
+	return mgo.Index{
+		Key:        []string{"-at"},
+		Background: true,
+	}
+}
+
+// MongoAuditStorage implements the AuditStorage interface
+type MongoAuditStorage struct {
+	collection *mgo.Collection
+}
+
+// NewMongoAuditStorage creates a new storage based of a session, database name, and collection name
+func NewMongoAuditStorage(session *MongoSession, dbName string, collectionName string) AuditStorage {
+	collection := session.GetCollection(dbName, collectionName)
+	collection.EnsureIndex(auditAtIndex())
+	return &MongoAuditStorage{collection}
+}
+
+// Record inserts an entry
+func (s *MongoAuditStorage) Record(ctx context.Context, entry models.AuditEntry) error {
+	return s.collection.Insert(newMongoAuditEntry(entry))
+}
+
+// List returns a page of entries, newest first
+func (s *MongoAuditStorage) List(ctx context.Context, offset int, limit int) ([]models.AuditEntry, int, error) {
+	total, err := s.collection.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+	var found []mongoAuditEntry
+	err = s.collection.Find(nil).Sort("-at").Skip(offset).Limit(limit).All(&found)
+	entries := make([]models.AuditEntry, len(found))
+	for i, m := range found {
+		entries[i] = m.toModel()
+	}
+	return entries, total, err
+}
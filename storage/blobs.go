@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrBlobNotFound is returned when no blob is stored under a key
+var ErrBlobNotFound = errors.New("Blob not found")
+
+// BlobStore keeps files, like contact photos, under slash separated keys such as photos/ab/ab12...
+type BlobStore interface {
+	// Put stores a blob, replacing the blob under the key
+	Put(context.Context, string, io.Reader) error
+	// Get opens a blob. Close it when done
+	Get(context.Context, string) (io.ReadSeekCloser, error)
+	// Delete removes a blob. Deleting a blob that isn't stored isn't an error
+	Delete(context.Context, string) error
+}
+
+// validateBlobKey rejects keys that could escape the store, like ../users
+func validateBlobKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("blob keys can't be empty")
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("invalid blob key %q", key)
+		}
+		for _, r := range segment {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+				return fmt.Errorf("invalid blob key %q", key)
+			}
+		}
+	}
+	return nil
+}
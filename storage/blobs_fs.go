@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FSBlobStore keeps blobs as files in a directory, the slashes of their keys making subdirectories
+type FSBlobStore struct {
+	dir string
+}
+
+// NewFSBlobStore creates a FSBlobStore keeping its files in dir, which is created if needed
+func NewFSBlobStore(dir string) BlobStore {
+	return &FSBlobStore{dir: dir}
+}
+
+// path is the file of a blob
+func (s *FSBlobStore) path(key string) (string, error) {
+	if err := validateBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes a blob to a temporary file then renames it, so readers never see part of a blob
+func (s *FSBlobStore) Put(ctx context.Context, key string, r io.Reader) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get opens the file of a blob
+func (s *FSBlobStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Delete removes the file of a blob
+func (s *FSBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// MemoryBlobStore keeps blobs in memory. Only suitable for a single server, and lost on restart
+type MemoryBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+// NewMemoryBlobStore creates an empty MemoryBlobStore
+func NewMemoryBlobStore() BlobStore {
+	return &MemoryBlobStore{blobs: map[string][]byte{}}
+}
+
+// Put stores a blob, replacing the blob under the key
+func (s *MemoryBlobStore) Put(ctx context.Context, key string, r io.Reader) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[key] = data
+	return nil
+}
+
+// Get opens a blob
+func (s *MemoryBlobStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.blobs[key]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return memoryBlob{bytes.NewReader(data)}, nil
+}
+
+// Delete removes a blob
+func (s *MemoryBlobStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, key)
+	return nil
+}
+
+// memoryBlob is a stored blob being read
+type memoryBlob struct {
+	*bytes.Reader
+}
+
+// Close does nothing, blobs in memory hold no resources
+func (memoryBlob) Close() error {
+	return nil
+}
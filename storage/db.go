@@ -2,19 +2,184 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/Dacode45/addressbook/models"
 )
 
+// ErrUsernameTaken is returned when renaming a user to a username that is in use
+var ErrUsernameTaken = errors.New("Username is taken")
+
+// ErrOIDCIdentityLinked is returned when linking an identity provider account that is linked to another user
+var ErrOIDCIdentityLinked = errors.New("Identity is linked to another user")
+
+// ErrBookNotFound is returned when a user has no book with the id
+var ErrBookNotFound = errors.New("No book with that id")
+
+// ErrBookNameTaken is returned when a user already has a book with the name
+var ErrBookNameTaken = errors.New("A book with that name exists")
+
+// ErrDefaultBook is returned when renaming, deleting or sharing the default book
+var ErrDefaultBook = errors.New("The default book can't be changed or shared")
+
+// ErrBookForbidden is returned when a user can see a book but wasn't granted enough access for the call
+var ErrBookForbidden = errors.New("Not allowed to do that with this book")
+
+// ErrShareNotFound is returned when revoking a share that doesn't exist
+var ErrShareNotFound = errors.New("The book isn't shared with them")
+
+// ErrContactNotFound is returned when a book has no contact with the id
+var ErrContactNotFound = errors.New("No contact with that id")
+
+// ErrTagNotFound is returned when a book has no tag with the name
+var ErrTagNotFound = errors.New("No tag with that name")
+
+// ErrTagExists is returned when making or renaming to a tag a book already has
+var ErrTagExists = errors.New("A tag with that name exists")
+
+// ErrTooManyTags is returned when tagging a contact would give it more than models.MaxContactTags tags
+var ErrTooManyTags = errors.New("Contacts can't have that many tags")
+
+// ErrGroupNotFound is returned when a user has no group with the id
+var ErrGroupNotFound = errors.New("No group with that id")
+
+// ErrContactGroupNotFound is returned when a user has no group of contacts with the id
+var ErrContactGroupNotFound = errors.New("No contact group with that id")
+
+// ErrAttachmentNotFound is returned when a contact has no attachment with the id
+var ErrAttachmentNotFound = errors.New("No attachment with that id")
+
+// ErrAttachmentQuota is returned when an attachment would take the files attached to a user's contacts over their quota
+var ErrAttachmentQuota = errors.New("Attachment storage quota exceeded")
+
+// ErrInteractionNotFound is returned when a contact has no interaction with the id
+var ErrInteractionNotFound = errors.New("No interaction with that id")
+
+// ErrInteractionLink is returned when an interaction links contacts that aren't in the book of its contact
+var ErrInteractionLink = errors.New("Interactions can only link contacts of the same book")
+
 // UserStorage acts as a generic storage interface. In this app we use mongodb, but firebase and other methods were considered.
 type UserStorage interface {
 	Login(context.Context, models.Credentials) (*models.User, error)
 	FindAll(context.Context) ([]models.User, error)
 	FindByUsername(context.Context, string) (*models.User, error)
+	FindByEmail(context.Context, string) (*models.User, error)
 	Insert(context.Context, models.User) error
 	Delete(context.Context, string) error
 
-	// CRUD On Contacts
+	// Account recovery
+	SetEmail(context.Context, string, string) error
+	MarkEmailVerified(context.Context, string, string) error
+	SetPassword(context.Context, string, string) error
+	SetTokenNonce(context.Context, string, string, string) error
+	ConsumeTokenNonce(context.Context, string, string, string) error
+
+	// Account management
+	SetUsername(context.Context, string, string) error
+	ScheduleDeletion(context.Context, string, time.Time) error
+	RestoreUser(context.Context, string) error
+	// PurgeDeletedUsers returns the users removed with their contacts, so the files of the contacts can be deleted
+	PurgeDeletedUsers(context.Context, time.Time) ([]models.User, error)
+
+	// Administration
+	SearchUsers(context.Context, models.UserQuery) ([]models.UserSummary, int, error)
+	CountByRole(context.Context, models.Role) (int, error)
+	AssignRole(context.Context, string, models.Role) error
+	UnassignRole(context.Context, string, models.Role) error
+	UnassignRoleFromAll(context.Context, models.Role) error
+	SetDisabled(context.Context, string, bool) error
+	RequirePasswordReset(context.Context, string) error
+
+	// Profile visibility, and who can see the user's contacts
+	SetProfileVisibility(context.Context, string, models.ProfileVisibility) error
+	AddContactViewer(context.Context, string, string) error
+	RemoveContactViewer(context.Context, string, string) error
+
+	// Two factor authentication
+	SetTOTPSecret(context.Context, string, string) error
+	EnableTwoFactor(context.Context, string, []string) error
+	DisableTwoFactor(context.Context, string) error
+	ConsumeTOTPStep(context.Context, string, int64) error
+	ConsumeRecoveryCode(context.Context, string, string) error
+
+	// WebAuthn credentials, and the session of the registration or login in progress
+	AddWebAuthnCredential(context.Context, string, models.WebAuthnCredential) error
+	UpdateWebAuthnCredential(context.Context, string, models.WebAuthnCredential) error
+	RemoveWebAuthnCredential(context.Context, string, []byte) error
+	SetWebAuthnSession(context.Context, string, models.WebAuthnCeremony, []byte) error
+	TakeWebAuthnSession(context.Context, string, models.WebAuthnCeremony) ([]byte, error)
+
+	// Accounts at OpenID Connect providers
+	FindByOIDCIdentity(context.Context, models.OIDCIdentity) (*models.User, error)
+	AddOIDCIdentity(context.Context, string, models.OIDCIdentity) error
+
+	// Grants to third party apps
+	SaveOAuthGrant(context.Context, string, models.OAuthGrant) error
+	RemoveOAuthGrant(context.Context, string, string) error
+	RemoveOAuthGrantFromAll(context.Context, string) error
+
+	// Address books. Contacts without a book are in the default book. Calls on a book check the user owns it or was granted
+	// enough access, and fail with ErrBookNotFound or ErrBookForbidden
+	FindBooks(context.Context, string) ([]models.Book, error)
+	FindBook(context.Context, string, string) (*models.Book, error)
+	CreateBook(context.Context, string, models.Book) (*models.Book, error)
+	UpdateBook(context.Context, string, models.Book) error
+	UpdateBookFields(context.Context, string, string, models.FieldDefinitions) error
+	DeleteBook(context.Context, string, string) error
+	ShareBook(context.Context, string, string, models.BookShare) error
+	UnshareBook(context.Context, string, string, models.BookShare) error
+	FindBookContacts(context.Context, string, string) ([]models.Contact, error)
+	FindBookContact(context.Context, string, string, string) (*models.Contact, error)
+	UpdateBookContact(context.Context, string, string, models.Contact) error
+	DeleteBookContact(context.Context, string, string, string) error
+	// MoveContact fails with ErrAttachmentQuota when the attachments of a contact moved to another owner's book would take
+	// them over the quota, in bytes. CopyContact fails the same way when the copy's attachments would
+	MoveContact(context.Context, string, string, string, string, int64) error
+	CopyContact(context.Context, string, string, string, string, int64) (*models.Contact, error)
+	// SetContactPhoto replaces the photo of a contact in a book the user can edit, or removes it with nil, and returns the
+	// photo it had. PhotoInUse checks if any contact has a photo, so it isn't deleted while copies still show it
+	SetContactPhoto(context.Context, string, string, string, *models.ContactPhoto) (*models.ContactPhoto, error)
+	PhotoInUse(context.Context, string) (bool, error)
+	// AddAttachment attaches a file to a contact in a book the user can edit. It fails with ErrAttachmentQuota when the
+	// attachments of the book owner's contacts would be above the quota, in bytes, with copies of contacts counting twice.
+	// RemoveAttachment returns the attachment removed, and AttachmentInUse checks if any contact still has one
+	AddAttachment(context.Context, string, string, string, models.Attachment, int64) error
+	RemoveAttachment(context.Context, string, string, string, string) (*models.Attachment, error)
+	AttachmentInUse(context.Context, string) (bool, error)
+	// The timeline of a contact, the interactions logged against it and those linking it, newest first. FindInteractions
+	// returns a page of it from an offset, and how long it is. Contacts are returned with when they were LastContacted
+	FindInteractions(context.Context, string, string, string, int, int) ([]models.Interaction, int, error)
+	AddInteraction(context.Context, string, string, string, models.Interaction) (*models.Interaction, error)
+	DeleteInteraction(context.Context, string, string, string, string) error
+
+	// Tags of the contacts in a book. Tags are compared ignoring case, and renaming, merging and deleting them changes the contacts
+	FindTags(context.Context, string, string) ([]models.Tag, error)
+	CreateTag(context.Context, string, string, string) error
+	RenameTag(context.Context, string, string, string, string) error
+	MergeTags(context.Context, string, string, string, string) error
+	DeleteTag(context.Context, string, string, string) error
+	TagContacts(context.Context, string, string, []string, []string, []string) (int, error)
+
+	// Groups of users that books can be shared with
+	FindUserGroups(context.Context, string) ([]models.UserGroup, error)
+	CreateUserGroup(context.Context, string, models.UserGroup) (*models.UserGroup, error)
+	UpdateUserGroup(context.Context, string, models.UserGroup) error
+	DeleteUserGroup(context.Context, string, string) error
+
+	// Groups of the user's own contacts, which can contain other groups
+	FindContactGroups(context.Context, string) ([]models.ContactGroup, error)
+	CreateContactGroup(context.Context, string, models.ContactGroup) (*models.ContactGroup, error)
+	UpdateContactGroup(context.Context, string, models.ContactGroup) error
+	DeleteContactGroup(context.Context, string, string) error
+
+	// Memberships of organisations, see OrgStorage
+	FindOrgMembers(context.Context, string) ([]models.OrgMember, error)
+	SaveOrgMembership(context.Context, string, models.OrgMembership) error
+	RemoveOrgMembership(context.Context, string, string) error
+	RemoveOrgMembershipFromAll(context.Context, string) error
+
+	// CRUD On the user's own Contacts. Contacts are created in their BookID if the user can edit it, and keep their book when updated
 	CreateContact(context.Context, string, models.Contact) (*models.Contact, error)
 	FindAllContacts(context.Context, string) ([]models.Contact, error)
 	FindContactById(context.Context, string, string) (*models.Contact, error)
@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Dacode45/addressbook/models"
+)
+
+var (
+	// ErrClientNotFound is returned when a third party app isn't registered
+	ErrClientNotFound = errors.New("Client not found")
+	// ErrCodeNotFound is returned when an authorization code doesn't exist or was already used
+	ErrCodeNotFound = errors.New("Authorization code not found")
+)
+
+// OAuthStorage keeps the registered third party apps, and the authorization codes issued to them
+type OAuthStorage interface {
+	FindClients(context.Context) ([]models.OAuthClient, error)
+	FindClient(context.Context, string) (models.OAuthClient, error)
+	InsertClient(context.Context, models.OAuthClient) error
+	DeleteClient(context.Context, string) error
+
+	SaveCode(context.Context, models.OAuthCode) error
+	// TakeCode finds a code by its hash and removes it, so each code is only exchanged once
+	TakeCode(context.Context, string) (models.OAuthCode, error)
+}
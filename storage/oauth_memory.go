@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Dacode45/addressbook/models"
+)
+
+// MemoryOAuthStorage keeps third party apps and authorization codes in memory. Only suitable for a single server, and lost on restart
+type MemoryOAuthStorage struct {
+	mu      sync.Mutex
+	clients map[string]models.OAuthClient
+	codes   map[string]models.OAuthCode
+}
+
+// NewMemoryOAuthStorage creates an empty MemoryOAuthStorage
+func NewMemoryOAuthStorage() OAuthStorage {
+	return &MemoryOAuthStorage{
+		clients: map[string]models.OAuthClient{},
+		codes:   map[string]models.OAuthCode{},
+	}
+}
+
+// FindClients returns every client sorted by name
+func (s *MemoryOAuthStorage) FindClients(ctx context.Context) ([]models.OAuthClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clients := make([]models.OAuthClient, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	return clients, nil
+}
+
+// FindClient returns a client by id
+func (s *MemoryOAuthStorage) FindClient(ctx context.Context, id string) (models.OAuthClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client, ok := s.clients[id]
+	if !ok {
+		return client, ErrClientNotFound
+	}
+	return client, nil
+}
+
+// InsertClient registers a client
+func (s *MemoryOAuthStorage) InsertClient(ctx context.Context, client models.OAuthClient) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[client.ID] = client
+	return nil
+}
+
+// DeleteClient removes a client and its unused codes
+func (s *MemoryOAuthStorage) DeleteClient(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[id]; !ok {
+		return ErrClientNotFound
+	}
+	delete(s.clients, id)
+	for hash, code := range s.codes {
+		if code.ClientID == id {
+			delete(s.codes, hash)
+		}
+	}
+	return nil
+}
+
+// SaveCode stores a code until it is taken. Expired codes are dropped as new ones are saved
+func (s *MemoryOAuthStorage) SaveCode(ctx context.Context, code models.OAuthCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for hash, c := range s.codes {
+		if now.After(c.ExpiresAt) {
+			delete(s.codes, hash)
+		}
+	}
+	s.codes[code.CodeHash] = code
+	return nil
+}
+
+// TakeCode finds a code by its hash and removes it
+func (s *MemoryOAuthStorage) TakeCode(ctx context.Context, hash string) (models.OAuthCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code, ok := s.codes[hash]
+	if !ok {
+		return code, ErrCodeNotFound
+	}
+	delete(s.codes, hash)
+	return code, nil
+}
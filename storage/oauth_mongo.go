@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/Dacode45/addressbook/models"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mongoOAuthClient is a mongodb specific implementation of the OAuthClient struct, keyed by client id
+type mongoOAuthClient struct {
+	ID           string         `bson:"_id"`
+	Name         string         `bson:"name"`
+	RedirectURIs []string       `bson:"redirect_uris"`
+	Scopes       []models.Scope `bson:"scopes"`
+	Confidential bool           `bson:"confidential"`
+	SecretHash   string         `bson:"secret_hash,omitempty"`
+	CreatedBy    string         `bson:"created_by"`
+	CreatedAt    time.Time      `bson:"created_at"`
+}
+
+// toModel converts to the OAuthClient struct
+func (c mongoOAuthClient) toModel() models.OAuthClient {
+	return models.OAuthClient(c)
+}
+
+// mongoOAuthCode is a mongodb specific implementation of the OAuthCode struct, keyed by the hash of the code
+type mongoOAuthCode struct {
+	CodeHash      string         `bson:"_id"`
+	ClientID      string         `bson:"client_id"`
+	Username      string         `bson:"username"`
+	GrantID       string         `bson:"grant_id"`
+	RedirectURI   string         `bson:"redirect_uri"`
+	Scopes        []models.Scope `bson:"scopes"`
+	CodeChallenge string         `bson:"code_challenge"`
+	ExpiresAt     time.Time      `bson:"expires_at"`
+}
+
+// toModel converts to the OAuthCode struct
+func (c mongoOAuthCode) toModel() models.OAuthCode {
+	return models.OAuthCode(c)
+}
+
+// codeExpiryIndex removes codes once they expire
+func codeExpiryIndex() mgo.Index {
+	return mgo.Index{
+		Key:         []string{"expires_at"},
+		Background:  true,
+		ExpireAfter: time.Second,
+	}
+}
+
+// MongoOAuthStorage implements the OAuthStorage interface
+type MongoOAuthStorage struct {
+	clients *mgo.Collection
+	codes   *mgo.Collection
+}
+
+// NewMongoOAuthStorage creates a new storage based of a session, database name, and the collection names for clients and codes
+func NewMongoOAuthStorage(session *MongoSession, dbName string, clientCollectionName string, codeCollectionName string) OAuthStorage {
+	codes := session.GetCollection(dbName, codeCollectionName)
+	codes.EnsureIndex(codeExpiryIndex())
+	return &MongoOAuthStorage{
+		clients: session.GetCollection(dbName, clientCollectionName),
+		codes:   codes,
+	}
+}
+
+// FindClients returns every client sorted by name
+func (s *MongoOAuthStorage) FindClients(ctx context.Context) ([]models.OAuthClient, error) {
+	var found []mongoOAuthClient
+	err := s.clients.Find(nil).Sort("name").All(&found)
+	clients := make([]models.OAuthClient, len(found))
+	for i, c := range found {
+		clients[i] = c.toModel()
+	}
+	return clients, err
+}
+
+// FindClient returns a client by id
+func (s *MongoOAuthStorage) FindClient(ctx context.Context, id string) (models.OAuthClient, error) {
+	var found mongoOAuthClient
+	err := s.clients.FindId(id).One(&found)
+	if err == mgo.ErrNotFound {
+		return models.OAuthClient{}, ErrClientNotFound
+	}
+	return found.toModel(), err
+}
+
+// InsertClient registers a client
+func (s *MongoOAuthStorage) InsertClient(ctx context.Context, client models.OAuthClient) error {
+	return s.clients.Insert(mongoOAuthClient(client))
+}
+
+// DeleteClient removes a client and its unused codes
+func (s *MongoOAuthStorage) DeleteClient(ctx context.Context, id string) error {
+	err := s.clients.RemoveId(id)
+	if err == mgo.ErrNotFound {
+		return ErrClientNotFound
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.codes.RemoveAll(bson.M{"client_id": id})
+	return err
+}
+
+// SaveCode stores a code until it is taken or expires
+func (s *MongoOAuthStorage) SaveCode(ctx context.Context, code models.OAuthCode) error {
+	return s.codes.Insert(mongoOAuthCode(code))
+}
+
+// TakeCode atomically finds a code by its hash and removes it
+func (s *MongoOAuthStorage) TakeCode(ctx context.Context, hash string) (models.OAuthCode, error) {
+	var found mongoOAuthCode
+	_, err := s.codes.FindId(hash).Apply(mgo.Change{Remove: true}, &found)
+	if err == mgo.ErrNotFound {
+		return models.OAuthCode{}, ErrCodeNotFound
+	}
+	return found.toModel(), err
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Dacode45/addressbook/models"
+)
+
+var (
+	// ErrOrgNotFound is returned when an organisation doesn't exist
+	ErrOrgNotFound = errors.New("Organisation not found")
+	// ErrInviteNotFound is returned when an invite doesn't exist, expired, or was already used
+	ErrInviteNotFound = errors.New("Invite not found")
+)
+
+// OrgStorage keeps organisations, their company directories, and the invites into them.
+// Memberships are kept on the users, see UserStorage
+type OrgStorage interface {
+	FindOrg(context.Context, string) (*models.Org, error)
+	CreateOrg(context.Context, models.Org) (*models.Org, error)
+	RenameOrg(context.Context, string, string) error
+	// DeleteOrg removes an organisation with its directory and invites
+	DeleteOrg(context.Context, string) error
+
+	// The company directory
+	FindDirectory(context.Context, string) ([]models.Contact, error)
+	FindDirectoryContact(context.Context, string, string) (*models.Contact, error)
+	CreateDirectoryContact(context.Context, string, models.Contact) (*models.Contact, error)
+	UpdateDirectoryContact(context.Context, string, models.Contact) error
+	DeleteDirectoryContact(context.Context, string, string) error
+
+	// Invites. Expired invites aren't found
+	FindOrgInvites(context.Context, string) ([]models.OrgInvite, error)
+	FindUserInvites(context.Context, string) ([]models.OrgInvite, error)
+	SaveOrgInvite(context.Context, models.OrgInvite) (*models.OrgInvite, error)
+	// TakeOrgInvite finds an invite by id and removes it, so each invite is only used once
+	TakeOrgInvite(context.Context, string) (*models.OrgInvite, error)
+	DeleteOrgInvite(context.Context, string, string) error
+}
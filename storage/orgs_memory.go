@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Dacode45/addressbook/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// memoryOrg is an organisation with its directory
+type memoryOrg struct {
+	org       models.Org
+	directory []models.Contact
+}
+
+// MemoryOrgStorage keeps organisations in memory. Only suitable for a single server, and lost on restart
+type MemoryOrgStorage struct {
+	mu      sync.Mutex
+	orgs    map[string]*memoryOrg
+	invites map[string]models.OrgInvite
+}
+
+// NewMemoryOrgStorage creates an empty MemoryOrgStorage
+func NewMemoryOrgStorage() OrgStorage {
+	return &MemoryOrgStorage{
+		orgs:    map[string]*memoryOrg{},
+		invites: map[string]models.OrgInvite{},
+	}
+}
+
+// FindOrg returns an organisation by id
+func (s *MemoryOrgStorage) FindOrg(ctx context.Context, id string) (*models.Org, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orgs[id]
+	if !ok {
+		return nil, ErrOrgNotFound
+	}
+	org := o.org
+	return &org, nil
+}
+
+// CreateOrg creates an organisation with an empty directory
+func (s *MemoryOrgStorage) CreateOrg(ctx context.Context, org models.Org) (*models.Org, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	org.ID = bson.NewObjectId().Hex()
+	org.CreatedAt = time.Now().UTC()
+	s.orgs[org.ID] = &memoryOrg{org: org}
+	return &org, nil
+}
+
+// RenameOrg renames an organisation
+func (s *MemoryOrgStorage) RenameOrg(ctx context.Context, id string, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orgs[id]
+	if !ok {
+		return ErrOrgNotFound
+	}
+	o.org.Name = name
+	return nil
+}
+
+// DeleteOrg removes an organisation with its directory and invites
+func (s *MemoryOrgStorage) DeleteOrg(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.orgs[id]; !ok {
+		return ErrOrgNotFound
+	}
+	delete(s.orgs, id)
+	for inviteID, invite := range s.invites {
+		if invite.OrgID == id {
+			delete(s.invites, inviteID)
+		}
+	}
+	return nil
+}
+
+// FindDirectory returns the organisation's directory
+func (s *MemoryOrgStorage) FindDirectory(ctx context.Context, orgID string) ([]models.Contact, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orgs[orgID]
+	if !ok {
+		return nil, ErrOrgNotFound
+	}
+	return append([]models.Contact{}, o.directory...), nil
+}
+
+// FindDirectoryContact returns a contact of the organisation's directory
+func (s *MemoryOrgStorage) FindDirectoryContact(ctx context.Context, orgID string, contactID string) (*models.Contact, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orgs[orgID]
+	if !ok {
+		return nil, ErrOrgNotFound
+	}
+	for _, c := range o.directory {
+		if c.ID == contactID {
+			return &c, nil
+		}
+	}
+	return nil, ErrContactNotFound
+}
+
+// CreateDirectoryContact adds a contact to the organisation's directory
+func (s *MemoryOrgStorage) CreateDirectoryContact(ctx context.Context, orgID string, contact models.Contact) (*models.Contact, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orgs[orgID]
+	if !ok {
+		return nil, ErrOrgNotFound
+	}
+	contact.ID = bson.NewObjectId().Hex()
+	contact.BookID = ""
+	o.directory = append(o.directory, contact)
+	return &contact, nil
+}
+
+// UpdateDirectoryContact replaces a contact of the organisation's directory
+func (s *MemoryOrgStorage) UpdateDirectoryContact(ctx context.Context, orgID string, contact models.Contact) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orgs[orgID]
+	if !ok {
+		return ErrOrgNotFound
+	}
+	for i, c := range o.directory {
+		if c.ID == contact.ID {
+			contact.BookID = ""
+			o.directory[i] = contact
+			return nil
+		}
+	}
+	return ErrContactNotFound
+}
+
+// DeleteDirectoryContact removes a contact from the organisation's directory
+func (s *MemoryOrgStorage) DeleteDirectoryContact(ctx context.Context, orgID string, contactID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orgs[orgID]
+	if !ok {
+		return ErrOrgNotFound
+	}
+	for i, c := range o.directory {
+		if c.ID == contactID {
+			o.directory = append(o.directory[:i], o.directory[i+1:]...)
+			return nil
+		}
+	}
+	return ErrContactNotFound
+}
+
+// FindOrgInvites returns the organisation's invites, oldest first
+func (s *MemoryOrgStorage) FindOrgInvites(ctx context.Context, orgID string) ([]models.OrgInvite, error) {
+	return s.findInvites(func(invite models.OrgInvite) bool { return invite.OrgID == orgID }), nil
+}
+
+// FindUserInvites returns the invites to a user, oldest first
+func (s *MemoryOrgStorage) FindUserInvites(ctx context.Context, username string) ([]models.OrgInvite, error) {
+	return s.findInvites(func(invite models.OrgInvite) bool { return invite.Username == username }), nil
+}
+
+// findInvites returns the invites that haven't expired and match, oldest first
+func (s *MemoryOrgStorage) findInvites(match func(models.OrgInvite) bool) []models.OrgInvite {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	invites := []models.OrgInvite{}
+	for _, invite := range s.invites {
+		if now.Before(invite.ExpiresAt) && match(invite) {
+			invites = append(invites, invite)
+		}
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].CreatedAt.Before(invites[j].CreatedAt) })
+	return invites
+}
+
+// SaveOrgInvite stores an invite, replacing the earlier invite of the user into the same organisation
+func (s *MemoryOrgStorage) SaveOrgInvite(ctx context.Context, invite models.OrgInvite) (*models.OrgInvite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, existing := range s.invites {
+		if existing.OrgID == invite.OrgID && existing.Username == invite.Username {
+			delete(s.invites, id)
+		}
+	}
+	invite.ID = bson.NewObjectId().Hex()
+	s.invites[invite.ID] = invite
+	return &invite, nil
+}
+
+// TakeOrgInvite finds an invite by id and removes it
+func (s *MemoryOrgStorage) TakeOrgInvite(ctx context.Context, id string) (*models.OrgInvite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invite, ok := s.invites[id]
+	if !ok || time.Now().After(invite.ExpiresAt) {
+		return nil, ErrInviteNotFound
+	}
+	delete(s.invites, id)
+	return &invite, nil
+}
+
+// DeleteOrgInvite removes one of the organisation's invites
+func (s *MemoryOrgStorage) DeleteOrgInvite(ctx context.Context, orgID string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invite, ok := s.invites[id]
+	if !ok || invite.OrgID != orgID {
+		return ErrInviteNotFound
+	}
+	delete(s.invites, id)
+	return nil
+}
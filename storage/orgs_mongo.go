@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/Dacode45/addressbook/models"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mongoOrg is a mongodb specific implementation of the Org struct, with its directory
+type mongoOrg struct {
+	ID        bson.ObjectId `bson:"_id"`
+	Name      string        `bson:"name"`
+	CreatedBy string        `bson:"created_by"`
+	CreatedAt time.Time     `bson:"created_at"`
+	Directory mongoContacts `bson:"directory"`
+}
+
+// toModel converts to the Org struct
+func (o mongoOrg) toModel() *models.Org {
+	return &models.Org{ID: o.ID.Hex(), Name: o.Name, CreatedBy: o.CreatedBy, CreatedAt: o.CreatedAt}
+}
+
+// mongoOrgInvite is a mongodb specific implementation of the OrgInvite struct
+type mongoOrgInvite struct {
+	ID        bson.ObjectId  `bson:"_id"`
+	OrgID     string         `bson:"org_id"`
+	OrgName   string         `bson:"org_name"`
+	Username  string         `bson:"username"`
+	Role      models.OrgRole `bson:"role"`
+	InvitedBy string         `bson:"invited_by"`
+	CreatedAt time.Time      `bson:"created_at"`
+	ExpiresAt time.Time      `bson:"expires_at"`
+}
+
+// toModel converts to the OrgInvite struct
+func (i mongoOrgInvite) toModel() models.OrgInvite {
+	return models.OrgInvite{
+		ID:        i.ID.Hex(),
+		OrgID:     i.OrgID,
+		OrgName:   i.OrgName,
+		Username:  i.Username,
+		Role:      i.Role,
+		InvitedBy: i.InvitedBy,
+		CreatedAt: i.CreatedAt,
+		ExpiresAt: i.ExpiresAt,
+	}
+}
+
+// inviteExpiryIndex removes invites once they expire
+func inviteExpiryIndex() mgo.Index {
+	return mgo.Index{
+		Key:         []string{"expires_at"},
+		Background:  true,
+		ExpireAfter: time.Second,
+	}
+}
+
+// MongoOrgStorage implements the OrgStorage interface
+type MongoOrgStorage struct {
+	orgs    *mgo.Collection
+	invites *mgo.Collection
+}
+
+// NewMongoOrgStorage creates a new storage based of a session, database name, and the collection names for organisations and invites
+func NewMongoOrgStorage(session *MongoSession, dbName string, orgCollectionName string, inviteCollectionName string) OrgStorage {
+	invites := session.GetCollection(dbName, inviteCollectionName)
+	invites.EnsureIndex(inviteExpiryIndex())
+	return &MongoOrgStorage{
+		orgs:    session.GetCollection(dbName, orgCollectionName),
+		invites: invites,
+	}
+}
+
+// orgID converts an organisation id, failing with ErrOrgNotFound if it isn't an object id
+func orgID(id string) (bson.ObjectId, error) {
+	if !bson.IsObjectIdHex(id) {
+		return "", ErrOrgNotFound
+	}
+	return bson.ObjectIdHex(id), nil
+}
+
+// findOrg finds an organisation with its directory
+func (s *MongoOrgStorage) findOrg(id string) (*mongoOrg, error) {
+	oid, err := orgID(id)
+	if err != nil {
+		return nil, err
+	}
+	var org mongoOrg
+	err = s.orgs.FindId(oid).One(&org)
+	if err == mgo.ErrNotFound {
+		return nil, ErrOrgNotFound
+	}
+	return &org, err
+}
+
+// FindOrg returns an organisation by id
+func (s *MongoOrgStorage) FindOrg(ctx context.Context, id string) (*models.Org, error) {
+	org, err := s.findOrg(id)
+	if err != nil {
+		return nil, err
+	}
+	return org.toModel(), nil
+}
+
+// CreateOrg creates an organisation with an empty directory
+func (s *MongoOrgStorage) CreateOrg(ctx context.Context, org models.Org) (*models.Org, error) {
+	created := mongoOrg{
+		ID:        bson.NewObjectId(),
+		Name:      org.Name,
+		CreatedBy: org.CreatedBy,
+		CreatedAt: time.Now().UTC(),
+		Directory: mongoContacts{},
+	}
+	if err := s.orgs.Insert(created); err != nil {
+		return nil, err
+	}
+	return created.toModel(), nil
+}
+
+// RenameOrg renames an organisation
+func (s *MongoOrgStorage) RenameOrg(ctx context.Context, id string, name string) error {
+	oid, err := orgID(id)
+	if err != nil {
+		return err
+	}
+	err = s.orgs.UpdateId(oid, bson.M{"$set": bson.M{"name": name}})
+	if err == mgo.ErrNotFound {
+		return ErrOrgNotFound
+	}
+	return err
+}
+
+// DeleteOrg removes an organisation with its directory and invites
+func (s *MongoOrgStorage) DeleteOrg(ctx context.Context, id string) error {
+	oid, err := orgID(id)
+	if err != nil {
+		return err
+	}
+	err = s.orgs.RemoveId(oid)
+	if err == mgo.ErrNotFound {
+		return ErrOrgNotFound
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.invites.RemoveAll(bson.M{"org_id": id})
+	return err
+}
+
+// FindDirectory returns the organisation's directory
+func (s *MongoOrgStorage) FindDirectory(ctx context.Context, orgID string) ([]models.Contact, error) {
+	org, err := s.findOrg(orgID)
+	if err != nil {
+		return nil, err
+	}
+	contacts := make([]models.Contact, len(org.Directory))
+	for i, c := range org.Directory {
+		contacts[i] = *c.toModel()
+		contacts[i].BookID = ""
+	}
+	return contacts, nil
+}
+
+// FindDirectoryContact returns a contact of the organisation's directory
+func (s *MongoOrgStorage) FindDirectoryContact(ctx context.Context, orgID string, contactID string) (*models.Contact, error) {
+	org, err := s.findOrg(orgID)
+	if err != nil {
+		return nil, err
+	}
+	contact := org.Directory.findByID(contactID)
+	if contact == nil {
+		return nil, ErrContactNotFound
+	}
+	found := contact.toModel()
+	found.BookID = ""
+	return found, nil
+}
+
+// CreateDirectoryContact adds a contact to the organisation's directory
+func (s *MongoOrgStorage) CreateDirectoryContact(ctx context.Context, id string, contact models.Contact) (*models.Contact, error) {
+	oid, err := orgID(id)
+	if err != nil {
+		return nil, err
+	}
+	contact.BookID = ""
+	newContact := newMongoContact(contact, true)
+	err = s.orgs.UpdateId(oid, bson.M{"$push": bson.M{"directory": newContact}})
+	if err == mgo.ErrNotFound {
+		return nil, ErrOrgNotFound
+	}
+	created := newContact.toModel()
+	created.BookID = ""
+	return created, err
+}
+
+// UpdateDirectoryContact replaces a contact of the organisation's directory
+func (s *MongoOrgStorage) UpdateDirectoryContact(ctx context.Context, id string, contact models.Contact) error {
+	oid, err := orgID(id)
+	if err != nil {
+		return err
+	}
+	if !bson.IsObjectIdHex(contact.ID) {
+		return ErrContactNotFound
+	}
+	contact.BookID = ""
+	update := newMongoContact(contact, false)
+	update.ID = bson.ObjectIdHex(contact.ID)
+	err = s.orgs.Update(
+		bson.M{"_id": oid, "directory._id": update.ID},
+		bson.M{"$set": bson.M{"directory.$": update}},
+	)
+	if err == mgo.ErrNotFound {
+		return ErrContactNotFound
+	}
+	return err
+}
+
+// DeleteDirectoryContact removes a contact from the organisation's directory
+func (s *MongoOrgStorage) DeleteDirectoryContact(ctx context.Context, id string, contactID string) error {
+	oid, err := orgID(id)
+	if err != nil {
+		return err
+	}
+	if !bson.IsObjectIdHex(contactID) {
+		return ErrContactNotFound
+	}
+	err = s.orgs.Update(
+		bson.M{"_id": oid, "directory._id": bson.ObjectIdHex(contactID)},
+		bson.M{"$pull": bson.M{"directory": bson.M{"_id": bson.ObjectIdHex(contactID)}}},
+	)
+	if err == mgo.ErrNotFound {
+		return ErrContactNotFound
+	}
+	return err
+}
+
+// FindOrgInvites returns the organisation's invites, oldest first
+func (s *MongoOrgStorage) FindOrgInvites(ctx context.Context, orgID string) ([]models.OrgInvite, error) {
+	return s.findInvites(bson.M{"org_id": orgID})
+}
+
+// FindUserInvites returns the invites to a user, oldest first
+func (s *MongoOrgStorage) FindUserInvites(ctx context.Context, username string) ([]models.OrgInvite, error) {
+	return s.findInvites(bson.M{"username": username})
+}
+
+// findInvites returns the invites that haven't expired and match the query, oldest first
+func (s *MongoOrgStorage) findInvites(query bson.M) ([]models.OrgInvite, error) {
+	// the expiry index removes invites in the background, so expired ones may still be around
+	query["expires_at"] = bson.M{"$gt": time.Now()}
+	var found []mongoOrgInvite
+	err := s.invites.Find(query).Sort("created_at").All(&found)
+	invites := make([]models.OrgInvite, len(found))
+	for i, invite := range found {
+		invites[i] = invite.toModel()
+	}
+	return invites, err
+}
+
+// SaveOrgInvite stores an invite, replacing the earlier invite of the user into the same organisation
+func (s *MongoOrgStorage) SaveOrgInvite(ctx context.Context, invite models.OrgInvite) (*models.OrgInvite, error) {
+	saved := mongoOrgInvite{
+		ID:        bson.NewObjectId(),
+		OrgID:     invite.OrgID,
+		OrgName:   invite.OrgName,
+		Username:  invite.Username,
+		Role:      invite.Role,
+		InvitedBy: invite.InvitedBy,
+		CreatedAt: invite.CreatedAt,
+		ExpiresAt: invite.ExpiresAt,
+	}
+	if _, err := s.invites.RemoveAll(bson.M{"org_id": invite.OrgID, "username": invite.Username}); err != nil {
+		return nil, err
+	}
+	if err := s.invites.Insert(saved); err != nil {
+		return nil, err
+	}
+	model := saved.toModel()
+	return &model, nil
+}
+
+// TakeOrgInvite finds an invite by id and removes it
+func (s *MongoOrgStorage) TakeOrgInvite(ctx context.Context, id string) (*models.OrgInvite, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInviteNotFound
+	}
+	var invite mongoOrgInvite
+	_, err := s.invites.Find(bson.M{"_id": bson.ObjectIdHex(id), "expires_at": bson.M{"$gt": time.Now()}}).
+		Apply(mgo.Change{Remove: true}, &invite)
+	if err == mgo.ErrNotFound {
+		return nil, ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	model := invite.toModel()
+	return &model, nil
+}
+
+// DeleteOrgInvite removes one of the organisation's invites
+func (s *MongoOrgStorage) DeleteOrgInvite(ctx context.Context, orgID string, id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInviteNotFound
+	}
+	err := s.invites.Remove(bson.M{"_id": bson.ObjectIdHex(id), "org_id": orgID})
+	if err == mgo.ErrNotFound {
+		return ErrInviteNotFound
+	}
+	return err
+}
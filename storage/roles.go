@@ -0,0 +1,20 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Dacode45/addressbook/models"
+)
+
+// ErrRoleNotFound is returned when a custom role doesn't exist
+var ErrRoleNotFound = errors.New("Role not found")
+
+// RoleStorage keeps the custom roles defined at runtime. Built in roles are not stored
+type RoleStorage interface {
+	FindAll(context.Context) ([]models.RoleDefinition, error)
+	Find(context.Context, models.Role) (models.RoleDefinition, error)
+	// Save creates or replaces a role
+	Save(context.Context, models.RoleDefinition) error
+	Delete(context.Context, models.Role) error
+}
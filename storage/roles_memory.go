@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/Dacode45/addressbook/models"
+)
+
+// MemoryRoleStorage keeps custom roles in memory. Only suitable for a single server, and lost on restart
+type MemoryRoleStorage struct {
+	mu    sync.Mutex
+	roles map[models.Role]models.RoleDefinition
+}
+
+// NewMemoryRoleStorage creates an empty MemoryRoleStorage
+func NewMemoryRoleStorage() RoleStorage {
+	return &MemoryRoleStorage{roles: map[models.Role]models.RoleDefinition{}}
+}
+
+// FindAll returns every custom role sorted by name
+func (s *MemoryRoleStorage) FindAll(ctx context.Context) ([]models.RoleDefinition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	roles := make([]models.RoleDefinition, 0, len(s.roles))
+	for _, def := range s.roles {
+		roles = append(roles, def)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles, nil
+}
+
+// Find returns a custom role by name
+func (s *MemoryRoleStorage) Find(ctx context.Context, name models.Role) (models.RoleDefinition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	def, ok := s.roles[name]
+	if !ok {
+		return def, ErrRoleNotFound
+	}
+	return def, nil
+}
+
+// Save creates or replaces a role
+func (s *MemoryRoleStorage) Save(ctx context.Context, def models.RoleDefinition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roles[def.Name] = def
+	return nil
+}
+
+// Delete removes a role
+func (s *MemoryRoleStorage) Delete(ctx context.Context, name models.Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.roles[name]; !ok {
+		return ErrRoleNotFound
+	}
+	delete(s.roles, name)
+	return nil
+}
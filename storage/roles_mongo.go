@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/Dacode45/addressbook/models"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// mongoRoleDefinition is a mongodb specific implementation of the RoleDefinition struct, keyed by name
+type mongoRoleDefinition struct {
+	Name        models.Role         `bson:"_id"`
+	Description string              `bson:"description,omitempty"`
+	Permissions []models.Permission `bson:"permissions"`
+}
+
+// newMongoRoleDefinition creates a mongoRoleDefinition from a RoleDefinition
+func newMongoRoleDefinition(def models.RoleDefinition) mongoRoleDefinition {
+	return mongoRoleDefinition{
+		Name:        def.Name,
+		Description: def.Description,
+		Permissions: def.Permissions,
+	}
+}
+
+// toModel converts to the RoleDefinition struct
+func (r mongoRoleDefinition) toModel() models.RoleDefinition {
+	permissions := r.Permissions
+	if permissions == nil {
+		permissions = []models.Permission{}
+	}
+	return models.RoleDefinition{
+		Name:        r.Name,
+		Description: r.Description,
+		Permissions: permissions,
+	}
+}
+
+// MongoRoleStorage implements the RoleStorage interface
+type MongoRoleStorage struct {
+	collection *mgo.Collection
+}
+
+// NewMongoRoleStorage creates a new storage based of a session, database name, and collection name
+func NewMongoRoleStorage(session *MongoSession, dbName string, collectionName string) RoleStorage {
+	return &MongoRoleStorage{session.GetCollection(dbName, collectionName)}
+}
+
+// FindAll returns every custom role sorted by name
+func (s *MongoRoleStorage) FindAll(ctx context.Context) ([]models.RoleDefinition, error) {
+	var found []mongoRoleDefinition
+	err := s.collection.Find(nil).Sort("_id").All(&found)
+	roles := make([]models.RoleDefinition, len(found))
+	for i, r := range found {
+		roles[i] = r.toModel()
+	}
+	return roles, err
+}
+
+// Find returns a custom role by name
+func (s *MongoRoleStorage) Find(ctx context.Context, name models.Role) (models.RoleDefinition, error) {
+	var found mongoRoleDefinition
+	err := s.collection.FindId(name).One(&found)
+	if err == mgo.ErrNotFound {
+		return models.RoleDefinition{}, ErrRoleNotFound
+	}
+	return found.toModel(), err
+}
+
+// Save creates or replaces a role
+func (s *MongoRoleStorage) Save(ctx context.Context, def models.RoleDefinition) error {
+	_, err := s.collection.UpsertId(def.Name, newMongoRoleDefinition(def))
+	return err
+}
+
+// Delete removes a role
+func (s *MongoRoleStorage) Delete(ctx context.Context, name models.Role) error {
+	err := s.collection.RemoveId(name)
+	if err == mgo.ErrNotFound {
+		return ErrRoleNotFound
+	}
+	return err
+}
@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// LoginAttempts is the failed login history of a username or ip
+type LoginAttempts struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// ThrottleStorage records failed logins. Servers sharing a ThrottleStorage share throttling and lockouts
+type ThrottleStorage interface {
+	Get(context.Context, string) (LoginAttempts, error)
+	RecordFailure(context.Context, string, time.Time) (LoginAttempts, error)
+	Lock(context.Context, string, time.Time) error
+	Reset(context.Context, string) error
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryThrottleStorage keeps login attempts in memory. Only suitable for a single server
+type MemoryThrottleStorage struct {
+	mu       sync.Mutex
+	attempts map[string]LoginAttempts
+}
+
+// NewMemoryThrottleStorage creates an empty MemoryThrottleStorage
+func NewMemoryThrottleStorage() ThrottleStorage {
+	return &MemoryThrottleStorage{attempts: map[string]LoginAttempts{}}
+}
+
+// Get returns the attempts for a key
+func (s *MemoryThrottleStorage) Get(ctx context.Context, key string) (LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts[key], nil
+}
+
+// RecordFailure counts a failure and returns the updated attempts
+func (s *MemoryThrottleStorage) RecordFailure(ctx context.Context, key string, at time.Time) (LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.attempts[key]
+	a.Failures++
+	a.LastFailure = at
+	s.attempts[key] = a
+	return a, nil
+}
+
+// Lock locks a key until the given time
+func (s *MemoryThrottleStorage) Lock(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.attempts[key]
+	a.LockedUntil = until
+	s.attempts[key] = a
+	return nil
+}
+
+// Reset forgets the attempts of a key, and unlocks it
+func (s *MemoryThrottleStorage) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
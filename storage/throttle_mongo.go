@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mongoLoginAttempts is a mongodb specific implementation of LoginAttempts, keyed by username or ip
+type mongoLoginAttempts struct {
+	Key         string    `bson:"_id"`
+	Failures    int       `bson:"failures"`
+	LastFailure time.Time `bson:"last_failure"`
+	LockedUntil time.Time `bson:"locked_until,omitempty"`
+}
+
+// toModel converts to the LoginAttempts struct
+func (a *mongoLoginAttempts) toModel() LoginAttempts {
+	return LoginAttempts{
+		Failures:    a.Failures,
+		LastFailure: a.LastFailure,
+		LockedUntil: a.LockedUntil,
+	}
+}
+
+// lastFailureIndex expires attempts a day after the last failure. Lockouts must be shorter than that
+func lastFailureIndex() mgo.Index {
+	return mgo.Index{
+		Key:         []string{"last_failure"},
+		Background:  true,
+		ExpireAfter: 24 * time.Hour,
+	}
+}
+
+// MongoThrottleStorage implements the ThrottleStorage interface
+type MongoThrottleStorage struct {
+	collection *mgo.Collection
+}
+
+// NewMongoThrottleStorage creates a new storage based of a session, database name, and collection name
+func NewMongoThrottleStorage(session *MongoSession, dbName string, collectionName string) ThrottleStorage {
+	collection := session.GetCollection(dbName, collectionName)
+	collection.EnsureIndex(lastFailureIndex())
+	return &MongoThrottleStorage{collection}
+}
+
+// Get returns the attempts for a key
+func (s *MongoThrottleStorage) Get(ctx context.Context, key string) (LoginAttempts, error) {
+	var model mongoLoginAttempts
+	err := s.collection.FindId(key).One(&model)
+	if err == mgo.ErrNotFound {
+		return LoginAttempts{}, nil
+	}
+	return model.toModel(), err
+}
+
+// RecordFailure atomically counts a failure and returns the updated attempts
+func (s *MongoThrottleStorage) RecordFailure(ctx context.Context, key string, at time.Time) (LoginAttempts, error) {
+	var model mongoLoginAttempts
+	_, err := s.collection.FindId(key).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"failures": 1}, "$set": bson.M{"last_failure": at}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &model)
+	return model.toModel(), err
+}
+
+// Lock locks a key until the given time
+func (s *MongoThrottleStorage) Lock(ctx context.Context, key string, until time.Time) error {
+	_, err := s.collection.UpsertId(key, bson.M{"$set": bson.M{"locked_until": until, "last_failure": time.Now()}})
+	return err
+}
+
+// Reset forgets the attempts of a key, and unlocks it
+func (s *MongoThrottleStorage) Reset(ctx context.Context, key string) error {
+	err := s.collection.RemoveId(key)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
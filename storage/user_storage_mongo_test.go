@@ -3,12 +3,15 @@ package storage_test
 import (
 	"context"
 	"log"
+	"strings"
 	"testing"
 
+	"github.com/Dacode45/addressbook/crypto"
 	"github.com/Dacode45/addressbook/mock"
 	"github.com/Dacode45/addressbook/models"
 	"github.com/Dacode45/addressbook/storage"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
 )
 
 const (
@@ -21,6 +24,9 @@ func Test_MongoUserStorage(t *testing.T) {
 	t.Run("Insert user", should_insert_user)
 	t.Run("Query users", should_query_users)
 	t.Run("Query contacts", should_query_contacts)
+	t.Run("Rehash on login", should_rehash_on_login)
+	t.Run("Migrate flat contacts", should_migrate_flat_contacts)
+	t.Run("Migrate roles", should_migrate_roles)
 }
 
 func should_insert_user(t *testing.T) {
@@ -151,3 +157,95 @@ func should_query_contacts(t *testing.T) {
 	fakeContact, err = uStorage.FindContactById(ctx, fakeUser.UserID, fakeContact.ID)
 	assert.Error(t, err, "failed to delete contact")
 }
+
+func should_rehash_on_login(t *testing.T) {
+	session, err := storage.NewMongoSession(mongoUrl)
+	if err != nil {
+		log.Fatalf("Unable to connect to mongo: %s", err)
+	}
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	ctx := context.Background()
+	legacyStorage := storage.NewMongoUserStorage(session.Copy(), dbName, userCollectionName, &crypto.Hash{})
+	user := models.User{
+		Username: "test_user",
+		Password: "test_password",
+	}
+	assert.NoError(t, legacyStorage.Insert(ctx, user), "Unable to create user")
+
+	params := crypto.Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	uStorage := storage.NewMongoUserStorage(session.Copy(), dbName, userCollectionName, crypto.NewArgon2Hash(params))
+	_, err = uStorage.Login(ctx, models.Credentials{Username: user.Username, Password: "wrong_password"})
+	assert.Error(t, err, "Logged in with the wrong password")
+
+	_, err = uStorage.Login(ctx, models.Credentials{Username: user.Username, Password: user.Password})
+	assert.NoError(t, err, "Unable to log in with a legacy hash")
+
+	var stored models.User
+	session.GetCollection(dbName, userCollectionName).Find(nil).One(&stored)
+	assert.True(t, strings.HasPrefix(stored.Password, "$argon2id$"), "Password was not rehashed")
+
+	_, err = uStorage.Login(ctx, models.Credentials{Username: user.Username, Password: user.Password})
+	assert.NoError(t, err, "Unable to log in after the rehash")
+}
+
+func should_migrate_flat_contacts(t *testing.T) {
+	session, err := storage.NewMongoSession(mongoUrl)
+	if err != nil {
+		log.Fatalf("Unable to connect to mongo: %s", err)
+	}
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	// a contact as it was stored before labelled values
+	collection := session.GetCollection(dbName, userCollectionName)
+	err = collection.Insert(bson.M{
+		"username": "test_user",
+		"password": "test_password",
+		"contacts": []bson.M{{"_id": bson.NewObjectId(), "first_name": "Ada", "email": "ada@example.com", "phone": "555-0100"}},
+	})
+	assert.NoError(t, err, "Unable to create user")
+
+	ctx := context.Background()
+	uStorage := storage.NewMongoUserStorage(session.Copy(), dbName, userCollectionName, &mock.Hash{})
+	contacts, err := uStorage.FindAllContacts(ctx, "test_user")
+	assert.NoError(t, err, "Failed to fetch all contacts")
+	assert.Len(t, contacts, 1, "Unexpected contact count")
+	assert.Equal(t, models.ContactValues{{Value: "ada@example.com", Preferred: true}}, contacts[0].Emails, "The email should be migrated")
+	assert.Equal(t, models.ContactValues{{Value: "555-0100", Preferred: true}}, contacts[0].Phones, "The phone should be migrated")
+
+	var stored bson.M
+	collection.Find(bson.M{"contacts.email": bson.M{"$exists": true}}).One(&stored)
+	assert.Nil(t, stored, "Flat fields should be rewritten")
+}
+
+func should_migrate_roles(t *testing.T) {
+	session, err := storage.NewMongoSession(mongoUrl)
+	if err != nil {
+		log.Fatalf("Unable to connect to mongo: %s", err)
+	}
+	defer func() {
+		session.DropDatabase(dbName)
+		session.Close()
+	}()
+
+	// a user as it was stored when users had a single role
+	collection := session.GetCollection(dbName, userCollectionName)
+	err = collection.Insert(bson.M{"username": "test_user", "password": "test_password", "role": "admin"})
+	assert.NoError(t, err, "Unable to create user")
+
+	ctx := context.Background()
+	uStorage := storage.NewMongoUserStorage(session.Copy(), dbName, userCollectionName, &mock.Hash{})
+	count, err := uStorage.CountByRole(ctx, models.RoleAdmin)
+	assert.NoError(t, err, "Failed to count admins")
+	assert.Equal(t, 1, count, "The role should be migrated")
+
+	var stored bson.M
+	collection.Find(bson.M{"role": bson.M{"$exists": true}}).One(&stored)
+	assert.Nil(t, stored, "The single role should be unset")
+}
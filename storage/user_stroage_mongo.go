@@ -3,6 +3,10 @@ package storage
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/Dacode45/addressbook/common"
 	"github.com/Dacode45/addressbook/models"
@@ -12,11 +16,125 @@ import (
 
 // mongoContact is a mongodb specific implementaiton of the Contact struct
 type mongoContact struct {
-	ID        bson.ObjectId `bson:"_id" json:"id"`
-	FirstName string        `bson:"first_name" json:"first_name"`
-	LastName  string        `bson:"last_name" json:"last_name"`
-	Email     string        `bson:"email" json:"email"`
-	Phone     string        `bson:"phone" json:"phone"`
+	ID bson.ObjectId `bson:"_id" json:"id"`
+	// BookID is left out for contacts in the default book
+	BookID            string              `bson:"book_id,omitempty" json:"book_id"`
+	Prefix            string              `bson:"prefix,omitempty" json:"prefix"`
+	FirstName         string              `bson:"first_name" json:"first_name"`
+	MiddleName        string              `bson:"middle_name,omitempty" json:"middle_name"`
+	LastName          string              `bson:"last_name" json:"last_name"`
+	Suffix            string              `bson:"suffix,omitempty" json:"suffix"`
+	Nickname          string              `bson:"nickname,omitempty" json:"nickname"`
+	PhoneticFirstName string              `bson:"phonetic_first_name,omitempty" json:"phonetic_first_name"`
+	PhoneticLastName  string              `bson:"phonetic_last_name,omitempty" json:"phonetic_last_name"`
+	Emails            []mongoContactValue `bson:"emails,omitempty" json:"emails"`
+	Phones            []mongoContactValue `bson:"phones,omitempty" json:"phones"`
+	Addresses         []mongoAddress      `bson:"addresses,omitempty" json:"addresses"`
+	Organization      string              `bson:"organization,omitempty" json:"organization"`
+	JobTitle          string              `bson:"job_title,omitempty" json:"job_title"`
+	Birthday          string              `bson:"birthday,omitempty" json:"birthday"`
+	Anniversary       string              `bson:"anniversary,omitempty" json:"anniversary"`
+	URLs              []string            `bson:"urls,omitempty" json:"urls"`
+	Notes             string              `bson:"notes,omitempty" json:"notes"`
+	Tags              []string            `bson:"tags,omitempty" json:"tags"`
+	Custom            map[string]string   `bson:"custom,omitempty" json:"custom"`
+	Photo             *mongoPhoto         `bson:"photo,omitempty" json:"photo"`
+	Attachments       []mongoAttachment   `bson:"attachments,omitempty" json:"attachments"`
+	Interactions      []mongoInteraction  `bson:"interactions,omitempty" json:"-"`
+	// Email and Phone are the single email and phone of contacts stored before labelled values. See migrateFlatContacts
+	Email string `bson:"email,omitempty" json:"-"`
+	Phone string `bson:"phone,omitempty" json:"-"`
+}
+
+// mongoContactValue is a models.ContactValue with bson tags
+type mongoContactValue struct {
+	Label     string `bson:"label,omitempty"`
+	Value     string `bson:"value"`
+	Preferred bool   `bson:"preferred,omitempty"`
+}
+
+// mongoAddress is a models.Address with bson tags
+type mongoAddress struct {
+	Label     string `bson:"label,omitempty"`
+	Street    string `bson:"street,omitempty"`
+	Locality  string `bson:"locality,omitempty"`
+	Region    string `bson:"region,omitempty"`
+	Postcode  string `bson:"postcode,omitempty"`
+	Country   string `bson:"country,omitempty"`
+	Preferred bool   `bson:"preferred,omitempty"`
+}
+
+// mongoPhoto is a models.ContactPhoto with bson tags
+type mongoPhoto struct {
+	Hash        string    `bson:"hash"`
+	ContentType string    `bson:"content_type"`
+	Width       int       `bson:"width"`
+	Height      int       `bson:"height"`
+	Size        int64     `bson:"size"`
+	UpdatedAt   time.Time `bson:"updated_at"`
+}
+
+// newMongoPhoto converts a photo, nil for contacts without one
+func newMongoPhoto(p *models.ContactPhoto) *mongoPhoto {
+	if p == nil {
+		return nil
+	}
+	photo := mongoPhoto(*p)
+	return &photo
+}
+
+// toModel converts a photo, nil for contacts without one
+func (p *mongoPhoto) toModel() *models.ContactPhoto {
+	if p == nil {
+		return nil
+	}
+	photo := models.ContactPhoto(*p)
+	return &photo
+}
+
+// mongoAttachment is a models.Attachment with bson tags
+type mongoAttachment struct {
+	ID          string    `bson:"id"`
+	Filename    string    `bson:"filename"`
+	ContentType string    `bson:"content_type"`
+	Size        int64     `bson:"size"`
+	Hash        string    `bson:"hash"`
+	CreatedAt   time.Time `bson:"created_at"`
+}
+
+// mongoInteraction is a models.Interaction with bson tags. It is kept in the contact it was logged against
+type mongoInteraction struct {
+	ID        bson.ObjectId `bson:"_id"`
+	Kind      string        `bson:"kind"`
+	At        time.Time     `bson:"at"`
+	Text      string        `bson:"text,omitempty"`
+	Links     []string      `bson:"links,omitempty"`
+	Author    string        `bson:"author"`
+	CreatedAt time.Time     `bson:"created_at"`
+}
+
+// toModel converts an interaction logged against a contact
+func (i mongoInteraction) toModel(contactID bson.ObjectId) models.Interaction {
+	return models.Interaction{
+		ID:        i.ID.Hex(),
+		ContactID: contactID.Hex(),
+		Kind:      models.InteractionKind(i.Kind),
+		At:        i.At,
+		Text:      i.Text,
+		Links:     i.Links,
+		Author:    i.Author,
+		CreatedAt: i.CreatedAt,
+	}
+}
+
+// links checks if the interaction links a contact
+func (i mongoInteraction) links(contactID bson.ObjectId) bool {
+	for _, link := range i.Links {
+		if link == contactID.Hex() {
+			return true
+		}
+	}
+	return false
 }
 
 // newMOngoContact creates a new MongodbContact from a Contact
@@ -25,12 +143,50 @@ func newMongoContact(c models.Contact, newID bool) *mongoContact {
 	if newID {
 		id = bson.NewObjectId()
 	}
+	bookID := c.BookID
+	if bookID == models.DefaultBookID {
+		bookID = ""
+	}
+	emails := make([]mongoContactValue, len(c.Emails))
+	for i, v := range c.Emails {
+		emails[i] = mongoContactValue(v)
+	}
+	phones := make([]mongoContactValue, len(c.Phones))
+	for i, v := range c.Phones {
+		phones[i] = mongoContactValue(v)
+	}
+	addresses := make([]mongoAddress, len(c.Addresses))
+	for i, a := range c.Addresses {
+		addresses[i] = mongoAddress(a)
+	}
+	var attachments []mongoAttachment
+	for _, a := range c.Attachments {
+		attachments = append(attachments, mongoAttachment(a))
+	}
 	return &mongoContact{
-		ID:        id,
-		FirstName: c.FirstName,
-		LastName:  c.LastName,
-		Email:     c.Email,
-		Phone:     c.Phone,
+		ID:                id,
+		BookID:            bookID,
+		Prefix:            c.Prefix,
+		FirstName:         c.FirstName,
+		MiddleName:        c.MiddleName,
+		LastName:          c.LastName,
+		Suffix:            c.Suffix,
+		Nickname:          c.Nickname,
+		PhoneticFirstName: c.PhoneticFirstName,
+		PhoneticLastName:  c.PhoneticLastName,
+		Emails:            emails,
+		Phones:            phones,
+		Addresses:         addresses,
+		Organization:      c.Organization,
+		JobTitle:          c.JobTitle,
+		Birthday:          c.Birthday,
+		Anniversary:       c.Anniversary,
+		URLs:              c.URLs,
+		Notes:             c.Notes,
+		Tags:              c.Tags,
+		Custom:            c.Custom,
+		Photo:             newMongoPhoto(c.Photo),
+		Attachments:       attachments,
 	}
 
 }
@@ -51,6 +207,43 @@ func (contacts mongoContacts) findByID(id string) *mongoContact {
 	return nil
 }
 
+// lastContacted finds when each contact was last contacted by a time, from the interactions logged against them or
+// linking them
+func (contacts mongoContacts) lastContacted(by time.Time) map[string]time.Time {
+	last := map[string]time.Time{}
+	for _, c := range contacts {
+		for _, i := range c.Interactions {
+			if !i.toModel(c.ID).Contacted(by) {
+				continue
+			}
+			for _, id := range append([]string{c.ID.Hex()}, i.Links...) {
+				if i.At.After(last[id]) {
+					last[id] = i.At
+				}
+			}
+		}
+	}
+	return last
+}
+
+// inBook keeps the contacts in a book. Users a book is shared with only see the interactions of its contacts
+func (contacts mongoContacts) inBook(bookID string) mongoContacts {
+	in := mongoContacts{}
+	for _, c := range contacts {
+		if c.toModel().BookID == bookID {
+			in = append(in, c)
+		}
+	}
+	return in
+}
+
+// setLastContacted sets when a contact was last contacted, leaving it nil for contacts never contacted
+func setLastContacted(contact *models.Contact, last map[string]time.Time) {
+	if at, ok := last[contact.ID]; ok {
+		contact.LastContacted = &at
+	}
+}
+
 // replaces (used for updating) an element of the contact slice with another
 func (contacts mongoContacts) replaceWith(contact mongoContact) mongoContacts {
 	update := contacts
@@ -77,36 +270,349 @@ func (contacts mongoContacts) removeID(id string) mongoContacts {
 	return update
 }
 
-// converts to the Contact struct
+// converts to the Contact struct. The single email and phone of contacts from before labelled values are read as their preferred ones
 func (c *mongoContact) toModel() *models.Contact {
+	bookID := c.BookID
+	if bookID == "" {
+		bookID = models.DefaultBookID
+	}
+	emails := make(models.ContactValues, len(c.Emails))
+	for i, v := range c.Emails {
+		emails[i] = models.ContactValue(v)
+	}
+	if len(emails) == 0 && c.Email != "" {
+		emails = models.ContactValues{{Value: c.Email, Preferred: true}}
+	}
+	phones := make(models.ContactValues, len(c.Phones))
+	for i, v := range c.Phones {
+		phones[i] = models.ContactValue(v)
+	}
+	if len(phones) == 0 && c.Phone != "" {
+		phones = models.ContactValues{{Value: c.Phone, Preferred: true}}
+	}
+	addresses := make(models.Addresses, len(c.Addresses))
+	for i, a := range c.Addresses {
+		addresses[i] = models.Address(a)
+	}
+	urls := append(models.URLs{}, c.URLs...)
+	var custom models.CustomFields
+	if len(c.Custom) > 0 {
+		custom = models.CustomFields(c.Custom)
+	}
+	var attachments []models.Attachment
+	for _, a := range c.Attachments {
+		attachments = append(attachments, models.Attachment(a))
+	}
 	return &models.Contact{
-		ID:        c.ID.Hex(),
-		FirstName: c.FirstName,
-		LastName:  c.LastName,
-		Email:     c.Email,
-		Phone:     c.Phone,
+		ID:                c.ID.Hex(),
+		BookID:            bookID,
+		Prefix:            c.Prefix,
+		FirstName:         c.FirstName,
+		MiddleName:        c.MiddleName,
+		LastName:          c.LastName,
+		Suffix:            c.Suffix,
+		Nickname:          c.Nickname,
+		PhoneticFirstName: c.PhoneticFirstName,
+		PhoneticLastName:  c.PhoneticLastName,
+		Emails:            emails,
+		Phones:            phones,
+		Addresses:         addresses,
+		Organization:      c.Organization,
+		JobTitle:          c.JobTitle,
+		Birthday:          c.Birthday,
+		Anniversary:       c.Anniversary,
+		URLs:              urls,
+		Notes:             c.Notes,
+		Tags:              append(models.Tags{}, c.Tags...),
+		Custom:            custom,
+		Photo:             c.Photo.toModel(),
+		Attachments:       attachments,
 	}
 }
 
 // mongoUser creates a mongodb specific User
 type mongoUser struct {
-	UserID   bson.ObjectId `bson:"_id,omitempty" json:"id"`
-	Username string        `bson:"username" json:"username"`
-	Password string        `bson:"password" json:"password"`
-	Contacts mongoContacts
+	UserID                bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	Username              string        `bson:"username" json:"username"`
+	Password              string        `bson:"password" json:"password"`
+	Email                 string        `bson:"email,omitempty" json:"email"`
+	EmailVerified         bool          `bson:"email_verified" json:"email_verified"`
+	Roles                 []models.Role `bson:"roles,omitempty" json:"-"`
+	Disabled              bool          `bson:"disabled" json:"-"`
+	PasswordResetRequired bool          `bson:"password_reset_required" json:"-"`
+	// ProfileVisibility is left out for users who never changed it
+	ProfileVisibility string   `bson:"profile_visibility,omitempty" json:"-"`
+	ContactViewers    []string `bson:"contact_viewers,omitempty" json:"-"`
+	// TokenNonces holds the nonce of the outstanding single use token for each purpose
+	TokenNonces   map[string]string `bson:"token_nonces,omitempty" json:"-"`
+	TOTPSecret    string            `bson:"totp_secret,omitempty" json:"-"`
+	TOTPEnabled   bool              `bson:"totp_enabled" json:"-"`
+	TOTPStep      int64             `bson:"totp_step" json:"-"`
+	RecoveryCodes []string          `bson:"recovery_codes,omitempty" json:"-"`
+	// WebAuthnSessions holds the json encoded session of the ceremony in progress for each kind of ceremony, so starting
+	// a login can't replace a registration in progress
+	WebAuthnSessions    map[string][]byte         `bson:"webauthn_sessions,omitempty" json:"-"`
+	WebAuthnCredentials []mongoWebAuthnCredential `bson:"webauthn_credentials,omitempty" json:"-"`
+	OIDCIdentities      []mongoOIDCIdentity       `bson:"oidc_identities,omitempty" json:"-"`
+	OAuthGrants         []mongoOAuthGrant         `bson:"oauth_grants,omitempty" json:"-"`
+	SessionVersion      int                       `bson:"session_version" json:"-"`
+	DeletedAt           *time.Time                `bson:"deleted_at,omitempty" json:"-"`
+	Books               []mongoBook               `bson:"books,omitempty" json:"-"`
+	DefaultBookFields   []mongoFieldDefinition    `bson:"default_book_fields,omitempty" json:"-"`
+	DefaultBookTags     []string                  `bson:"default_book_tags,omitempty" json:"-"`
+	UserGroups          []mongoUserGroup          `bson:"user_groups,omitempty" json:"-"`
+	ContactGroups       []mongoContactGroup       `bson:"contact_groups,omitempty" json:"-"`
+	Orgs                []mongoOrgMembership      `bson:"orgs,omitempty" json:"-"`
+	Contacts            mongoContacts
+}
+
+// mongoBook is a mongodb specific implementation of the Book struct. The default book isn't stored
+type mongoBook struct {
+	ID        bson.ObjectId          `bson:"_id"`
+	Name      string                 `bson:"name"`
+	CreatedAt time.Time              `bson:"created_at"`
+	Shares    []mongoBookShare       `bson:"shares,omitempty"`
+	Fields    []mongoFieldDefinition `bson:"fields,omitempty"`
+	// Tags are the tags made for the book's contacts, listed even while no contact has them
+	Tags []string `bson:"tags,omitempty"`
+}
+
+// mongoBookShare is a models.BookShare with bson tags
+type mongoBookShare struct {
+	Username   string                `bson:"username,omitempty"`
+	GroupID    string                `bson:"group_id,omitempty"`
+	Permission models.BookPermission `bson:"permission"`
+	GrantedBy  string                `bson:"granted_by"`
+	GrantedAt  time.Time             `bson:"granted_at"`
+}
+
+// mongoFieldDefinition is a models.FieldDefinition with bson tags
+type mongoFieldDefinition struct {
+	Key      string           `bson:"key"`
+	Label    string           `bson:"label"`
+	Type     models.FieldType `bson:"type"`
+	Options  []string         `bson:"options,omitempty"`
+	Required bool             `bson:"required,omitempty"`
+}
+
+// newMongoFieldDefinitions converts the custom fields of a book
+func newMongoFieldDefinitions(fields models.FieldDefinitions) []mongoFieldDefinition {
+	converted := make([]mongoFieldDefinition, len(fields))
+	for i, f := range fields {
+		converted[i] = mongoFieldDefinition(f)
+	}
+	return converted
+}
+
+// fieldDefinitions converts stored custom fields to the FieldDefinitions struct
+func fieldDefinitions(fields []mongoFieldDefinition) models.FieldDefinitions {
+	var converted models.FieldDefinitions
+	for _, f := range fields {
+		converted = append(converted, models.FieldDefinition(f))
+	}
+	return converted
+}
+
+// toModel converts to the Book struct
+func (b mongoBook) toModel() models.Book {
+	shares := make([]models.BookShare, len(b.Shares))
+	for i, share := range b.Shares {
+		shares[i] = models.BookShare(share)
+	}
+	return models.Book{ID: b.ID.Hex(), Name: b.Name, CreatedAt: b.CreatedAt, Shares: shares, Fields: fieldDefinitions(b.Fields)}
+}
+
+// mongoUserGroup is a mongodb specific implementation of the UserGroup struct. The owner is the user it is stored in
+type mongoUserGroup struct {
+	ID        bson.ObjectId `bson:"_id"`
+	Name      string        `bson:"name"`
+	Members   []string      `bson:"members"`
+	CreatedAt time.Time     `bson:"created_at"`
+}
+
+// toModel converts to the UserGroup struct
+func (g mongoUserGroup) toModel(owner string) models.UserGroup {
+	return models.UserGroup{ID: g.ID.Hex(), Name: g.Name, Owner: owner, Members: g.Members, CreatedAt: g.CreatedAt}
+}
+
+// mongoContactGroup is a mongodb specific implementation of the ContactGroup struct
+type mongoContactGroup struct {
+	ID        bson.ObjectId `bson:"_id"`
+	Name      string        `bson:"name"`
+	Contacts  []string      `bson:"contacts"`
+	Groups    []string      `bson:"groups"`
+	CreatedAt time.Time     `bson:"created_at"`
+}
+
+// toModel converts to the ContactGroup struct
+func (g mongoContactGroup) toModel() models.ContactGroup {
+	return models.ContactGroup{ID: g.ID.Hex(), Name: g.Name, Contacts: g.Contacts, Groups: g.Groups, CreatedAt: g.CreatedAt}
+}
+
+// book finds one of the user's books by id, including the default book, as seen by username.
+// groups are the ids of the groups username is in. Returns false if username can't see the book
+func (u *mongoUser) book(bookID string, username string, groups map[string]bool) (models.Book, bool) {
+	book := models.Book{ID: models.DefaultBookID, Name: models.DefaultBookName, Default: true, Fields: fieldDefinitions(u.DefaultBookFields)}
+	if bookID != models.DefaultBookID {
+		found := false
+		for _, b := range u.Books {
+			if b.ID.Hex() == bookID {
+				book, found = b.toModel(), true
+				break
+			}
+		}
+		if !found {
+			return book, false
+		}
+	}
+	book.Owner = u.Username
+	book.Permission = bookPermission(book, username, groups)
+	if book.Permission == "" {
+		return book, false
+	}
+	if !book.Permission.Allows(models.BookManage) {
+		book.Shares = nil
+	}
+	for _, c := range u.Contacts {
+		if c.toModel().BookID == book.ID {
+			book.ContactCount++
+		}
+	}
+	return book, true
+}
+
+// bookPermission is the most access username has to the book, as its owner or through its shares
+func bookPermission(book models.Book, username string, groups map[string]bool) models.BookPermission {
+	if book.Owner == username {
+		return models.BookOwner
+	}
+	var permission models.BookPermission
+	for _, share := range book.Shares {
+		granted := (share.Username != "" && share.Username == username) || (share.GroupID != "" && groups[share.GroupID])
+		if granted && !permission.Allows(share.Permission) {
+			permission = share.Permission
+		}
+	}
+	return permission
+}
+
+// bookNameTaken checks if another of the user's books has the name, ignoring case
+func (u *mongoUser) bookNameTaken(name string, except string) bool {
+	if strings.EqualFold(name, models.DefaultBookName) {
+		return true
+	}
+	for _, b := range u.Books {
+		if b.ID.Hex() != except && strings.EqualFold(b.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// mongoWebAuthnCredential is a mongodb specific implementation of the WebAuthnCredential struct
+type mongoWebAuthnCredential struct {
+	ID              []byte    `bson:"id"`
+	Name            string    `bson:"name"`
+	PublicKey       []byte    `bson:"public_key"`
+	AttestationType string    `bson:"attestation_type"`
+	Transports      []string  `bson:"transports,omitempty"`
+	AAGUID          []byte    `bson:"aaguid"`
+	SignCount       uint32    `bson:"sign_count"`
+	BackupEligible  bool      `bson:"backup_eligible"`
+	BackupState     bool      `bson:"backup_state"`
+	CloneWarning    bool      `bson:"clone_warning"`
+	CreatedAt       time.Time `bson:"created_at"`
+	LastUsedAt      time.Time `bson:"last_used_at,omitempty"`
+}
+
+// newMongoWebAuthnCredential creates a mongoWebAuthnCredential from a WebAuthnCredential
+func newMongoWebAuthnCredential(c models.WebAuthnCredential) mongoWebAuthnCredential {
+	return mongoWebAuthnCredential(c)
+}
+
+// toModel converts to the WebAuthnCredential struct
+func (c mongoWebAuthnCredential) toModel() models.WebAuthnCredential {
+	return models.WebAuthnCredential(c)
+}
+
+// mongoOIDCIdentity is a models.OIDCIdentity with bson tags
+type mongoOIDCIdentity struct {
+	Issuer  string `bson:"issuer"`
+	Subject string `bson:"subject"`
+}
+
+// mongoOAuthGrant is a models.OAuthGrant with bson tags
+type mongoOAuthGrant struct {
+	ID         string         `bson:"id"`
+	ClientID   string         `bson:"client_id"`
+	ClientName string         `bson:"client_name"`
+	Scopes     []models.Scope `bson:"scopes"`
+	GrantedAt  time.Time      `bson:"granted_at"`
+}
+
+// mongoOrgMembership is a models.OrgMembership with bson tags
+type mongoOrgMembership struct {
+	OrgID    string         `bson:"org_id"`
+	Role     models.OrgRole `bson:"role"`
+	JoinedAt time.Time      `bson:"joined_at"`
 }
 
 // toModel transforms the mongo user to a User struct
 func (u *mongoUser) toModel() *models.User {
 	contacts := make([]models.Contact, len(u.Contacts))
+	last := u.Contacts.lastContacted(time.Now())
 	for i, c := range u.Contacts {
 		contacts[i] = *c.toModel()
+		setLastContacted(&contacts[i], last)
+	}
+	credentials := make([]models.WebAuthnCredential, len(u.WebAuthnCredentials))
+	for i, c := range u.WebAuthnCredentials {
+		credentials[i] = c.toModel()
+	}
+	identities := make([]models.OIDCIdentity, len(u.OIDCIdentities))
+	for i, id := range u.OIDCIdentities {
+		identities[i] = models.OIDCIdentity(id)
+	}
+	grants := make([]models.OAuthGrant, len(u.OAuthGrants))
+	for i, g := range u.OAuthGrants {
+		grants[i] = models.OAuthGrant(g)
+	}
+	books := make([]models.Book, len(u.Books))
+	for i, b := range u.Books {
+		books[i] = b.toModel()
+		books[i].Owner = u.Username
+	}
+	groups := make([]models.UserGroup, len(u.UserGroups))
+	for i, g := range u.UserGroups {
+		groups[i] = g.toModel(u.Username)
+	}
+	orgs := make([]models.OrgMembership, len(u.Orgs))
+	for i, m := range u.Orgs {
+		orgs[i] = models.OrgMembership(m)
 	}
 	return &models.User{
-		UserID:   u.UserID.Hex(),
-		Username: u.Username,
-		Password: u.Password,
-		Contacts: contacts,
+		UserID:                u.UserID.Hex(),
+		Username:              u.Username,
+		Password:              u.Password,
+		Email:                 u.Email,
+		EmailVerified:         u.EmailVerified,
+		Roles:                 u.Roles,
+		Disabled:              u.Disabled,
+		PasswordResetRequired: u.PasswordResetRequired,
+		ProfileVisibility:     models.ProfileVisibility(u.ProfileVisibility),
+		ContactViewers:        u.ContactViewers,
+		TwoFactorEnabled:      u.TOTPEnabled,
+		TOTPSecret:            u.TOTPSecret,
+		WebAuthnCredentials:   credentials,
+		OIDCIdentities:        identities,
+		OAuthGrants:           grants,
+		SessionVersion:        u.SessionVersion,
+		DeletedAt:             u.DeletedAt,
+		Books:                 books,
+		DefaultBookFields:     fieldDefinitions(u.DefaultBookFields),
+		UserGroups:            groups,
+		Orgs:                  orgs,
+		Contacts:              contacts,
 	}
 }
 
@@ -121,11 +627,97 @@ func usernameIndex() mgo.Index {
 	}
 }
 
+// emailIndex creates an index on the email field. Users without an email don't have the field
+func emailIndex() mgo.Index {
+	return mgo.Index{
+		Key:        []string{"email"},
+		Unique:     true,
+		Background: true,
+		Sparse:     true,
+	}
+}
+
+// oidcIndex creates an index on the oidc identities, so each identity belongs to at most one user
+func oidcIndex() mgo.Index {
+	return mgo.Index{
+		Key:        []string{"oidc_identities.issuer", "oidc_identities.subject"},
+		Unique:     true,
+		Background: true,
+		Sparse:     true,
+	}
+}
+
+// orgIndex creates an index on the organisations users are members of
+func orgIndex() mgo.Index {
+	return mgo.Index{
+		Key:        []string{"orgs.org_id"},
+		Background: true,
+		Sparse:     true,
+	}
+}
+
+// migrateFlatContacts rewrites contacts stored with a single email and phone to labelled values.
+// Contacts it misses are still read correctly, and are rewritten once they change
+func migrateFlatContacts(collection *mgo.Collection) error {
+	iter := collection.Find(bson.M{"$or": []bson.M{
+		{"contacts.email": bson.M{"$exists": true}},
+		{"contacts.phone": bson.M{"$exists": true}},
+	}}).Select(bson.M{"contacts": 1}).Iter()
+	for {
+		var user mongoUser
+		if !iter.Next(&user) {
+			break
+		}
+		contacts := make(mongoContacts, len(user.Contacts))
+		for i, c := range user.Contacts {
+			migrated := newMongoContact(*c.toModel(), false)
+			migrated.ID = c.ID
+			migrated.Interactions = c.Interactions
+			contacts[i] = *migrated
+		}
+		if err := collection.UpdateId(user.UserID, bson.M{"$set": bson.M{"contacts": contacts}}); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// migrateRoles moves the single role users were given before they could have several into roles
+func migrateRoles(collection *mgo.Collection) error {
+	iter := collection.Find(bson.M{"role": bson.M{"$exists": true}}).Select(bson.M{"role": 1}).Iter()
+	for {
+		var user struct {
+			UserID bson.ObjectId `bson:"_id"`
+			Role   models.Role   `bson:"role"`
+		}
+		if !iter.Next(&user) {
+			break
+		}
+		update := bson.M{"$unset": bson.M{"role": ""}}
+		// every user has the user role, it is never stored
+		if user.Role != "" && user.Role != models.RoleUser {
+			update["$addToSet"] = bson.M{"roles": user.Role}
+		}
+		if err := collection.UpdateId(user.UserID, update); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
 // newMongoUser creates a new mongoUser
 func newMongoUser(u *models.User) *mongoUser {
+	identities := make([]mongoOIDCIdentity, len(u.OIDCIdentities))
+	for i, id := range u.OIDCIdentities {
+		identities[i] = mongoOIDCIdentity(id)
+	}
 	return &mongoUser{
-		Username: u.Username,
-		Password: u.Password,
+		Username:       u.Username,
+		Password:       u.Password,
+		Email:          u.Email,
+		OIDCIdentities: identities,
 	}
 }
 
@@ -139,6 +731,11 @@ type MongoUserStorage struct {
 func NewMongoUserStorage(session *MongoSession, dbName string, collectionName string, hash common.Hash) UserStorage {
 	collection := session.GetCollection(dbName, collectionName)
 	collection.EnsureIndex(usernameIndex())
+	collection.EnsureIndex(emailIndex())
+	collection.EnsureIndex(oidcIndex())
+	collection.EnsureIndex(orgIndex())
+	migrateFlatContacts(collection)
+	migrateRoles(collection)
 	return &MongoUserStorage{
 		collection,
 		hash,
@@ -149,14 +746,35 @@ func NewMongoUserStorage(session *MongoSession, dbName string, collectionName st
 func (s *MongoUserStorage) Login(ctx context.Context, c models.Credentials) (*models.User, error) {
 	model := mongoUser{}
 	err := s.collection.Find(bson.M{"username": c.Username}).One(&model)
+	if err != nil {
+		return nil, err
+	}
 	err = s.hash.Compare(model.Password, c.Password)
 	if err != nil {
 		return nil, err
 	}
+	s.rehash(model, c.Password)
 
 	return model.toModel(), nil
 }
 
+// rehash upgrades a password hash made by an outdated algorithm or with outdated parameters.
+// The password is only replaced if it hasn't changed since it was checked. Failures are ignored, the old hash still works
+func (s *MongoUserStorage) rehash(model mongoUser, password string) {
+	rehasher, ok := s.hash.(common.Rehasher)
+	if !ok || !rehasher.NeedsRehash(model.Password) {
+		return
+	}
+	hashedPassword, err := s.hash.Generate(password)
+	if err != nil {
+		return
+	}
+	s.collection.Update(
+		bson.M{"username": model.Username, "password": model.Password},
+		bson.M{"$set": bson.M{"password": hashedPassword}},
+	)
+}
+
 // FindAll finds all users
 func (s *MongoUserStorage) FindAll(ctx context.Context) ([]models.User, error) {
 	var mUsers []mongoUser
@@ -175,6 +793,16 @@ func (s *MongoUserStorage) FindByUsername(ctx context.Context, username string)
 	return model.toModel(), err
 }
 
+// FindByEmail finds a user by email
+func (s *MongoUserStorage) FindByEmail(ctx context.Context, email string) (*models.User, error) {
+	var model mongoUser
+	err := s.collection.Find(bson.M{"email": email}).One(&model)
+	if err != nil {
+		return nil, err
+	}
+	return model.toModel(), nil
+}
+
 // Insert inserts a user into the db
 func (s *MongoUserStorage) Insert(ctx context.Context, user models.User) error {
 	u := newMongoUser(&user)
@@ -188,67 +816,1512 @@ func (s *MongoUserStorage) Insert(ctx context.Context, user models.User) error {
 
 // Delete removes a user from the db
 func (s *MongoUserStorage) Delete(ctx context.Context, username string) error {
-	return s.collection.Remove(bson.M{"username": username})
+	if err := s.collection.Remove(bson.M{"username": username}); err != nil {
+		return err
+	}
+	return s.removeGrantee(username)
 }
 
-// Contact methods
+// Account recovery methods
 
-// getUser gets a user from the databse. Utility function
-func (s *MongoUserStorage) getUser(ctx context.Context, username string) (*mongoUser, error) {
-	var user mongoUser
-	err := s.collection.Find(bson.M{"username": username}).One(&user)
+// SetEmail changes the email of a user. The new email is unverified, and an empty email removes it
+func (s *MongoUserStorage) SetEmail(ctx context.Context, username string, email string) error {
+	update := bson.M{"$set": bson.M{"email": email, "email_verified": false}}
+	if email == "" {
+		update = bson.M{"$set": bson.M{"email_verified": false}, "$unset": bson.M{"email": ""}}
+	}
+	return s.collection.Update(bson.M{"username": username}, update)
+}
+
+// MarkEmailVerified verifies the email of a user, as long as it hasn't changed since the verification was sent
+func (s *MongoUserStorage) MarkEmailVerified(ctx context.Context, username string, email string) error {
+	return s.collection.Update(
+		bson.M{"username": username, "email": email},
+		bson.M{"$set": bson.M{"email_verified": true}},
+	)
+}
+
+// SetPassword hashes and stores a new password, and revokes the user's sessions
+func (s *MongoUserStorage) SetPassword(ctx context.Context, username string, password string) error {
+	hashedPassword, err := s.hash.Generate(password)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &user, nil
+	return s.collection.Update(
+		bson.M{"username": username},
+		bson.M{
+			"$set": bson.M{"password": hashedPassword, "password_reset_required": false},
+			"$inc": bson.M{"session_version": 1},
+		},
+	)
 }
 
-// CreateContact creates a new contact
-func (s *MongoUserStorage) CreateContact(ctx context.Context, username string, contact models.Contact) (*models.Contact, error) {
-	user, err := s.getUser(ctx, username)
+// SetUsername renames a user, and revokes their sessions. Fails if the new username is taken
+func (s *MongoUserStorage) SetUsername(ctx context.Context, username string, newUsername string) error {
+	err := s.collection.Update(
+		bson.M{"username": username},
+		bson.M{"$set": bson.M{"username": newUsername}, "$inc": bson.M{"session_version": 1}},
+	)
+	if mgo.IsDup(err) {
+		return ErrUsernameTaken
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
-	newContact := newMongoContact(contact, true)
-	user.Contacts = append(user.Contacts, *newContact)
-	err = s.collection.Update(bson.M{"_id": user.UserID}, bson.M{"$set": bson.M{"contacts": user.Contacts}})
-	return newContact.toModel(), err
+	// access granted to the old username follows the user
+	_, err = s.collection.UpdateAll(
+		bson.M{"contact_viewers": username},
+		bson.M{"$set": bson.M{"contact_viewers.$": newUsername}},
+	)
+	if err != nil {
+		return err
+	}
+	return s.renameGrantee(username, newUsername)
 }
 
-// FindContactById retrieves the specified contact
-func (s *MongoUserStorage) FindContactById(ctx context.Context, username string, contactID string) (*models.Contact, error) {
-	user, err := s.getUser(ctx, username)
+// renameGrantee replaces a username in the shares of books and the members of groups of users
+func (s *MongoUserStorage) renameGrantee(username string, newUsername string) error {
+	var owners []mongoUser
+	err := s.collection.Find(bson.M{"$or": []bson.M{
+		{"books.shares.username": username},
+		{"user_groups.members": username},
+	}}).Select(bson.M{"books": 1, "user_groups": 1}).All(&owners)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	contact := user.Contacts.findByID(contactID)
-	if contact == nil {
-		return nil, fmt.Errorf("No contact with that id")
+	for _, owner := range owners {
+		for _, b := range owner.Books {
+			for i := range b.Shares {
+				if b.Shares[i].Username == username {
+					b.Shares[i].Username = newUsername
+				}
+			}
+		}
+		for _, g := range owner.UserGroups {
+			for i := range g.Members {
+				if g.Members[i] == username {
+					g.Members[i] = newUsername
+				}
+			}
+		}
+		set := bson.M{}
+		if len(owner.Books) > 0 {
+			set["books"] = owner.Books
+		}
+		if len(owner.UserGroups) > 0 {
+			set["user_groups"] = owner.UserGroups
+		}
+		err = s.collection.Update(bson.M{"_id": owner.UserID}, bson.M{"$set": set})
+		if err != nil {
+			return err
+		}
 	}
-	return contact.toModel(), nil
+	return nil
 }
 
-// FindAllContacts finds all the contacts of a user
-func (s *MongoUserStorage) FindAllContacts(ctx context.Context, username string) ([]models.Contact, error) {
-	user, err := s.getUser(ctx, username)
+// removeGrantee revokes every grant to a removed user: contact viewers, book shares and membership of groups of users.
+// A new user with the same username doesn't inherit them
+func (s *MongoUserStorage) removeGrantee(username string) error {
+	_, err := s.collection.UpdateAll(bson.M{"contact_viewers": username}, bson.M{"$pull": bson.M{"contact_viewers": username}})
+	if err != nil {
+		return err
+	}
+	_, err = s.collection.UpdateAll(
+		bson.M{"books.shares.username": username},
+		bson.M{"$pull": bson.M{"books.$[].shares": bson.M{"username": username}}},
+	)
 	if err != nil {
+		return err
+	}
+	_, err = s.collection.UpdateAll(
+		bson.M{"user_groups.members": username},
+		bson.M{"$pull": bson.M{"user_groups.$[].members": username}},
+	)
+	return err
+}
+
+// ScheduleDeletion marks a user as deleted at a time, and revokes their sessions. The user is kept until PurgeDeletedUsers removes them
+func (s *MongoUserStorage) ScheduleDeletion(ctx context.Context, username string, at time.Time) error {
+	return s.collection.Update(
+		bson.M{"username": username, "deleted_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"deleted_at": at}, "$inc": bson.M{"session_version": 1}},
+	)
+}
+
+// RestoreUser cancels the scheduled deletion of a user
+func (s *MongoUserStorage) RestoreUser(ctx context.Context, username string) error {
+	err := s.collection.Update(
+		bson.M{"username": username, "deleted_at": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"deleted_at": ""}},
+	)
+	if err == mgo.ErrNotFound {
+		return fmt.Errorf("Account is not scheduled for deletion")
+	}
+	return err
+}
+
+// PurgeDeletedUsers removes the users deleted at or before a time, and returns them with their contacts
+func (s *MongoUserStorage) PurgeDeletedUsers(ctx context.Context, before time.Time) ([]models.User, error) {
+	query := bson.M{"deleted_at": bson.M{"$lte": before}}
+	var deleted []mongoUser
+	if err := s.collection.Find(query).Select(bson.M{"username": 1, "contacts": 1}).All(&deleted); err != nil {
 		return nil, err
 	}
-	return user.toModel().Contacts, nil
+	removed := []models.User{}
+	for _, u := range deleted {
+		// users restored since they were found are kept
+		err := s.collection.Remove(bson.M{"_id": u.UserID, "deleted_at": bson.M{"$lte": before}})
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, *u.toModel())
+		if err = s.removeGrantee(u.Username); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
 }
 
-// UpdateContact updates a specific contact of a user
-func (s *MongoUserStorage) UpdateContact(ctx context.Context, username string, update models.Contact) error {
-	if !bson.IsObjectIdHex(update.ID) {
-		return fmt.Errorf("Invalid id")
+// Administration methods
+
+// mongoUserSummary is a mongodb specific implementation of the UserSummary struct
+type mongoUserSummary struct {
+	Username              string        `bson:"username"`
+	Email                 string        `bson:"email"`
+	EmailVerified         bool          `bson:"email_verified"`
+	Roles                 []models.Role `bson:"roles"`
+	Disabled              bool          `bson:"disabled"`
+	PasswordResetRequired bool          `bson:"password_reset_required"`
+	TOTPEnabled           bool          `bson:"totp_enabled"`
+	DeletedAt             *time.Time    `bson:"deleted_at"`
+	ContactCount          int           `bson:"contact_count"`
+}
+
+// toModel converts to the UserSummary struct
+func (u mongoUserSummary) toModel() models.UserSummary {
+	roles := append([]models.Role{models.RoleUser}, u.Roles...)
+	return models.UserSummary{
+		Username:              u.Username,
+		Email:                 u.Email,
+		EmailVerified:         u.EmailVerified,
+		Roles:                 roles,
+		Disabled:              u.Disabled,
+		PasswordResetRequired: u.PasswordResetRequired,
+		TwoFactorEnabled:      u.TOTPEnabled,
+		DeletedAt:             u.DeletedAt,
+		ContactCount:          u.ContactCount,
 	}
-	user, err := s.getUser(ctx, username)
+}
+
+// SearchUsers returns a page of users sorted by username, with their contact counts, and the total number of matching users
+func (s *MongoUserStorage) SearchUsers(ctx context.Context, query models.UserQuery) ([]models.UserSummary, int, error) {
+	match := bson.M{}
+	if query.Search != "" {
+		pattern := bson.RegEx{Pattern: regexp.QuoteMeta(query.Search), Options: "i"}
+		match["$or"] = []bson.M{{"username": pattern}, {"email": pattern}}
+	}
+	total, err := s.collection.Find(match).Count()
 	if err != nil {
-		return nil
+		return nil, 0, err
+	}
+
+	var found []mongoUserSummary
+	err = s.collection.Pipe([]bson.M{
+		{"$match": match},
+		{"$sort": bson.M{"username": 1}},
+		{"$skip": query.Offset},
+		{"$limit": query.Limit},
+		{"$project": bson.M{
+			"username":                1,
+			"email":                   1,
+			"email_verified":          1,
+			"roles":                   1,
+			"disabled":                1,
+			"password_reset_required": 1,
+			"totp_enabled":            1,
+			"deleted_at":              1,
+			"contact_count":           bson.M{"$size": bson.M{"$ifNull": []interface{}{"$contacts", []interface{}{}}}},
+		}},
+	}).All(&found)
+	users := make([]models.UserSummary, len(found))
+	for i, u := range found {
+		users[i] = u.toModel()
+	}
+	return users, total, err
+}
+
+// CountByRole counts the users assigned a role
+func (s *MongoUserStorage) CountByRole(ctx context.Context, role models.Role) (int, error) {
+	return s.collection.Find(bson.M{"roles": role}).Count()
+}
+
+// AssignRole gives a user a role. Assigning a role the user has does nothing
+func (s *MongoUserStorage) AssignRole(ctx context.Context, username string, role models.Role) error {
+	return s.collection.Update(bson.M{"username": username}, bson.M{"$addToSet": bson.M{"roles": role}})
+}
+
+// UnassignRole takes a role away from a user
+func (s *MongoUserStorage) UnassignRole(ctx context.Context, username string, role models.Role) error {
+	return s.collection.Update(bson.M{"username": username}, bson.M{"$pull": bson.M{"roles": role}})
+}
+
+// UnassignRoleFromAll takes a role away from every user, for roles that are removed
+func (s *MongoUserStorage) UnassignRoleFromAll(ctx context.Context, role models.Role) error {
+	_, err := s.collection.UpdateAll(bson.M{"roles": role}, bson.M{"$pull": bson.M{"roles": role}})
+	return err
+}
+
+// SetDisabled disables or enables a user. Disabling revokes their sessions
+func (s *MongoUserStorage) SetDisabled(ctx context.Context, username string, disabled bool) error {
+	update := bson.M{"$set": bson.M{"disabled": disabled}}
+	if disabled {
+		update["$inc"] = bson.M{"session_version": 1}
+	}
+	return s.collection.Update(bson.M{"username": username}, update)
+}
+
+// RequirePasswordReset stops a user from logging in with their password until they set a new one, and revokes their sessions
+func (s *MongoUserStorage) RequirePasswordReset(ctx context.Context, username string) error {
+	return s.collection.Update(
+		bson.M{"username": username},
+		bson.M{"$set": bson.M{"password_reset_required": true}, "$inc": bson.M{"session_version": 1}},
+	)
+}
+
+// Profile methods
+
+// SetProfileVisibility changes who can see the user's profile
+func (s *MongoUserStorage) SetProfileVisibility(ctx context.Context, username string, visibility models.ProfileVisibility) error {
+	return s.collection.Update(bson.M{"username": username}, bson.M{"$set": bson.M{"profile_visibility": visibility}})
+}
+
+// AddContactViewer grants viewer read access to the user's contacts
+func (s *MongoUserStorage) AddContactViewer(ctx context.Context, username string, viewer string) error {
+	return s.collection.Update(bson.M{"username": username}, bson.M{"$addToSet": bson.M{"contact_viewers": viewer}})
+}
+
+// RemoveContactViewer revokes viewer's read access to the user's contacts
+func (s *MongoUserStorage) RemoveContactViewer(ctx context.Context, username string, viewer string) error {
+	return s.collection.Update(bson.M{"username": username}, bson.M{"$pull": bson.M{"contact_viewers": viewer}})
+}
+
+// SetTokenNonce stores the nonce of a new single use token. Earlier tokens for the same purpose stop working
+func (s *MongoUserStorage) SetTokenNonce(ctx context.Context, username string, purpose string, nonce string) error {
+	return s.collection.Update(bson.M{"username": username}, bson.M{"$set": bson.M{"token_nonces." + purpose: nonce}})
+}
+
+// ConsumeTokenNonce removes the nonce of a single use token. Fails if the token was already used or replaced
+func (s *MongoUserStorage) ConsumeTokenNonce(ctx context.Context, username string, purpose string, nonce string) error {
+	err := s.collection.Update(
+		bson.M{"username": username, "token_nonces." + purpose: nonce},
+		bson.M{"$unset": bson.M{"token_nonces." + purpose: ""}},
+	)
+	if err == mgo.ErrNotFound {
+		return fmt.Errorf("Token was already used")
+	}
+	return err
+}
+
+// Two factor methods
+
+// SetTOTPSecret stores the secret of a pending enrollment. Two factor stays disabled until EnableTwoFactor is called
+func (s *MongoUserStorage) SetTOTPSecret(ctx context.Context, username string, secret string) error {
+	return s.collection.Update(
+		bson.M{"username": username, "totp_enabled": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"totp_secret": secret, "totp_step": 0}},
+	)
+}
+
+// EnableTwoFactor turns on two factor for the pending secret, and replaces the recovery codes. Codes are stored hashed
+func (s *MongoUserStorage) EnableTwoFactor(ctx context.Context, username string, recoveryCodes []string) error {
+	hashed, err := s.hashRecoveryCodes(recoveryCodes)
+	if err != nil {
+		return err
+	}
+	return s.collection.Update(
+		bson.M{"username": username, "totp_secret": bson.M{"$exists": true}},
+		bson.M{"$set": bson.M{"totp_enabled": true, "recovery_codes": hashed}},
+	)
+}
+
+// DisableTwoFactor removes the secret and recovery codes
+func (s *MongoUserStorage) DisableTwoFactor(ctx context.Context, username string) error {
+	return s.collection.Update(
+		bson.M{"username": username},
+		bson.M{
+			"$set":   bson.M{"totp_enabled": false, "totp_step": 0},
+			"$unset": bson.M{"totp_secret": "", "recovery_codes": ""},
+		},
+	)
+}
+
+// ConsumeTOTPStep records that the code for a period was used. Fails if that period or a later one was already used so codes can't be replayed
+func (s *MongoUserStorage) ConsumeTOTPStep(ctx context.Context, username string, step int64) error {
+	err := s.collection.Update(
+		bson.M{"username": username, "totp_step": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"totp_step": step}},
+	)
+	if err == mgo.ErrNotFound {
+		return fmt.Errorf("Code was already used")
+	}
+	return err
+}
+
+// ConsumeRecoveryCode checks a recovery code and removes it so it can only be used once
+func (s *MongoUserStorage) ConsumeRecoveryCode(ctx context.Context, username string, code string) error {
+	user, err := s.getUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, hashed := range user.RecoveryCodes {
+		if s.hash.Compare(hashed, code) != nil {
+			continue
+		}
+		// pulling the matched hash fails if another request used the code first
+		err = s.collection.Update(
+			bson.M{"_id": user.UserID, "recovery_codes": hashed},
+			bson.M{"$pull": bson.M{"recovery_codes": hashed}},
+		)
+		if err == mgo.ErrNotFound {
+			return fmt.Errorf("Recovery code was already used")
+		}
+		return err
+	}
+	return fmt.Errorf("Invalid recovery code")
+}
+
+// hashRecoveryCodes hashes every code with the storage hash
+func (s *MongoUserStorage) hashRecoveryCodes(codes []string) ([]string, error) {
+	hashed := make([]string, len(codes))
+	for i, c := range codes {
+		h, err := s.hash.Generate(c)
+		if err != nil {
+			return nil, err
+		}
+		hashed[i] = h
+	}
+	return hashed, nil
+}
+
+// WebAuthn methods
+
+// AddWebAuthnCredential registers a new credential to a user
+func (s *MongoUserStorage) AddWebAuthnCredential(ctx context.Context, username string, credential models.WebAuthnCredential) error {
+	return s.collection.Update(
+		bson.M{"username": username, "webauthn_credentials.id": bson.M{"$ne": credential.ID}},
+		bson.M{"$push": bson.M{"webauthn_credentials": newMongoWebAuthnCredential(credential)}},
+	)
+}
+
+// UpdateWebAuthnCredential saves the counter, backup state and last use of a credential after a login
+func (s *MongoUserStorage) UpdateWebAuthnCredential(ctx context.Context, username string, credential models.WebAuthnCredential) error {
+	return s.collection.Update(
+		bson.M{"username": username, "webauthn_credentials.id": credential.ID},
+		bson.M{"$set": bson.M{
+			"webauthn_credentials.$.sign_count":    credential.SignCount,
+			"webauthn_credentials.$.backup_state":  credential.BackupState,
+			"webauthn_credentials.$.clone_warning": credential.CloneWarning,
+			"webauthn_credentials.$.last_used_at":  credential.LastUsedAt,
+		}},
+	)
+}
+
+// RemoveWebAuthnCredential removes a credential from a user
+func (s *MongoUserStorage) RemoveWebAuthnCredential(ctx context.Context, username string, id []byte) error {
+	return s.collection.Update(
+		bson.M{"username": username, "webauthn_credentials.id": id},
+		bson.M{"$pull": bson.M{"webauthn_credentials": bson.M{"id": id}}},
+	)
+}
+
+// SetWebAuthnSession stores the session of a ceremony, replacing the ceremony of the same kind in progress
+func (s *MongoUserStorage) SetWebAuthnSession(ctx context.Context, username string, ceremony models.WebAuthnCeremony, session []byte) error {
+	return s.collection.Update(bson.M{"username": username}, bson.M{"$set": bson.M{"webauthn_sessions." + string(ceremony): session}})
+}
+
+// TakeWebAuthnSession returns and removes the session of the ceremony of a kind in progress so it can only be finished once
+func (s *MongoUserStorage) TakeWebAuthnSession(ctx context.Context, username string, ceremony models.WebAuthnCeremony) ([]byte, error) {
+	field := "webauthn_sessions." + string(ceremony)
+	var user mongoUser
+	_, err := s.collection.Find(bson.M{"username": username, field: bson.M{"$exists": true}}).
+		Select(bson.M{field: 1}).
+		Apply(mgo.Change{Update: bson.M{"$unset": bson.M{field: ""}}}, &user)
+	if err == mgo.ErrNotFound {
+		return nil, fmt.Errorf("No webauthn %s in progress", ceremony)
+	}
+	return user.WebAuthnSessions[string(ceremony)], err
+}
+
+// OIDC methods
+
+// FindByOIDCIdentity finds the user linked to an account at an OpenID Connect provider
+func (s *MongoUserStorage) FindByOIDCIdentity(ctx context.Context, identity models.OIDCIdentity) (*models.User, error) {
+	model := mongoUser{}
+	err := s.collection.Find(bson.M{"oidc_identities": bson.M{"$elemMatch": bson.M{
+		"issuer":  identity.Issuer,
+		"subject": identity.Subject,
+	}}}).One(&model)
+	if err != nil {
+		return nil, err
+	}
+	return model.toModel(), nil
+}
+
+// AddOIDCIdentity links an account at an OpenID Connect provider to a user. Fails with ErrOIDCIdentityLinked if another user has it
+func (s *MongoUserStorage) AddOIDCIdentity(ctx context.Context, username string, identity models.OIDCIdentity) error {
+	err := s.collection.Update(
+		bson.M{"username": username},
+		bson.M{"$addToSet": bson.M{"oidc_identities": mongoOIDCIdentity(identity)}},
+	)
+	if mgo.IsDup(err) {
+		return ErrOIDCIdentityLinked
+	}
+	return err
+}
+
+// OAuth grant methods
+
+// SaveOAuthGrant stores a user's grant to a client, replacing their earlier grant to it
+func (s *MongoUserStorage) SaveOAuthGrant(ctx context.Context, username string, grant models.OAuthGrant) error {
+	err := s.collection.Update(
+		bson.M{"username": username, "oauth_grants.client_id": grant.ClientID},
+		bson.M{"$set": bson.M{"oauth_grants.$": mongoOAuthGrant(grant)}},
+	)
+	if err != mgo.ErrNotFound {
+		return err
+	}
+	return s.collection.Update(
+		bson.M{"username": username, "oauth_grants.client_id": bson.M{"$ne": grant.ClientID}},
+		bson.M{"$push": bson.M{"oauth_grants": mongoOAuthGrant(grant)}},
+	)
+}
+
+// RemoveOAuthGrant removes a user's grant to a client
+func (s *MongoUserStorage) RemoveOAuthGrant(ctx context.Context, username string, clientID string) error {
+	return s.collection.Update(bson.M{"username": username}, bson.M{"$pull": bson.M{"oauth_grants": bson.M{"client_id": clientID}}})
+}
+
+// RemoveOAuthGrantFromAll removes every user's grant to a client, when the client is removed
+func (s *MongoUserStorage) RemoveOAuthGrantFromAll(ctx context.Context, clientID string) error {
+	_, err := s.collection.UpdateAll(
+		bson.M{"oauth_grants.client_id": clientID},
+		bson.M{"$pull": bson.M{"oauth_grants": bson.M{"client_id": clientID}}},
+	)
+	return err
+}
+
+// Address book methods
+
+// getUser gets a user from the databse. Utility function
+func (s *MongoUserStorage) getUser(ctx context.Context, username string) (*mongoUser, error) {
+	var user mongoUser
+	err := s.collection.Find(bson.M{"username": username}).One(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// groupIDs finds the ids of the groups of users username owns or is a member of
+func (s *MongoUserStorage) groupIDs(ctx context.Context, username string) (map[string]bool, error) {
+	var owners []mongoUser
+	err := s.collection.Find(bson.M{"$or": []bson.M{
+		{"username": username},
+		{"user_groups.members": username},
+	}}).Select(bson.M{"username": 1, "user_groups": 1}).All(&owners)
+	if err != nil {
+		return nil, err
+	}
+	groups := map[string]bool{}
+	for _, owner := range owners {
+		for _, g := range owner.UserGroups {
+			if g.toModel(owner.Username).HasMember(username) {
+				groups[g.ID.Hex()] = true
+			}
+		}
+	}
+	return groups, nil
+}
+
+// bookAccess finds the owner of a book and the book as seen by username, if username was granted at least need.
+// The default book is always username's own
+func (s *MongoUserStorage) bookAccess(ctx context.Context, username string, bookID string, need models.BookPermission) (*mongoUser, models.Book, error) {
+	var owner *mongoUser
+	var err error
+	switch {
+	case bookID == models.DefaultBookID:
+		owner, err = s.getUser(ctx, username)
+	case bson.IsObjectIdHex(bookID):
+		owner = &mongoUser{}
+		err = s.collection.Find(bson.M{"books._id": bson.ObjectIdHex(bookID)}).One(owner)
+		if err == mgo.ErrNotFound {
+			err = ErrBookNotFound
+		}
+	default:
+		err = ErrBookNotFound
+	}
+	if err != nil {
+		return nil, models.Book{}, err
+	}
+
+	groups := map[string]bool{}
+	if owner.Username != username {
+		if groups, err = s.groupIDs(ctx, username); err != nil {
+			return nil, models.Book{}, err
+		}
+	}
+	book, ok := owner.book(bookID, username, groups)
+	if !ok {
+		// books that aren't shared with the user don't exist for them
+		return nil, models.Book{}, ErrBookNotFound
+	}
+	if !book.Permission.Allows(need) {
+		return nil, models.Book{}, ErrBookForbidden
+	}
+	return owner, book, nil
+}
+
+// FindBooks lists the user's books, starting with the default book, then the books shared with them
+func (s *MongoUserStorage) FindBooks(ctx context.Context, username string) ([]models.Book, error) {
+	user, err := s.getUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	books := []models.Book{}
+	defaultBook, _ := user.book(models.DefaultBookID, username, nil)
+	books = append(books, defaultBook)
+	for _, b := range user.Books {
+		book, _ := user.book(b.ID.Hex(), username, nil)
+		books = append(books, book)
+	}
+
+	groups, err := s.groupIDs(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	groupIDs := []string{}
+	for id := range groups {
+		groupIDs = append(groupIDs, id)
+	}
+	var owners []mongoUser
+	err = s.collection.Find(bson.M{
+		"username": bson.M{"$ne": username},
+		"$or": []bson.M{
+			{"books.shares.username": username},
+			{"books.shares.group_id": bson.M{"$in": groupIDs}},
+		},
+	}).All(&owners)
+	if err != nil {
+		return nil, err
+	}
+	for _, owner := range owners {
+		for _, b := range owner.Books {
+			if book, ok := owner.book(b.ID.Hex(), username, groups); ok {
+				books = append(books, book)
+			}
+		}
+	}
+	return books, nil
+}
+
+// FindBook finds a book the user owns or was shared
+func (s *MongoUserStorage) FindBook(ctx context.Context, username string, bookID string) (*models.Book, error) {
+	_, book, err := s.bookAccess(ctx, username, bookID, models.BookRead)
+	if err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+// CreateBook creates a book with a name that is unique among the user's books
+func (s *MongoUserStorage) CreateBook(ctx context.Context, username string, book models.Book) (*models.Book, error) {
+	user, err := s.getUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user.bookNameTaken(book.Name, "") {
+		return nil, ErrBookNameTaken
+	}
+	newBook := mongoBook{ID: bson.NewObjectId(), Name: book.Name, CreatedAt: time.Now().UTC(), Fields: newMongoFieldDefinitions(book.Fields)}
+	err = s.collection.Update(bson.M{"_id": user.UserID}, bson.M{"$push": bson.M{"books": newBook}})
+	if err != nil {
+		return nil, err
+	}
+	created := newBook.toModel()
+	created.Owner = username
+	created.Permission = models.BookOwner
+	return &created, nil
+}
+
+// UpdateBook renames a book. Needs BookManage, and the default book can't be renamed
+func (s *MongoUserStorage) UpdateBook(ctx context.Context, username string, book models.Book) error {
+	if book.ID == models.DefaultBookID {
+		return ErrDefaultBook
+	}
+	owner, _, err := s.bookAccess(ctx, username, book.ID, models.BookManage)
+	if err != nil {
+		return err
+	}
+	if owner.bookNameTaken(book.Name, book.ID) {
+		return ErrBookNameTaken
+	}
+	return s.collection.Update(
+		bson.M{"_id": owner.UserID, "books._id": bson.ObjectIdHex(book.ID)},
+		bson.M{"$set": bson.M{"books.$.name": book.Name}},
+	)
+}
+
+// UpdateBookFields replaces the custom fields of a book. Needs BookManage. The default book has custom fields too.
+// Values of the book's contacts that don't fit the new fields are dropped
+func (s *MongoUserStorage) UpdateBookFields(ctx context.Context, username string, bookID string, fields models.FieldDefinitions) error {
+	owner, _, err := s.bookAccess(ctx, username, bookID, models.BookManage)
+	if err != nil {
+		return err
+	}
+	_, err = s.updateBookContacts(owner, bookID, bson.M{"fields": newMongoFieldDefinitions(fields)}, func(c *mongoContact) bool {
+		c.Custom = fields.Keep(c.Custom)
+		return true
+	})
+	return err
+}
+
+// updateBookContacts sets fields of a book, like its fields or tags, and saves the book's contacts changed by update.
+// The fields of the default book are kept on its owner. Returns the number of contacts changed
+func (s *MongoUserStorage) updateBookContacts(owner *mongoUser, bookID string, bookFields bson.M, update func(*mongoContact) bool) (int, error) {
+	changed := 0
+	contacts := mongoContacts{}
+	for _, c := range owner.Contacts {
+		if c.toModel().BookID == bookID && update(&c) {
+			changed++
+		}
+		contacts = append(contacts, c)
+	}
+	query := bson.M{"_id": owner.UserID}
+	set := bson.M{"contacts": contacts}
+	for field, value := range bookFields {
+		if bookID == models.DefaultBookID {
+			set["default_book_"+field] = value
+			continue
+		}
+		query["books._id"] = bson.ObjectIdHex(bookID)
+		set["books.$."+field] = value
+	}
+	return changed, s.collection.Update(query, bson.M{"$set": set})
+}
+
+// bookTags are the tags made for a book
+func (u *mongoUser) bookTags(bookID string) []string {
+	if bookID == models.DefaultBookID {
+		return u.DefaultBookTags
+	}
+	for _, b := range u.Books {
+		if b.ID.Hex() == bookID {
+			return b.Tags
+		}
+	}
+	return nil
+}
+
+// FindTags counts the contacts with each tag of a book the user can read, including tags no contact has yet
+func (s *MongoUserStorage) FindTags(ctx context.Context, username string, bookID string) ([]models.Tag, error) {
+	owner, _, err := s.bookAccess(ctx, username, bookID, models.BookRead)
+	if err != nil {
+		return nil, err
+	}
+	contacts := []models.Contact{}
+	for _, c := range owner.Contacts {
+		if contact := c.toModel(); contact.BookID == bookID {
+			contacts = append(contacts, *contact)
+		}
+	}
+	return models.CountTags(owner.bookTags(bookID), contacts), nil
+}
+
+// bookTagsInUse are the tags made for a book and the tags of its contacts
+func (u *mongoUser) bookTagsInUse(bookID string) models.Tags {
+	tags := models.Tags(u.bookTags(bookID))
+	for _, c := range u.Contacts {
+		if c.toModel().BookID == bookID {
+			tags = tags.Add(c.Tags...)
+		}
+	}
+	return tags
+}
+
+// CreateTag makes a tag in a book the user can edit, so it is listed before any contact has it
+func (s *MongoUserStorage) CreateTag(ctx context.Context, username string, bookID string, name string) error {
+	owner, _, err := s.bookAccess(ctx, username, bookID, models.BookEdit)
+	if err != nil {
+		return err
+	}
+	if owner.bookTagsInUse(bookID).Has(name) {
+		return ErrTagExists
+	}
+	_, err = s.updateBookContacts(owner, bookID, bson.M{"tags": append(owner.bookTags(bookID), name)}, func(*mongoContact) bool { return false })
+	return err
+}
+
+// RenameTag renames a tag of a book the user can edit, on the book and its contacts. Renaming to another spelling of the same tag
+// is allowed, renaming to another tag isn't, see MergeTags
+func (s *MongoUserStorage) RenameTag(ctx context.Context, username string, bookID string, from string, to string) error {
+	owner, _, err := s.bookAccess(ctx, username, bookID, models.BookEdit)
+	if err != nil {
+		return err
+	}
+	tags := owner.bookTagsInUse(bookID)
+	if !tags.Has(from) {
+		return ErrTagNotFound
+	}
+	if !strings.EqualFold(from, to) && tags.Has(to) {
+		return ErrTagExists
+	}
+	return s.replaceTag(owner, bookID, from, to)
+}
+
+// MergeTags merges the tag from into the tag into of a book the user can edit. Contacts with from get into, and from is removed
+func (s *MongoUserStorage) MergeTags(ctx context.Context, username string, bookID string, from string, into string) error {
+	owner, _, err := s.bookAccess(ctx, username, bookID, models.BookEdit)
+	if err != nil {
+		return err
+	}
+	tags := owner.bookTagsInUse(bookID)
+	if !tags.Has(from) || !tags.Has(into) {
+		return ErrTagNotFound
+	}
+	// merging keeps the spelling of into
+	for _, tag := range tags {
+		if strings.EqualFold(tag, into) {
+			into = tag
+		}
+	}
+	return s.replaceTag(owner, bookID, from, into)
+}
+
+// replaceTag replaces a tag with another on a book and its contacts
+func (s *MongoUserStorage) replaceTag(owner *mongoUser, bookID string, from string, to string) error {
+	made := models.Tags(owner.bookTags(bookID))
+	if made.Has(from) {
+		made = made.Replace(from, to)
+	}
+	_, err := s.updateBookContacts(owner, bookID, bson.M{"tags": []string(made)}, func(c *mongoContact) bool {
+		if !models.Tags(c.Tags).Has(from) {
+			return false
+		}
+		c.Tags = models.Tags(c.Tags).Replace(from, to)
+		return true
+	})
+	return err
+}
+
+// DeleteTag removes a tag from a book the user can edit and from its contacts
+func (s *MongoUserStorage) DeleteTag(ctx context.Context, username string, bookID string, name string) error {
+	owner, _, err := s.bookAccess(ctx, username, bookID, models.BookEdit)
+	if err != nil {
+		return err
+	}
+	if !owner.bookTagsInUse(bookID).Has(name) {
+		return ErrTagNotFound
+	}
+	made := models.Tags(owner.bookTags(bookID)).Remove(name)
+	_, err = s.updateBookContacts(owner, bookID, bson.M{"tags": []string(made)}, func(c *mongoContact) bool {
+		if !models.Tags(c.Tags).Has(name) {
+			return false
+		}
+		c.Tags = models.Tags(c.Tags).Remove(name)
+		return true
+	})
+	return err
+}
+
+// TagContacts adds and removes tags on contacts of a book the user can edit, all at once.
+// Fails with ErrContactNotFound if one of the contacts isn't in the book. Returns the number of contacts changed
+func (s *MongoUserStorage) TagContacts(ctx context.Context, username string, bookID string, contactIDs []string, add []string, remove []string) (int, error) {
+	owner, _, err := s.bookAccess(ctx, username, bookID, models.BookEdit)
+	if err != nil {
+		return 0, err
+	}
+	tagged := map[bson.ObjectId]models.Tags{}
+	for _, id := range contactIDs {
+		contact := owner.Contacts.findByID(id)
+		if contact == nil || contact.toModel().BookID != bookID {
+			return 0, ErrContactNotFound
+		}
+		tags := models.Tags(contact.Tags).Remove(remove...).Add(add...)
+		if len(tags) > models.MaxContactTags {
+			return 0, ErrTooManyTags
+		}
+		tagged[contact.ID] = tags
+	}
+	return s.updateBookContacts(owner, bookID, bson.M{}, func(c *mongoContact) bool {
+		tags, ok := tagged[c.ID]
+		if !ok {
+			return false
+		}
+		changed := len(tags) != len(c.Tags) || len(models.Tags(c.Tags).Remove(tags...)) > 0
+		c.Tags = tags
+		return changed
+	})
+}
+
+// DeleteBook deletes a book and the contacts in it. Only the owner can delete a book, and the default book can't be deleted
+func (s *MongoUserStorage) DeleteBook(ctx context.Context, username string, bookID string) error {
+	if bookID == models.DefaultBookID {
+		return ErrDefaultBook
+	}
+	owner, _, err := s.bookAccess(ctx, username, bookID, models.BookOwner)
+	if err != nil {
+		return err
+	}
+	return s.collection.Update(bson.M{"_id": owner.UserID}, bson.M{"$pull": bson.M{
+		"books":    bson.M{"_id": bson.ObjectIdHex(bookID)},
+		"contacts": bson.M{"book_id": bookID},
+	}})
+}
+
+// ShareBook grants a user, or the members of one of the user's groups, access to a book. Needs BookManage.
+// A share replaces the earlier share with the same grantee. The default book can't be shared
+func (s *MongoUserStorage) ShareBook(ctx context.Context, username string, bookID string, share models.BookShare) error {
+	if bookID == models.DefaultBookID {
+		return ErrDefaultBook
+	}
+	owner, book, err := s.bookAccess(ctx, username, bookID, models.BookManage)
+	if err != nil {
+		return err
+	}
+	if share.GroupID != "" {
+		groups, err := s.FindUserGroups(ctx, username)
+		if err != nil {
+			return err
+		}
+		owned := false
+		for _, g := range groups {
+			owned = owned || (g.ID == share.GroupID && g.Owner == username)
+		}
+		if !owned {
+			return ErrGroupNotFound
+		}
+	}
+
+	shares := []mongoBookShare{}
+	for _, existing := range book.Shares {
+		if existing.Grantee() != share.Grantee() {
+			shares = append(shares, mongoBookShare(existing))
+		}
+	}
+	share.GrantedBy = username
+	share.GrantedAt = time.Now().UTC()
+	shares = append(shares, mongoBookShare(share))
+	return s.collection.Update(
+		bson.M{"_id": owner.UserID, "books._id": bson.ObjectIdHex(bookID)},
+		bson.M{"$set": bson.M{"books.$.shares": shares}},
+	)
+}
+
+// UnshareBook revokes a share. Needs BookManage, except for users giving up their own share
+func (s *MongoUserStorage) UnshareBook(ctx context.Context, username string, bookID string, share models.BookShare) error {
+	need := models.BookManage
+	if share.GroupID == "" && share.Username == username {
+		need = models.BookRead
+	}
+	owner, _, err := s.bookAccess(ctx, username, bookID, need)
+	if err != nil {
+		return err
+	}
+	pull := bson.M{"username": share.Username}
+	if share.GroupID != "" {
+		pull = bson.M{"group_id": share.GroupID}
+	}
+	info, err := s.collection.UpdateAll(
+		bson.M{"_id": owner.UserID, "books": bson.M{"$elemMatch": bson.M{"_id": bson.ObjectIdHex(bookID), "shares": bson.M{"$elemMatch": pull}}}},
+		bson.M{"$pull": bson.M{"books.$.shares": pull}},
+	)
+	if err != nil {
+		return err
+	}
+	if info.Updated == 0 {
+		return ErrShareNotFound
+	}
+	return nil
+}
+
+// FindBookContacts finds the contacts in a book the user can read
+func (s *MongoUserStorage) FindBookContacts(ctx context.Context, username string, bookID string) ([]models.Contact, error) {
+	owner, _, err := s.bookAccess(ctx, username, bookID, models.BookRead)
+	if err != nil {
+		return nil, err
+	}
+	contacts := []models.Contact{}
+	inBook := owner.Contacts.inBook(bookID)
+	last := inBook.lastContacted(time.Now())
+	for _, c := range inBook {
+		contact := c.toModel()
+		setLastContacted(contact, last)
+		contacts = append(contacts, *contact)
+	}
+	return contacts, nil
+}
+
+// bookContact finds the owner of a book and one of its contacts, if username was granted at least need
+func (s *MongoUserStorage) bookContact(ctx context.Context, username string, bookID string, contactID string, need models.BookPermission) (*mongoUser, *mongoContact, error) {
+	owner, _, err := s.bookAccess(ctx, username, bookID, need)
+	if err != nil {
+		return nil, nil, err
+	}
+	contact := owner.Contacts.findByID(contactID)
+	if contact == nil || contact.toModel().BookID != bookID {
+		return nil, nil, ErrContactNotFound
+	}
+	return owner, contact, nil
+}
+
+// FindBookContact finds a contact in a book the user can read
+func (s *MongoUserStorage) FindBookContact(ctx context.Context, username string, bookID string, contactID string) (*models.Contact, error) {
+	owner, contact, err := s.bookContact(ctx, username, bookID, contactID, models.BookRead)
+	if err != nil {
+		return nil, err
+	}
+	found := contact.toModel()
+	setLastContacted(found, owner.Contacts.inBook(bookID).lastContacted(time.Now()))
+	return found, nil
+}
+
+// UpdateBookContact updates a contact in a book the user can edit. The contact stays in the book
+func (s *MongoUserStorage) UpdateBookContact(ctx context.Context, username string, bookID string, update models.Contact) error {
+	owner, old, err := s.bookContact(ctx, username, bookID, update.ID, models.BookEdit)
+	if err != nil {
+		return err
+	}
+	contact := newMongoContact(update, false)
+	contact.ID = old.ID
+	contact.BookID = old.BookID
+	contact.Photo = old.Photo
+	contact.Attachments = old.Attachments
+	contact.Interactions = old.Interactions
+	return s.collection.Update(
+		bson.M{"_id": owner.UserID, "contacts._id": old.ID},
+		bson.M{"$set": bson.M{"contacts.$": contact}},
+	)
+}
+
+// SetContactPhoto replaces the photo of a contact in a book the user can edit, or removes it with nil. Returns the photo it had
+func (s *MongoUserStorage) SetContactPhoto(ctx context.Context, username string, bookID string, contactID string, photo *models.ContactPhoto) (*models.ContactPhoto, error) {
+	owner, old, err := s.bookContact(ctx, username, bookID, contactID, models.BookEdit)
+	if err != nil {
+		return nil, err
+	}
+	update := bson.M{"$unset": bson.M{"contacts.$.photo": ""}}
+	if photo != nil {
+		update = bson.M{"$set": bson.M{"contacts.$.photo": newMongoPhoto(photo)}}
+	}
+	if err = s.collection.Update(bson.M{"_id": owner.UserID, "contacts._id": old.ID}, update); err != nil {
+		return nil, err
+	}
+	return old.Photo.toModel(), nil
+}
+
+// PhotoInUse checks if a contact of any user has the photo with the hash
+func (s *MongoUserStorage) PhotoInUse(ctx context.Context, hash string) (bool, error) {
+	n, err := s.collection.Find(bson.M{"contacts.photo.hash": hash}).Count()
+	return n > 0, err
+}
+
+// AddAttachment attaches a file to a contact in a book the user can edit, if the attachments of the book owner's
+// contacts stay within quota bytes
+func (s *MongoUserStorage) AddAttachment(ctx context.Context, username string, bookID string, contactID string, attachment models.Attachment, quota int64) error {
+	owner, contact, err := s.bookContact(ctx, username, bookID, contactID, models.BookEdit)
+	if err != nil {
+		return err
+	}
+	err = s.collection.Update(
+		bson.M{"_id": owner.UserID, "contacts._id": contact.ID, "$expr": withinAttachmentQuota(attachment.Size, quota)},
+		bson.M{"$push": bson.M{"contacts.$.attachments": mongoAttachment(attachment)}},
+	)
+	if err == mgo.ErrNotFound {
+		// the contact may have been deleted since it was found
+		if n, _ := s.collection.Find(bson.M{"_id": owner.UserID, "contacts._id": contact.ID}).Count(); n == 0 {
+			return ErrContactNotFound
+		}
+		return ErrAttachmentQuota
+	}
+	return err
+}
+
+// withinAttachmentQuota is an aggregation expression matching users whose contacts have room for size more bytes of
+// attachments. It is checked by the update adding them, so concurrent uploads can't both take the last of the quota
+func withinAttachmentQuota(size int64, quota int64) bson.M {
+	used := bson.M{"$sum": bson.M{"$map": bson.M{
+		"input": bson.M{"$ifNull": []interface{}{"$contacts", []interface{}{}}},
+		"as":    "contact",
+		"in":    bson.M{"$sum": "$$contact.attachments.size"},
+	}}}
+	return bson.M{"$lte": []interface{}{used, quota - size}}
+}
+
+// RemoveAttachment removes an attachment from a contact in a book the user can edit, and returns it
+func (s *MongoUserStorage) RemoveAttachment(ctx context.Context, username string, bookID string, contactID string, attachmentID string) (*models.Attachment, error) {
+	owner, contact, err := s.bookContact(ctx, username, bookID, contactID, models.BookEdit)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range contact.Attachments {
+		if a.ID != attachmentID {
+			continue
+		}
+		err = s.collection.Update(
+			bson.M{"_id": owner.UserID, "contacts._id": contact.ID},
+			bson.M{"$pull": bson.M{"contacts.$.attachments": bson.M{"id": attachmentID}}},
+		)
+		if err != nil {
+			return nil, err
+		}
+		removed := models.Attachment(a)
+		return &removed, nil
+	}
+	return nil, ErrAttachmentNotFound
+}
+
+// AttachmentInUse checks if a contact of any user has the attachment with the id
+func (s *MongoUserStorage) AttachmentInUse(ctx context.Context, id string) (bool, error) {
+	n, err := s.collection.Find(bson.M{"contacts.attachments.id": id}).Count()
+	return n > 0, err
+}
+
+// FindInteractions finds a page of the timeline of a contact in a book the user can read, and how long it is. The timeline
+// has the interactions logged against the contact and those of other contacts in the book linking it, newest first
+func (s *MongoUserStorage) FindInteractions(ctx context.Context, username string, bookID string, contactID string, offset int, limit int) ([]models.Interaction, int, error) {
+	owner, contact, err := s.bookContact(ctx, username, bookID, contactID, models.BookRead)
+	if err != nil {
+		return nil, 0, err
+	}
+	timeline := []models.Interaction{}
+	for _, c := range owner.Contacts.inBook(bookID) {
+		for _, i := range c.Interactions {
+			if c.ID == contact.ID || i.links(contact.ID) {
+				timeline = append(timeline, i.toModel(c.ID))
+			}
+		}
+	}
+	sort.SliceStable(timeline, func(a, b int) bool {
+		if !timeline[a].At.Equal(timeline[b].At) {
+			return timeline[a].At.After(timeline[b].At)
+		}
+		return timeline[a].CreatedAt.After(timeline[b].CreatedAt)
+	})
+	total := len(timeline)
+	if offset > total {
+		offset = total
+	}
+	if end := offset + limit; end < total {
+		timeline = timeline[:end]
+	}
+	return timeline[offset:], total, nil
+}
+
+// AddInteraction logs an interaction against a contact in a book the user can edit. It fails with ErrInteractionLink
+// when it links contacts outside the book
+func (s *MongoUserStorage) AddInteraction(ctx context.Context, username string, bookID string, contactID string, interaction models.Interaction) (*models.Interaction, error) {
+	owner, contact, err := s.bookContact(ctx, username, bookID, contactID, models.BookEdit)
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range interaction.Links {
+		if linked := owner.Contacts.findByID(link); linked == nil || linked.toModel().BookID != bookID {
+			return nil, ErrInteractionLink
+		}
+	}
+	newInteraction := mongoInteraction{
+		ID:        bson.NewObjectId(),
+		Kind:      string(interaction.Kind),
+		At:        interaction.At,
+		Text:      interaction.Text,
+		Links:     interaction.Links,
+		Author:    interaction.Author,
+		CreatedAt: time.Now().UTC(),
+	}
+	err = s.collection.Update(
+		bson.M{"_id": owner.UserID, "contacts._id": contact.ID},
+		bson.M{"$push": bson.M{"contacts.$.interactions": newInteraction}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	created := newInteraction.toModel(contact.ID)
+	return &created, nil
+}
+
+// DeleteInteraction deletes an interaction logged against a contact in a book the user can edit
+func (s *MongoUserStorage) DeleteInteraction(ctx context.Context, username string, bookID string, contactID string, interactionID string) error {
+	owner, contact, err := s.bookContact(ctx, username, bookID, contactID, models.BookEdit)
+	if err != nil {
+		return err
+	}
+	for _, i := range contact.Interactions {
+		if i.ID.Hex() == interactionID {
+			return s.collection.Update(
+				bson.M{"_id": owner.UserID, "contacts._id": contact.ID},
+				bson.M{"$pull": bson.M{"contacts.$.interactions": bson.M{"_id": i.ID}}},
+			)
+		}
+	}
+	return ErrInteractionNotFound
+}
+
+// DeleteBookContact deletes a contact from a book the user can edit
+func (s *MongoUserStorage) DeleteBookContact(ctx context.Context, username string, bookID string, contactID string) error {
+	owner, contact, err := s.bookContact(ctx, username, bookID, contactID, models.BookEdit)
+	if err != nil {
+		return err
+	}
+	return s.collection.Update(bson.M{"_id": owner.UserID}, bson.M{"$pull": bson.M{"contacts": bson.M{"_id": contact.ID}}})
+}
+
+// MoveContact moves a contact between books the user can edit. The books can have different owners, and the attachments
+// of a contact moved to another owner have to fit in their quota. Custom values the other book has no field for are dropped
+func (s *MongoUserStorage) MoveContact(ctx context.Context, username string, fromBookID string, contactID string, toBookID string, quota int64) error {
+	from, contact, err := s.bookContact(ctx, username, fromBookID, contactID, models.BookEdit)
+	if err != nil {
+		return err
+	}
+	to, toBook, err := s.bookAccess(ctx, username, toBookID, models.BookEdit)
+	if err != nil {
+		return err
+	}
+
+	moved := newMongoContact(*contact.toModel(), false)
+	moved.ID = contact.ID
+	moved.Interactions = contact.Interactions
+	moved.BookID = newMongoContact(models.Contact{BookID: toBookID}, false).BookID
+	moved.Custom = toBook.Fields.Keep(contact.Custom)
+	if from.UserID == to.UserID {
+		return s.collection.Update(
+			bson.M{"_id": from.UserID, "contacts._id": contact.ID},
+			bson.M{"$set": bson.M{"contacts.$": moved}},
+		)
+	}
+	// the contact is added before it is removed, so a failure leaves it in both books rather than neither
+	if err = s.pushContact(to.UserID, moved, quota); err != nil {
+		return err
+	}
+	return s.collection.Update(bson.M{"_id": from.UserID}, bson.M{"$pull": bson.M{"contacts": bson.M{"_id": contact.ID}}})
+}
+
+// CopyContact copies a contact from a book the user can read to one they can edit, and returns the copy. The copy's
+// attachments count again, and have to fit in the quota of the other book's owner. Custom values the other book has
+// no field for are left out
+func (s *MongoUserStorage) CopyContact(ctx context.Context, username string, fromBookID string, contactID string, toBookID string, quota int64) (*models.Contact, error) {
+	_, contact, err := s.bookContact(ctx, username, fromBookID, contactID, models.BookRead)
+	if err != nil {
+		return nil, err
+	}
+	to, toBook, err := s.bookAccess(ctx, username, toBookID, models.BookEdit)
+	if err != nil {
+		return nil, err
+	}
+	duplicate := *contact.toModel()
+	duplicate.BookID = toBookID
+	duplicate.Custom = toBook.Fields.Keep(duplicate.Custom)
+	copied := newMongoContact(duplicate, true)
+	if err = s.pushContact(to.UserID, copied, quota); err != nil {
+		return nil, err
+	}
+	return copied.toModel(), nil
+}
+
+// pushContact adds a contact to a user. Contacts with attachments are only added if they fit in the user's quota
+func (s *MongoUserStorage) pushContact(userID bson.ObjectId, contact *mongoContact, quota int64) error {
+	query := bson.M{"_id": userID}
+	size := int64(0)
+	for _, a := range contact.Attachments {
+		size += a.Size
+	}
+	if size > 0 {
+		query["$expr"] = withinAttachmentQuota(size, quota)
+	}
+	err := s.collection.Update(query, bson.M{"$push": bson.M{"contacts": contact}})
+	if err == mgo.ErrNotFound && size > 0 {
+		return ErrAttachmentQuota
+	}
+	return err
+}
+
+// User group methods
+
+// FindUserGroups lists the groups of users the user owns or is a member of
+func (s *MongoUserStorage) FindUserGroups(ctx context.Context, username string) ([]models.UserGroup, error) {
+	var owners []mongoUser
+	err := s.collection.Find(bson.M{"$or": []bson.M{
+		{"username": username},
+		{"user_groups.members": username},
+	}}).Select(bson.M{"username": 1, "user_groups": 1}).All(&owners)
+	if err != nil {
+		return nil, err
+	}
+	groups := []models.UserGroup{}
+	for _, owner := range owners {
+		for _, g := range owner.UserGroups {
+			if group := g.toModel(owner.Username); group.HasMember(username) {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups, nil
+}
+
+// CreateUserGroup creates a group of users owned by the user
+func (s *MongoUserStorage) CreateUserGroup(ctx context.Context, username string, group models.UserGroup) (*models.UserGroup, error) {
+	newGroup := mongoUserGroup{ID: bson.NewObjectId(), Name: group.Name, Members: group.Members, CreatedAt: time.Now().UTC()}
+	if newGroup.Members == nil {
+		newGroup.Members = []string{}
+	}
+	err := s.collection.Update(bson.M{"username": username}, bson.M{"$push": bson.M{"user_groups": newGroup}})
+	if err != nil {
+		return nil, err
+	}
+	created := newGroup.toModel(username)
+	return &created, nil
+}
+
+// UpdateUserGroup renames one of the user's groups and replaces its members
+func (s *MongoUserStorage) UpdateUserGroup(ctx context.Context, username string, group models.UserGroup) error {
+	if !bson.IsObjectIdHex(group.ID) {
+		return ErrGroupNotFound
+	}
+	members := group.Members
+	if members == nil {
+		members = []string{}
+	}
+	err := s.collection.Update(
+		bson.M{"username": username, "user_groups._id": bson.ObjectIdHex(group.ID)},
+		bson.M{"$set": bson.M{"user_groups.$.name": group.Name, "user_groups.$.members": members}},
+	)
+	if err == mgo.ErrNotFound {
+		return ErrGroupNotFound
+	}
+	return err
+}
+
+// DeleteUserGroup deletes one of the user's groups, and the shares to it
+func (s *MongoUserStorage) DeleteUserGroup(ctx context.Context, username string, groupID string) error {
+	if !bson.IsObjectIdHex(groupID) {
+		return ErrGroupNotFound
+	}
+	err := s.collection.Update(
+		bson.M{"username": username, "user_groups._id": bson.ObjectIdHex(groupID)},
+		bson.M{"$pull": bson.M{"user_groups": bson.M{"_id": bson.ObjectIdHex(groupID)}}},
+	)
+	if err == mgo.ErrNotFound {
+		return ErrGroupNotFound
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.collection.UpdateAll(
+		bson.M{"books.shares.group_id": groupID},
+		bson.M{"$pull": bson.M{"books.$[].shares": bson.M{"group_id": groupID}}},
+	)
+	return err
+}
+
+// Contact group methods
+
+// FindContactGroups lists the user's groups of contacts
+func (s *MongoUserStorage) FindContactGroups(ctx context.Context, username string) ([]models.ContactGroup, error) {
+	user, err := s.getUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	groups := []models.ContactGroup{}
+	for _, g := range user.ContactGroups {
+		groups = append(groups, g.toModel())
+	}
+	return groups, nil
+}
+
+// newMongoContactGroup converts a group of contacts, without nil lists
+func newMongoContactGroup(group models.ContactGroup) mongoContactGroup {
+	g := mongoContactGroup{Name: group.Name, Contacts: group.Contacts, Groups: group.Groups, CreatedAt: group.CreatedAt}
+	if g.Contacts == nil {
+		g.Contacts = []string{}
+	}
+	if g.Groups == nil {
+		g.Groups = []string{}
+	}
+	return g
+}
+
+// CreateContactGroup creates a group of the user's contacts
+func (s *MongoUserStorage) CreateContactGroup(ctx context.Context, username string, group models.ContactGroup) (*models.ContactGroup, error) {
+	newGroup := newMongoContactGroup(group)
+	newGroup.ID = bson.NewObjectId()
+	newGroup.CreatedAt = time.Now().UTC()
+	err := s.collection.Update(bson.M{"username": username}, bson.M{"$push": bson.M{"contact_groups": newGroup}})
+	if err != nil {
+		return nil, err
+	}
+	created := newGroup.toModel()
+	return &created, nil
+}
+
+// UpdateContactGroup renames one of the user's groups of contacts and replaces its contacts and nested groups
+func (s *MongoUserStorage) UpdateContactGroup(ctx context.Context, username string, group models.ContactGroup) error {
+	if !bson.IsObjectIdHex(group.ID) {
+		return ErrContactGroupNotFound
+	}
+	update := newMongoContactGroup(group)
+	err := s.collection.Update(
+		bson.M{"username": username, "contact_groups._id": bson.ObjectIdHex(group.ID)},
+		bson.M{"$set": bson.M{
+			"contact_groups.$.name":     update.Name,
+			"contact_groups.$.contacts": update.Contacts,
+			"contact_groups.$.groups":   update.Groups,
+		}},
+	)
+	if err == mgo.ErrNotFound {
+		return ErrContactGroupNotFound
+	}
+	return err
+}
+
+// DeleteContactGroup deletes one of the user's groups of contacts, and takes it out of the groups it was nested in
+func (s *MongoUserStorage) DeleteContactGroup(ctx context.Context, username string, groupID string) error {
+	user, err := s.getUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	groups := []mongoContactGroup{}
+	found := false
+	for _, g := range user.ContactGroups {
+		if g.ID.Hex() == groupID {
+			found = true
+			continue
+		}
+		nested := []string{}
+		for _, id := range g.Groups {
+			if id != groupID {
+				nested = append(nested, id)
+			}
+		}
+		g.Groups = nested
+		groups = append(groups, g)
+	}
+	if !found {
+		return ErrContactGroupNotFound
+	}
+	return s.collection.Update(bson.M{"_id": user.UserID}, bson.M{"$set": bson.M{"contact_groups": groups}})
+}
+
+// Organisation membership methods
+
+// FindOrgMembers finds the members of an organisation, sorted by username
+func (s *MongoUserStorage) FindOrgMembers(ctx context.Context, orgID string) ([]models.OrgMember, error) {
+	var users []mongoUser
+	err := s.collection.Find(bson.M{"orgs.org_id": orgID}).
+		Select(bson.M{"username": 1, "orgs": 1}).Sort("username").All(&users)
+	if err != nil {
+		return nil, err
+	}
+	members := []models.OrgMember{}
+	for _, u := range users {
+		for _, m := range u.Orgs {
+			if m.OrgID == orgID {
+				members = append(members, models.OrgMember{Username: u.Username, Role: m.Role, JoinedAt: m.JoinedAt})
+			}
+		}
+	}
+	return members, nil
+}
+
+// SaveOrgMembership stores a user's membership of an organisation, replacing their earlier membership of it
+func (s *MongoUserStorage) SaveOrgMembership(ctx context.Context, username string, membership models.OrgMembership) error {
+	err := s.collection.Update(
+		bson.M{"username": username, "orgs.org_id": membership.OrgID},
+		bson.M{"$set": bson.M{"orgs.$": mongoOrgMembership(membership)}},
+	)
+	if err != mgo.ErrNotFound {
+		return err
+	}
+	return s.collection.Update(
+		bson.M{"username": username, "orgs.org_id": bson.M{"$ne": membership.OrgID}},
+		bson.M{"$push": bson.M{"orgs": mongoOrgMembership(membership)}},
+	)
+}
+
+// RemoveOrgMembership removes a user from an organisation
+func (s *MongoUserStorage) RemoveOrgMembership(ctx context.Context, username string, orgID string) error {
+	return s.collection.Update(bson.M{"username": username}, bson.M{"$pull": bson.M{"orgs": bson.M{"org_id": orgID}}})
+}
+
+// RemoveOrgMembershipFromAll removes every member from an organisation, when the organisation is deleted
+func (s *MongoUserStorage) RemoveOrgMembershipFromAll(ctx context.Context, orgID string) error {
+	_, err := s.collection.UpdateAll(
+		bson.M{"orgs.org_id": orgID},
+		bson.M{"$pull": bson.M{"orgs": bson.M{"org_id": orgID}}},
+	)
+	return err
+}
+
+// Contact methods
+
+// CreateContact creates a new contact in its book, or the user's default book. Needs BookEdit on the book
+func (s *MongoUserStorage) CreateContact(ctx context.Context, username string, contact models.Contact) (*models.Contact, error) {
+	if contact.BookID == "" {
+		contact.BookID = models.DefaultBookID
+	}
+	owner, _, err := s.bookAccess(ctx, username, contact.BookID, models.BookEdit)
+	if err != nil {
+		return nil, err
+	}
+	newContact := newMongoContact(contact, true)
+	err = s.collection.Update(bson.M{"_id": owner.UserID}, bson.M{"$push": bson.M{"contacts": newContact}})
+	return newContact.toModel(), err
+}
+
+// FindContactById retrieves the specified contact
+func (s *MongoUserStorage) FindContactById(ctx context.Context, username string, contactID string) (*models.Contact, error) {
+	user, err := s.getUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	contact := user.Contacts.findByID(contactID)
+	if contact == nil {
+		return nil, ErrContactNotFound
+	}
+	found := contact.toModel()
+	setLastContacted(found, user.Contacts.lastContacted(time.Now()))
+	return found, nil
+}
+
+// FindAllContacts finds all the contacts of a user
+func (s *MongoUserStorage) FindAllContacts(ctx context.Context, username string) ([]models.Contact, error) {
+	user, err := s.getUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	return user.toModel().Contacts, nil
+}
+
+// UpdateContact updates a specific contact of a user
+func (s *MongoUserStorage) UpdateContact(ctx context.Context, username string, update models.Contact) error {
+	if !bson.IsObjectIdHex(update.ID) {
+		return fmt.Errorf("Invalid id")
+	}
+	user, err := s.getUser(ctx, username)
+	if err != nil {
+		return nil
+	}
+	oldID := update.ID
+	contact := newMongoContact(update, false)
+	contact.ID = bson.ObjectIdHex(oldID)
+	// contacts change books through MoveContact, and photos and attachments through their own calls
+	if old := user.Contacts.findByID(oldID); old != nil {
+		contact.BookID = old.BookID
+		contact.Photo = old.Photo
+		contact.Attachments = old.Attachments
+		contact.Interactions = old.Interactions
 	}
-	oldID := update.ID
-	contact := newMongoContact(update, false)
-	contact.ID = bson.ObjectIdHex(oldID)
 	contacts := user.Contacts.replaceWith(*contact)
 	err = s.collection.Update(bson.M{"_id": user.UserID}, bson.M{"$set": bson.M{"contacts": contacts}})
 	return err
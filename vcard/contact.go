@@ -0,0 +1,273 @@
+package vcard
+
+import (
+	"encoding/base64"
+	"strings"
+	"unicode"
+
+	"github.com/Dacode45/addressbook/models"
+)
+
+// fieldValueTypes are the vCard value types of custom fields. Other fields are text
+var fieldValueTypes = map[models.FieldType]string{
+	models.FieldNumber:  "float",
+	models.FieldDate:    "date",
+	models.FieldURL:     "uri",
+	models.FieldBoolean: "boolean",
+}
+
+// FromContact converts a contact to a vCard. Set the display name first, it is the FN of the card.
+// Custom fields are X- properties named after their key, like X-ACCOUNT-MANAGER for account_manager
+func FromContact(c models.Contact, fields models.FieldDefinitions) Card {
+	card := Card{}
+	card.Add("UID", Escape(c.ID), nil)
+	card.Add("FN", Escape(c.DisplayName), nil)
+	card.Add("N", structured(c.LastName, c.FirstName, c.MiddleName, c.Prefix, c.Suffix), nil)
+	card.AddText("NICKNAME", c.Nickname, nil)
+	card.AddText("X-PHONETIC-FIRST-NAME", c.PhoneticFirstName, nil)
+	card.AddText("X-PHONETIC-LAST-NAME", c.PhoneticLastName, nil)
+	for _, email := range c.Emails {
+		card.AddText("EMAIL", email.Value, valueParams(email.Label, email.Preferred))
+	}
+	for _, phone := range c.Phones {
+		label := phone.Label
+		if label == models.LabelMobile {
+			label = "cell"
+		}
+		card.AddText("TEL", phone.Value, valueParams(label, phone.Preferred))
+	}
+	for _, a := range c.Addresses {
+		card.Add("ADR", structured("", "", a.Street, a.Locality, a.Region, a.Postcode, a.Country), valueParams(a.Label, a.Preferred))
+	}
+	card.AddText("ORG", c.Organization, nil)
+	card.AddText("TITLE", c.JobTitle, nil)
+	card.AddText("BDAY", date(c.Birthday), nil)
+	card.AddText("ANNIVERSARY", date(c.Anniversary), nil)
+	for _, u := range c.URLs {
+		card.Add("URL", u, nil)
+	}
+	card.AddText("NOTE", c.Notes, nil)
+	if len(c.Tags) > 0 {
+		card.Add("CATEGORIES", structuredList(c.Tags), nil)
+	}
+	for _, f := range fields {
+		value, ok := c.Custom[f.Key]
+		if !ok {
+			continue
+		}
+		valueType, ok := fieldValueTypes[f.Type]
+		if !ok {
+			card.AddText(FieldProperty(f.Key), value, nil)
+			continue
+		}
+		switch f.Type {
+		case models.FieldDate:
+			value = date(value)
+		case models.FieldBoolean:
+			value = strings.ToUpper(value)
+		}
+		card.Add(FieldProperty(f.Key), value, map[string]string{"VALUE": valueType})
+	}
+	return card
+}
+
+// AddPhoto adds a PHOTO property with the photo inline, as a data uri
+func (c *Card) AddPhoto(contentType string, data []byte) {
+	c.Add("PHOTO", "data:"+contentType+";base64,"+base64.StdEncoding.EncodeToString(data), nil)
+}
+
+// ToContact converts a vCard to a contact, reading custom fields from the X- properties named after their key.
+// Cards without N take their FN as first name. Normalize and validate the contact before saving it
+func ToContact(card Card, fields models.FieldDefinitions) models.Contact {
+	c := models.Contact{}
+	custom := map[string]models.FieldDefinition{}
+	for _, f := range fields {
+		custom[FieldProperty(f.Key)] = f
+	}
+	hasName, formatted := false, ""
+	for _, p := range card {
+		switch p.Name {
+		case "FN":
+			formatted = Unescape(p.Value)
+		case "N":
+			n := append(splitValue(p.Value, ';'), "", "", "", "", "")
+			c.LastName, c.FirstName, c.MiddleName, c.Prefix, c.Suffix = n[0], n[1], n[2], n[3], n[4]
+			hasName = c.LastName != "" || c.FirstName != ""
+		case "NICKNAME":
+			c.Nickname = splitValue(p.Value, ',')[0]
+		case "X-PHONETIC-FIRST-NAME":
+			c.PhoneticFirstName = Unescape(p.Value)
+		case "X-PHONETIC-LAST-NAME":
+			c.PhoneticLastName = Unescape(p.Value)
+		case "EMAIL":
+			c.Emails = append(c.Emails, models.ContactValue{Label: typeLabel(p), Value: Unescape(p.Value), Preferred: isPreferred(p)})
+		case "TEL":
+			value := strings.TrimPrefix(Unescape(p.Value), "tel:")
+			c.Phones = append(c.Phones, models.ContactValue{Label: typeLabel(p), Value: value, Preferred: isPreferred(p)})
+		case "ADR":
+			a := append(splitValue(p.Value, ';'), "", "", "", "", "", "", "")
+			c.Addresses = append(c.Addresses, models.Address{
+				Label:     typeLabel(p),
+				Street:    a[2],
+				Locality:  a[3],
+				Region:    a[4],
+				Postcode:  a[5],
+				Country:   a[6],
+				Preferred: isPreferred(p),
+			})
+		case "ORG":
+			c.Organization = splitValue(p.Value, ';')[0]
+		case "TITLE":
+			c.JobTitle = Unescape(p.Value)
+		case "BDAY":
+			c.Birthday = fromDate(Unescape(p.Value))
+		case "ANNIVERSARY":
+			c.Anniversary = fromDate(Unescape(p.Value))
+		case "URL":
+			c.URLs = append(c.URLs, Unescape(p.Value))
+		case "NOTE":
+			c.Notes = Unescape(p.Value)
+		case "CATEGORIES":
+			c.Tags = append(c.Tags, splitValue(p.Value, ',')...)
+		default:
+			f, ok := custom[p.Name]
+			if !ok {
+				continue
+			}
+			if c.Custom == nil {
+				c.Custom = models.CustomFields{}
+			}
+			value := Unescape(p.Value)
+			if f.Type == models.FieldDate {
+				value = fromDate(value)
+			}
+			c.Custom[f.Key] = value
+		}
+	}
+	if !hasName {
+		c.FirstName = formatted
+	}
+	return c
+}
+
+// PhotoData decodes the photo of a card when it is inline: a data uri in vCard 4.0, or base64 with ENCODING=b in 3.0 and 2.1.
+// Photos linked by url are left out, they aren't fetched
+func PhotoData(card Card) ([]byte, bool) {
+	for _, p := range card {
+		if p.Name != "PHOTO" {
+			continue
+		}
+		value, encoding := p.Value, strings.ToLower(p.Params["ENCODING"])
+		if strings.HasPrefix(strings.ToLower(value), "data:") {
+			comma := strings.Index(value, ",")
+			if comma < 0 || !strings.HasSuffix(strings.ToLower(value[:comma]), ";base64") {
+				continue
+			}
+			value = value[comma+1:]
+		} else if encoding != "b" && encoding != "base64" {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.Map(dropSpace, value))
+		if err != nil {
+			continue
+		}
+		return data, true
+	}
+	return nil, false
+}
+
+// FieldProperty is the name of the X- property of a custom field
+func FieldProperty(key string) string {
+	return "X-" + strings.ToUpper(strings.Replace(key, "_", "-", -1))
+}
+
+// valueParams are the TYPE and PREF parameters of an email, phone or address
+func valueParams(label string, preferred bool) map[string]string {
+	params := map[string]string{}
+	if label != "" {
+		params["TYPE"] = label
+	}
+	if preferred {
+		params["PREF"] = "1"
+	}
+	return params
+}
+
+// structured escapes and joins the components of a structured value
+func structured(components ...string) string {
+	escaped := make([]string, len(components))
+	for i, component := range components {
+		escaped[i] = Escape(component)
+	}
+	return strings.Join(escaped, ";")
+}
+
+// structuredList escapes and joins the values of a list, like CATEGORIES
+func structuredList(values []string) string {
+	escaped := make([]string, len(values))
+	for i, value := range values {
+		escaped[i] = Escape(value)
+	}
+	return strings.Join(escaped, ",")
+}
+
+// typeLabel is the label of an email, phone or address, the first of its types that isn't generic like internet or voice
+func typeLabel(p Property) string {
+	for _, t := range strings.Split(strings.ToLower(p.Params["TYPE"]), ",") {
+		switch t {
+		case "", "pref", "internet", "voice", "x400":
+		case "cell":
+			return models.LabelMobile
+		default:
+			return t
+		}
+	}
+	return ""
+}
+
+// isPreferred checks for PREF in vCard 4.0 or TYPE=pref in 3.0
+func isPreferred(p Property) bool {
+	if p.Params["PREF"] != "" {
+		return true
+	}
+	for _, t := range strings.Split(strings.ToLower(p.Params["TYPE"]), ",") {
+		if t == "pref" {
+			return true
+		}
+	}
+	return false
+}
+
+// dropSpace drops the spaces base64 is wrapped with
+func dropSpace(r rune) rune {
+	if unicode.IsSpace(r) {
+		return -1
+	}
+	return r
+}
+
+// fromDate reads a date in the basic or extended format, like 18151210 or 1815-12-10, as YYYY-MM-DD or --MM-DD. Times are dropped
+func fromDate(value string) string {
+	if i := strings.Index(value, "T"); i >= 0 {
+		value = value[:i]
+	}
+	digits := strings.TrimPrefix(value, "--")
+	if strings.Trim(digits, "0123456789") != "" {
+		return value
+	}
+	switch {
+	case len(value) == 8:
+		return value[:4] + "-" + value[4:6] + "-" + value[6:]
+	case len(value) == 6 && strings.HasPrefix(value, "--"):
+		return "--" + value[2:4] + "-" + value[4:]
+	}
+	return value
+}
+
+// date writes a YYYY-MM-DD or --MM-DD date in the basic format of vCard, like 18151210 or --1210
+func date(value string) string {
+	if strings.HasPrefix(value, "--") {
+		return "--" + strings.Replace(value[2:], "-", "", -1)
+	}
+	return strings.Replace(value, "-", "", -1)
+}
@@ -0,0 +1,200 @@
+package vcard
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxCardProperties bounds the properties of a card read, so a stream without END isn't read into memory whole
+const maxCardProperties = 1000
+
+// Decoder reads vCards from a stream. It reads versions 2.1, 3.0 and 4.0, but not quoted-printable values
+type Decoder struct {
+	r    *bufio.Reader
+	line int
+	// next is a line read ahead to check it isn't folded into the one before
+	next *string
+}
+
+// NewDecoder returns a decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next card, leaving out BEGIN, VERSION and END. Returns io.EOF when there are no more cards
+func (d *Decoder) Decode() (Card, error) {
+	var card Card
+	inCard := false
+	for {
+		line, err := d.readLine()
+		if err == io.EOF && inCard {
+			return nil, fmt.Errorf("line %d: card without END", d.line)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		p, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", d.line, err)
+		}
+		switch {
+		case !inCard && p.Name == "BEGIN" && strings.EqualFold(p.Value, "VCARD"):
+			inCard = true
+			card = Card{}
+		case !inCard:
+			return nil, fmt.Errorf("line %d: expected BEGIN:VCARD", d.line)
+		case p.Name == "END" && strings.EqualFold(p.Value, "VCARD"):
+			return card, nil
+		case p.Name == "VERSION":
+		default:
+			if len(card) >= maxCardProperties {
+				return nil, fmt.Errorf("line %d: cards have at most %d properties", d.line, maxCardProperties)
+			}
+			card = append(card, p)
+		}
+	}
+}
+
+// readLine reads a content line, unfolding the lines starting with a space or tab into it
+func (d *Decoder) readLine() (string, error) {
+	line, err := d.readPhysicalLine()
+	if err != nil {
+		return "", err
+	}
+	for {
+		next, err := d.readPhysicalLine()
+		if err == io.EOF {
+			return line, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if next == "" || (next[0] != ' ' && next[0] != '\t') {
+			d.next = &next
+			return line, nil
+		}
+		line += next[1:]
+	}
+}
+
+// readPhysicalLine reads a line without its line ending, or the line read ahead
+func (d *Decoder) readPhysicalLine() (string, error) {
+	if d.next != nil {
+		line := *d.next
+		d.next = nil
+		return line, nil
+	}
+	line, err := d.r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	d.line++
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// parseLine splits a content line like item1.EMAIL;TYPE=work,pref:ada@example.com into its name, parameters and value.
+// Groups are dropped, names are upper cased and parameters without a name, like TEL;CELL in vCard 2.1, are types
+func parseLine(line string) (Property, error) {
+	p := Property{Params: map[string]string{}}
+	// the name and parameters end at the first colon outside quotes
+	end, quoted := -1, false
+	for i, r := range line {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ':' && !quoted {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return p, fmt.Errorf("no : in %q", line)
+	}
+	p.Value = line[end+1:]
+	parts := splitParams(line[:end])
+	p.Name = strings.ToUpper(parts[0])
+	if i := strings.LastIndex(p.Name, "."); i >= 0 {
+		p.Name = p.Name[i+1:]
+	}
+	if p.Name == "" {
+		return p, fmt.Errorf("no property name in %q", line)
+	}
+	for _, param := range parts[1:] {
+		name, value := "TYPE", param
+		if i := strings.Index(param, "="); i >= 0 {
+			name, value = strings.ToUpper(param[:i]), param[i+1:]
+		}
+		value = strings.Replace(value, `"`, "", -1)
+		if p.Params[name] != "" {
+			value = p.Params[name] + "," + value
+		}
+		p.Params[name] = value
+	}
+	return p, nil
+}
+
+// splitParams splits the name and parameters of a content line at the semicolons outside quotes
+func splitParams(s string) []string {
+	parts := []string{}
+	start, quoted := 0, false
+	for i, r := range s {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ';' && !quoted {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Unescape reads a text value written with Escape
+func Unescape(value string) string {
+	var out strings.Builder
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped && (r == 'n' || r == 'N'):
+			out.WriteRune('\n')
+		case escaped:
+			out.WriteRune(r)
+		case r == '\\':
+			escaped = true
+			continue
+		default:
+			out.WriteRune(r)
+		}
+		escaped = false
+	}
+	return out.String()
+}
+
+// splitValue splits a structured or list value at the separators that aren't escaped, and unescapes the components
+func splitValue(value string, separator rune) []string {
+	components := []string{}
+	var current strings.Builder
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped:
+			current.WriteRune('\\')
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == separator:
+			components = append(components, Unescape(current.String()))
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	return append(components, Unescape(current.String()))
+}
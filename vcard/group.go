@@ -0,0 +1,13 @@
+package vcard
+
+// FromGroup converts a group of contacts to a vCard of KIND group, with a MEMBER for each email of its contacts
+func FromGroup(id string, name string, emails []string) Card {
+	card := Card{}
+	card.Add("KIND", "group", nil)
+	card.Add("UID", Escape(id), nil)
+	card.Add("FN", Escape(name), nil)
+	for _, email := range emails {
+		card.Add("MEMBER", "mailto:"+email, nil)
+	}
+	return card
+}
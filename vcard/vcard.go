@@ -0,0 +1,102 @@
+// Package vcard writes contacts as vCard 4.0 (RFC 6350), and reads them from vCard 2.1, 3.0 and 4.0
+package vcard
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxLineLength is the length in octets lines are folded at
+const maxLineLength = 75
+
+// Property is a line of a vCard, like EMAIL;TYPE=work:ada@example.com
+type Property struct {
+	Name string
+	// Params are written sorted by name, like TYPE=work;PREF=1
+	Params map[string]string
+	// Value is written as is. Escape text values with Escape
+	Value string
+}
+
+// Card is a vCard. BEGIN, VERSION and END are added when it is written
+type Card []Property
+
+// Add adds a property with a value that is written as is
+func (c *Card) Add(name string, value string, params map[string]string) {
+	*c = append(*c, Property{Name: name, Params: params, Value: value})
+}
+
+// AddText adds a property with a text value, escaping it. Empty values are left out
+func (c *Card) AddText(name string, value string, params map[string]string) {
+	if value != "" {
+		c.Add(name, Escape(value), params)
+	}
+}
+
+// Escape escapes a text value. Structured values, like N and ADR, escape each component and join them with ;
+func Escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
+
+// Encoder writes vCards to a stream
+type Encoder struct {
+	w *bufio.Writer
+}
+
+// NewEncoder returns an encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{bufio.NewWriter(w)}
+}
+
+// Encode writes a card
+func (e *Encoder) Encode(card Card) error {
+	e.writeLine("BEGIN:VCARD")
+	e.writeLine("VERSION:4.0")
+	for _, p := range card {
+		e.writeLine(p.line())
+	}
+	e.writeLine("END:VCARD")
+	return e.w.Flush()
+}
+
+// line writes the property as an unfolded content line
+func (p Property) line() string {
+	names := []string{}
+	for name := range p.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	line := strings.ToUpper(p.Name)
+	for _, name := range names {
+		line += ";" + strings.ToUpper(name) + "=" + paramValue(p.Params[name])
+	}
+	return line + ":" + p.Value
+}
+
+// paramValue quotes parameter values with characters that end a parameter. Quotes can't be escaped so they are dropped
+func paramValue(value string) string {
+	value = strings.Replace(value, `"`, "", -1)
+	if strings.ContainsAny(value, ";:,") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// writeLine writes a content line, folding it every 75 octets without splitting characters
+func (e *Encoder) writeLine(line string) {
+	limit := maxLineLength
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		e.w.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// continuation lines start with a space
+		limit = maxLineLength - 1
+	}
+	e.w.WriteString(line + "\r\n")
+}
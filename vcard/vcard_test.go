@@ -0,0 +1,118 @@
+package vcard_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Dacode45/addressbook/models"
+	"github.com/Dacode45/addressbook/vcard"
+)
+
+func Test_VCard(t *testing.T) {
+	t.Run("Writes contacts", should_write_contacts)
+	t.Run("Folds long lines", should_fold_long_lines)
+	t.Run("Reads contacts", should_read_contacts)
+}
+
+func encode(t *testing.T, card vcard.Card) string {
+	var out bytes.Buffer
+	assert.NoError(t, vcard.NewEncoder(&out).Encode(card), "Encode failed")
+	return out.String()
+}
+
+func should_write_contacts(t *testing.T) {
+	contact := models.Contact{
+		ID:          "42",
+		DisplayName: "Ada Lovelace",
+		FirstName:   "Ada",
+		LastName:    "Lovelace",
+		Emails:      models.ContactValues{{Label: models.LabelWork, Value: "ada@example.com", Preferred: true}},
+		Phones:      models.ContactValues{{Label: models.LabelMobile, Value: "555-0100"}},
+		Addresses:   models.Addresses{{Label: "home", Street: "12 Main St; Apt 3", Locality: "Springfield"}},
+		Birthday:    "--12-10",
+		Notes:       "Met at the Analytical Society, 1833",
+		Custom:      models.CustomFields{"tier": "Gold", "active": "true"},
+	}
+	fields := models.FieldDefinitions{{Key: "tier", Type: models.FieldEnum}, {Key: "active", Type: models.FieldBoolean}}
+
+	out := encode(t, vcard.FromContact(contact, fields))
+	assert.True(t, strings.HasPrefix(out, "BEGIN:VCARD\r\nVERSION:4.0\r\n"), "Cards start with BEGIN and VERSION")
+	assert.True(t, strings.HasSuffix(out, "END:VCARD\r\n"), "Cards end with END")
+	for _, line := range []string{
+		"FN:Ada Lovelace",
+		"N:Lovelace;Ada;;;",
+		"EMAIL;PREF=1;TYPE=work:ada@example.com",
+		"TEL;TYPE=cell:555-0100",
+		`ADR;TYPE=home:;;12 Main St\; Apt 3;Springfield;;;`,
+		"BDAY:--1210",
+		`NOTE:Met at the Analytical Society\, 1833`,
+		"X-TIER:Gold",
+		"X-ACTIVE;VALUE=boolean:TRUE",
+	} {
+		assert.Contains(t, out, line+"\r\n", "Missing line")
+	}
+}
+
+func should_fold_long_lines(t *testing.T) {
+	card := vcard.Card{}
+	card.AddText("NOTE", strings.Repeat("é", 100), nil)
+	out := encode(t, card)
+	lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+	note := ""
+	for _, line := range lines[2 : len(lines)-1] {
+		assert.True(t, len(line) <= 75, "Lines should be at most 75 octets")
+		note += strings.TrimPrefix(line, " ")
+	}
+	assert.Equal(t, "NOTE:"+strings.Repeat("é", 100), note, "Unfolding should give back the line")
+}
+
+func should_read_contacts(t *testing.T) {
+	fields := models.FieldDefinitions{{Key: "tier", Type: models.FieldEnum}, {Key: "renewal", Type: models.FieldDate}}
+	in := "BEGIN:VCARD\r\nVERSION:3.0\r\nN:Hopper;Grace;Brewster;;\r\nFN:Grace Hopper\r\n" +
+		"item1.EMAIL;TYPE=INTERNET,WORK,pref:grace@example.com\r\nTEL;TYPE=CELL:555-0199\r\n" +
+		"NOTE:Wrote the first\r\n  compiler\\, A-0\r\nBDAY:1906-12-09\r\nCATEGORIES:navy,pioneer\r\n" +
+		"X-RENEWAL:20301231\r\nPHOTO;ENCODING=b;TYPE=JPEG:aGVs\r\n bG8=\r\nEND:VCARD\r\n"
+	decoder := vcard.NewDecoder(strings.NewReader(in))
+	card, err := decoder.Decode()
+	assert.NoError(t, err, "Decode failed")
+	_, err = decoder.Decode()
+	assert.Equal(t, io.EOF, err, "There is a single card")
+
+	c := vcard.ToContact(card, fields)
+	assert.Equal(t, "Grace", c.FirstName, "Unexpected first name")
+	assert.Equal(t, "Brewster", c.MiddleName, "Unexpected middle name")
+	assert.Equal(t, models.ContactValues{{Label: "work", Value: "grace@example.com", Preferred: true}}, c.Emails, "Unexpected emails")
+	assert.Equal(t, models.LabelMobile, c.Phones[0].Label, "cell phones are mobile")
+	assert.Equal(t, "Wrote the first compiler, A-0", c.Notes, "Folded lines should be unfolded and unescaped")
+	assert.Equal(t, "1906-12-09", c.Birthday, "Unexpected birthday")
+	assert.Equal(t, models.Tags{"navy", "pioneer"}, c.Tags, "Unexpected tags")
+	assert.Equal(t, "2030-12-31", c.Custom["renewal"], "Dates should be read in the extended format")
+	data, ok := vcard.PhotoData(card)
+	assert.True(t, ok, "The photo should be read")
+	assert.Equal(t, "hello", string(data), "Unexpected photo")
+
+	// contacts written and read back keep their fields
+	contact := models.Contact{
+		ID:        "42",
+		FirstName: "Ada",
+		LastName:  "Lovelace",
+		Emails:    models.ContactValues{{Label: models.LabelHome, Value: "ada@example.com", Preferred: true}},
+		Addresses: models.Addresses{{Label: "home", Street: "12 Main St; Apt 3", Locality: "Springfield"}},
+		Birthday:  "--12-10",
+		Notes:     "Line one\nLine two, with a comma",
+		Custom:    models.CustomFields{"tier": "Gold"},
+	}
+	card = vcard.FromContact(contact, fields)
+	card.AddPhoto("image/jpeg", []byte("hello"))
+	card, err = vcard.NewDecoder(strings.NewReader(encode(t, card))).Decode()
+	assert.NoError(t, err, "Decode failed")
+	read := vcard.ToContact(card, fields)
+	read.ID = contact.ID
+	assert.Equal(t, contact, read, "Contacts should survive a round trip")
+	data, _ = vcard.PhotoData(card)
+	assert.Equal(t, "hello", string(data), "Photos should survive a round trip")
+}